@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"common/auth"
+	"common/config"
+	"common/origins"
+	"common/rbac"
+	"common/shutdown"
+)
+
+// Config is the chat service's configuration; see config.Load for how it is
+// read. The port, shutdown timing, history store, knowledge index and
+// prompts directory need a restart; the rest is reloaded on SIGHUP, the
+// persona templates included.
+type Config struct {
+	Port        int             `yaml:"port" env:"PORT"`
+	OllamaURL   string          `yaml:"ollama_url" env:"OLLAMA_URL"`
+	OllamaModel string          `yaml:"ollama_model" env:"OLLAMA_MODEL"`
+	Models      []ModelSpec     `yaml:"models"`
+	Guard       AIGuardConfig   `yaml:"guard"`
+	History     HistoryConfig   `yaml:"history"`
+	Knowledge   KnowledgeConfig `yaml:"knowledge"`
+	Prompts     PromptsConfig   `yaml:"prompts"`
+	Origins     origins.Config  `yaml:"origins"`
+	Auth        auth.Config     `yaml:"auth"`
+	Access      rbac.Config     `yaml:"access"`
+	Shutdown    shutdown.Config `yaml:"shutdown"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:      5001,
+		OllamaURL: "http://localhost:11434",
+		// Default to a smaller, efficient model; see defaultModels for the
+		// others
+		OllamaModel: "tinyllama:1.1b-chat",
+		Models:      defaultModels(),
+		Guard:       AIGuardConfig{Base: "https://api.xdr.trendmicro.com/beta/aiSecurity"},
+		History:     defaultHistoryConfig(),
+		Knowledge:   defaultKnowledgeConfig(),
+		Prompts:     defaultPromptsConfig(),
+		Auth:        auth.DefaultConfig(),
+		Shutdown:    shutdown.DefaultConfig(),
+	}
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs config.Errors
+	if c.Port < 1 || c.Port > 65535 {
+		errs.Addf("port must be between 1 and 65535, got %d", c.Port)
+	}
+	for name, raw := range map[string]string{"ollama_url": c.OllamaURL, "guard.base_url": c.Guard.Base} {
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.Addf("%s must be an http or https URL, got %q", name, raw)
+		}
+	}
+	if strings.TrimSpace(c.OllamaModel) == "" {
+		errs.Addf("ollama_model must not be empty")
+	}
+	if err := validateModels(c.Models); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.History.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Knowledge.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Prompts.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Auth.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Shutdown.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs.Err()
+}
+
+// settings holds the configuration in force; handlers read it per request
+// so a reload applies to the next chat.
+var settings atomic.Pointer[Config]
+
+func currentConfig() *Config { return settings.Load() }
+
+// reloadConfig re-reads the configuration and applies everything but the
+// port. An invalid file leaves the running settings untouched.
+func reloadConfig(file string, authn *auth.Authenticator, access *rbac.Enforcer) {
+	cfg := defaultConfig()
+	if err := config.Load(cfg, file); err != nil {
+		log.Printf("Configuration reload failed, keeping current settings: %v", err)
+		return
+	}
+	running := currentConfig()
+	if cfg.Port != running.Port || cfg.Shutdown != running.Shutdown {
+		log.Printf("Port or shutdown settings changed; restart to apply")
+	}
+	if cfg.History.Store != running.History.Store || cfg.History.Path != running.History.Path ||
+		cfg.History.MaxConversations != running.History.MaxConversations {
+		log.Printf("History store settings changed; restart to apply")
+	}
+	if cfg.Knowledge.Enabled != running.Knowledge.Enabled || cfg.Knowledge.IndexPath != running.Knowledge.IndexPath {
+		log.Printf("Knowledge index settings changed; restart to apply")
+	}
+	if cfg.Prompts.Dir != running.Prompts.Dir {
+		log.Printf("Prompts directory changed; restart to apply")
+	}
+	if err := prompts.Reload(); err != nil {
+		log.Printf("Cannot reload personas, keeping the current ones: %v", err)
+	}
+	if err := allowedOrigins.Update(cfg.Origins); err != nil {
+		log.Printf("Cannot reload origins settings: %v", err)
+		cfg.Origins = running.Origins
+	}
+	// Credentials and the policy they are checked against change together
+	if err := access.UpdateWithAuth(authn, cfg.Auth, cfg.Access); err != nil {
+		log.Printf("Cannot reload auth and access settings: %v", err)
+		cfg.Auth, cfg.Access = running.Auth, running.Access
+	}
+	settings.Store(cfg)
+	// Pull whatever the new settings need that Ollama lacks
+	go pullStartupModels(cfg)
+	if knowledgeBase != nil && cfg.Knowledge.EmbeddingModel != running.Knowledge.EmbeddingModel {
+		log.Printf("Embedding model changed; documents embedded with %s are not searched until the sdk sends them again", running.Knowledge.EmbeddingModel)
+	}
+	log.Printf("Configuration reloaded")
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"common/auth"
+	"common/config"
+	"github.com/labstack/echo/v4"
+)
+
+// HistoryConfig says where conversations are kept and how much of them is
+// sent to the model. The store needs a restart; the rest is reloaded.
+type HistoryConfig struct {
+	// Store is "memory" (lost on restart) or "sqlite".
+	Store string `yaml:"store" env:"HISTORY_STORE"`
+	// Path is the SQLite database file.
+	Path string `yaml:"path" env:"HISTORY_DB_PATH"`
+	// MaxConversations bounds the memory store; the conversations updated
+	// least recently are dropped first.
+	MaxConversations int `yaml:"max_conversations" env:"HISTORY_MAX_CONVERSATIONS"`
+	// ContextTokens is roughly how many tokens of prompt and history are
+	// sent, leaving the rest of the model's context window for the reply.
+	ContextTokens int `yaml:"context_tokens" env:"HISTORY_CONTEXT_TOKENS"`
+	// Summarize condenses the messages trimmed from the context into a
+	// running summary instead of just leaving them out.
+	Summarize bool `yaml:"summarize" env:"HISTORY_SUMMARIZE"`
+}
+
+func defaultHistoryConfig() HistoryConfig {
+	return HistoryConfig{
+		Store:            "memory",
+		Path:             "conversations.db",
+		MaxConversations: 1000,
+		// tinyllama has a 2048 token context
+		ContextTokens: 1536,
+		Summarize:     true,
+	}
+}
+
+// Validate checks the history settings.
+func (c HistoryConfig) Validate() error {
+	var errs config.Errors
+	switch c.Store {
+	case "memory":
+		if c.MaxConversations < 1 {
+			errs.Addf("history.max_conversations must be at least 1, got %d", c.MaxConversations)
+		}
+	case "sqlite":
+		if c.Path == "" {
+			errs.Addf("history.path must be set for the sqlite store")
+		}
+	default:
+		errs.Addf("history.store must be memory or sqlite, got %q", c.Store)
+	}
+	if c.ContextTokens < 256 {
+		errs.Addf("history.context_tokens must be at least 256, got %d", c.ContextTokens)
+	}
+	return errs.Err()
+}
+
+// Message is a stored message of a conversation.
+type Message struct {
+	ChatMessage
+	Time time.Time `json:"time"`
+}
+
+// Conversation is a chat between one owner and the assistant.
+type Conversation struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"-"`
+	Title   string    `json:"title"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	// Summary condenses the first Summarized messages, which no longer fit
+	// in the model's context.
+	Summary    string `json:"summary,omitempty"`
+	Summarized int    `json:"-"`
+	// MessageCount is set when listing, which leaves Messages out.
+	MessageCount int       `json:"messageCount"`
+	Messages     []Message `json:"messages,omitempty"`
+}
+
+var errConversationNotFound = errors.New("conversation not found")
+
+// ConversationStore keeps conversations. Implementations must be safe for
+// concurrent use.
+type ConversationStore interface {
+	// Get returns a conversation with its messages, or
+	// errConversationNotFound.
+	Get(ctx context.Context, id string) (*Conversation, error)
+	// Save writes the conversation's details and any messages added since
+	// it was last saved.
+	Save(ctx context.Context, c *Conversation) error
+	// List returns the owner's conversations without their messages, most
+	// recently updated first.
+	List(ctx context.Context, owner string) ([]*Conversation, error)
+	// Delete removes a conversation; deleting a missing one is not an error.
+	Delete(ctx context.Context, id string) error
+	Close() error
+}
+
+// conversations is the store selected by the history configuration.
+var conversations ConversationStore
+
+// newConversationStore opens the store cfg selects.
+func newConversationStore(cfg HistoryConfig) (ConversationStore, error) {
+	if cfg.Store == "sqlite" {
+		return openSQLiteStore(cfg.Path)
+	}
+	return newMemoryStore(cfg.MaxConversations), nil
+}
+
+// memoryStore keeps conversations in memory, up to max of them.
+type memoryStore struct {
+	mu    sync.Mutex
+	max   int
+	convs map[string]*Conversation
+}
+
+func newMemoryStore(max int) *memoryStore {
+	return &memoryStore{max: max, convs: map[string]*Conversation{}}
+}
+
+// clone copies c, so callers cannot change the stored conversation.
+func clone(c *Conversation, withMessages bool) *Conversation {
+	cp := *c
+	cp.MessageCount = len(c.Messages)
+	cp.Messages = nil
+	if withMessages {
+		cp.Messages = append([]Message(nil), c.Messages...)
+	}
+	return &cp
+}
+
+func (s *memoryStore) Get(_ context.Context, id string) (*Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.convs[id]
+	if !ok {
+		return nil, errConversationNotFound
+	}
+	return clone(c, true), nil
+}
+
+func (s *memoryStore) Save(_ context.Context, c *Conversation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.convs[c.ID] = clone(c, true)
+	for len(s.convs) > s.max {
+		var oldest *Conversation
+		for _, c := range s.convs {
+			if oldest == nil || c.Updated.Before(oldest.Updated) {
+				oldest = c
+			}
+		}
+		delete(s.convs, oldest.ID)
+	}
+	return nil
+}
+
+func (s *memoryStore) List(_ context.Context, owner string) ([]*Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*Conversation
+	for _, c := range s.convs {
+		if c.Owner == owner {
+			out = append(out, clone(c, false))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Updated.After(out[j].Updated) })
+	return out, nil
+}
+
+func (s *memoryStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.convs, id)
+	return nil
+}
+
+func (s *memoryStore) Close() error { return nil }
+
+// ownerOf names the caller whose conversations a request may see. Without
+// authentication every caller is the same anonymous owner.
+func ownerOf(ctx context.Context) string {
+	p, ok := auth.FromContext(ctx)
+	if !ok {
+		return auth.MethodAnonymous
+	}
+	if p.Tenant != "" {
+		return p.Tenant + "/" + p.Subject
+	}
+	return p.Subject
+}
+
+// historyOwner is ownerOf for the history endpoints. Anonymous callers all
+// share one owner, so they could list, read and delete each other's
+// conversations; they get false and may only continue a conversation whose
+// ID they were given.
+func historyOwner(ctx context.Context) (string, bool) {
+	if p, ok := auth.FromContext(ctx); !ok || p.Anonymous() {
+		return "", false
+	}
+	return ownerOf(ctx), true
+}
+
+func historyRefused(c echo.Context) error {
+	return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Conversation history needs a credential"})
+}
+
+// conversationLocks serializes turns within a conversation, so concurrent
+// messages cannot both append to the same history. Locks are dropped once
+// nobody holds or waits for them.
+var conversationLocks = struct {
+	sync.Mutex
+	held map[string]*conversationLock
+}{held: map[string]*conversationLock{}}
+
+type conversationLock struct {
+	sync.Mutex
+	refs int
+}
+
+func lockConversation(id string) (unlock func()) {
+	conversationLocks.Lock()
+	l := conversationLocks.held[id]
+	if l == nil {
+		l = &conversationLock{}
+		conversationLocks.held[id] = l
+	}
+	l.refs++
+	conversationLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		conversationLocks.Lock()
+		defer conversationLocks.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(conversationLocks.held, id)
+		}
+	}
+}
+
+// openConversation locks and loads the owner's conversation id, or starts a
+// new one if id is empty. Other owners' conversations are not found.
+func openConversation(ctx context.Context, id, owner string) (*Conversation, func(), error) {
+	if id == "" {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		id = hex.EncodeToString(buf)
+		now := time.Now().UTC()
+		return &Conversation{ID: id, Owner: owner, Created: now, Updated: now}, lockConversation(id), nil
+	}
+	unlock := lockConversation(id)
+	c, err := conversations.Get(ctx, id)
+	if err == nil && c.Owner != owner {
+		err = errConversationNotFound
+	}
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	return c, unlock, nil
+}
+
+// saveExchange appends an allowed prompt and reply to the conversation.
+// Blocked exchanges are never stored, so they cannot reach later prompts.
+func saveExchange(ctx context.Context, c *Conversation, prompt, reply string) error {
+	now := time.Now().UTC()
+	if c.Title == "" {
+		c.Title = titleOf(prompt)
+	}
+	c.Messages = append(c.Messages,
+		Message{ChatMessage{Role: "user", Content: prompt}, now},
+		Message{ChatMessage{Role: "assistant", Content: reply}, now})
+	c.Updated = now
+	return conversations.Save(ctx, c)
+}
+
+// titleOf names a conversation after its first message.
+func titleOf(prompt string) string {
+	title := strings.Join(strings.Fields(prompt), " ")
+	if r := []rune(title); len(r) > 60 {
+		title = string(r[:60]) + "…"
+	}
+	return title
+}
+
+// historyFor returns the history settings for a chat with model, whose
+// context window may leave less room than configured.
+func historyFor(model ModelSpec) HistoryConfig {
+	cfg := currentConfig().History
+	cfg.ContextTokens = model.contextTokens(cfg.ContextTokens)
+	return cfg
+}
+
+// estimateTokens is a rough token count, about four characters per token
+// plus the message framing.
+func estimateTokens(m ChatMessage) int {
+	return len(m.Content)/4 + 4
+}
+
+// buildContext returns the messages to send Ollama for the next message of
+// c: the system prompt of the chosen persona, the summary of earlier messages, as much recent
+// history as fits in cfg.ContextTokens, extra (such as document excerpts)
+// and the new message. Messages that no longer fit are folded into the
+// summary if cfg.Summarize is set.
+func buildContext(ctx context.Context, c *Conversation, systemPrompt, message string, extra []ChatMessage, cfg HistoryConfig) []ChatMessage {
+	system := ChatMessage{Role: "system", Content: systemPrompt}
+	user := ChatMessage{Role: "user", Content: message}
+	summary := func() ChatMessage {
+		return ChatMessage{Role: "system", Content: "Summary of the conversation so far: " + c.Summary}
+	}
+
+	used := estimateTokens(system) + estimateTokens(user)
+	for _, m := range extra {
+		used += estimateTokens(m)
+	}
+	if c.Summary != "" {
+		used += estimateTokens(summary())
+	}
+	history := c.Messages[c.Summarized:]
+	keep := len(history)
+	for keep > 0 {
+		t := estimateTokens(history[keep-1].ChatMessage)
+		if used+t > cfg.ContextTokens {
+			break
+		}
+		used += t
+		keep--
+	}
+	if trimmed := history[:keep]; len(trimmed) > 0 && cfg.Summarize {
+		s, err := summarize(ctx, c.Summary, trimmed)
+		if err != nil {
+			log.Printf("Cannot summarise conversation %s, leaving out %d messages: %v", c.ID, len(trimmed), err)
+		} else {
+			c.Summary = s
+			c.Summarized += len(trimmed)
+		}
+	}
+
+	messages := []ChatMessage{system}
+	if c.Summary != "" {
+		messages = append(messages, summary())
+	}
+	for _, m := range history[keep:] {
+		messages = append(messages, m.ChatMessage)
+	}
+	messages = append(messages, extra...)
+	return append(messages, user)
+}
+
+// summarize asks the default model to fold messages into the running
+// summary.
+func summarize(ctx context.Context, summary string, messages []Message) (string, error) {
+	var transcript strings.Builder
+	if summary != "" {
+		fmt.Fprintf(&transcript, "Earlier summary: %s\n\n", summary)
+	}
+	for _, m := range messages {
+		fmt.Fprintf(&transcript, "%s: %s\n", m.Role, m.Content)
+	}
+	reply, err := generate(ctx, defaultModel(), []ChatMessage{
+		{Role: "system", Content: "Summarise the conversation below in at most 100 words, keeping names, facts and open questions."},
+		{Role: "user", Content: transcript.String()},
+	}, func(string) error { return nil })
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(reply), nil
+}
+
+func conversationError(c echo.Context, err error) error {
+	if errors.Is(err, errConversationNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Conversation not found"})
+	}
+	log.Printf("Conversation store: %v", err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Cannot read conversations"})
+}
+
+// handleListConversations serves GET /conversations.
+func handleListConversations(c echo.Context) error {
+	owner, ok := historyOwner(c.Request().Context())
+	if !ok {
+		return historyRefused(c)
+	}
+	list, err := conversations.List(c.Request().Context(), owner)
+	if err != nil {
+		return conversationError(c, err)
+	}
+	if list == nil {
+		list = []*Conversation{}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"conversations": list})
+}
+
+// handleGetConversation serves GET /conversations/:id with its messages.
+func handleGetConversation(c echo.Context) error {
+	ctx := c.Request().Context()
+	owner, ok := historyOwner(ctx)
+	if !ok {
+		return historyRefused(c)
+	}
+	conv, err := conversations.Get(ctx, c.Param("id"))
+	if err == nil && conv.Owner != owner {
+		err = errConversationNotFound
+	}
+	if err != nil {
+		return conversationError(c, err)
+	}
+	conv.MessageCount = len(conv.Messages)
+	return c.JSON(http.StatusOK, conv)
+}
+
+// handleDeleteConversation serves DELETE /conversations/:id.
+func handleDeleteConversation(c echo.Context) error {
+	ctx := c.Request().Context()
+	owner, ok := historyOwner(ctx)
+	if !ok {
+		return historyRefused(c)
+	}
+	id := c.Param("id")
+	unlock := lockConversation(id)
+	defer unlock()
+	conv, err := conversations.Get(ctx, id)
+	if err == nil && conv.Owner != owner {
+		err = errConversationNotFound
+	}
+	if err == nil {
+		err = conversations.Delete(ctx, id)
+	}
+	if err != nil {
+		return conversationError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore keeps conversations in a SQLite database, so they survive
+// restarts. Messages are only ever appended.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS conversations (
+	id         TEXT PRIMARY KEY,
+	owner      TEXT NOT NULL,
+	title      TEXT NOT NULL,
+	summary    TEXT NOT NULL DEFAULT '',
+	summarized INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS conversations_by_owner ON conversations (owner, updated_at);
+CREATE TABLE IF NOT EXISTS messages (
+	conversation_id TEXT NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+	seq             INTEGER NOT NULL,
+	role            TEXT NOT NULL,
+	content         TEXT NOT NULL,
+	created_at      TIMESTAMP NOT NULL,
+	PRIMARY KEY (conversation_id, seq)
+);`
+
+// openSQLiteStore opens or creates the database at path.
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot set up conversation database %s: %w", path, err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Get(ctx context.Context, id string) (*Conversation, error) {
+	c := &Conversation{ID: id}
+	err := s.db.QueryRowContext(ctx,
+		`SELECT owner, title, summary, summarized, created_at, updated_at FROM conversations WHERE id = ?`, id).
+		Scan(&c.Owner, &c.Title, &c.Summary, &c.Summarized, &c.Created, &c.Updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errConversationNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT role, content, created_at FROM messages WHERE conversation_id = ? ORDER BY seq`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.Role, &m.Content, &m.Time); err != nil {
+			return nil, err
+		}
+		c.Messages = append(c.Messages, m)
+	}
+	c.MessageCount = len(c.Messages)
+	return c, rows.Err()
+}
+
+func (s *sqliteStore) Save(ctx context.Context, c *Conversation) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+INSERT INTO conversations (id, owner, title, summary, summarized, created_at, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET
+	title = excluded.title, summary = excluded.summary,
+	summarized = excluded.summarized, updated_at = excluded.updated_at`,
+		c.ID, c.Owner, c.Title, c.Summary, c.Summarized, c.Created, c.Updated)
+	if err != nil {
+		return err
+	}
+	var stored int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM messages WHERE conversation_id = ?`, c.ID).Scan(&stored); err != nil {
+		return err
+	}
+	for i := stored; i < len(c.Messages); i++ {
+		m := c.Messages[i]
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO messages (conversation_id, seq, role, content, created_at) VALUES (?, ?, ?, ?, ?)`,
+			c.ID, i, m.Role, m.Content, m.Time); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) List(ctx context.Context, owner string) ([]*Conversation, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT c.id, c.title, c.summary, c.created_at, c.updated_at,
+	(SELECT COUNT(*) FROM messages m WHERE m.conversation_id = c.id)
+FROM conversations c WHERE c.owner = ? ORDER BY c.updated_at DESC`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*Conversation
+	for rows.Next() {
+		c := &Conversation{Owner: owner}
+		if err := rows.Scan(&c.ID, &c.Title, &c.Summary, &c.Created, &c.Updated, &c.MessageCount); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) Delete(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM conversations WHERE id = ?`, id)
+	return err
+}
+
+func (s *sqliteStore) Close() error { return s.db.Close() }
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"common/auth"
+	"github.com/labstack/echo/v4"
+)
+
+// useConversations makes store the conversation store for the test.
+func useConversations(t *testing.T, store ConversationStore) {
+	t.Helper()
+	prev := conversations
+	conversations = store
+	t.Cleanup(func() { conversations = prev })
+}
+
+// serveConversation calls handler as p, with id as the :id parameter.
+func serveConversation(handler echo.HandlerFunc, method, id string, p *auth.Principal) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/conversations/"+id, nil)
+	if p != nil {
+		r = r.WithContext(auth.WithPrincipal(r.Context(), p))
+	}
+	w := httptest.NewRecorder()
+	c := echo.New().NewContext(r, w)
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	handler(c)
+	return w
+}
+
+func TestHistoryNeedsCredential(t *testing.T) {
+	store := newMemoryStore(10)
+	useConversations(t, store)
+	now := time.Now()
+	if err := store.Save(context.Background(), &Conversation{ID: "c1", Owner: auth.MethodAnonymous, Created: now, Updated: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	anonymous := &auth.Principal{Subject: auth.MethodAnonymous, Method: auth.MethodAnonymous}
+	for _, caller := range []*auth.Principal{nil, anonymous} {
+		for _, tc := range []struct {
+			method  string
+			handler echo.HandlerFunc
+		}{
+			{http.MethodGet, handleListConversations},
+			{http.MethodGet, handleGetConversation},
+			{http.MethodDelete, handleDeleteConversation},
+		} {
+			if w := serveConversation(tc.handler, tc.method, "c1", caller); w.Code != http.StatusUnauthorized {
+				t.Errorf("%s as %v: status %d, want %d", tc.method, caller, w.Code, http.StatusUnauthorized)
+			}
+		}
+	}
+	if _, err := store.Get(context.Background(), "c1"); err != nil {
+		t.Fatalf("anonymous delete removed the conversation: %v", err)
+	}
+
+	// An authenticated caller sees only their own conversations
+	alice := &auth.Principal{Subject: "alice", Method: auth.MethodAPIKey}
+	if w := serveConversation(handleGetConversation, http.MethodGet, "c1", alice); w.Code != http.StatusNotFound {
+		t.Errorf("other owner's conversation: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if err := store.Save(context.Background(), &Conversation{ID: "c2", Owner: "alice", Created: now, Updated: now}); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveConversation(handleGetConversation, http.MethodGet, "c2", alice); w.Code != http.StatusOK {
+		t.Errorf("own conversation: status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := serveConversation(handleDeleteConversation, http.MethodDelete, "c2", alice); w.Code != http.StatusNoContent {
+		t.Errorf("deleting own conversation: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+// fakeSummarizer serves Ollama's /api/chat, answering every request with
+// reply, or failing if reply is empty. It returns the requests received.
+func fakeSummarizer(t *testing.T, reply string) *[]OllamaRequest {
+	t.Helper()
+	var received []OllamaRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req OllamaRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		received = append(received, req)
+		if reply == "" {
+			http.Error(w, "model not loaded", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(OllamaResponse{Message: ChatMessage{Role: "assistant", Content: reply}, Done: true})
+	}))
+	t.Cleanup(srv.Close)
+	prev := settings.Load()
+	cfg := defaultConfig()
+	cfg.OllamaURL = srv.URL
+	settings.Store(cfg)
+	t.Cleanup(func() { settings.Store(prev) })
+	return &received
+}
+
+// testConversation has n messages of 40 characters, 14 tokens each, with
+// the message's index as its first character.
+func testConversation(n int) *Conversation {
+	c := &Conversation{ID: "c1"}
+	for i := 0; i < n; i++ {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		content := fmt.Sprintf("%d%s", i, strings.Repeat("x", 39))
+		c.Messages = append(c.Messages, Message{ChatMessage: ChatMessage{Role: role, Content: content}})
+	}
+	return c
+}
+
+// contents lists the messages' contents, with the index of history messages
+// in place of their text.
+func contents(messages []ChatMessage) []string {
+	var out []string
+	for _, m := range messages {
+		if len(m.Content) == 40 && strings.HasSuffix(m.Content, "xxx") {
+			out = append(out, m.Content[:1])
+		} else {
+			out = append(out, m.Content)
+		}
+	}
+	return out
+}
+
+func TestBuildContextKeepsRecentHistoryWithinBudget(t *testing.T) {
+	// "sys" and "hello" take 4 and 5 tokens, each history message 14
+	extra := []ChatMessage{{Role: "system", Content: strings.Repeat("s", 40)}}
+	for _, tc := range []struct {
+		name   string
+		tokens int
+		extra  []ChatMessage
+		want   []string
+	}{
+		{"everything fits", 1000, nil, []string{"sys", "0", "1", "2", "3", "4", "hello"}},
+		{"two fit", 4 + 5 + 2*14, nil, []string{"sys", "3", "4", "hello"}},
+		{"one token short of two", 4 + 5 + 2*14 - 1, nil, []string{"sys", "4", "hello"}},
+		{"extra counts against the budget", 4 + 5 + 2*14, extra, []string{"sys", "4", extra[0].Content, "hello"}},
+		{"nothing fits", 4 + 5, nil, []string{"sys", "hello"}},
+	} {
+		c := testConversation(5)
+		got := contents(buildContext(context.Background(), c, "sys", "hello", tc.extra, HistoryConfig{ContextTokens: tc.tokens}))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+		if c.Summary != "" || c.Summarized != 0 {
+			t.Errorf("%s: summarised without Summarize set", tc.name)
+		}
+	}
+}
+
+func TestBuildContextSkipsSummarizedMessages(t *testing.T) {
+	c := testConversation(5)
+	c.Summary, c.Summarized = "earlier", 2
+	got := contents(buildContext(context.Background(), c, "sys", "hello", nil, HistoryConfig{ContextTokens: 1000, Summarize: true}))
+	want := []string{"sys", "Summary of the conversation so far: earlier", "2", "3", "4", "hello"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestBuildContextSummarizesTrimmedMessages(t *testing.T) {
+	received := fakeSummarizer(t, " condensed \n")
+	c := testConversation(6)
+	c.Summary, c.Summarized = "earlier", 1
+	summary := estimateTokens(ChatMessage{Content: "Summary of the conversation so far: earlier"})
+	cfg := HistoryConfig{ContextTokens: 4 + 5 + summary + 2*14, Summarize: true}
+
+	got := contents(buildContext(context.Background(), c, "sys", "hello", nil, cfg))
+	want := []string{"sys", "Summary of the conversation so far: condensed", "4", "5", "hello"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if c.Summary != "condensed" || c.Summarized != 4 {
+		t.Errorf("summary %q of %d messages, want \"condensed\" of 4", c.Summary, c.Summarized)
+	}
+	// Only the newly trimmed messages are sent, with the earlier summary
+	if len(*received) != 1 {
+		t.Fatalf("%d summary requests, want 1", len(*received))
+	}
+	transcript := (*received)[0].Messages[1].Content
+	for _, part := range []string{"Earlier summary: earlier", "user: 2", "assistant: 1", "assistant: 3"} {
+		if !strings.Contains(transcript, part) {
+			t.Errorf("transcript lacks %q:\n%s", part, transcript)
+		}
+	}
+	for _, part := range []string{"user: 0", "user: 4", "assistant: 5"} {
+		if strings.Contains(transcript, part) {
+			t.Errorf("transcript has %q:\n%s", part, transcript)
+		}
+	}
+}
+
+func TestBuildContextLeavesOutMessagesWhenSummaryFails(t *testing.T) {
+	fakeSummarizer(t, "")
+	c := testConversation(5)
+	got := contents(buildContext(context.Background(), c, "sys", "hello", nil, HistoryConfig{ContextTokens: 4 + 5 + 14, Summarize: true}))
+	if want := []string{"sys", "4", "hello"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if c.Summary != "" || c.Summarized != 0 {
+		t.Errorf("failed summary recorded: %q of %d messages", c.Summary, c.Summarized)
+	}
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUpdated(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore(2)
+	start := time.Now()
+	save := func(id, owner string, minutes int) {
+		t.Helper()
+		if err := s.Save(ctx, &Conversation{ID: id, Owner: owner, Updated: start.Add(time.Duration(minutes) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("a", "alice", 0)
+	save("b", "alice", 1)
+	save("a", "alice", 2) // updating a keeps it
+	save("c", "bob", 3)
+
+	if _, err := s.Get(ctx, "b"); !errors.Is(err, errConversationNotFound) {
+		t.Errorf("least recently updated conversation kept: %v", err)
+	}
+	for _, id := range []string{"a", "c"} {
+		if _, err := s.Get(ctx, id); err != nil {
+			t.Errorf("conversation %s evicted: %v", id, err)
+		}
+	}
+}
+
+func TestMemoryStoreListsOwnConversations(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore(10)
+	start := time.Now()
+	for i, conv := range []struct{ id, owner string }{{"a1", "alice"}, {"b1", "bob"}, {"a2", "alice"}} {
+		c := &Conversation{ID: conv.id, Owner: conv.owner, Updated: start.Add(time.Duration(i) * time.Minute)}
+		c.Messages = []Message{{ChatMessage: ChatMessage{Role: "user", Content: "hi"}}}
+		if err := s.Save(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := s.List(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, c := range list {
+		ids = append(ids, c.ID)
+		if c.Messages != nil || c.MessageCount != 1 {
+			t.Errorf("listed %s with %d messages, count %d", c.ID, len(c.Messages), c.MessageCount)
+		}
+	}
+	if want := []string{"a2", "a1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("alice's conversations %v, want %v", ids, want)
+	}
+
+	// Changing a conversation read from the store does not change it
+	c, _ := s.Get(ctx, "a1")
+	c.Messages[0].Content = "changed"
+	if c, _ := s.Get(ctx, "a1"); c.Messages[0].Content != "hi" {
+		t.Errorf("stored message changed to %q", c.Messages[0].Content)
+	}
+}
+
+func TestSQLiteStoreAppendsNewMessages(t *testing.T) {
+	ctx := context.Background()
+	s, err := openSQLiteStore(filepath.Join(t.TempDir(), "conversations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c := testConversation(2)
+	c.Owner, c.Title = "alice", "first"
+	if err := s.Save(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	more := testConversation(4)
+	c.Messages = append(c.Messages, more.Messages[2:]...)
+	c.Summary, c.Summarized = "condensed", 2
+	for i := 0; i < 2; i++ {
+		if err := s.Save(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT seq, content FROM messages WHERE conversation_id = ? ORDER BY seq`, c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var seqs []int
+	for rows.Next() {
+		var seq int
+		var content string
+		if err := rows.Scan(&seq, &content); err != nil {
+			t.Fatal(err)
+		}
+		if content != c.Messages[seq].Content {
+			t.Errorf("message %d is %q, want %q", seq, content, c.Messages[seq].Content)
+		}
+		seqs = append(seqs, seq)
+	}
+	if want := []int{0, 1, 2, 3}; !reflect.DeepEqual(seqs, want) {
+		t.Fatalf("stored seqs %v, want %v", seqs, want)
+	}
+
+	got, err := s.Get(ctx, c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Owner != "alice" || got.Summary != "condensed" || got.Summarized != 2 || len(got.Messages) != 4 {
+		t.Errorf("read back owner %q, summary %q of %d, %d messages", got.Owner, got.Summary, got.Summarized, len(got.Messages))
+	}
+}
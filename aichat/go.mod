@@ -4,7 +4,14 @@ go 1.23.0
 
 toolchain go1.23.11
 
-require github.com/labstack/echo/v4 v4.13.4
+require (
+	common v0.0.0
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/gorilla/websocket v1.5.1
+	github.com/labstack/echo/v4 v4.13.4
+	github.com/ledongthuc/pdf v0.0.0-20220302134840-0c2507a12d80
+	github.com/mattn/go-sqlite3 v1.14.33
+)
 
 require (
 	github.com/labstack/gommon v0.4.2 // indirect
@@ -17,4 +24,7 @@ require (
 	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/text v0.25.0 // indirect
 	golang.org/x/time v0.11.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace common => ../common
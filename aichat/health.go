@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"common/health"
+)
+
+// healthChecks builds the checks behind /livez and /readyz. Chat needs
+// Ollama with the model pulled; without an AI Guard key chats still work,
+// unguarded, and without the embedding model they are answered without
+// documents, so those only degrade readiness.
+func healthChecks() *health.Checker {
+	h := health.New("aichat")
+	h.Ready(health.Draining(func() bool { return server.Draining() }))
+	h.Ready(health.Check{Name: "ollama", Critical: true, Run: checkOllama})
+	h.Ready(health.Check{
+		Name: "ai_guard",
+		Run: func(context.Context) error {
+			if currentConfig().Guard.APIKey == "" {
+				return errors.New("API_KEY not set; guard checks are skipped")
+			}
+			return nil
+		},
+	})
+	h.Ready(health.Check{
+		Name: "knowledge",
+		Run: func(ctx context.Context) error {
+			if knowledgeBase == nil {
+				return nil
+			}
+			return ollamaHasModel(ctx, currentConfig().Knowledge.EmbeddingModel)
+		},
+	})
+	return h
+}
+
+// checkOllama looks for the chat model.
+func checkOllama(ctx context.Context) error {
+	return ollamaHasModel(ctx, currentConfig().OllamaModel)
+}
+
+// ollamaHasModel looks for model among Ollama's local models.
+func ollamaHasModel(ctx context.Context, model string) error {
+	pulled, err := pulledModels(ctx)
+	if err != nil {
+		return err
+	}
+	if !pulled[modelKey(model)] {
+		if st, _ := models.Status(model); st.State == statePulling {
+			return fmt.Errorf("model %s is being pulled: %.0f%%", model, st.Progress)
+		}
+		return fmt.Errorf("model %s has not been pulled", model)
+	}
+	return nil
+}
+
+// pulledModels lists Ollama's local models by modelKey.
+func pulledModels(ctx context.Context) (map[string]bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, currentConfig().OllamaURL+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ollama unreachable: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama returned %s", res.Status)
+	}
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tags); err != nil {
+		return nil, fmt.Errorf("cannot read ollama model list: %w", err)
+	}
+	pulled := map[string]bool{}
+	for _, m := range tags.Models {
+		pulled[modelKey(m.Name)] = true
+	}
+	return pulled, nil
+}
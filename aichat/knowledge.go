@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"common/auth"
+	"common/config"
+	"github.com/labstack/echo/v4"
+)
+
+// KnowledgeConfig controls answering from the company's documents. The sdk
+// names every clean upload at /knowledge/documents; the document is read
+// back from the sdk, its text cut into chunks, embedded with EmbeddingModel
+// and searched for each chat message. Enabled and IndexPath need a
+// restart; the rest is reloaded.
+type KnowledgeConfig struct {
+	Enabled        bool   `yaml:"enabled" env:"KNOWLEDGE_ENABLED"`
+	EmbeddingModel string `yaml:"embedding_model" env:"KNOWLEDGE_EMBEDDING_MODEL"`
+	// SDKURL is the sdk documents are read from and SDKAPIKey an indexer
+	// key it accepts. Nothing is indexed while SDKURL is empty.
+	SDKURL    string `yaml:"sdk_url" env:"KNOWLEDGE_SDK_URL"`
+	SDKAPIKey string `yaml:"sdk_api_key" env:"KNOWLEDGE_SDK_API_KEY" secret:"true"`
+	// IndexPath is the SQLite file the index is kept in; empty keeps it in
+	// memory only, and the sdk has to send documents again after a restart.
+	IndexPath string `yaml:"index_path" env:"KNOWLEDGE_INDEX_PATH"`
+	// ChunkSize and ChunkOverlap are in characters; consecutive chunks
+	// share up to ChunkOverlap characters so no passage is only ever seen
+	// cut in half.
+	ChunkSize    int `yaml:"chunk_size" env:"KNOWLEDGE_CHUNK_SIZE"`
+	ChunkOverlap int `yaml:"chunk_overlap" env:"KNOWLEDGE_CHUNK_OVERLAP"`
+	// TopK chunks scoring at least MinScore (cosine similarity) are given
+	// to the model with each message.
+	TopK            int     `yaml:"top_k" env:"KNOWLEDGE_TOP_K"`
+	MinScore        float64 `yaml:"min_score" env:"KNOWLEDGE_MIN_SCORE"`
+	MaxDocumentSize int64   `yaml:"max_document_size" env:"KNOWLEDGE_MAX_DOCUMENT_SIZE"`
+}
+
+func defaultKnowledgeConfig() KnowledgeConfig {
+	return KnowledgeConfig{
+		Enabled:         true,
+		EmbeddingModel:  "nomic-embed-text",
+		ChunkSize:       800,
+		ChunkOverlap:    150,
+		TopK:            3,
+		MinScore:        0.45,
+		MaxDocumentSize: 20 << 20,
+	}
+}
+
+// Validate checks the knowledge settings.
+func (c KnowledgeConfig) Validate() error {
+	var errs config.Errors
+	if !c.Enabled {
+		return nil
+	}
+	if strings.TrimSpace(c.EmbeddingModel) == "" {
+		errs.Addf("knowledge.embedding_model must not be empty")
+	}
+	if c.SDKURL != "" {
+		if u, err := url.Parse(c.SDKURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.Addf("knowledge.sdk_url must be an http or https URL, got %q", c.SDKURL)
+		}
+	}
+	if c.ChunkSize < 100 {
+		errs.Addf("knowledge.chunk_size must be at least 100, got %d", c.ChunkSize)
+	}
+	if c.ChunkOverlap < 0 || c.ChunkOverlap > c.ChunkSize/2 {
+		errs.Addf("knowledge.chunk_overlap must be between 0 and half the chunk size, got %d", c.ChunkOverlap)
+	}
+	if c.TopK < 1 || c.TopK > 20 {
+		errs.Addf("knowledge.top_k must be between 1 and 20, got %d", c.TopK)
+	}
+	if c.MinScore < -1 || c.MinScore > 1 {
+		errs.Addf("knowledge.min_score must be between -1 and 1, got %g", c.MinScore)
+	}
+	if c.MaxDocumentSize < 1 {
+		errs.Addf("knowledge.max_document_size must be positive, got %d", c.MaxDocumentSize)
+	}
+	return errs.Err()
+}
+
+// defaultTenant owns documents and chats of callers without a tenant, as in
+// the sdk.
+const defaultTenant = "default"
+
+// tenantOf returns the tenant whose documents a caller may search.
+func tenantOf(ctx context.Context) string {
+	if p, ok := auth.FromContext(ctx); ok && p.Tenant != "" {
+		return p.Tenant
+	}
+	return defaultTenant
+}
+
+// knowledgeBase is the document index; nil when knowledge is disabled.
+var knowledgeBase *knowledgeIndex
+
+// Source is a document excerpt an answer was given with. The model is asked
+// to cite it as [Ref].
+type Source struct {
+	Ref        int     `json:"ref"`
+	DocumentID string  `json:"documentId"`
+	Name       string  `json:"name"`
+	Excerpt    string  `json:"excerpt"`
+	Score      float64 `json:"score"`
+}
+
+// retrieve finds the excerpts of the caller's documents most relevant to
+// message. Chats go on without them if the search fails.
+func retrieve(ctx context.Context, message string) []Source {
+	cfg := currentConfig().Knowledge
+	tenant := tenantOf(ctx)
+	if knowledgeBase == nil || !knowledgeBase.Has(tenant) {
+		return nil
+	}
+	vec, err := embed(ctx, cfg.EmbeddingModel, message)
+	if err != nil {
+		log.Printf("Knowledge search skipped: %v", err)
+		return nil
+	}
+	var sources []Source
+	for i, hit := range knowledgeBase.Search(tenant, cfg.EmbeddingModel, vec, cfg.TopK, cfg.MinScore) {
+		sources = append(sources, Source{
+			Ref:        i + 1,
+			DocumentID: hit.DocumentID,
+			Name:       hit.Name,
+			Excerpt:    hit.Text,
+			Score:      math.Round(hit.Score*1000) / 1000,
+		})
+	}
+	return sources
+}
+
+// sourcesMessage gives the model the excerpts to answer from.
+func sourcesMessage(sources []Source) []ChatMessage {
+	if len(sources) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("Excerpts from the company's documents that may help answer the next message. " +
+		"Use them when they are relevant and cite each one you use by its number, like [1]. " +
+		"If they do not answer the question, say so instead of guessing.\n")
+	for _, s := range sources {
+		fmt.Fprintf(&b, "\n[%d] %s\n%s\n", s.Ref, s.Name, s.Excerpt)
+	}
+	return []ChatMessage{{Role: "system", Content: b.String()}}
+}
+
+// embed returns the unit-length embedding of text.
+func embed(ctx context.Context, model, text string) ([]float32, error) {
+	body, _ := json.Marshal(map[string]string{"model": model, "prompt": text})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, currentConfig().OllamaURL+"/api/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot embed with %s: %w", model, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("cannot embed with %s: %s: %s", model, res.Status, bytes.TrimSpace(msg))
+	}
+	var out struct {
+		Embedding []float64 `json:"embedding"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("cannot read embedding: %w", err)
+	}
+	if len(out.Embedding) == 0 {
+		return nil, fmt.Errorf("%s returned an empty embedding", model)
+	}
+	return normalize(out.Embedding), nil
+}
+
+// normalize scales v to unit length, so a dot product is the cosine
+// similarity.
+func normalize(v []float64) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += x * x
+	}
+	norm := math.Sqrt(sum)
+	if norm == 0 {
+		norm = 1
+	}
+	out := make([]float32, len(v))
+	for i, x := range v {
+		out[i] = float32(x / norm)
+	}
+	return out
+}
+
+// documentRef names a document the sdk asks to index.
+type documentRef struct {
+	ID     string `json:"id"`
+	Tenant string `json:"tenant"`
+}
+
+// scannedDocument is the sdk's description of a stored upload.
+type scannedDocument struct {
+	ID          string `json:"id"`
+	Tenant      string `json:"tenant"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	SHA256      string `json:"sha256"`
+	Verdict     string `json:"verdict"`
+	ReleasedBy  string `json:"released_by"`
+}
+
+// errNotIndexable marks documents the sdk does not hold as clean uploads.
+var errNotIndexable = errors.New("not a clean document")
+
+// fetchScannedDocument reads a document and its content from the sdk, which
+// only serves clean uploads to indexers. The content must match the
+// document's digest and fit in limit bytes.
+func fetchScannedDocument(ctx context.Context, cfg KnowledgeConfig, ref documentRef, limit int64) (*scannedDocument, []byte, error) {
+	base := strings.TrimSuffix(cfg.SDKURL, "/") + "/indexing/documents/" + url.PathEscape(ref.ID)
+	query := "?tenant=" + url.QueryEscape(ref.Tenant)
+	get := func(target string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.SDKAPIKey != "" {
+			req.Header.Set("X-API-Key", cfg.SDKAPIKey)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+			res.Body.Close()
+			err := fmt.Errorf("sdk: %s: %s", res.Status, bytes.TrimSpace(msg))
+			if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusConflict {
+				err = fmt.Errorf("%w: %v", errNotIndexable, err)
+			}
+			return nil, err
+		}
+		return res, nil
+	}
+
+	res, err := get(base + query)
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc scannedDocument
+	err = json.NewDecoder(res.Body).Decode(&doc)
+	res.Body.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read document metadata: %w", err)
+	}
+	if doc.ID != ref.ID || doc.Verdict != "clean" || doc.ReleasedBy != "" {
+		return nil, nil, errNotIndexable
+	}
+
+	res, err = get(base + "/content" + query)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read document: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, nil, errDocumentTooLarge
+	}
+	if sum := sha256.Sum256(data); !strings.EqualFold(hex.EncodeToString(sum[:]), doc.SHA256) {
+		return nil, nil, fmt.Errorf("%w: content does not match its SHA-256", errNotIndexable)
+	}
+	return &doc, data, nil
+}
+
+// errDocumentTooLarge marks documents over the configured size.
+var errDocumentTooLarge = errors.New("document too large")
+
+func knowledgeError(c echo.Context, status int, msg string) error {
+	return c.JSON(status, map[string]string{"error": msg})
+}
+
+// documentTenant returns the tenant an indexer acts for. Indexers bound to
+// a tenant may only change that tenant's documents.
+func documentTenant(c echo.Context, tenant string) (string, bool) {
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	if p, ok := auth.FromContext(c.Request().Context()); ok && p.Tenant != "" && p.Tenant != tenant {
+		return "", false
+	}
+	return tenant, true
+}
+
+// handleIndexDocument serves POST /knowledge/documents: a JSON {"id",
+// "tenant"} naming a stored upload. The document is read from the sdk
+// rather than taken from the caller, so only files the scanner found clean
+// are indexed. Callers need an indexer credential; indexing a document again
+// replaces it.
+func handleIndexDocument(c echo.Context) error {
+	if knowledgeBase == nil {
+		return knowledgeError(c, http.StatusNotFound, "Knowledge base is disabled")
+	}
+	if p, ok := auth.FromContext(c.Request().Context()); !ok || p.Anonymous() {
+		return knowledgeError(c, http.StatusUnauthorized, "Indexing needs an indexer credential")
+	}
+	cfg := currentConfig().Knowledge
+	if cfg.SDKURL == "" {
+		return knowledgeError(c, http.StatusServiceUnavailable, "Knowledge base has no sdk to read documents from")
+	}
+	var ref documentRef
+	if err := json.NewDecoder(io.LimitReader(c.Request().Body, 4096)).Decode(&ref); err != nil || ref.ID == "" {
+		return knowledgeError(c, http.StatusBadRequest, "Expected a JSON document id and tenant")
+	}
+	tenant, ok := documentTenant(c, ref.Tenant)
+	if !ok {
+		return knowledgeError(c, http.StatusForbidden, "Cannot index documents of another tenant")
+	}
+	ref.Tenant = tenant
+
+	doc, data, err := fetchScannedDocument(c.Request().Context(), cfg, ref, cfg.MaxDocumentSize)
+	switch {
+	case errors.Is(err, errNotIndexable):
+		log.Printf("Refused to index %s for tenant %s: %v", ref.ID, tenant, err)
+		return knowledgeError(c, http.StatusUnprocessableEntity, "Only documents with a clean scan verdict can be indexed")
+	case errors.Is(err, errDocumentTooLarge):
+		return knowledgeError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Documents over %d bytes are not indexed", cfg.MaxDocumentSize))
+	case err != nil:
+		log.Printf("Cannot read %s from the sdk: %v", ref.ID, err)
+		return knowledgeError(c, http.StatusBadGateway, "Cannot read document from the sdk")
+	}
+
+	text, err := extractText(doc.Name, doc.ContentType, data)
+	switch {
+	case errors.Is(err, errUnsupportedDocument):
+		return knowledgeError(c, http.StatusUnsupportedMediaType, err.Error())
+	case err != nil:
+		log.Printf("Cannot extract text from %s (%s): %v", doc.ID, doc.Name, err)
+		return knowledgeError(c, http.StatusUnprocessableEntity, "Cannot extract text from document")
+	}
+	texts := chunkText(text, cfg.ChunkSize, cfg.ChunkOverlap)
+	if len(texts) == 0 {
+		return knowledgeError(c, http.StatusUnprocessableEntity, "Document has no text")
+	}
+
+	ctx := c.Request().Context()
+	chunks := make([]indexedChunk, len(texts))
+	for i, t := range texts {
+		vec, err := embed(ctx, cfg.EmbeddingModel, t)
+		if err != nil {
+			log.Printf("Cannot index %s (%s): %v", doc.ID, doc.Name, err)
+			return knowledgeError(c, http.StatusBadGateway, "Cannot embed document")
+		}
+		chunks[i] = indexedChunk{Seq: i, Text: t, Vector: vec}
+	}
+	indexed := &IndexedDocument{
+		ID:          doc.ID,
+		Name:        doc.Name,
+		ContentType: doc.ContentType,
+		SHA256:      doc.SHA256,
+		Model:       cfg.EmbeddingModel,
+		Chunks:      len(chunks),
+		Indexed:     time.Now().UTC(),
+	}
+	if err := knowledgeBase.Replace(ctx, tenant, indexed, chunks); err != nil {
+		log.Printf("Cannot store index of %s: %v", doc.ID, err)
+		return knowledgeError(c, http.StatusInternalServerError, "Cannot store document index")
+	}
+	log.Printf("Indexed document %s (%s) for tenant %s: %d chunks", doc.ID, doc.Name, tenant, len(chunks))
+	return c.JSON(http.StatusCreated, indexed)
+}
+
+// handleRemoveDocument serves DELETE /knowledge/documents/:id; indexers
+// name the document's tenant with ?tenant=.
+func handleRemoveDocument(c echo.Context) error {
+	if knowledgeBase == nil {
+		return knowledgeError(c, http.StatusNotFound, "Knowledge base is disabled")
+	}
+	if p, ok := auth.FromContext(c.Request().Context()); !ok || p.Anonymous() {
+		return knowledgeError(c, http.StatusUnauthorized, "Removing documents needs an indexer credential")
+	}
+	tenant, ok := documentTenant(c, c.QueryParam("tenant"))
+	if !ok {
+		return knowledgeError(c, http.StatusForbidden, "Cannot remove documents of another tenant")
+	}
+	found, err := knowledgeBase.Remove(c.Request().Context(), tenant, c.Param("id"))
+	if err != nil {
+		log.Printf("Cannot remove %s from the index: %v", c.Param("id"), err)
+		return knowledgeError(c, http.StatusInternalServerError, "Cannot remove document")
+	}
+	if !found {
+		return knowledgeError(c, http.StatusNotFound, "Document not indexed")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// handleListIndexed serves GET /knowledge/documents: the documents the
+// caller's chats are answered from.
+func handleListIndexed(c echo.Context) error {
+	docs := []*IndexedDocument{}
+	if knowledgeBase != nil {
+		docs = append(docs, knowledgeBase.Documents(tenantOf(c.Request().Context()))...)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"documents": docs})
+}
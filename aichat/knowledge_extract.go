@@ -0,0 +1,301 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+)
+
+var errUnsupportedDocument = errors.New("only plain text, Markdown, PDF and DOCX documents can be indexed")
+
+// maxDocxXML bounds how much of a DOCX's main part is decompressed, so a
+// zip bomb cannot exhaust memory.
+const maxDocxXML = 64 << 20
+
+// extractText returns the text of a document, picking the format by file
+// extension and then by content type.
+func extractText(name, contentType string, data []byte) (string, error) {
+	ct := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	var text string
+	var err error
+	switch ext := strings.ToLower(path.Ext(name)); {
+	case ext == ".md" || ext == ".markdown" || ct == "text/markdown":
+		text = stripMarkdown(string(data))
+	case ext == ".txt" || ext == ".text" || ct == "text/plain":
+		text = string(data)
+	case ext == ".pdf" || ct == "application/pdf":
+		text, err = pdfText(data)
+	case ext == ".docx" || ct == "application/vnd.openxmlformats-officedocument.wordprocessingml.document":
+		text, err = docxText(data)
+	default:
+		return "", errUnsupportedDocument
+	}
+	if err != nil {
+		return "", err
+	}
+	return cleanText(text), nil
+}
+
+var (
+	blankLines = regexp.MustCompile(`\n{3,}`)
+	spaceRuns  = regexp.MustCompile(`[ \t\f\v\x{00a0}]+`)
+)
+
+// cleanText drops invalid UTF-8 and control characters and collapses runs
+// of spaces and blank lines.
+func cleanText(s string) string {
+	s = strings.ToValidUTF8(s, "")
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.Map(func(r rune) rune {
+		if r == '\r' {
+			return '\n'
+		}
+		if r < 0x20 && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, s)
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSpace(spaceRuns.ReplaceAllString(l, " "))
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+var (
+	mdImage    = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdLink     = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+	mdHeading  = regexp.MustCompile(`(?m)^\s{0,3}#{1,6}\s+`)
+	mdQuote    = regexp.MustCompile(`(?m)^\s*>\s?`)
+	mdFence    = regexp.MustCompile("(?m)^\\s*(```|~~~).*$")
+	mdEmphasis = regexp.MustCompile(`(\*\*|__|\*|_|~~|` + "`" + `)(\S(?:.*?\S)?)(\*\*|__|\*|_|~~|` + "`" + `)`)
+	mdRule     = regexp.MustCompile(`(?m)^\s*([-*_]\s*){3,}$`)
+	mdHTML     = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+)
+
+// stripMarkdown removes Markdown syntax that means nothing to the model,
+// keeping link and image text.
+func stripMarkdown(s string) string {
+	s = mdFence.ReplaceAllString(s, "")
+	s = mdImage.ReplaceAllString(s, "$1")
+	s = mdLink.ReplaceAllString(s, "$1")
+	s = mdHeading.ReplaceAllString(s, "")
+	s = mdQuote.ReplaceAllString(s, "")
+	s = mdRule.ReplaceAllString(s, "")
+	s = mdHTML.ReplaceAllString(s, "")
+	return mdEmphasis.ReplaceAllString(s, "$2")
+}
+
+// pdfText returns the text of a PDF. The parser panics on some malformed
+// files, which only fails this document.
+func pdfText(data []byte) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed PDF: %v", r)
+		}
+	}()
+	r, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for i := 1; i <= r.NumPage(); i++ {
+		p := r.Page(i)
+		if p.V.IsNull() {
+			continue
+		}
+		t, err := p.GetPlainText(nil)
+		if err != nil {
+			return "", fmt.Errorf("page %d: %w", i, err)
+		}
+		b.WriteString(t)
+		b.WriteString("\n\n")
+	}
+	return b.String(), nil
+}
+
+// docxText returns the text of a Word document's body, one paragraph per
+// line.
+func docxText(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("not a DOCX file: %w", err)
+	}
+	var body *zip.File
+	for _, f := range zr.File {
+		if f.Name == "word/document.xml" {
+			body = f
+			break
+		}
+	}
+	if body == nil {
+		return "", errors.New("not a DOCX file: word/document.xml missing")
+	}
+	rc, err := body.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	var b strings.Builder
+	dec := xml.NewDecoder(io.LimitReader(rc, maxDocxXML))
+	inText := false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("cannot read DOCX body: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				b.WriteByte('\t')
+			case "br", "cr":
+				b.WriteByte('\n')
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				b.WriteString("\n\n")
+			case "tc":
+				b.WriteByte('\t')
+			}
+		case xml.CharData:
+			if inText {
+				b.Write(t)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// chunkText cuts text into chunks of about size bytes. Chunks break between
+// paragraphs where possible, then between sentences, then between words;
+// each chunk starts with up to overlap bytes of the end of the previous one.
+func chunkText(text string, size, overlap int) []string {
+	type piece struct {
+		text string
+		// para marks the first piece of a paragraph
+		para bool
+	}
+	var pieces []piece
+	for _, para := range strings.Split(text, "\n\n") {
+		para = strings.TrimSpace(para)
+		if para == "" {
+			continue
+		}
+		for i, p := range splitPassage(para, size) {
+			pieces = append(pieces, piece{p, i == 0})
+		}
+	}
+
+	var chunks []string
+	var cur []piece
+	length := func(ps []piece) int {
+		n := 0
+		for _, p := range ps {
+			n += len(p.text) + 2
+		}
+		return n
+	}
+	join := func(ps []piece) string {
+		var b strings.Builder
+		for i, p := range ps {
+			if i > 0 {
+				if p.para {
+					b.WriteString("\n\n")
+				} else {
+					b.WriteByte(' ')
+				}
+			}
+			b.WriteString(p.text)
+		}
+		return b.String()
+	}
+	for _, p := range pieces {
+		if len(cur) > 0 && length(cur)+len(p.text) > size {
+			chunks = append(chunks, join(cur))
+			// Carry the last pieces over, as long as they fit in overlap
+			// and leave room for p
+			start := len(cur)
+			for start > 0 && length(cur[start-1:]) <= overlap && length(cur[start-1:])+len(p.text) <= size {
+				start--
+			}
+			cur = append([]piece(nil), cur[start:]...)
+		}
+		cur = append(cur, p)
+	}
+	if len(cur) > 0 {
+		chunks = append(chunks, join(cur))
+	}
+	return chunks
+}
+
+var sentenceEnd = regexp.MustCompile(`[.!?]["')\]]*\s+`)
+
+// splitPassage cuts a paragraph longer than size into sentences, and
+// sentences longer than size into runs of words.
+func splitPassage(para string, size int) []string {
+	if len(para) <= size {
+		return []string{para}
+	}
+	var out []string
+	start := 0
+	ends := sentenceEnd.FindAllStringIndex(para, -1)
+	ends = append(ends, []int{len(para), len(para)})
+	for _, end := range ends {
+		sentence := strings.TrimSpace(para[start:end[1]])
+		start = end[1]
+		if sentence == "" {
+			continue
+		}
+		if len(sentence) <= size {
+			out = append(out, sentence)
+			continue
+		}
+		var words []string
+		n := 0
+		for _, w := range strings.Fields(sentence) {
+			if len(w) > size && n > 0 {
+				out = append(out, strings.Join(words, " "))
+				words, n = nil, 0
+			}
+			for len(w) > size {
+				// A "word" longer than a chunk, such as a URL or a table
+				// row without spaces; cut it between runes
+				cut := size
+				for cut > 0 && !utf8.RuneStart(w[cut]) {
+					cut--
+				}
+				out = append(out, w[:cut])
+				w = w[cut:]
+			}
+			// n counts a space after each word
+			if n > 0 && n+len(w) > size {
+				out = append(out, strings.Join(words, " "))
+				words, n = nil, 0
+			}
+			words = append(words, w)
+			n += len(w) + 1
+		}
+		if len(words) > 0 {
+			out = append(out, strings.Join(words, " "))
+		}
+	}
+	return out
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IndexedDocument is a document the assistant answers from.
+type IndexedDocument struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	SHA256      string `json:"sha256,omitempty"`
+	// Model is the embedding model its chunks were embedded with; they are
+	// only searched while the same model is configured.
+	Model   string    `json:"model"`
+	Chunks  int       `json:"chunks"`
+	Indexed time.Time `json:"indexed"`
+}
+
+// indexedChunk is a passage of a document with its unit-length embedding.
+type indexedChunk struct {
+	Seq    int
+	Text   string
+	Vector []float32
+}
+
+// searchHit is a chunk found for a query.
+type searchHit struct {
+	DocumentID string
+	Name       string
+	Text       string
+	Score      float64
+}
+
+// knowledgeIndex holds every tenant's chunks in memory and searches them by
+// brute force, which is plenty for a company's worth of documents. With a
+// database, changes are written through and the index is loaded from it on
+// start.
+type knowledgeIndex struct {
+	mu      sync.RWMutex
+	tenants map[string]*tenantIndex
+	db      *sql.DB
+}
+
+type tenantIndex struct {
+	docs   map[string]*IndexedDocument
+	chunks map[string][]indexedChunk
+}
+
+const knowledgeSchema = `
+CREATE TABLE IF NOT EXISTS knowledge_documents (
+	tenant       TEXT NOT NULL,
+	id           TEXT NOT NULL,
+	name         TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	sha256       TEXT NOT NULL,
+	model        TEXT NOT NULL,
+	indexed_at   TIMESTAMP NOT NULL,
+	PRIMARY KEY (tenant, id)
+);
+CREATE TABLE IF NOT EXISTS knowledge_chunks (
+	tenant      TEXT NOT NULL,
+	document_id TEXT NOT NULL,
+	seq         INTEGER NOT NULL,
+	text        TEXT NOT NULL,
+	vector      BLOB NOT NULL,
+	PRIMARY KEY (tenant, document_id, seq),
+	FOREIGN KEY (tenant, document_id) REFERENCES knowledge_documents (tenant, id) ON DELETE CASCADE
+);`
+
+// openKnowledgeIndex returns an index kept in the SQLite file at path, or
+// in memory only if path is empty.
+func openKnowledgeIndex(path string) (*knowledgeIndex, error) {
+	idx := &knowledgeIndex{tenants: map[string]*tenantIndex{}}
+	if path == "" {
+		return idx, nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(knowledgeSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot set up knowledge index %s: %w", path, err)
+	}
+	idx.db = db
+	if err := idx.load(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot load knowledge index %s: %w", path, err)
+	}
+	return idx, nil
+}
+
+func (x *knowledgeIndex) load() error {
+	rows, err := x.db.Query(`SELECT tenant, id, name, content_type, sha256, model, indexed_at FROM knowledge_documents`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tenant string
+		d := &IndexedDocument{}
+		if err := rows.Scan(&tenant, &d.ID, &d.Name, &d.ContentType, &d.SHA256, &d.Model, &d.Indexed); err != nil {
+			return err
+		}
+		x.tenant(tenant).docs[d.ID] = d
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	chunks, err := x.db.Query(`SELECT tenant, document_id, seq, text, vector FROM knowledge_chunks ORDER BY tenant, document_id, seq`)
+	if err != nil {
+		return err
+	}
+	defer chunks.Close()
+	for chunks.Next() {
+		var tenant, id string
+		var c indexedChunk
+		var blob []byte
+		if err := chunks.Scan(&tenant, &id, &c.Seq, &c.Text, &blob); err != nil {
+			return err
+		}
+		c.Vector = decodeVector(blob)
+		t := x.tenant(tenant)
+		t.chunks[id] = append(t.chunks[id], c)
+		if d := t.docs[id]; d != nil {
+			d.Chunks++
+		}
+	}
+	return chunks.Err()
+}
+
+// tenant returns the tenant's index, creating it; x.mu must be held.
+func (x *knowledgeIndex) tenant(name string) *tenantIndex {
+	t := x.tenants[name]
+	if t == nil {
+		t = &tenantIndex{docs: map[string]*IndexedDocument{}, chunks: map[string][]indexedChunk{}}
+		x.tenants[name] = t
+	}
+	return t
+}
+
+// Replace indexes doc for tenant, replacing any earlier version of it.
+func (x *knowledgeIndex) Replace(ctx context.Context, tenant string, doc *IndexedDocument, chunks []indexedChunk) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.db != nil {
+		tx, err := x.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.ExecContext(ctx, `DELETE FROM knowledge_documents WHERE tenant = ? AND id = ?`, tenant, doc.ID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO knowledge_documents (tenant, id, name, content_type, sha256, model, indexed_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			tenant, doc.ID, doc.Name, doc.ContentType, doc.SHA256, doc.Model, doc.Indexed); err != nil {
+			return err
+		}
+		for _, c := range chunks {
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO knowledge_chunks (tenant, document_id, seq, text, vector) VALUES (?, ?, ?, ?, ?)`,
+				tenant, doc.ID, c.Seq, c.Text, encodeVector(c.Vector)); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	t := x.tenant(tenant)
+	t.docs[doc.ID] = doc
+	t.chunks[doc.ID] = chunks
+	return nil
+}
+
+// Remove drops a document from the tenant's index and reports whether it
+// was there.
+func (x *knowledgeIndex) Remove(ctx context.Context, tenant, id string) (bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	t := x.tenants[tenant]
+	if t == nil || t.docs[id] == nil {
+		return false, nil
+	}
+	if x.db != nil {
+		if _, err := x.db.ExecContext(ctx, `DELETE FROM knowledge_documents WHERE tenant = ? AND id = ?`, tenant, id); err != nil {
+			return false, err
+		}
+	}
+	delete(t.docs, id)
+	delete(t.chunks, id)
+	return true, nil
+}
+
+// Has reports whether the tenant has any documents indexed.
+func (x *knowledgeIndex) Has(tenant string) bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	t := x.tenants[tenant]
+	return t != nil && len(t.docs) > 0
+}
+
+// Documents lists the tenant's indexed documents, most recent first.
+func (x *knowledgeIndex) Documents(tenant string) []*IndexedDocument {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var out []*IndexedDocument
+	if t := x.tenants[tenant]; t != nil {
+		for _, d := range t.docs {
+			cp := *d
+			out = append(out, &cp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Indexed.After(out[j].Indexed) })
+	return out
+}
+
+// Search returns up to k of the tenant's chunks embedded with model that
+// are most similar to the unit vector query, scoring at least minScore.
+func (x *knowledgeIndex) Search(tenant, model string, query []float32, k int, minScore float64) []searchHit {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	t := x.tenants[tenant]
+	if t == nil {
+		return nil
+	}
+	var hits []searchHit
+	for id, chunks := range t.chunks {
+		doc := t.docs[id]
+		if doc == nil || doc.Model != model {
+			continue
+		}
+		for _, c := range chunks {
+			if len(c.Vector) != len(query) {
+				continue
+			}
+			var dot float64
+			for i, v := range c.Vector {
+				dot += float64(v) * float64(query[i])
+			}
+			if dot >= minScore {
+				hits = append(hits, searchHit{DocumentID: id, Name: doc.Name, Text: c.Text, Score: dot})
+			}
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
+
+func (x *knowledgeIndex) Close() error {
+	if x.db == nil {
+		return nil
+	}
+	return x.db.Close()
+}
+
+// encodeVector stores a vector as little-endian float32s.
+func encodeVector(v []float32) []byte {
+	buf := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+	}
+	return buf
+}
+
+func decodeVector(buf []byte) []float32 {
+	v := make([]float32, len(buf)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return v
+}
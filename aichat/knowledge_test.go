@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// buildDocx returns a minimal DOCX whose body is documentXML.
+func buildDocx(t *testing.T, documentXML string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"[Content_Types].xml": `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"/>`,
+		"word/document.xml":   documentXML,
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractText(t *testing.T) {
+	docx := buildDocx(t, `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>`+
+		`<w:p><w:r><w:t>Quarterly</w:t></w:r><w:r><w:t xml:space="preserve"> report</w:t></w:r></w:p>`+
+		`<w:p><w:r><w:t>Paper</w:t><w:tab/><w:t>12 tons</w:t><w:br/><w:t>Ink</w:t></w:r></w:p>`+
+		`<w:p><w:r><w:instrText>ignored field code</w:instrText></w:r></w:p>`+
+		`</w:body></w:document>`)
+	for _, tc := range []struct {
+		name, contentType string
+		data              []byte
+		want              string
+	}{
+		{"notes.txt", "", []byte("line one\r\nline   two\x00\n\n\n\nend"), "line one\nline two\n\nend"},
+		{"upload", "text/plain; charset=utf-8", []byte("plain \xffby type"), "plain by type"},
+		{"README.md", "", []byte("# Title\n\nSee [the docs](https://example.com) and **bold** `code`."), "Title\n\nSee the docs and bold code."},
+		{"upload", "text/markdown", []byte("> quoted _text_"), "quoted text"},
+		{"report.docx", "application/octet-stream", docx, "Quarterly report\n\nPaper 12 tons\nInk"},
+	} {
+		got, err := extractText(tc.name, tc.contentType, tc.data)
+		if err != nil {
+			t.Errorf("%s (%s): %v", tc.name, tc.contentType, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s (%s): got %q, want %q", tc.name, tc.contentType, got, tc.want)
+		}
+	}
+
+	if _, err := extractText("image.png", "image/png", []byte("\x89PNG")); !errors.Is(err, errUnsupportedDocument) {
+		t.Errorf("PNG: got %v, want errUnsupportedDocument", err)
+	}
+	if _, err := extractText("fake.docx", "", []byte("not a zip")); err == nil {
+		t.Error("DOCX that is not a zip accepted")
+	}
+	var noBody bytes.Buffer
+	zip.NewWriter(&noBody).Close()
+	if _, err := extractText("empty.docx", "", noBody.Bytes()); err == nil {
+		t.Error("DOCX without word/document.xml accepted")
+	}
+}
+
+func TestStripMarkdown(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"## Heading", "Heading"},
+		{"![logo](logo.png) and [link](http://x)", "logo and link"},
+		{"*em* __strong__ ~~gone~~ `tick`", "em strong gone tick"},
+		{"```go\nfmt.Println()\n```", "\nfmt.Println()\n"},
+		{"> a quote", "a quote"},
+		{"above\n---\nbelow", "above\n\nbelow"},
+		{"<b>bold</b> text", "bold text"},
+		{"2 * 3 * 4", "2 * 3 * 4"},
+	} {
+		if got := stripMarkdown(tc.in); got != tc.want {
+			t.Errorf("stripMarkdown(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestChunkTextSizesAndOverlap(t *testing.T) {
+	var paras []string
+	for i := 0; i < 12; i++ {
+		paras = append(paras, strings.Repeat(string(rune('a'+i)), 30)+".")
+	}
+	text := strings.Join(paras, "\n\n")
+	chunks := chunkText(text, 100, 40)
+	if len(chunks) < 2 {
+		t.Fatalf("got %d chunks, want several", len(chunks))
+	}
+	for i, c := range chunks {
+		if len(c) > 100 {
+			t.Errorf("chunk %d is %d bytes, more than 100", i, len(c))
+		}
+		if i == 0 {
+			continue
+		}
+		// The last paragraph of the previous chunk starts this one
+		prev := strings.Split(chunks[i-1], "\n\n")
+		if last := prev[len(prev)-1]; !strings.HasPrefix(c, last+"\n\n") {
+			t.Errorf("chunk %d does not start with the end of chunk %d: %q", i, i-1, c)
+		}
+	}
+	// Every paragraph is somewhere
+	joined := strings.Join(chunks, "\n\n")
+	for _, p := range paras {
+		if !strings.Contains(joined, p) {
+			t.Errorf("paragraph %q lost", p)
+		}
+	}
+
+	// Without overlap every paragraph appears once
+	chunks = chunkText(text, 100, 0)
+	if n := strings.Count(strings.Join(chunks, "\n\n"), "."); n != len(paras) {
+		t.Errorf("without overlap %d paragraphs in the chunks, want %d", n, len(paras))
+	}
+	if chunks := chunkText("  \n\n \n\n", 100, 10); len(chunks) != 0 {
+		t.Errorf("blank text gave chunks %q", chunks)
+	}
+}
+
+func TestSplitPassage(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		para string
+		size int
+		want []string
+	}{
+		{"fits", "Short one. Another.", 50, []string{"Short one. Another."}},
+		{"sentences", "First sentence here. Second one! Third?", 22, []string{"First sentence here.", "Second one!", "Third?"}},
+		{"quoted sentence end", `He said "stop." Then left.`, 16, []string{`He said "stop."`, "Then left."}},
+		{"words", "one two three four five six", 10, []string{"one two", "three four", "five six"}},
+		{"long word", "see abcdefghijkl now", 5, []string{"see", "abcde", "fghij", "kl", "now"}},
+	} {
+		if got := splitPassage(tc.para, tc.size); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSplitPassageCutsBetweenRunes(t *testing.T) {
+	word := strings.Repeat("日本語", 10) // 3 bytes a rune
+	for size := 4; size <= 11; size++ {
+		parts := splitPassage(word, size)
+		if strings.Join(parts, "") != word {
+			t.Fatalf("size %d: parts %q do not add up to the word", size, parts)
+		}
+		for _, p := range parts {
+			if len(p) > size || !utf8.ValidString(p) {
+				t.Errorf("size %d: part %q is %d bytes or splits a rune", size, p, len(p))
+			}
+		}
+	}
+}
+
+// unit returns the two-dimensional vector (cos, sin), of unit length for
+// the cosine and sine of an angle.
+func unit(cos, sin float32) []float32 { return []float32{cos, sin} }
+
+func TestKnowledgeIndexSearch(t *testing.T) {
+	ctx := context.Background()
+	x, err := openKnowledgeIndex("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	put := func(tenant, id, model string, chunks ...indexedChunk) {
+		t.Helper()
+		doc := &IndexedDocument{ID: id, Name: id + ".txt", Model: model, Chunks: len(chunks), Indexed: now}
+		if err := x.Replace(ctx, tenant, doc, chunks); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("acme", "near", "embed-a",
+		indexedChunk{Seq: 0, Text: "closest", Vector: unit(1, 0)},
+		indexedChunk{Seq: 1, Text: "close", Vector: unit(0.9, 0.43589)})
+	put("acme", "far", "embed-a", indexedChunk{Seq: 0, Text: "far", Vector: unit(0.6, 0.8)})
+	put("acme", "other-model", "embed-b", indexedChunk{Seq: 0, Text: "other model", Vector: unit(1, 0)})
+	put("globex", "theirs", "embed-a", indexedChunk{Seq: 0, Text: "other tenant", Vector: unit(1, 0)})
+
+	texts := func(hits []searchHit) []string {
+		var out []string
+		for _, h := range hits {
+			out = append(out, h.Text)
+		}
+		return out
+	}
+	query := unit(1, 0)
+	if got, want := texts(x.Search("acme", "embed-a", query, 10, 0)), []string{"closest", "close", "far"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("all hits %v, want %v", got, want)
+	}
+	if got, want := texts(x.Search("acme", "embed-a", query, 2, 0)), []string{"closest", "close"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("top 2 %v, want %v", got, want)
+	}
+	if got, want := texts(x.Search("acme", "embed-a", query, 10, 0.7)), []string{"closest", "close"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hits scoring 0.7 %v, want %v", got, want)
+	}
+	if got, want := texts(x.Search("acme", "embed-b", query, 10, 0)), []string{"other model"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hits of the other model %v, want %v", got, want)
+	}
+	if hits := x.Search("acme", "embed-a", []float32{1, 0, 0}, 10, 0); len(hits) != 0 {
+		t.Errorf("query of another dimension matched %v", texts(hits))
+	}
+	if hits := x.Search("initech", "embed-a", query, 10, 0); hits != nil {
+		t.Errorf("tenant without documents matched %v", texts(hits))
+	}
+
+	// Indexing a document again replaces its chunks
+	put("acme", "near", "embed-a", indexedChunk{Seq: 0, Text: "rewritten", Vector: unit(0.8, 0.6)})
+	if got, want := texts(x.Search("acme", "embed-a", query, 10, 0)), []string{"rewritten", "far"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hits after replacing %v, want %v", got, want)
+	}
+	if docs := x.Documents("acme"); len(docs) != 3 {
+		t.Errorf("%d documents after replacing one, want 3", len(docs))
+	}
+}
+
+func TestKnowledgeIndexPersists(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "knowledge.db")
+	x, err := openKnowledgeIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := &IndexedDocument{ID: "d1", Name: "d1.txt", Model: "embed-a", Chunks: 1, Indexed: time.Now()}
+	if err := x.Replace(ctx, "acme", doc, []indexedChunk{{Seq: 0, Text: "old", Vector: unit(1, 0)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Replace(ctx, "acme", doc, []indexedChunk{{Seq: 0, Text: "new", Vector: unit(0, 1)}}); err != nil {
+		t.Fatal(err)
+	}
+	x.Close()
+
+	x, err = openKnowledgeIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	hits := x.Search("acme", "embed-a", unit(0, 1), 10, 0)
+	if len(hits) != 1 || hits[0].Text != "new" || hits[0].Score < 0.99 {
+		t.Fatalf("hits after reopening %+v, want only the replaced chunk", hits)
+	}
+	if removed, err := x.Remove(ctx, "acme", "d1"); err != nil || !removed {
+		t.Fatalf("Remove: %t, %v", removed, err)
+	}
+	if x.Has("acme") {
+		t.Error("tenant still has documents after the only one was removed")
+	}
+}
@@ -3,13 +3,21 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"strings"
 
+	"common/auth"
+	"common/config"
+	"common/origins"
+	"common/rbac"
+	"common/shutdown"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
@@ -17,49 +25,71 @@ import (
 type ChatRequest struct {
 	Message         string `json:"message"`
 	SecurityEnabled *bool  `json:"securityEnabled,omitempty"`
+	// ConversationID continues a conversation; empty starts a new one.
+	ConversationID string `json:"conversationId,omitempty"`
+	// Persona picks the system prompt; empty uses the tenant's or the
+	// default one.
+	Persona string `json:"persona,omitempty"`
+	// Model picks a registered model; empty uses the default one.
+	Model string `json:"model,omitempty"`
+}
+
+// Messages shown to the user in place of a reply.
+const (
+	msgInvalidRequest = "Invalid request"
+	msgBlocked        = "Blocked: Trend Vision One"
+	msgPolicyError    = "Error checking policy"
+
+	msgConversationNotFound = "Conversation not found"
+	msgConversationError    = "Error loading conversation"
+	msgUnknownPersona       = "Unknown persona"
+	msgUnknownModel         = "Unknown model"
+	msgModelUnavailable     = "Model is not available yet"
+)
+
+// modelErrorMessage returns the message shown when chooseModel fails.
+func modelErrorMessage(err error) string {
+	if errors.Is(err, errModelUnavailable) {
+		return msgModelUnavailable
+	}
+	return msgUnknownModel
+}
+
+// securityEnabled reports whether the guard should run; it defaults to true
+// if not specified.
+func (r ChatRequest) securityEnabled() bool {
+	return r.SecurityEnabled == nil || *r.SecurityEnabled
 }
 
 type AIGuardConfig struct {
-	APIKey string
-	Base   string
+	APIKey string `yaml:"api_key" env:"API_KEY" secret:"true"`
+	Base   string `yaml:"base_url" env:"AI_GUARD_URL"`
+}
+
+// ChatMessage is a role-tagged message of Ollama's chat API; Role is
+// "system", "user" or "assistant".
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
 }
 
 // OllamaRequest includes Stream:true
 type OllamaRequest struct {
-	Model  string `json:"model"`
-	Prompt string `json:"prompt"`
-	Stream bool   `json:"stream"`
+	Model    string                 `json:"model"`
+	Messages []ChatMessage          `json:"messages"`
+	Stream   bool                   `json:"stream"`
+	Options  map[string]interface{} `json:"options,omitempty"`
 }
 
 type OllamaResponse struct {
-	Response string `json:"response"`
-	Done     bool   `json:"done"`
+	Message ChatMessage `json:"message"`
+	Done    bool        `json:"done"`
 }
 
-func initAIGuard() *AIGuardConfig {
-	apiKey := os.Getenv("API_KEY")
-	if apiKey == "" {
+func initAIGuard(cfg *Config) {
+	if cfg.Guard.APIKey == "" {
 		fmt.Fprintln(os.Stderr, "Warning: API_KEY not set; guard checks will be skipped")
 	}
-	return &AIGuardConfig{
-		APIKey: apiKey,
-		Base:   "https://api.xdr.trendmicro.com/beta/aiSecurity",
-	}
-}
-
-// getModelName returns the model to use, with fallback to smaller models
-func getModelName() string {
-	// Check for environment variable first
-	if model := os.Getenv("OLLAMA_MODEL"); model != "" {
-		return model
-	}
-
-	// Default to a smaller, efficient model
-	// Options in order of preference (smallest to largest):
-	// - tinyllama:1.1b-chat: ~1.1GB, fast, good for chat
-	// - phi:2.7b: ~1.7GB, good balance
-	// - phi:latest: ~2.7GB, original choice
-	return "tinyllama:1.1b-chat"
 }
 
 // checkAIGuard POSTs to TrendVisionOne, logs and returns true if action=="Block"
@@ -101,125 +131,243 @@ func checkAIGuard(label, content string, cfg *AIGuardConfig) (bool, error) {
 	return strings.EqualFold(gr.Action, "Block"), nil
 }
 
-func pullModel() error {
-	ollamaURL := os.Getenv("OLLAMA_URL")
-	if ollamaURL == "" {
-		ollamaURL = "http://localhost:11434"
+// Errors from generate; their text is what the user is shown.
+var (
+	errLLMCall = errors.New("Failed to call LLM")
+	errLLMRead = errors.New("Error reading LLM response")
+)
+
+// llmErrorMessage returns the message shown for a generate error.
+func llmErrorMessage(err error) string {
+	if errors.Is(err, errLLMRead) {
+		return errLLMRead.Error()
 	}
-	pullURL := ollamaURL + "/api/pull"
+	return errLLMCall.Error()
+}
 
-	modelName := getModelName()
-	fmt.Printf("[Ollama] Pulling model: %s\n", modelName)
+// generate asks model for the next assistant message after messages, passes
+// each chunk to onChunk as it arrives and returns the whole reply.
+// Generation is tied to ctx, so Ollama stops when the client goes away or
+// shutdown gives up waiting.
+func generate(ctx context.Context, model ModelSpec, messages []ChatMessage, onChunk func(string) error) (string, error) {
+	genURL := currentConfig().OllamaURL + "/api/chat"
 
-	reqBody, _ := json.Marshal(map[string]string{"name": modelName})
-	res, err := http.Post(pullURL, "application/json", bytes.NewBuffer(reqBody))
+	ollReq := OllamaRequest{
+		Model:    model.Name,
+		Messages: messages,
+		Stream:   true,
+		Options:  model.options(),
+	}
+	reqBody, _ := json.Marshal(ollReq)
+	genReq, err := http.NewRequestWithContext(ctx, http.MethodPost, genURL, bytes.NewBuffer(reqBody))
 	if err != nil {
-		return err
+		return "", fmt.Errorf("%w: %v", errLLMCall, err)
+	}
+	genReq.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(genReq)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errLLMCall, err)
 	}
 	defer res.Body.Close()
-	io.Copy(os.Stdout, res.Body)
-	return nil
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return "", fmt.Errorf("%w: %s: %s", errLLMCall, res.Status, bytes.TrimSpace(body))
+	}
+
+	var replyBuilder strings.Builder
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		var chunk OllamaResponse
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			continue
+		}
+		replyBuilder.WriteString(chunk.Message.Content)
+		if chunk.Message.Content != "" {
+			if err := onChunk(chunk.Message.Content); err != nil {
+				return replyBuilder.String(), err
+			}
+		}
+		if chunk.Done {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return replyBuilder.String(), fmt.Errorf("%w: %v", errLLMRead, err)
+	}
+	return replyBuilder.String(), nil
 }
 
 func handleHealth(c echo.Context) error {
+	if server != nil && server.Draining() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "draining", "service": "aichat"})
+	}
 	return c.JSON(http.StatusOK, map[string]string{"status": "healthy", "service": "aichat"})
 }
 
 func handleChat(c echo.Context, guardCfg *AIGuardConfig) error {
 	var req ChatRequest
 	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"response": "Invalid request"})
+		return c.JSON(http.StatusBadRequest, map[string]string{"response": msgInvalidRequest})
 	}
 
-	// Check if security is enabled (default to true if not specified)
-	securityEnabled := true
-	if req.SecurityEnabled != nil {
-		securityEnabled = *req.SecurityEnabled
+	securityEnabled := req.securityEnabled()
+	ctx := c.Request().Context()
+	system, err := systemPromptFor(ctx, req.Persona)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"response": msgUnknownPersona})
 	}
+	model, err := chooseModel(req.Model)
+	if errors.Is(err, errModelUnavailable) {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"response": msgModelUnavailable})
+	} else if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"response": msgUnknownModel})
+	}
+	conv, unlock, err := openConversation(ctx, req.ConversationID, ownerOf(ctx))
+	if errors.Is(err, errConversationNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"response": msgConversationNotFound})
+	} else if err != nil {
+		log.Printf("Cannot open conversation %s: %v", req.ConversationID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"response": msgConversationError})
+	}
+	defer unlock()
 
 	// 1) Guard the **prompt** only (if security is enabled)
 	if securityEnabled {
 		if blocked, err := checkAIGuard("prompt", req.Message, guardCfg); err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"response": "Error checking policy"})
+			return c.JSON(http.StatusInternalServerError, map[string]string{"response": msgPolicyError})
 		} else if blocked {
-			return c.JSON(http.StatusForbidden, map[string]string{"response": "Blocked: Trend Vision One"})
+			return c.JSON(http.StatusForbidden, map[string]string{"response": msgBlocked})
 		}
 	}
 
-	// 2) Call Ollama with streaming enabled
-	ollamaURL := os.Getenv("OLLAMA_URL")
-	if ollamaURL == "" {
-		ollamaURL = "http://localhost:11434"
-	}
-	genURL := ollamaURL + "/api/generate"
-
-	modelName := getModelName()
-	ollReq := OllamaRequest{
-		Model:  modelName,
-		Prompt: fmt.Sprintf("You are a helpful assistant for the Boring Paper Company. %s", req.Message),
-		Stream: true,
-	}
-	reqBody, _ := json.Marshal(ollReq)
-	res, err := http.Post(genURL, "application/json", bytes.NewBuffer(reqBody))
+	// 2) Look up the caller's documents, then call Ollama with them and the
+	// conversation so far and assemble the streamed chunks
+	sources := retrieve(ctx, req.Message)
+	messages := buildContext(ctx, conv, system, req.Message, sourcesMessage(sources), historyFor(model))
+	response, err := generate(ctx, model, messages, func(string) error { return nil })
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"response": "Failed to call LLM"})
+		return c.JSON(http.StatusInternalServerError, map[string]string{"response": llmErrorMessage(err)})
 	}
-	defer res.Body.Close()
 
-	// 3) Assemble streamed chunks
-	var replyBuilder strings.Builder
-	scanner := bufio.NewScanner(res.Body)
-	for scanner.Scan() {
-		var chunk OllamaResponse
-		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
-			continue
-		}
-		replyBuilder.WriteString(chunk.Response)
-		if chunk.Done {
-			break
-		}
-	}
-	if err := scanner.Err(); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"response": "Error reading LLM response"})
-	}
-
-	// 4) Guard the **response** as well (if security is enabled)
-	response := replyBuilder.String()
+	// 3) Guard the **response** as well (if security is enabled)
 	if securityEnabled {
 		if blocked, err := checkAIGuard("response", response, guardCfg); err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"response": "Error checking policy"})
+			return c.JSON(http.StatusInternalServerError, map[string]string{"response": msgPolicyError})
 		} else if blocked {
-			return c.JSON(http.StatusForbidden, map[string]string{"response": "Blocked: Trend Vision One"})
+			return c.JSON(http.StatusForbidden, map[string]string{"response": msgBlocked})
 		}
 	}
 
-	// 5) Return the allowed reply
-	return c.JSON(http.StatusOK, map[string]string{"response": response})
+	// 4) Remember the exchange and return the allowed reply with the
+	// excerpts it may cite
+	reply := map[string]interface{}{"response": response}
+	if len(sources) > 0 {
+		reply["sources"] = sources
+	}
+	if err := saveExchange(ctx, conv, req.Message, response); err != nil {
+		log.Printf("Cannot save conversation %s: %v", conv.ID, err)
+		return c.JSON(http.StatusOK, reply)
+	}
+	reply["conversationId"] = conv.ID
+	return c.JSON(http.StatusOK, reply)
 }
 
+// server drains the service on SIGTERM; health checks fail once it starts.
+var server *shutdown.Server
+
+// allowedOrigins is replaced in place when the configuration is reloaded.
+var allowedOrigins *origins.Policy
+
 func main() {
-	guardCfg := initAIGuard()
-	if err := pullModel(); err != nil {
-		fmt.Fprintf(os.Stderr, "pullModel error: %v\n", err)
+	cfg := defaultConfig()
+	opts := config.MustLoad("aichat", cfg)
+	settings.Store(cfg)
+	initAIGuard(cfg)
+	// Readiness fails until the default model is there, and chats are
+	// answered without documents until the embedding model is
+	go pullStartupModels(cfg)
+
+	store, err := newConversationStore(cfg.History)
+	if err != nil {
+		log.Fatalf("Cannot open conversation history: %v", err)
+	}
+	conversations = store
+
+	if prompts, err = loadPrompts(cfg.Prompts.Dir); err != nil {
+		log.Fatalf("Cannot load personas: %v", err)
+	}
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	go prompts.Watch(watchCtx)
+
+	if cfg.Knowledge.Enabled {
+		if knowledgeBase, err = openKnowledgeIndex(cfg.Knowledge.IndexPath); err != nil {
+			log.Fatalf("Cannot open knowledge index: %v", err)
+		}
 	}
 
+	allowedOrigins = origins.Must("aichat", cfg.Origins)
+	authn := auth.Must("aichat", cfg.Auth)
+	access := rbac.Must("aichat", cfg.Access)
+	config.OnReload("aichat", func() { reloadConfig(opts.File, authn, access) })
+
 	e := echo.New()
 	e.Use(middleware.Logger(), middleware.Recover(), middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins:     []string{"http://ui-service", "http://ollama-service", "http://localhost", "https://localhost"},
-		AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodOptions},
-		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization},
+		AllowOriginFunc: func(origin string) (bool, error) {
+			return allowedOrigins.Allowed(origin), nil
+		},
+		AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions},
+		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization, "X-API-Key"},
 		AllowCredentials: false,
 		MaxAge:           86400,
 	}))
 
+	// Everything but the health check requires credentials and the route's
+	// permission
+	requireAuth := []echo.MiddlewareFunc{
+		echo.WrapMiddleware(authn.Middleware),
+		echo.WrapMiddleware(access.Middleware),
+	}
+
 	e.GET("/health", handleHealth)
+	checks := healthChecks()
+	e.GET("/livez", echo.WrapHandler(http.HandlerFunc(checks.LiveHandler)))
+	e.GET("/readyz", echo.WrapHandler(http.HandlerFunc(checks.ReadyHandler)))
 	e.POST("/chat", func(c echo.Context) error {
-		return handleChat(c, guardCfg)
-	})
+		return handleChat(c, &currentConfig().Guard)
+	}, requireAuth...)
+	// Streams the reply as it is generated: SSE for a POST, or JSON messages
+	// over a WebSocket
+	streamChat := func(c echo.Context) error {
+		return handleChatStream(c, &currentConfig().Guard)
+	}
+	e.POST("/chat/stream", streamChat, requireAuth...)
+	e.GET("/chat/stream", streamChat, requireAuth...)
+
+	// Conversations are only visible to the caller who had them
+	e.GET("/conversations", handleListConversations, requireAuth...)
+	e.GET("/conversations/:id", handleGetConversation, requireAuth...)
+	e.DELETE("/conversations/:id", handleDeleteConversation, requireAuth...)
+	e.GET("/personas", handleListPersonas, requireAuth...)
+	e.GET("/models", handleListModels, requireAuth...)
+	e.POST("/models/:name/pull", handlePullModel, requireAuth...)
+
+	// The sdk indexes clean uploads here; listing shows callers what their
+	// chats are answered from
+	e.POST("/knowledge/documents", handleIndexDocument, requireAuth...)
+	e.DELETE("/knowledge/documents/:id", handleRemoveDocument, requireAuth...)
+	e.GET("/knowledge/documents", handleListIndexed, requireAuth...)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "5001"
+	// In-flight chats finish before the process exits, including those on
+	// WebSockets, which the HTTP server does not track
+	server = shutdown.New("aichat", &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: e}, cfg.Shutdown)
+	server.OnShutdown("chat sockets", waitChatSockets)
+	server.OnShutdown("prompt watcher", func(context.Context) error { stopWatching(); return nil })
+	server.OnShutdown("conversation history", func(context.Context) error { return conversations.Close() })
+	if knowledgeBase != nil {
+		server.OnShutdown("knowledge index", func(context.Context) error { return knowledgeBase.Close() })
 	}
-	e.Logger.Fatal(e.Start(":" + port))
-}
\ No newline at end of file
+	log.Printf("aichat listening on :%d", cfg.Port)
+	if err := server.ListenAndServe(); err != nil {
+		e.Logger.Fatal(err)
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"common/config"
+	"github.com/labstack/echo/v4"
+)
+
+// ModelSpec is a model chats may ask for instead of the default one
+// (ollama_model), with the Ollama options it runs with. Unset options keep
+// the model's own defaults.
+type ModelSpec struct {
+	Name        string   `yaml:"name" json:"name"`
+	Description string   `yaml:"description" json:"description,omitempty"`
+	Temperature *float64 `yaml:"temperature,omitempty" json:"temperature,omitempty"`
+	TopP        *float64 `yaml:"top_p,omitempty" json:"top_p,omitempty"`
+	// NumCtx is the context window in tokens; it also caps how much history
+	// is sent (see contextTokens).
+	NumCtx int      `yaml:"num_ctx" json:"num_ctx,omitempty"`
+	Stop   []string `yaml:"stop" json:"stop,omitempty"`
+	// Pull downloads the model at startup. The default model is always
+	// pulled; others can be pulled later through POST /models/:name/pull.
+	Pull bool `yaml:"pull" json:"-"`
+}
+
+func floatPtr(f float64) *float64 { return &f }
+
+// defaultModels are the models known to work well on small nodes, smallest
+// first.
+func defaultModels() []ModelSpec {
+	return []ModelSpec{
+		{Name: "tinyllama:1.1b-chat", Description: "~1.1GB, fast, good for chat", Temperature: floatPtr(0.7), NumCtx: 2048, Stop: []string{"</s>"}},
+		{Name: "phi:2.7b", Description: "~1.7GB, good balance", Temperature: floatPtr(0.7), NumCtx: 2048},
+		{Name: "phi:latest", Description: "~2.7GB, original choice", Temperature: floatPtr(0.7), NumCtx: 2048},
+	}
+}
+
+// validateModels checks the registry.
+func validateModels(models []ModelSpec) error {
+	var errs config.Errors
+	seen := map[string]bool{}
+	for i, m := range models {
+		switch {
+		case strings.TrimSpace(m.Name) == "":
+			errs.Addf("models[%d].name must not be empty", i)
+			continue
+		case seen[m.Name]:
+			errs.Addf("models: %s is listed twice", m.Name)
+		}
+		seen[m.Name] = true
+		if m.Temperature != nil && (*m.Temperature < 0 || *m.Temperature > 2) {
+			errs.Addf("models: %s: temperature must be between 0 and 2, got %g", m.Name, *m.Temperature)
+		}
+		if m.TopP != nil && (*m.TopP <= 0 || *m.TopP > 1) {
+			errs.Addf("models: %s: top_p must be above 0 and at most 1, got %g", m.Name, *m.TopP)
+		}
+		if m.NumCtx != 0 && m.NumCtx < 256 {
+			errs.Addf("models: %s: num_ctx must be at least 256, got %d", m.Name, m.NumCtx)
+		}
+	}
+	return errs.Err()
+}
+
+// options returns the model's parameters as Ollama request options.
+func (m ModelSpec) options() map[string]interface{} {
+	opts := map[string]interface{}{}
+	if m.Temperature != nil {
+		opts["temperature"] = *m.Temperature
+	}
+	if m.TopP != nil {
+		opts["top_p"] = *m.TopP
+	}
+	if m.NumCtx > 0 {
+		opts["num_ctx"] = m.NumCtx
+	}
+	if len(m.Stop) > 0 {
+		opts["stop"] = m.Stop
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	return opts
+}
+
+// contextTokens caps the history budget at three quarters of the model's
+// context window, leaving the rest for the reply.
+func (m ModelSpec) contextTokens(budget int) int {
+	if limit := m.NumCtx * 3 / 4; m.NumCtx > 0 && limit < budget {
+		return limit
+	}
+	return budget
+}
+
+// registeredModels returns the models chats may use. The default model is
+// always among them, with the model's own options if it is not listed.
+func (c *Config) registeredModels() []ModelSpec {
+	for _, m := range c.Models {
+		if sameModel(m.Name, c.OllamaModel) {
+			return c.Models
+		}
+	}
+	return append([]ModelSpec{{Name: c.OllamaModel}}, c.Models...)
+}
+
+// lookupModel finds a registered model; an empty name is the default one.
+func (c *Config) lookupModel(name string) (ModelSpec, bool) {
+	if name == "" {
+		name = c.OllamaModel
+	}
+	for _, m := range c.registeredModels() {
+		if sameModel(m.Name, name) {
+			return m, true
+		}
+	}
+	return ModelSpec{}, false
+}
+
+// sameModel compares model names, treating a missing tag as ":latest".
+func sameModel(a, b string) bool {
+	return modelKey(a) == modelKey(b)
+}
+
+// defaultModel returns the model chats use unless they pick another.
+func defaultModel() ModelSpec {
+	m, _ := currentConfig().lookupModel("")
+	return m
+}
+
+var (
+	errUnknownModel     = errors.New("unknown model")
+	errModelUnavailable = errors.New("model not pulled")
+)
+
+// chooseModel returns the registered model a chat asked for. Models known
+// not to be pulled are refused rather than left to fail in Ollama.
+func chooseModel(name string) (ModelSpec, error) {
+	m, ok := currentConfig().lookupModel(name)
+	if !ok {
+		return ModelSpec{}, fmt.Errorf("%w %q", errUnknownModel, name)
+	}
+	if st, known := models.Status(m.Name); known && st.State != statePulled {
+		return ModelSpec{}, fmt.Errorf("%w: %s is %s", errModelUnavailable, m.Name, st.State)
+	}
+	return m, nil
+}
+
+// Pull states of a model.
+const (
+	statePulled  = "pulled"
+	statePulling = "pulling"
+	stateFailed  = "failed"
+	stateMissing = "missing"
+)
+
+// PullStatus is what is known about a model on the Ollama server.
+type PullStatus struct {
+	State string `json:"state"`
+	// Progress is the percentage downloaded while pulling.
+	Progress float64 `json:"progress,omitempty"`
+	// Detail is Ollama's last status line while pulling, or why the pull
+	// failed.
+	Detail  string    `json:"detail,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// modelPuller pulls models in the background, one pull per model at a
+// time, and remembers how each is doing.
+type modelPuller struct {
+	mu     sync.Mutex
+	status map[string]*PullStatus
+}
+
+// models tracks the models of the Ollama server.
+var models = &modelPuller{status: map[string]*PullStatus{}}
+
+// modelKey normalizes a model name, treating a missing tag as ":latest".
+func modelKey(name string) string {
+	if !strings.Contains(name, ":") {
+		name += ":latest"
+	}
+	return name
+}
+
+// Status returns what is known about a model; known is false until it has
+// been pulled or listed.
+func (p *modelPuller) Status(name string) (PullStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st, ok := p.status[modelKey(name)]
+	if !ok {
+		return PullStatus{}, false
+	}
+	return *st, true
+}
+
+func (p *modelPuller) set(name string, st PullStatus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st.Updated = time.Now().UTC()
+	p.status[modelKey(name)] = &st
+}
+
+// Pull starts pulling a model unless it is being pulled already, and
+// reports whether it started.
+func (p *modelPuller) Pull(name string) bool {
+	p.mu.Lock()
+	if st := p.status[modelKey(name)]; st != nil && st.State == statePulling {
+		p.mu.Unlock()
+		return false
+	}
+	p.status[modelKey(name)] = &PullStatus{State: statePulling, Updated: time.Now().UTC()}
+	p.mu.Unlock()
+
+	go func() {
+		if err := p.pull(name); err != nil {
+			log.Printf("[Ollama] Pulling %s failed: %v", name, err)
+			p.set(name, PullStatus{State: stateFailed, Detail: err.Error()})
+		}
+	}()
+	return true
+}
+
+// pull asks Ollama for a model and follows its progress, logging every
+// tenth of the download.
+func (p *modelPuller) pull(name string) error {
+	log.Printf("[Ollama] Pulling model %s", name)
+	body, _ := json.Marshal(map[string]interface{}{"name": name, "stream": true})
+	res, err := http.Post(currentConfig().OllamaURL+"/api/pull", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	// Layers are reported one after another; progress covers all seen so far
+	totals := map[string]int64{}
+	done := map[string]int64{}
+	logged := -1
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		var line struct {
+			Status    string `json:"status"`
+			Digest    string `json:"digest"`
+			Total     int64  `json:"total"`
+			Completed int64  `json:"completed"`
+			Error     string `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+		if line.Error != "" {
+			return errors.New(line.Error)
+		}
+		if line.Status == "success" {
+			log.Printf("[Ollama] Pulled model %s", name)
+			p.set(name, PullStatus{State: statePulled})
+			return nil
+		}
+		if line.Digest != "" && line.Total > 0 {
+			totals[line.Digest], done[line.Digest] = line.Total, line.Completed
+		}
+		var total, completed int64
+		for d, t := range totals {
+			total += t
+			completed += done[d]
+		}
+		var progress float64
+		if total > 0 {
+			progress = math.Floor(float64(completed)*1000/float64(total)) / 10
+		}
+		p.set(name, PullStatus{State: statePulling, Progress: progress, Detail: line.Status})
+		if tenth := int(progress / 10); tenth > logged && total > 0 {
+			logged = tenth
+			log.Printf("[Ollama] Pulling %s: %.0f%% of %d MB", name, progress, total>>20)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("pull ended without success")
+}
+
+// Refresh records which of names Ollama has, leaving pulls in progress and
+// failures alone.
+func (p *modelPuller) Refresh(ctx context.Context, names []string) error {
+	pulled, err := pulledModels(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		st, _ := p.Status(name)
+		switch {
+		case st.State == statePulling:
+		case pulled[modelKey(name)]:
+			if st.State != statePulled {
+				p.set(name, PullStatus{State: statePulled})
+			}
+		case st.State != stateFailed:
+			p.set(name, PullStatus{State: stateMissing})
+		}
+	}
+	return nil
+}
+
+// pullStartupModels pulls the models cfg needs that Ollama does not have
+// yet: the default model, those marked for pulling and the embedding model.
+func pullStartupModels(cfg *Config) {
+	var names, wanted []string
+	for _, m := range cfg.registeredModels() {
+		names = append(names, m.Name)
+		if m.Pull || sameModel(m.Name, cfg.OllamaModel) {
+			wanted = append(wanted, m.Name)
+		}
+	}
+	if cfg.Knowledge.Enabled {
+		names = append(names, cfg.Knowledge.EmbeddingModel)
+		wanted = append(wanted, cfg.Knowledge.EmbeddingModel)
+	}
+	if err := models.Refresh(context.Background(), names); err != nil {
+		log.Printf("[Ollama] Cannot list models: %v", err)
+	}
+	for _, name := range wanted {
+		if st, _ := models.Status(name); st.State != statePulled {
+			models.Pull(name)
+		}
+	}
+}
+
+// modelInfo is a registered model as GET /models reports it.
+type modelInfo struct {
+	ModelSpec
+	Default bool `json:"default,omitempty"`
+	PullStatus
+}
+
+// handleListModels serves GET /models: the registered models, their
+// parameters and whether Ollama has them.
+func handleListModels(c echo.Context) error {
+	cfg := currentConfig()
+	registered := cfg.registeredModels()
+	var names []string
+	for _, m := range registered {
+		names = append(names, m.Name)
+	}
+	if err := models.Refresh(c.Request().Context(), names); err != nil {
+		log.Printf("[Ollama] Cannot list models: %v", err)
+	}
+	list := make([]modelInfo, 0, len(registered))
+	for _, m := range registered {
+		st, ok := models.Status(m.Name)
+		if !ok {
+			st.State = "unknown"
+		}
+		list = append(list, modelInfo{ModelSpec: m, Default: sameModel(m.Name, cfg.OllamaModel), PullStatus: st})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"default": cfg.OllamaModel, "models": list})
+}
+
+// handlePullModel serves POST /models/:name/pull, starting to pull a
+// registered model in the background; GET /models shows the progress.
+func handlePullModel(c echo.Context) error {
+	m, ok := currentConfig().lookupModel(c.Param("name"))
+	if !ok || c.Param("name") == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Model is not registered"})
+	}
+	models.Pull(m.Name)
+	st, _ := models.Status(m.Name)
+	return c.JSON(http.StatusAccepted, modelInfo{ModelSpec: m, PullStatus: st})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLookupModel(t *testing.T) {
+	listed := &Config{OllamaModel: "phi", Models: []ModelSpec{
+		{Name: "phi:latest", NumCtx: 4096},
+		{Name: "tinyllama:1.1b-chat", NumCtx: 2048},
+	}}
+	unlisted := &Config{OllamaModel: "llama3", Models: []ModelSpec{{Name: "tinyllama:1.1b-chat"}}}
+	for _, tc := range []struct {
+		name      string
+		cfg       *Config
+		requested string
+		want      string
+		ok        bool
+	}{
+		{"default when none requested", listed, "", "phi:latest", true},
+		{"registered model", listed, "tinyllama:1.1b-chat", "tinyllama:1.1b-chat", true},
+		{"missing tag means latest", listed, "phi", "phi:latest", true},
+		{"other tag of a registered model", listed, "phi:2.7b", "", false},
+		{"unregistered model", listed, "mistral", "", false},
+		{"unlisted default is registered", unlisted, "", "llama3", true},
+		{"unlisted default by name", unlisted, "llama3:latest", "llama3", true},
+	} {
+		m, ok := tc.cfg.lookupModel(tc.requested)
+		if ok != tc.ok || m.Name != tc.want {
+			t.Errorf("%s: got %q, %t; want %q, %t", tc.name, m.Name, ok, tc.want, tc.ok)
+		}
+	}
+	if got := len(listed.registeredModels()); got != 2 {
+		t.Errorf("listed default registered twice: %d models", got)
+	}
+	if got := unlisted.registeredModels(); len(got) != 2 || got[0].Name != "llama3" {
+		t.Errorf("unlisted default not registered first: %+v", got)
+	}
+}
+
+func TestValidateModels(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		models []ModelSpec
+		ok     bool
+	}{
+		{"defaults", defaultModels(), true},
+		{"no options", []ModelSpec{{Name: "phi"}}, true},
+		{"empty name", []ModelSpec{{Name: " "}}, false},
+		{"listed twice", []ModelSpec{{Name: "phi"}, {Name: "phi"}}, false},
+		{"temperature too high", []ModelSpec{{Name: "phi", Temperature: floatPtr(2.5)}}, false},
+		{"temperature zero", []ModelSpec{{Name: "phi", Temperature: floatPtr(0)}}, true},
+		{"top_p zero", []ModelSpec{{Name: "phi", TopP: floatPtr(0)}}, false},
+		{"top_p one", []ModelSpec{{Name: "phi", TopP: floatPtr(1)}}, true},
+		{"num_ctx too small", []ModelSpec{{Name: "phi", NumCtx: 128}}, false},
+	} {
+		if err := validateModels(tc.models); (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want ok %t", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestModelOptions(t *testing.T) {
+	m := ModelSpec{Name: "phi", Temperature: floatPtr(0), TopP: floatPtr(0.9), NumCtx: 2048, Stop: []string{"</s>"}}
+	want := map[string]interface{}{"temperature": 0.0, "top_p": 0.9, "num_ctx": 2048, "stop": []string{"</s>"}}
+	if got := m.options(); !reflect.DeepEqual(got, want) {
+		t.Errorf("options %v, want %v", got, want)
+	}
+	if got := (ModelSpec{Name: "phi"}).options(); got != nil {
+		t.Errorf("model without options sent %v", got)
+	}
+	if got := m.contextTokens(4000); got != 1536 {
+		t.Errorf("history budget %d, want three quarters of num_ctx", got)
+	}
+	if got := m.contextTokens(1000); got != 1000 {
+		t.Errorf("history budget %d, want the smaller configured budget", got)
+	}
+	if got := (ModelSpec{Name: "phi"}).contextTokens(1000); got != 1000 {
+		t.Errorf("history budget %d without num_ctx, want 1000", got)
+	}
+}
+
+// fakeOllama serves /api/tags with the given models and /api/pull with the
+// given progress lines. A pull response stays open until hold is closed.
+func fakeOllama(t *testing.T, tags []string, pull []string, hold chan struct{}) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/tags", func(w http.ResponseWriter, r *http.Request) {
+		var resp struct {
+			Models []map[string]string `json:"models"`
+		}
+		for _, name := range tags {
+			resp.Models = append(resp.Models, map[string]string{"name": name})
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/api/pull", func(w http.ResponseWriter, r *http.Request) {
+		for _, line := range pull {
+			fmt.Fprintln(w, line)
+		}
+		if hold != nil {
+			w.(http.Flusher).Flush()
+			select {
+			case <-hold:
+			case <-r.Context().Done():
+			}
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	cfg := defaultConfig()
+	cfg.OllamaURL = srv.URL
+	cfg.OllamaModel = "phi"
+	cfg.Models = []ModelSpec{{Name: "phi:latest"}, {Name: "tinyllama:1.1b-chat"}, {Name: "mistral"}}
+	settings.Store(cfg)
+	models = &modelPuller{status: map[string]*PullStatus{}}
+}
+
+func TestChooseModel(t *testing.T) {
+	fakeOllama(t, []string{"phi:latest"}, nil, nil)
+	if m, err := chooseModel("mistral"); err != nil || m.Name != "mistral" {
+		t.Fatalf("model of unknown pull state: got %q, %v", m.Name, err)
+	}
+	if err := models.Refresh(context.Background(), []string{"phi", "tinyllama:1.1b-chat"}); err != nil {
+		t.Fatal(err)
+	}
+	models.set("mistral", PullStatus{State: statePulling})
+
+	for _, tc := range []struct {
+		requested string
+		want      string
+		err       error
+	}{
+		{"", "phi:latest", nil},
+		{"phi", "phi:latest", nil},
+		{"tinyllama:1.1b-chat", "", errModelUnavailable},
+		{"mistral", "", errModelUnavailable},
+		{"llama3", "", errUnknownModel},
+	} {
+		m, err := chooseModel(tc.requested)
+		if !errors.Is(err, tc.err) || m.Name != tc.want {
+			t.Errorf("chooseModel(%q) = %q, %v; want %q, %v", tc.requested, m.Name, err, tc.want, tc.err)
+		}
+	}
+}
+
+// waitForPull waits for a pull started in the background to finish.
+func waitForPull(t *testing.T, name string) PullStatus {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if st, _ := models.Status(name); st.State != statePulling {
+			return st
+		}
+	}
+	t.Fatalf("pull of %s did not finish", name)
+	return PullStatus{}
+}
+
+func TestModelPull(t *testing.T) {
+	fakeOllama(t, nil, []string{
+		`{"status":"pulling manifest"}`,
+		`{"status":"pulling a","digest":"sha256:a","total":300,"completed":150}`,
+		`{"status":"pulling a","digest":"sha256:a","total":300,"completed":300}`,
+		`{"status":"pulling b","digest":"sha256:b","total":100,"completed":0}`,
+		`{"status":"success"}`,
+	}, nil)
+	if !models.Pull("mistral") {
+		t.Fatal("pull not started")
+	}
+	if st := waitForPull(t, "mistral"); st.State != statePulled {
+		t.Fatalf("pull ended %+v", st)
+	}
+	if _, err := chooseModel("mistral"); err != nil {
+		t.Errorf("pulled model refused: %v", err)
+	}
+
+	// A pull in progress is not started twice
+	models.set("phi", PullStatus{State: statePulling})
+	if models.Pull("phi") {
+		t.Error("second pull of a model started")
+	}
+}
+
+func TestModelPullFailure(t *testing.T) {
+	fakeOllama(t, nil, []string{
+		`{"status":"pulling manifest"}`,
+		`{"error":"pull model manifest: file does not exist"}`,
+	}, nil)
+	models.Pull("mistral")
+	st := waitForPull(t, "mistral")
+	if st.State != stateFailed || st.Detail != "pull model manifest: file does not exist" {
+		t.Fatalf("failed pull reported %+v", st)
+	}
+	// A refresh does not hide the failure as merely missing
+	if err := models.Refresh(context.Background(), []string{"mistral"}); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := models.Status("mistral"); st.State != stateFailed {
+		t.Errorf("refresh turned a failed pull into %s", st.State)
+	}
+}
+
+func TestModelPullProgress(t *testing.T) {
+	hold := make(chan struct{})
+	fakeOllama(t, nil, []string{
+		`{"status":"pulling a","digest":"sha256:a","total":300,"completed":300}`,
+		`{"status":"pulling b","digest":"sha256:b","total":100,"completed":50}`,
+	}, hold)
+	models.Pull("mistral")
+
+	// Progress covers both layers: 350 of 400 bytes
+	var st PullStatus
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && st.Progress != 87.5; time.Sleep(10 * time.Millisecond) {
+		st, _ = models.Status("mistral")
+	}
+	if st.State != statePulling || st.Progress != 87.5 || st.Detail != "pulling b" {
+		t.Fatalf("pull in progress reported %+v", st)
+	}
+
+	// A pull that ends without success has failed
+	close(hold)
+	if st := waitForPull(t, "mistral"); st.State != stateFailed {
+		t.Fatalf("pull without success reported %+v", st)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"common/auth"
+	"common/config"
+	"github.com/fsnotify/fsnotify"
+	"github.com/labstack/echo/v4"
+)
+
+// PromptsConfig says where the assistant's system prompts come from. Each
+// persona is a text/template in Dir named <persona>.tmpl; files starting
+// with "_" hold templates shared by the personas. The files are reloaded
+// when they change; Dir needs a restart.
+type PromptsConfig struct {
+	Dir string `yaml:"dir" env:"PROMPTS_DIR"`
+	// DefaultPersona answers requests that name none, unless their tenant
+	// has its own in TenantPersonas, given as tenant=persona.
+	DefaultPersona string   `yaml:"default_persona" env:"PROMPTS_DEFAULT_PERSONA"`
+	TenantPersonas []string `yaml:"tenant_personas" env:"PROMPTS_TENANT_PERSONAS"`
+	Company        string   `yaml:"company" env:"COMPANY_NAME"`
+}
+
+func defaultPromptsConfig() PromptsConfig {
+	return PromptsConfig{
+		Dir:            "prompts",
+		DefaultPersona: builtinPersona,
+		Company:        "Boring Paper Company",
+	}
+}
+
+var personaName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Validate checks the prompt settings.
+func (c PromptsConfig) Validate() error {
+	var errs config.Errors
+	if !personaName.MatchString(c.DefaultPersona) {
+		errs.Addf("prompts.default_persona must be a persona name, got %q", c.DefaultPersona)
+	}
+	for _, entry := range c.TenantPersonas {
+		tenant, persona, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(tenant) == "" || !personaName.MatchString(strings.TrimSpace(persona)) {
+			errs.Addf("prompts.tenant_personas entry %q must be tenant=persona", entry)
+		}
+	}
+	if strings.TrimSpace(c.Company) == "" {
+		errs.Addf("prompts.company must not be empty")
+	}
+	return errs.Err()
+}
+
+// tenantPersona returns the persona configured for tenant, if any.
+func (c PromptsConfig) tenantPersona(tenant string) string {
+	for _, entry := range c.TenantPersonas {
+		if t, persona, _ := strings.Cut(entry, "="); strings.TrimSpace(t) == tenant {
+			return strings.TrimSpace(persona)
+		}
+	}
+	return ""
+}
+
+// builtinPersona is always available, so chats work without a prompts
+// directory; a default.tmpl in the directory replaces it.
+const builtinPersona = "default"
+
+var builtinPrompt = template.Must(template.New(builtinPersona).Parse("You are a helpful assistant for the {{.Company}}."))
+
+// PromptData is what a persona template can use.
+type PromptData struct {
+	Persona string
+	Company string
+	// Date is today's date, such as "Monday, 2 January 2006"; Now has the
+	// time for other layouts.
+	Date   string
+	Now    time.Time
+	User   string
+	Tenant string
+	// Role lists the caller's roles, comma-separated; it is empty when the
+	// credentials carry none.
+	Role  string
+	Roles []string
+}
+
+var errUnknownPersona = errors.New("unknown persona")
+
+// promptLibrary holds the persona templates, replacing them as a whole
+// whenever the directory changes. A directory that fails to parse leaves
+// the previous templates in place.
+type promptLibrary struct {
+	dir string
+
+	mu       sync.RWMutex
+	tmpl     *template.Template
+	personas map[string]bool
+}
+
+// prompts is the library the system prompt is rendered from.
+var prompts *promptLibrary
+
+// loadPrompts reads the persona templates in dir.
+func loadPrompts(dir string) (*promptLibrary, error) {
+	l := &promptLibrary{dir: dir}
+	return l, l.Reload()
+}
+
+// Reload parses the directory again.
+func (l *promptLibrary) Reload() error {
+	tmpl := template.New("").Option("missingkey=error")
+	template.Must(tmpl.AddParseTree(builtinPersona, builtinPrompt.Tree))
+	personas := map[string]bool{builtinPersona: true}
+	files, err := filepath.Glob(filepath.Join(l.dir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		if _, err := os.Stat(l.dir); err != nil {
+			log.Printf("No prompts directory %s (%v); using the built-in %s persona", l.dir, err, builtinPersona)
+		}
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+		if !strings.HasPrefix(name, "_") {
+			if !personaName.MatchString(name) {
+				return fmt.Errorf("%s: persona names are lower-case letters, digits, - and _", file)
+			}
+			personas[name] = true
+		}
+		if _, err := tmpl.New(name).Parse(string(data)); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	l.tmpl, l.personas = tmpl, personas
+	l.mu.Unlock()
+	log.Printf("Loaded personas from %s: %s", l.dir, strings.Join(l.Personas(), ", "))
+	return nil
+}
+
+// Personas lists the personas that can be chosen.
+func (l *promptLibrary) Personas() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var out []string
+	for name := range l.personas {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Has reports whether persona exists.
+func (l *promptLibrary) Has(persona string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.personas[persona]
+}
+
+// Render executes a persona's template.
+func (l *promptLibrary) Render(persona string, data PromptData) (string, error) {
+	l.mu.RLock()
+	tmpl, ok := l.tmpl, l.personas[persona]
+	l.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("%w %q", errUnknownPersona, persona)
+	}
+	var b strings.Builder
+	if err := tmpl.ExecuteTemplate(&b, persona, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// Watch reloads the templates when files in the directory change, until
+// ctx is done. Changes are picked up once they have settled, so an editor
+// saving in several steps or a Kubernetes ConfigMap update triggers one
+// reload.
+func (l *promptLibrary) Watch(ctx context.Context) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Cannot watch %s, personas are reloaded on SIGHUP only: %v", l.dir, err)
+		return
+	}
+	defer w.Close()
+	if err := w.Add(l.dir); err != nil {
+		log.Printf("Cannot watch %s, personas are reloaded on SIGHUP only: %v", l.dir, err)
+		return
+	}
+	settle := time.NewTimer(time.Hour)
+	settle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if ev.Op != fsnotify.Chmod {
+				settle.Reset(250 * time.Millisecond)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Watching %s: %v", l.dir, err)
+		case <-settle.C:
+			if err := l.Reload(); err != nil {
+				log.Printf("Cannot reload personas, keeping the current ones: %v", err)
+			}
+		}
+	}
+}
+
+// choosePersona picks the persona for a chat: the one the request names,
+// else the tenant's, else the default. Only a persona named by the request
+// has to exist; misconfigured ones fall back to the built-in prompt.
+func choosePersona(ctx context.Context, requested string) (string, error) {
+	if requested != "" {
+		if !prompts.Has(requested) {
+			return "", fmt.Errorf("%w %q", errUnknownPersona, requested)
+		}
+		return requested, nil
+	}
+	cfg := currentConfig().Prompts
+	for _, persona := range []string{cfg.tenantPersona(tenantOf(ctx)), cfg.DefaultPersona} {
+		if persona == "" {
+			continue
+		}
+		if prompts.Has(persona) {
+			return persona, nil
+		}
+		log.Printf("Persona %q is not defined; check %s", persona, cfg.Dir)
+	}
+	return builtinPersona, nil
+}
+
+// systemPromptFor renders the system prompt of the chosen persona for the
+// caller. A template that fails to render falls back to the built-in prompt
+// rather than failing the chat.
+func systemPromptFor(ctx context.Context, requested string) (string, error) {
+	persona, err := choosePersona(ctx, requested)
+	if err != nil {
+		return "", err
+	}
+	cfg := currentConfig().Prompts
+	now := time.Now()
+	data := PromptData{
+		Persona: persona,
+		Company: cfg.Company,
+		Date:    now.Format("Monday, 2 January 2006"),
+		Now:     now,
+		Tenant:  tenantOf(ctx),
+	}
+	if p, ok := auth.FromContext(ctx); ok {
+		data.User = p.Subject
+		data.Roles = p.Roles
+		data.Role = strings.Join(p.Roles, ", ")
+	}
+	prompt, err := prompts.Render(persona, data)
+	if err != nil {
+		log.Printf("Cannot render persona %s, using the built-in prompt: %v", persona, err)
+		data.Persona = builtinPersona
+		var b strings.Builder
+		if err := builtinPrompt.Execute(&b, data); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+	return prompt, nil
+}
+
+// handleListPersonas serves GET /personas: the personas a chat can name,
+// and the one the caller gets by default.
+func handleListPersonas(c echo.Context) error {
+	persona, _ := choosePersona(c.Request().Context(), "")
+	return c.JSON(http.StatusOK, map[string]interface{}{"personas": prompts.Personas(), "default": persona})
+}
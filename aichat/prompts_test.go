@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"common/auth"
+)
+
+var testPromptData = PromptData{
+	Company: "Boring Paper Company",
+	Date:    "Monday, 2 January 2006",
+	User:    "alice",
+	Tenant:  "acme",
+}
+
+func writePrompt(t *testing.T, dir, name, text string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRenderShippedPersonas renders the personas in the prompts directory
+// the image ships with.
+func TestRenderShippedPersonas(t *testing.T) {
+	lib, err := loadPrompts("prompts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withRole := testPromptData
+	withRole.Role, withRole.Roles = "uploader, viewer", []string{"uploader", "viewer"}
+	for _, tc := range []struct {
+		persona string
+		data    PromptData
+		want    []string
+		not     []string
+	}{
+		{"default", testPromptData, []string{"helpful assistant for the Boring Paper Company", "Today is Monday, 2 January 2006."}, []string{"role"}},
+		{"default", withRole, []string{"has the role uploader, viewer."}, nil},
+		{"sales", testPromptData, []string{"sales assistant for the Boring Paper Company", "sells paper"}, nil},
+		{"support", testPromptData, []string{"customer support agent", "order number"}, nil},
+		{"hr", withRole, []string{"HR assistant for employees of the Boring Paper Company", "has the role uploader, viewer."}, nil},
+	} {
+		tc.data.Persona = tc.persona
+		prompt, err := lib.Render(tc.persona, tc.data)
+		if err != nil {
+			t.Errorf("%s: %v", tc.persona, err)
+			continue
+		}
+		for _, s := range tc.want {
+			if !strings.Contains(prompt, s) {
+				t.Errorf("%s prompt lacks %q: %s", tc.persona, s, prompt)
+			}
+		}
+		for _, s := range tc.not {
+			if strings.Contains(prompt, s) {
+				t.Errorf("%s prompt has %q: %s", tc.persona, s, prompt)
+			}
+		}
+		if strings.Contains(prompt, "{{") || prompt != strings.TrimSpace(prompt) {
+			t.Errorf("%s prompt not fully rendered: %q", tc.persona, prompt)
+		}
+	}
+	if _, err := lib.Render("_company", testPromptData); !errors.Is(err, errUnknownPersona) {
+		t.Errorf("shared template rendered as a persona: %v", err)
+	}
+}
+
+func TestPromptLibraryReload(t *testing.T) {
+	dir := t.TempDir()
+	lib, err := loadPrompts(filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := lib.Render(builtinPersona, testPromptData); got != "You are a helpful assistant for the Boring Paper Company." {
+		t.Errorf("built-in persona rendered %q", got)
+	}
+
+	lib.dir = dir
+	writePrompt(t, dir, "_sig.tmpl", `{{define "_sig"}}Sign as {{.Company}}.{{end}}`)
+	writePrompt(t, dir, "legal.tmpl", `You answer legal questions for {{.Tenant}}. {{template "_sig" .}}`)
+	if err := lib.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(lib.Personas(), ","); got != "default,legal" {
+		t.Errorf("personas %s, want default,legal", got)
+	}
+	if got, _ := lib.Render("legal", testPromptData); got != "You answer legal questions for acme. Sign as Boring Paper Company." {
+		t.Errorf("legal persona rendered %q", got)
+	}
+
+	for name, text := range map[string]string{
+		"broken.tmpl":    `{{if .Company}}never closed`,
+		"Bad Name.tmpl":  `Hello`,
+		"undefined.tmpl": `{{template "_missing" .}}`,
+	} {
+		writePrompt(t, dir, name, text)
+		err := lib.Reload()
+		os.Remove(filepath.Join(dir, name))
+		if name == "undefined.tmpl" {
+			// Parses, but cannot render
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			if _, err := lib.Render("undefined", testPromptData); err == nil {
+				t.Errorf("%s rendered", name)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s loaded", name)
+		}
+		if !lib.Has("legal") {
+			t.Errorf("%s replaced the loaded personas", name)
+		}
+	}
+}
+
+func TestRenderRejectsUnknownFields(t *testing.T) {
+	dir := t.TempDir()
+	writePrompt(t, dir, "typo.tmpl", `Hello {{.Compnay}}`)
+	lib, err := loadPrompts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lib.Render("typo", testPromptData); err == nil {
+		t.Error("template using an unknown field rendered")
+	}
+}
+
+func TestChoosePersona(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"sales", "support"} {
+		writePrompt(t, dir, name+".tmpl", "You are "+name+" for {{.Company}}.")
+	}
+	writePrompt(t, dir, "broken.tmpl", `{{.Missing}}`)
+	lib, err := loadPrompts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompts = lib
+	cfg := defaultConfig()
+	cfg.Prompts.Dir = dir
+	cfg.Prompts.DefaultPersona = "support"
+	cfg.Prompts.TenantPersonas = []string{"acme=sales", "globex=nonexistent"}
+	settings.Store(cfg)
+
+	ctxFor := func(tenant string) context.Context {
+		return auth.WithPrincipal(context.Background(), &auth.Principal{Subject: "alice", Tenant: tenant, Method: auth.MethodAPIKey})
+	}
+	for _, tc := range []struct {
+		name, tenant, requested, want string
+	}{
+		{"requested", "acme", "support", "support"},
+		{"tenant", "acme", "", "sales"},
+		{"default", "initech", "", "support"},
+		{"undefined tenant persona falls back", "globex", "", "support"},
+	} {
+		got, err := choosePersona(ctxFor(tc.tenant), tc.requested)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %q, %v; want %q", tc.name, got, err, tc.want)
+		}
+	}
+	if _, err := choosePersona(ctxFor("acme"), "pirate"); !errors.Is(err, errUnknownPersona) {
+		t.Errorf("unknown requested persona: got %v, want errUnknownPersona", err)
+	}
+
+	cfg.Prompts.DefaultPersona = "nonexistent"
+	if got, _ := choosePersona(ctxFor("initech"), ""); got != builtinPersona {
+		t.Errorf("undefined default persona chose %q, want the built-in", got)
+	}
+
+	// A persona that fails to render falls back to the built-in prompt
+	prompt, err := systemPromptFor(ctxFor("acme"), "broken")
+	if err != nil || prompt != "You are a helpful assistant for the Boring Paper Company." {
+		t.Errorf("broken persona gave %q, %v", prompt, err)
+	}
+}
+
+func TestPromptLibraryWatch(t *testing.T) {
+	dir := t.TempDir()
+	lib, err := loadPrompts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lib.Watch(ctx)
+
+	// The watcher may not have started yet, so the file is written again
+	// until it is seen; each write restarts the settle delay
+	for attempt := 0; attempt < 5 && !lib.Has("hr"); attempt++ {
+		writePrompt(t, dir, "hr.tmpl", "You are HR for {{.Company}}.")
+		for wait := 0; wait < 10 && !lib.Has("hr"); wait++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if !lib.Has("hr") {
+		t.Fatal("new persona file not picked up")
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// With the guard on, a streamed reply is checked a window at a time: up to
+// the first sentence end after guardMinWindow bytes, or guardMaxWindow bytes
+// if no sentence ends sooner.
+const (
+	guardMinWindow = 40
+	guardMaxWindow = 400
+)
+
+// streamEvent is an event of /chat/stream. "token" events carry reply text
+// as it is released; every chat ends with one "verdict" event.
+type streamEvent struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+	// Verdict is "allowed", "blocked" or "error", and Stage tells whether it
+	// concerns the prompt or the response. Response is the whole reply when
+	// allowed, otherwise the message to show in place of the partial reply.
+	Verdict  string `json:"verdict,omitempty"`
+	Stage    string `json:"stage,omitempty"`
+	Response string `json:"response,omitempty"`
+	// ConversationID continues the conversation in the next request.
+	ConversationID string `json:"conversationId,omitempty"`
+	// Sources are the document excerpts an allowed reply may cite.
+	Sources []Source `json:"sources,omitempty"`
+}
+
+func verdictEvent(verdict, stage, response string) streamEvent {
+	return streamEvent{Type: "verdict", Verdict: verdict, Stage: stage, Response: response}
+}
+
+// streamChat answers req like handleChat, passing events to emit as the
+// reply is generated. Without the guard every chunk is sent as it arrives.
+// With it, text is only sent once its window has passed the guard, checked
+// together with the previous window so content split across a boundary is
+// still seen; the whole reply is checked again before the verdict.
+func streamChat(ctx context.Context, req ChatRequest, guardCfg *AIGuardConfig, emit func(streamEvent) error) error {
+	system, err := systemPromptFor(ctx, req.Persona)
+	if err != nil {
+		return emit(verdictEvent("error", "prompt", msgUnknownPersona))
+	}
+	model, err := chooseModel(req.Model)
+	if err != nil {
+		return emit(verdictEvent("error", "prompt", modelErrorMessage(err)))
+	}
+	conv, unlock, err := openConversation(ctx, req.ConversationID, ownerOf(ctx))
+	if errors.Is(err, errConversationNotFound) {
+		return emit(verdictEvent("error", "prompt", msgConversationNotFound))
+	} else if err != nil {
+		log.Printf("Cannot open conversation %s: %v", req.ConversationID, err)
+		return emit(verdictEvent("error", "prompt", msgConversationError))
+	}
+	defer unlock()
+
+	if !req.securityEnabled() {
+		sources := retrieve(ctx, req.Message)
+		messages := buildContext(ctx, conv, system, req.Message, sourcesMessage(sources), historyFor(model))
+		reply, err := generate(ctx, model, messages, func(text string) error {
+			return emit(streamEvent{Type: "token", Text: text})
+		})
+		if err != nil {
+			return emit(verdictEvent("error", "response", llmErrorMessage(err)))
+		}
+		return emit(allowedVerdict(ctx, conv, req.Message, reply, sources))
+	}
+
+	if blocked, err := checkAIGuard("prompt", req.Message, guardCfg); err != nil {
+		return emit(verdictEvent("error", "prompt", msgPolicyError))
+	} else if blocked {
+		return emit(verdictEvent("blocked", "prompt", msgBlocked))
+	}
+	sources := retrieve(ctx, req.Message)
+	messages := buildContext(ctx, conv, system, req.Message, sourcesMessage(sources), historyFor(model))
+
+	// Generation runs ahead while earlier windows are being checked
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	windows := make(chan string, 16)
+	var reply string
+	var genErr error
+	go func() {
+		defer close(windows)
+		var w guardWindows
+		send := func(win string) error {
+			select {
+			case windows <- win:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		reply, genErr = generate(ctx, model, messages, func(text string) error {
+			for _, win := range w.add(text) {
+				if err := send(win); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if rest := w.flush(); genErr == nil && rest != "" {
+			genErr = send(rest)
+		}
+	}()
+	// stop abandons generation and waits for it to end
+	stop := func() {
+		cancel()
+		for range windows {
+		}
+	}
+
+	var previous string
+	for win := range windows {
+		blocked, err := checkAIGuard("response", previous+win, guardCfg)
+		if err != nil {
+			stop()
+			return emit(verdictEvent("error", "response", msgPolicyError))
+		} else if blocked {
+			stop()
+			return emit(verdictEvent("blocked", "response", msgBlocked))
+		}
+		if err := emit(streamEvent{Type: "token", Text: win}); err != nil {
+			stop()
+			return err
+		}
+		previous = win
+	}
+	if genErr != nil {
+		return emit(verdictEvent("error", "response", llmErrorMessage(genErr)))
+	}
+	if blocked, err := checkAIGuard("response", reply, guardCfg); err != nil {
+		return emit(verdictEvent("error", "response", msgPolicyError))
+	} else if blocked {
+		return emit(verdictEvent("blocked", "response", msgBlocked))
+	}
+	return emit(allowedVerdict(ctx, conv, req.Message, reply, sources))
+}
+
+// allowedVerdict remembers an allowed exchange and returns the verdict that
+// ends it, with the sources the reply may cite, naming the conversation
+// once it has been saved.
+func allowedVerdict(ctx context.Context, conv *Conversation, prompt, reply string, sources []Source) streamEvent {
+	ev := verdictEvent("allowed", "", reply)
+	ev.Sources = sources
+	if err := saveExchange(ctx, conv, prompt, reply); err != nil {
+		log.Printf("Cannot save conversation %s: %v", conv.ID, err)
+		return ev
+	}
+	ev.ConversationID = conv.ID
+	return ev
+}
+
+// guardWindows cuts streamed text into the windows the guard checks.
+type guardWindows struct {
+	pending string
+}
+
+// add appends text and returns the windows it completes.
+func (g *guardWindows) add(text string) []string {
+	g.pending += text
+	var out []string
+	for n := g.next(); n > 0; n = g.next() {
+		out = append(out, g.pending[:n])
+		g.pending = g.pending[n:]
+	}
+	return out
+}
+
+// flush returns whatever text is left.
+func (g *guardWindows) flush() string {
+	rest := g.pending
+	g.pending = ""
+	return rest
+}
+
+// next returns the length of the first complete window, or 0.
+func (g *guardWindows) next() int {
+	p := g.pending
+	if len(p) <= guardMinWindow {
+		return 0
+	}
+	if i := strings.IndexAny(p[guardMinWindow:], ".!?\n"); i >= 0 && guardMinWindow+i < guardMaxWindow {
+		return guardMinWindow + i + 1
+	}
+	if len(p) < guardMaxWindow {
+		return 0
+	}
+	// No sentence end: break at a space, or failing that between runes
+	if i := strings.LastIndexAny(p[guardMinWindow:guardMaxWindow], " \t"); i >= 0 {
+		return guardMinWindow + i + 1
+	}
+	// The byte after the window tells whether its last rune is complete
+	n := guardMaxWindow
+	if len(p) == n {
+		return 0
+	}
+	for n > 0 && !utf8.RuneStart(p[n]) {
+		n--
+	}
+	return n
+}
+
+// handleChatStream serves /chat/stream: a POST with the /chat request body
+// gets the events as server-sent events, and a WebSocket upgrade gets them
+// as JSON messages (see handleChatWS).
+func handleChatStream(c echo.Context, guardCfg *AIGuardConfig) error {
+	if websocket.IsWebSocketUpgrade(c.Request()) {
+		return handleChatWS(c, guardCfg)
+	}
+	var req ChatRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"response": msgInvalidRequest})
+	}
+
+	w := c.Response()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	// Keep proxies from timing out while the model loads or the guard is
+	// slow; mu keeps heartbeats and events from interleaving
+	var mu sync.Mutex
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-heartbeat.C:
+				mu.Lock()
+				fmt.Fprint(w, ": keep-alive\n\n")
+				w.Flush()
+				mu.Unlock()
+			}
+		}
+	}()
+
+	err := streamChat(c.Request().Context(), req, guardCfg, func(ev streamEvent) error {
+		data, _ := json.Marshal(ev)
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+			return err
+		}
+		w.Flush()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Chat stream to %s ended early: %v", c.RealIP(), err)
+	}
+	return nil
+}
+
+var chatUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || allowedOrigins.Allowed(origin) {
+			return true
+		}
+		log.Printf("WebSocket origin rejected: %s", origin)
+		return false
+	},
+}
+
+// chatSockets counts open chat WebSockets, which the HTTP server does not
+// wait for on shutdown since they are hijacked.
+var chatSockets sync.WaitGroup
+
+// handleChatWS serves chats over a WebSocket. Each text message is a /chat
+// request body and is answered with streamEvent messages, ending with its
+// verdict; chats on one socket run one after another.
+func handleChatWS(c echo.Context, guardCfg *AIGuardConfig) error {
+	if server.Draining() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"response": "Server is shutting down"})
+	}
+	conn, err := chatUpgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		log.Println("upgrade:", err)
+		return nil
+	}
+	defer conn.Close()
+	chatSockets.Add(1)
+	defer chatSockets.Done()
+
+	// A closed socket cancels the chat in progress
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+	requests := make(chan []byte)
+	go func() {
+		defer cancel()
+		defer close(requests)
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case requests <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg, ok := <-requests:
+			if !ok {
+				return nil
+			}
+			var req ChatRequest
+			if err := json.Unmarshal(msg, &req); err != nil {
+				if err := conn.WriteJSON(verdictEvent("error", "prompt", msgInvalidRequest)); err != nil {
+					return nil
+				}
+				continue
+			}
+			if err := streamChat(ctx, req, guardCfg, func(ev streamEvent) error { return conn.WriteJSON(ev) }); err != nil {
+				log.Printf("Chat socket to %s ended early: %v", c.RealIP(), err)
+				return nil
+			}
+		case <-server.Done():
+			// Between chats; tell the client to reconnect elsewhere
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+			_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return nil
+		}
+	}
+}
+
+// waitChatSockets waits for chats in progress on WebSockets to finish, or
+// for ctx to expire.
+func waitChatSockets(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		chatSockets.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("chat sockets still open: %w", ctx.Err())
+	}
+}
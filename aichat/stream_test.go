@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestGuardWindows(t *testing.T) {
+	words := strings.Repeat("paper ", 100)
+	noSpaces := strings.Repeat("x", 1000)
+	runes := strings.Repeat("é", 300)
+	lastSpace := strings.LastIndex(words[:guardMaxWindow], " ") + 1
+	for _, tc := range []struct {
+		name string
+		text string
+		// want are the windows add returns; the rest is left for flush
+		want []string
+	}{
+		{"shorter than the minimum", "Hello there.", nil},
+		{"exactly the minimum", strings.Repeat("a", guardMinWindow-1) + ".", nil},
+		{"sentence end past the minimum", strings.Repeat("a", guardMinWindow) + ". And more",
+			[]string{strings.Repeat("a", guardMinWindow) + "."}},
+		{"sentence end inside the minimum is ignored", "Hi. " + strings.Repeat("a", guardMinWindow) + "! rest",
+			[]string{"Hi. " + strings.Repeat("a", guardMinWindow) + "!"}},
+		{"question mark and newline end sentences", strings.Repeat("a", guardMinWindow) + "?" + strings.Repeat("b", guardMinWindow) + "\nc",
+			[]string{strings.Repeat("a", guardMinWindow) + "?", strings.Repeat("b", guardMinWindow) + "\n"}},
+		{"no sentence end below the maximum", strings.Repeat("word ", (guardMaxWindow-1)/5), nil},
+		{"no sentence end breaks at the last space", words[:guardMaxWindow+10],
+			[]string{words[:lastSpace]}},
+		{"sentence end past the maximum breaks at a space", words[:guardMaxWindow+10] + ".",
+			[]string{words[:lastSpace]}},
+		{"no spaces at exactly the maximum waits for the next byte", noSpaces[:guardMaxWindow], nil},
+		{"no spaces breaks at the maximum", noSpaces[:guardMaxWindow+1],
+			[]string{noSpaces[:guardMaxWindow]}},
+		{"multibyte text breaks between runes", runes,
+			[]string{runes[:guardMaxWindow]}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var g guardWindows
+			got := g.add(tc.text)
+			if strings.Join(got, "|") != strings.Join(tc.want, "|") || len(got) != len(tc.want) {
+				t.Fatalf("windows %q, want %q", got, tc.want)
+			}
+			for _, w := range got {
+				if len(w) > guardMaxWindow || !utf8.ValidString(w) {
+					t.Errorf("window of %d bytes, valid UTF-8 %t", len(w), utf8.ValidString(w))
+				}
+			}
+			if rest := g.flush(); strings.Join(got, "")+rest != tc.text {
+				t.Errorf("windows and flush do not add up to the text")
+			}
+			if g.flush() != "" {
+				t.Error("second flush returned text")
+			}
+		})
+	}
+}
+
+// TestGuardWindowsIgnoreChunking checks that text arriving a few bytes at a
+// time is cut into the same windows as text arriving at once.
+func TestGuardWindowsIgnoreChunking(t *testing.T) {
+	text := strings.Repeat("The order of paper ships on Monday. ", 20) + strings.Repeat("ü", 250) + " done"
+	var whole guardWindows
+	want := append(whole.add(text), whole.flush())
+
+	for _, size := range []int{1, 3, 7, 64} {
+		var g guardWindows
+		var got []string
+		for i := 0; i < len(text); i += size {
+			got = append(got, g.add(text[i:min(i+size, len(text))])...)
+		}
+		got = append(got, g.flush())
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("chunks of %d: windows %q, want %q", size, got, want)
+		}
+	}
+}
@@ -46,8 +46,8 @@ for service in "${services[@]}"; do
                 --build-arg VITE_XDR_WS_URL="/api/xdr/terminal" \
                 -t $ACCOUNT_ID.dkr.ecr.$REGION.amazonaws.com/boringpaperco/$service:latest ../../$service
         else
-            # Build other services normally
-            docker build --platform linux/amd64 -t $ACCOUNT_ID.dkr.ecr.$REGION.amazonaws.com/boringpaperco/$service:latest ../../$service
+            # Go services build from the repo root to include the shared common module
+            docker build --platform linux/amd64 -t $ACCOUNT_ID.dkr.ecr.$REGION.amazonaws.com/boringpaperco/$service:latest -f ../../$service/Dockerfile ../..
         fi
         
         echo "📤 Pushing $service..."
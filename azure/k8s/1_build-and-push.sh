@@ -33,8 +33,8 @@ for service in "${services[@]}"; do
             --build-arg VITE_XDR_WS_URL="/api/xdr/terminal" \
             -t $ACR_SERVER/boringpaperco/$service:latest ../../$service
     else
-        # Build other services normally
-        docker build --platform linux/amd64 -t $ACR_SERVER/boringpaperco/$service:latest ../../$service
+        # Go services build from the repo root to include the shared common module
+        docker build --platform linux/amd64 -t $ACR_SERVER/boringpaperco/$service:latest -f ../../$service/Dockerfile ../..
     fi
     
     echo "📤 Pushing $service..."
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// APIKey is a static credential and the identity it grants.
+type APIKey struct {
+	Name   string   `json:"name" yaml:"name"`
+	Tenant string   `json:"tenant,omitempty" yaml:"tenant,omitempty"`
+	Roles  []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+	// Key is the secret itself; SHA256 is its hex digest, so files need not
+	// hold the secret. Exactly one must be set.
+	Key    string `json:"key,omitempty" yaml:"key,omitempty" secret:"true"`
+	SHA256 string `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+}
+
+// LoadAPIKeys parses keys from list, a comma-separated list of
+// name:key[:tenant[:role|role...]] entries, and from the JSON array of
+// APIKey in file.
+func LoadAPIKeys(list, file string) ([]APIKey, error) {
+	var keys []APIKey
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 4 {
+			return nil, fmt.Errorf("AUTH_API_KEYS entry %q must be name:key[:tenant[:roles]]", parts[0])
+		}
+		k := APIKey{Name: parts[0], Key: parts[1]}
+		if len(parts) > 2 {
+			k.Tenant = parts[2]
+		}
+		if len(parts) > 3 {
+			k.Roles = strings.Split(parts[3], "|")
+		}
+		keys = append(keys, k)
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var fromFile []APIKey
+		if err := json.Unmarshal(data, &fromFile); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", file, err)
+		}
+		keys = append(keys, fromFile...)
+	}
+	return keys, nil
+}
+
+// apiKeySet indexes keys by the SHA-256 of the secret, so a lookup doesn't
+// compare secrets byte by byte.
+type apiKeySet map[string]APIKey
+
+func newAPIKeySet(keys []APIKey) (apiKeySet, error) {
+	set := apiKeySet{}
+	for _, k := range keys {
+		digest := strings.ToLower(k.SHA256)
+		switch {
+		case k.Name == "":
+			return nil, errors.New("API key without a name")
+		case (k.Key == "") == (digest == ""):
+			return nil, fmt.Errorf("API key %q needs exactly one of key or sha256", k.Name)
+		case k.Key != "":
+			digest = hashKey(k.Key)
+		case len(digest) != sha256.Size*2:
+			return nil, fmt.Errorf("API key %q has an invalid sha256", k.Name)
+		}
+		if _, dup := set[digest]; dup {
+			return nil, fmt.Errorf("API key %q duplicates another key", k.Name)
+		}
+		k.Key = ""
+		set[digest] = k
+	}
+	return set, nil
+}
+
+func (s apiKeySet) lookup(key string) (APIKey, bool) {
+	k, ok := s[hashKey(key)]
+	return k, ok
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
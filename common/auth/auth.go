@@ -0,0 +1,308 @@
+// Package auth authenticates callers of the Go services with OIDC/JWT bearer
+// tokens, validated against a JWKS, or with static API keys.
+//
+// When neither tokens nor API keys are configured every request passes as an
+// anonymous principal, so a fresh deployment keeps working until auth is set
+// up.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authentication methods recorded in Principal.Method.
+const (
+	MethodAnonymous = "anonymous"
+	MethodJWT       = "jwt"
+	MethodAPIKey    = "api_key"
+)
+
+// Principal is an authenticated caller.
+type Principal struct {
+	Subject string   `json:"subject"`
+	Tenant  string   `json:"tenant,omitempty"`
+	Roles   []string `json:"roles,omitempty"`
+	Method  string   `json:"method"`
+	// Claims holds the token claims of a JWT principal.
+	Claims map[string]interface{} `json:"-"`
+}
+
+// Anonymous reports whether the principal was not authenticated.
+func (p *Principal) Anonymous() bool { return p.Method == MethodAnonymous }
+
+var (
+	// ErrNoCredentials means the request carried neither a token nor a key.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials means a token or key was presented but rejected.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Config configures an Authenticator.
+type Config struct {
+	// JWKSURL serves the keys that sign accepted tokens. When empty and
+	// Issuer is set, it is discovered from the issuer's OpenID configuration.
+	// Issuer and Audience are required once tokens are accepted, so a token
+	// the provider issued for another application is refused.
+	JWKSURL  string `yaml:"jwks_url" env:"AUTH_JWKS_URL"`
+	Issuer   string `yaml:"issuer" env:"AUTH_ISSUER"`
+	Audience string `yaml:"audience" env:"AUTH_AUDIENCE"`
+	// TenantClaim and RolesClaim name the claims that carry the caller's
+	// tenant and roles; dotted names reach into nested objects, such as
+	// "realm_access.roles".
+	TenantClaim string `yaml:"tenant_claim" env:"AUTH_TENANT_CLAIM"`
+	RolesClaim  string `yaml:"roles_claim" env:"AUTH_ROLES_CLAIM"`
+	// JWKSRefresh is how long fetched keys are trusted before a refetch.
+	JWKSRefresh time.Duration `yaml:"jwks_refresh" env:"AUTH_JWKS_REFRESH_MINUTES" unit:"m"`
+	// Leeway tolerates clock skew when checking exp and nbf.
+	Leeway time.Duration `yaml:"leeway" env:"AUTH_LEEWAY_SECONDS" unit:"s"`
+	// APIKeys are the accepted static keys, in addition to those in
+	// APIKeyList and APIKeysFile (see LoadAPIKeys).
+	APIKeys     []APIKey `yaml:"api_keys"`
+	APIKeyList  string   `yaml:"api_key_list" env:"AUTH_API_KEYS" secret:"true"`
+	APIKeysFile string   `yaml:"api_keys_file" env:"AUTH_API_KEYS_FILE"`
+	// AllowQueryToken accepts ?access_token= on WebSocket upgrades, which
+	// browsers cannot send headers with. It is off by default because query
+	// strings end up in proxy and access logs.
+	AllowQueryToken bool `yaml:"allow_query_token" env:"AUTH_QUERY_TOKEN"`
+}
+
+// DefaultConfig disables authentication until tokens or keys are set up.
+func DefaultConfig() Config {
+	return Config{
+		TenantClaim: "tenant",
+		RolesClaim:  "roles",
+		JWKSRefresh: time.Hour,
+		Leeway:      time.Minute,
+	}
+}
+
+// Validate checks the settings that New cannot fix up.
+func (c Config) Validate() error {
+	switch {
+	case c.JWKSRefresh <= 0:
+		return errors.New("auth: jwks_refresh must be positive")
+	case c.TenantClaim == "" || c.RolesClaim == "":
+		return errors.New("auth: tenant_claim and roles_claim must not be empty")
+	case (c.JWKSURL != "" || c.Issuer != "") && (c.Issuer == "" || c.Audience == ""):
+		return errors.New("auth: issuer and audience are required to accept tokens")
+	}
+	return nil
+}
+
+// Authenticator validates request credentials.
+type Authenticator struct {
+	mu   sync.RWMutex
+	cfg  Config
+	jwks *jwksCache
+	keys apiKeySet
+}
+
+// New builds an Authenticator. Token validation is enabled when JWKSURL or
+// Issuer is set.
+func New(cfg Config) (*Authenticator, error) {
+	a := &Authenticator{}
+	if err := a.Update(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Update replaces the configuration, for example to rotate API keys. The
+// fetched JWKS is kept while the token settings are unchanged.
+func (a *Authenticator) Update(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	keys, err := LoadAPIKeys(cfg.APIKeyList, cfg.APIKeysFile)
+	if err != nil {
+		return err
+	}
+	set, err := newAPIKeySet(append(keys, cfg.APIKeys...))
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.jwks == nil || cfg.JWKSURL != a.cfg.JWKSURL || cfg.Issuer != a.cfg.Issuer || cfg.JWKSRefresh != a.cfg.JWKSRefresh {
+		a.jwks = nil
+		if cfg.JWKSURL != "" || cfg.Issuer != "" {
+			a.jwks = newJWKSCache(cfg.JWKSURL, cfg.Issuer, cfg.JWKSRefresh)
+		}
+	}
+	a.cfg, a.keys = cfg, set
+	return nil
+}
+
+// Must builds an Authenticator, exiting the process if the configuration is
+// invalid. service names the caller in the log.
+func Must(service string, cfg Config) *Authenticator {
+	a, err := New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure %s authentication: %v", service, err)
+	}
+	a.logStatus(service)
+	return a
+}
+
+func (a *Authenticator) logStatus(service string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	switch {
+	case a.jwks == nil && len(a.keys) == 0:
+		log.Printf("WARNING: %s authentication is disabled; set AUTH_JWKS_URL, AUTH_ISSUER or AUTH_API_KEYS to require credentials", service)
+	default:
+		log.Printf("%s authentication: jwt: %t, api keys: %d", service, a.jwks != nil, len(a.keys))
+	}
+}
+
+// Enabled reports whether credentials are required.
+func (a *Authenticator) Enabled() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.jwks != nil || len(a.keys) > 0
+}
+
+// Authenticate identifies the caller of r. Credentials are read from an
+// "Authorization: Bearer" header, an X-API-Key header or, on WebSocket
+// upgrades, an access_token query parameter. A bearer value that is not a
+// JWT is tried as an API key.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	a.mu.RLock()
+	cfg, jwks, keys := a.cfg, a.jwks, a.keys
+	a.mu.RUnlock()
+	if jwks == nil && len(keys) == 0 {
+		return &Principal{Subject: MethodAnonymous, Method: MethodAnonymous}, nil
+	}
+	if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+		return authenticateKey(keys, key)
+	}
+	cred := bearerToken(r)
+	if cred == "" && cfg.AllowQueryToken && isWebSocket(r) {
+		cred = r.URL.Query().Get("access_token")
+	}
+	switch {
+	case cred == "":
+		return nil, ErrNoCredentials
+	case strings.Count(cred, ".") == 2:
+		if jwks == nil {
+			return nil, fmt.Errorf("%w: bearer tokens are not accepted", ErrInvalidCredentials)
+		}
+		return authenticateJWT(r.Context(), cfg, jwks, cred)
+	default:
+		return authenticateKey(keys, cred)
+	}
+}
+
+func authenticateKey(keys apiKeySet, key string) (*Principal, error) {
+	k, ok := keys.lookup(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown API key", ErrInvalidCredentials)
+	}
+	return &Principal{Subject: k.Name, Tenant: k.Tenant, Roles: k.Roles, Method: MethodAPIKey}, nil
+}
+
+func authenticateJWT(ctx context.Context, cfg Config, jwks *jwksCache, token string) (*Principal, error) {
+	claims, err := verifyJWT(ctx, token, jwks, cfg, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	p := &Principal{Method: MethodJWT, Claims: claims}
+	p.Subject, _ = claims["sub"].(string)
+	if p.Subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrInvalidCredentials)
+	}
+	p.Tenant, _ = claimValue(claims, cfg.TenantClaim).(string)
+	p.Roles = stringList(claimValue(claims, cfg.RolesClaim))
+	return p, nil
+}
+
+// Middleware rejects requests without valid credentials with 401 and makes
+// the caller's Principal available through FromContext. CORS preflight
+// requests pass through unauthenticated.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := a.Authenticate(r)
+		if err != nil {
+			log.Printf("Authentication failed for %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			challenge := `Bearer`
+			if errors.Is(err, ErrInvalidCredentials) {
+				challenge = `Bearer error="invalid_token"`
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
+
+// Wrap is Middleware for a single handler function.
+func (a *Authenticator) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return a.Middleware(next).ServeHTTP
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying p.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal stored by Middleware, if any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// claimValue looks up a possibly dotted claim name.
+func claimValue(claims map[string]interface{}, name string) interface{} {
+	var v interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[part]
+	}
+	return v
+}
+
+// stringList accepts a JSON array of strings or a space- or comma-separated
+// string, as identity providers differ.
+func stringList(v interface{}) []string {
+	var out []string
+	switch v := v.(type) {
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok && s != "" {
+				out = append(out, s)
+			}
+		}
+	case string:
+		out = strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	}
+	return out
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minJWKSRefetch limits how often an unknown key ID triggers a refetch, so
+// forged tokens cannot hammer the identity provider.
+const minJWKSRefetch = 30 * time.Second
+
+// jwksCache holds the signing keys of the identity provider, refetching
+// them when they expire or a token names a key ID it hasn't seen.
+type jwksCache struct {
+	url     string
+	issuer  string
+	refresh time.Duration
+	client  *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	tried   time.Time
+}
+
+func newJWKSCache(url, issuer string, refresh time.Duration) *jwksCache {
+	return &jwksCache{
+		url:     url,
+		issuer:  issuer,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Key returns the public key with the given ID.
+func (c *jwksCache) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	stale := c.keys == nil || now.Sub(c.fetched) > c.refresh
+	_, known := c.keys[kid]
+	if (stale || !known) && now.Sub(c.tried) >= minJWKSRefetch {
+		c.tried = now
+		if err := c.fetch(ctx); err != nil {
+			// Keep serving the keys we have if the provider is briefly down
+			log.Printf("JWKS refresh failed: %v", err)
+			if c.keys == nil {
+				return nil, err
+			}
+		}
+	}
+	key, ok := c.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (c *jwksCache) fetch(ctx context.Context) error {
+	if c.url == "" {
+		url, err := c.discover(ctx)
+		if err != nil {
+			return err
+		}
+		c.url = url
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := c.getJSON(ctx, c.url, &set); err != nil {
+		return err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	c.keys, c.fetched = keys, time.Now()
+	log.Printf("Loaded %d signing keys from %s", len(keys), c.url)
+	return nil
+}
+
+// discover finds the JWKS URL in the issuer's OpenID configuration.
+func (c *jwksCache) discover(ctx context.Context) (string, error) {
+	var doc struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	url := strings.TrimSuffix(c.issuer, "/") + "/.well-known/openid-configuration"
+	if err := c.getJSON(ctx, url, &doc); err != nil {
+		return "", err
+	}
+	if doc.JWKSURI == "" {
+		return "", fmt.Errorf("%s has no jwks_uri", url)
+	}
+	return doc.JWKSURI, nil
+}
+
+func (c *jwksCache) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode %s: %w", url, err)
+	}
+	return nil
+}
+
+// jwk is a JSON Web Key (RFC 7517) holding an RSA or EC public key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
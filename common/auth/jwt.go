@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// keySource resolves the key a token names in its header.
+type keySource interface {
+	Key(ctx context.Context, kid string) (crypto.PublicKey, error)
+}
+
+// signingAlgs are the accepted JWS algorithms. "none" and the HMAC family
+// are deliberately absent: tokens must be signed by the identity provider's
+// private key.
+var signingAlgs = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verifyJWT checks a compact JWS token's signature and its exp, nbf, iss
+// and aud claims, returning the claims.
+func verifyJWT(ctx context.Context, token string, keys keySource, cfg Config, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	hash, ok := signingAlgs[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	key, err := keys.Key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(header.Alg, key, hash, h.Sum(nil), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	if err := checkClaims(claims, cfg, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest, sig []byte) error {
+	invalid := errors.New("invalid signature")
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, hash, digest, sig) != nil {
+			return invalid
+		}
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPSS(pub, hash, digest, sig, nil) != nil {
+			return invalid
+		}
+	case "ES":
+		// JWS encodes ECDSA signatures as r||s, each padded to the curve size
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return invalid
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return invalid
+		}
+	}
+	return nil
+}
+
+func checkClaims(claims map[string]interface{}, cfg Config, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(cfg.Leeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(cfg.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not yet valid")
+	}
+	// Validate requires an issuer and audience, so empty ones match nothing
+	if iss, _ := claims["iss"].(string); cfg.Issuer == "" || strings.TrimSuffix(iss, "/") != strings.TrimSuffix(cfg.Issuer, "/") {
+		return fmt.Errorf("unexpected issuer %q", iss)
+	}
+	var aud []string
+	switch v := claims["aud"].(type) {
+	case string:
+		aud = []string{v}
+	case []interface{}:
+		aud = stringList(v)
+	}
+	found := false
+	for _, a := range aud {
+		found = found || (a != "" && a == cfg.Audience)
+	}
+	if !found {
+		return fmt.Errorf("token is not for audience %q", cfg.Audience)
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
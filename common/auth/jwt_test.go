@@ -0,0 +1,292 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testAudience = "doc-scanner"
+	testSubject  = "alice"
+)
+
+// testSigner signs tokens the way an identity provider would.
+type testSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func newRSASigner(t *testing.T, kid string) *testSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{kid: kid, alg: "RS256", key: key}
+}
+
+func newECSigner(t *testing.T, kid string) *testSigner {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{kid: kid, alg: "ES256", key: key}
+}
+
+// jwk returns the public half of the signer's key as a JSON Web Key.
+func (s *testSigner) jwk() map[string]string {
+	enc := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	switch pub := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "use": "sig", "n": enc(pub.N.Bytes()), "e": enc(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256", "x": enc(pub.X.FillBytes(make([]byte, 32))), "y": enc(pub.Y.FillBytes(make([]byte, 32)))}
+	}
+	panic("unsupported key")
+}
+
+func (s *testSigner) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	signingInput := segment(t, map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"}) + "." + segment(t, claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	var sig []byte
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, ss, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func segment(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// newIdentityProvider serves an OpenID configuration and a JWKS holding
+// the signers' public keys.
+func newIdentityProvider(t *testing.T, signers ...*testSigner) *httptest.Server {
+	t.Helper()
+	var keys []map[string]string
+	for _, s := range signers {
+		keys = append(keys, s.jwk())
+	}
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": srv.URL, "jwks_uri": srv.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	return srv
+}
+
+func newTokenAuthenticator(t *testing.T, issuer string) *Authenticator {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Issuer = issuer
+	cfg.Audience = testAudience
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/documents", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestVerifyJWT(t *testing.T) {
+	rsaSigner := newRSASigner(t, "rsa-key")
+	ecSigner := newECSigner(t, "ec-key")
+	idp := newIdentityProvider(t, rsaSigner, ecSigner)
+	a := newTokenAuthenticator(t, idp.URL)
+
+	now := time.Now()
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":    idp.URL,
+			"aud":    []string{"other-app", testAudience},
+			"sub":    testSubject,
+			"exp":    now.Add(time.Hour).Unix(),
+			"tenant": "acme",
+			"roles":  []string{"uploader"},
+		}
+	}
+
+	for _, signer := range []*testSigner{rsaSigner, ecSigner} {
+		signer := signer
+		t.Run(signer.alg, func(t *testing.T) {
+			p, err := a.Authenticate(bearerRequest(signer.sign(t, validClaims())))
+			if err != nil {
+				t.Fatalf("valid token rejected: %v", err)
+			}
+			if p.Subject != testSubject || p.Tenant != "acme" || len(p.Roles) != 1 || p.Roles[0] != "uploader" || p.Method != MethodJWT {
+				t.Fatalf("unexpected principal %+v", p)
+			}
+
+			tests := []struct {
+				name   string
+				change func(map[string]interface{})
+				signer *testSigner
+			}{
+				{name: "expired", change: func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() }},
+				{name: "no expiry", change: func(c map[string]interface{}) { delete(c, "exp") }},
+				{name: "not yet valid", change: func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() }},
+				{name: "wrong audience", change: func(c map[string]interface{}) { c["aud"] = "other-app" }},
+				{name: "no audience", change: func(c map[string]interface{}) { delete(c, "aud") }},
+				{name: "wrong issuer", change: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }},
+				{name: "no issuer", change: func(c map[string]interface{}) { delete(c, "iss") }},
+				{name: "no subject", change: func(c map[string]interface{}) { delete(c, "sub") }},
+				{name: "unknown kid", signer: &testSigner{kid: "rotated-away", alg: signer.alg, key: signer.key}},
+				{name: "key not in JWKS", signer: forgedSigner(t, signer)},
+			}
+			for _, tt := range tests {
+				claims := validClaims()
+				if tt.change != nil {
+					tt.change(claims)
+				}
+				s := signer
+				if tt.signer != nil {
+					s = tt.signer
+				}
+				if _, err := a.Authenticate(bearerRequest(s.sign(t, claims))); !errors.Is(err, ErrInvalidCredentials) {
+					t.Errorf("%s: got %v, want invalid credentials", tt.name, err)
+				}
+			}
+		})
+	}
+}
+
+// forgedSigner uses a fresh key under the kid of a published one.
+func forgedSigner(t *testing.T, published *testSigner) *testSigner {
+	if published.alg == "RS256" {
+		return newRSASigner(t, published.kid)
+	}
+	return newECSigner(t, published.kid)
+}
+
+func TestVerifyJWTRejectsUnsignedAndHMACTokens(t *testing.T) {
+	signer := newRSASigner(t, "rsa-key")
+	idp := newIdentityProvider(t, signer)
+	a := newTokenAuthenticator(t, idp.URL)
+	valid := map[string]interface{}{
+		"iss": idp.URL, "aud": testAudience, "sub": testSubject, "exp": time.Now().Add(time.Hour).Unix(),
+	}
+	claims := segment(t, valid)
+
+	// alg=none, with and without a signature segment
+	none := segment(t, map[string]string{"alg": "none", "kid": signer.kid}) + "." + claims
+	for _, token := range []string{none + ".", none + ".c2ln"} {
+		if _, err := a.Authenticate(bearerRequest(token)); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("alg=none token accepted: %v", err)
+		}
+	}
+
+	// HS256 keyed with the public key, the classic algorithm confusion
+	pub, err := x509.MarshalPKIXPublicKey(signer.key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range [][]byte{pub, []byte("secret")} {
+		input := segment(t, map[string]string{"alg": "HS256", "kid": signer.kid}) + "." + claims
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(input))
+		token := input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+		if _, err := a.Authenticate(bearerRequest(token)); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("HS256 token accepted: %v", err)
+		}
+	}
+
+	// A header claiming RS256 over an ECDSA-shaped signature
+	ec := newECSigner(t, signer.kid)
+	ec.alg = "RS256"
+	if _, err := a.Authenticate(bearerRequest(ec.sign(t, valid))); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("mismatched key type accepted: %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name                      string
+		jwksURL, issuer, audience string
+		ok                        bool
+	}{
+		{name: "tokens disabled", ok: true},
+		{name: "issuer and audience", issuer: "https://idp.example.com", audience: testAudience, ok: true},
+		{name: "jwks url with both", jwksURL: "https://idp.example.com/jwks", issuer: "https://idp.example.com", audience: testAudience, ok: true},
+		{name: "issuer without audience", issuer: "https://idp.example.com"},
+		{name: "jwks url without issuer", jwksURL: "https://idp.example.com/jwks", audience: testAudience},
+		{name: "jwks url alone", jwksURL: "https://idp.example.com/jwks"},
+	}
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		cfg.JWKSURL, cfg.Issuer, cfg.Audience = tt.jwksURL, tt.issuer, tt.audience
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestQueryToken(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.APIKeyList = "alice:alice-key"
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgrade := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/terminal?access_token=alice-key", nil)
+		r.Header.Set("Upgrade", "websocket")
+		return r
+	}
+	if _, err := a.Authenticate(upgrade()); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("query token accepted by default: %v", err)
+	}
+
+	cfg.AllowQueryToken = true
+	if err := a.Update(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := a.Authenticate(upgrade()); err != nil || p.Subject != "alice" {
+		t.Fatalf("query token rejected when allowed: %v", err)
+	}
+	r := upgrade()
+	r.Header.Del("Upgrade")
+	if _, err := a.Authenticate(r); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("query token accepted outside a WebSocket upgrade: %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+// Package config loads a service's typed configuration from an optional YAML
+// file and the environment.
+//
+// A configuration is a struct whose fields carry yaml and env tags:
+//
+//	type Config struct {
+//		Port     int           `yaml:"port" env:"PORT"`
+//		APIKey   string        `yaml:"api_key" env:"API_KEY" secret:"true"`
+//		Cooldown time.Duration `yaml:"cooldown" env:"COOLDOWN_SECONDS" unit:"s"`
+//	}
+//
+// Values start at whatever the struct holds (the defaults), are overridden
+// by the YAML file and then by environment variables. Durations are written
+// as "30s" in YAML; in the environment they are plain numbers in the field's
+// unit (ms, s, m or h). Lists are comma-separated in the environment. Pointer
+// fields stay nil unless set. Fields tagged secret are redacted by Print.
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Validator is implemented by configurations that check themselves after
+// loading.
+type Validator interface {
+	Validate() error
+}
+
+// Load fills cfg, a pointer to a struct holding the defaults, from the YAML
+// file (if file is not empty) and then from the environment, and validates
+// the result.
+func Load(cfg interface{}, file string) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return errors.New("config: Load needs a pointer to a struct")
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	if err := loadEnv(v.Elem()); err != nil {
+		return err
+	}
+	if val, ok := cfg.(Validator); ok {
+		if err := val.Validate(); err != nil {
+			return fmt.Errorf("invalid configuration: %w", err)
+		}
+	}
+	return nil
+}
+
+// loadEnv applies the environment variables named by env tags, recursing
+// into nested structs.
+func loadEnv(v reflect.Value) error {
+	t := v.Type()
+	var errs []error
+	for i := 0; i < t.NumField(); i++ {
+		f, fv := t.Field(i), v.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Tag.Get("env")
+		if name == "" {
+			if fv.Kind() == reflect.Struct {
+				if err := loadEnv(fv); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			continue
+		}
+		raw, ok := os.LookupEnv(name)
+		// An empty variable counts as unset, except that it clears a list
+		if !ok || (raw == "" && fv.Kind() != reflect.Slice) {
+			continue
+		}
+		if err := setFromString(fv, strings.TrimSpace(raw), f.Tag.Get("unit")); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+var units = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+func setFromString(v reflect.Value, raw, unit string) error {
+	if v.Kind() == reflect.Pointer {
+		// A pointer distinguishes "set" from the zero value
+		p := reflect.New(v.Type().Elem())
+		if err := setFromString(p.Elem(), raw, unit); err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	}
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(raw))
+	}
+	if v.Type() == durationType {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("want a non-negative whole number of %s, got %q", unitName(unit), raw)
+		}
+		mult, ok := units[unit]
+		if !ok {
+			return fmt.Errorf("duration field has no unit tag")
+		}
+		v.SetInt(n * int64(mult))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("want true or false, got %q", raw)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("want a whole number, got %q", raw)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("want a number, got %q", raw)
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("cannot be set from the environment")
+		}
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = reflect.Append(list, reflect.ValueOf(item).Convert(v.Type().Elem()))
+			}
+		}
+		v.Set(list)
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	return nil
+}
+
+func unitName(unit string) string {
+	return map[string]string{"ms": "milliseconds", "s": "seconds", "m": "minutes", "h": "hours"}[unit]
+}
+
+// redacted replaces secret values in Print's output.
+const redacted = "<redacted>"
+
+// Print writes cfg as YAML, annotating each setting with its environment
+// variable and hiding secrets.
+func Print(w io.Writer, cfg interface{}) error {
+	node, err := toNode(reflect.Indirect(reflect.ValueOf(cfg)), false)
+	if err != nil {
+		return err
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func toNode(v reflect.Value, secret bool) (*yaml.Node, error) {
+	if secret && !v.IsZero() {
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: redacted}, nil
+	}
+	switch {
+	case v.Kind() == reflect.Pointer && !v.IsNil() && v.Elem().Kind() == reflect.Struct:
+		return toNode(v.Elem(), secret)
+	case v.Kind() == reflect.Struct && v.Type() != reflect.TypeOf(time.Time{}):
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			val, err := toNode(v.Field(i), f.Tag.Get("secret") == "true")
+			if err != nil {
+				return nil, err
+			}
+			key := &yaml.Node{Kind: yaml.ScalarNode, Value: name}
+			if env := f.Tag.Get("env"); env != "" {
+				// Comments on a block value would land on its first item
+				if val.Kind == yaml.ScalarNode || val.Style&yaml.FlowStyle != 0 {
+					val.LineComment = "$" + env
+				} else {
+					key.LineComment = "$" + env
+				}
+			}
+			node.Content = append(node.Content, key, val)
+		}
+		return node, nil
+	case (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.IsNil():
+		// Unset, as opposed to empty
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		node := &yaml.Node{Kind: yaml.SequenceNode}
+		for i := 0; i < v.Len(); i++ {
+			item, err := toNode(v.Index(i), secret)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, item)
+		}
+		return node, nil
+	}
+	node := &yaml.Node{}
+	if err := node.Encode(v.Interface()); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// Options are the command-line flags every service accepts.
+type Options struct {
+	// File is the YAML file from --config, or CONFIG_FILE.
+	File string
+	// PrintConfig asks the service to print its configuration and exit.
+	PrintConfig bool
+}
+
+// ParseFlags reads --config and --print-config from the command line.
+func ParseFlags() Options {
+	var o Options
+	flag.StringVar(&o.File, "config", os.Getenv("CONFIG_FILE"), "YAML configuration file (default $CONFIG_FILE)")
+	flag.BoolVar(&o.PrintConfig, "print-config", false, "print the effective configuration with secrets redacted and exit")
+	flag.Parse()
+	return o
+}
+
+// MustLoad parses the command line and loads cfg, exiting with a clear
+// message if the configuration is invalid. With --print-config it prints
+// the configuration and exits. It returns the options so the service can
+// reload the same file later.
+func MustLoad(service string, cfg interface{}) Options {
+	opts := ParseFlags()
+	if err := Load(cfg, opts.File); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", service, err)
+		os.Exit(2)
+	}
+	if opts.PrintConfig {
+		if err := Print(os.Stdout, cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", service, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if opts.File != "" {
+		log.Printf("Loaded %s configuration from %s", service, opts.File)
+	}
+	return opts
+}
+
+// OnReload calls reload whenever the process receives SIGHUP.
+func OnReload(service string, reload func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			log.Printf("SIGHUP received, reloading %s configuration", service)
+			reload()
+		}
+	}()
+}
+
+// Errors collects validation failures so they can be reported together.
+type Errors []error
+
+// Addf records a failure.
+func (e *Errors) Addf(format string, args ...interface{}) {
+	*e = append(*e, fmt.Errorf(format, args...))
+}
+
+// Err returns the collected failures, or nil.
+func (e Errors) Err() error { return errors.Join(e...) }
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testLimits struct {
+	Size  int64    `yaml:"size" env:"TEST_LIMIT_SIZE"`
+	Ratio *float64 `yaml:"ratio" env:"TEST_LIMIT_RATIO"`
+}
+
+type testConfig struct {
+	Port     int           `yaml:"port" env:"TEST_PORT"`
+	Name     string        `yaml:"name" env:"TEST_NAME"`
+	Debug    bool          `yaml:"debug" env:"TEST_DEBUG"`
+	APIKey   string        `yaml:"api_key" env:"TEST_API_KEY" secret:"true"`
+	Cooldown time.Duration `yaml:"cooldown" env:"TEST_COOLDOWN_SECONDS" unit:"s"`
+	Hosts    []string      `yaml:"hosts" env:"TEST_HOSTS"`
+	Limits   testLimits    `yaml:"limits"`
+	Enabled  *bool         `yaml:"enabled" env:"TEST_ENABLED"`
+}
+
+func (c *testConfig) Validate() error {
+	var errs Errors
+	if c.Port < 1 {
+		errs.Addf("port must be positive, got %d", c.Port)
+	}
+	if c.Name == "invalid" {
+		errs.Addf("name must not be %q", c.Name)
+	}
+	return errs.Err()
+}
+
+func defaultTestConfig() *testConfig {
+	return &testConfig{Port: 80, Name: "default", Cooldown: time.Minute, Hosts: []string{"a"}, Limits: testLimits{Size: 10}}
+}
+
+func writeYAML(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeYAML(t, `
+port: 8080
+name: from-yaml
+cooldown: 30s
+hosts: [b, c]
+limits:
+  size: 20
+`)
+	t.Setenv("TEST_PORT", "9090")
+	t.Setenv("TEST_COOLDOWN_SECONDS", "45")
+	t.Setenv("TEST_LIMIT_RATIO", "2.5")
+	t.Setenv("TEST_NAME", "") // empty counts as unset
+
+	cfg := defaultTestConfig()
+	if err := Load(cfg, file); err != nil {
+		t.Fatal(err)
+	}
+	ratio := 2.5
+	want := &testConfig{
+		Port:     9090,        // environment over YAML
+		Name:     "from-yaml", // YAML over the default
+		Cooldown: 45 * time.Second,
+		Hosts:    []string{"b", "c"},
+		Limits:   testLimits{Size: 20, Ratio: &ratio},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+	if cfg.Enabled != nil {
+		t.Error("unset pointer field set")
+	}
+}
+
+func TestLoadEnvironment(t *testing.T) {
+	t.Setenv("TEST_DEBUG", "true")
+	t.Setenv("TEST_HOSTS", " x, ,y ")
+	t.Setenv("TEST_ENABLED", "false")
+	t.Setenv("TEST_LIMIT_SIZE", "30")
+	cfg := defaultTestConfig()
+	if err := Load(cfg, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Debug || !reflect.DeepEqual(cfg.Hosts, []string{"x", "y"}) || cfg.Limits.Size != 30 {
+		t.Errorf("got debug %t, hosts %q, size %d", cfg.Debug, cfg.Hosts, cfg.Limits.Size)
+	}
+	if cfg.Enabled == nil || *cfg.Enabled {
+		t.Errorf("pointer set to false from the environment: %v", cfg.Enabled)
+	}
+
+	// An empty list variable clears the list
+	t.Setenv("TEST_HOSTS", "")
+	cfg = defaultTestConfig()
+	if err := Load(cfg, ""); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Hosts == nil || len(cfg.Hosts) != 0 {
+		t.Errorf("empty TEST_HOSTS left hosts %q", cfg.Hosts)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	if err := Load(testConfig{}, ""); err == nil {
+		t.Error("non-pointer accepted")
+	}
+	if err := Load(defaultTestConfig(), filepath.Join(t.TempDir(), "missing.yaml")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: got %v", err)
+	}
+	if err := Load(defaultTestConfig(), writeYAML(t, "prot: 8080\n")); err == nil || !strings.Contains(err.Error(), "prot") {
+		t.Errorf("misspelt field: got %v", err)
+	}
+	if err := Load(defaultTestConfig(), writeYAML(t, "")); err != nil {
+		t.Errorf("empty file: %v", err)
+	}
+
+	// Every bad variable is reported
+	t.Setenv("TEST_PORT", "eighty")
+	t.Setenv("TEST_COOLDOWN_SECONDS", "1m")
+	t.Setenv("TEST_DEBUG", "yes please")
+	err := Load(defaultTestConfig(), "")
+	for _, name := range []string{"TEST_PORT", "TEST_COOLDOWN_SECONDS", "TEST_DEBUG"} {
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("error %v does not name %s", err, name)
+		}
+	}
+}
+
+func TestLoadValidates(t *testing.T) {
+	t.Setenv("TEST_PORT", "0")
+	t.Setenv("TEST_NAME", "invalid")
+	err := Load(defaultTestConfig(), "")
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid configuration") {
+		t.Fatalf("got %v, want a validation error", err)
+	}
+	// Validation failures are reported together
+	for _, part := range []string{"port must be positive", `name must not be "invalid"`} {
+		if !strings.Contains(err.Error(), part) {
+			t.Errorf("error %q lacks %q", err, part)
+		}
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	cfg := defaultTestConfig()
+	cfg.APIKey = "hunter2"
+	var buf bytes.Buffer
+	if err := Print(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "hunter2") || !strings.Contains(out, "api_key: "+redacted) {
+		t.Errorf("secret not redacted:\n%s", out)
+	}
+	for _, want := range []string{"port: 80 # $TEST_PORT", "cooldown: 1m0s # $TEST_COOLDOWN_SECONDS", "enabled: null # $TEST_ENABLED"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+
+	// An unset secret prints as empty, so it is clear it is missing
+	cfg.APIKey = ""
+	buf.Reset()
+	Print(&buf, cfg)
+	if strings.Contains(buf.String(), redacted) {
+		t.Errorf("empty secret redacted:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,227 @@
+// Package health serves /livez and /readyz from pluggable dependency checks.
+//
+// Liveness asks whether the process should be restarted, so it only runs
+// checks of the process itself; readiness asks whether it should get
+// traffic and also checks its dependencies. Each check reports its status
+// and latency:
+//
+//	{"status": "degraded", "service": "sdk",
+//	 "checks": [{"name": "uploads", "status": "ok", "latency_ms": 0.4},
+//	            {"name": "scanner", "status": "fail", "critical": false,
+//	             "error": "scanner not configured: no API key configured", "latency_ms": 0.1}]}
+//
+// A failing critical check answers 503; other failures only mark the report
+// degraded, for dependencies the service can run without.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Statuses of a check and of a report.
+const (
+	StatusOK       = "ok"
+	StatusFail     = "fail"
+	StatusDegraded = "degraded"
+)
+
+// DefaultTimeout bounds a check that sets no timeout of its own.
+const DefaultTimeout = 2 * time.Second
+
+// Check is one dependency check. Run returns nil when the dependency is
+// usable.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+	// Critical failures make the service unready (or not live).
+	Critical bool
+	Timeout  time.Duration
+}
+
+// Result is the outcome of a Check.
+type Result struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	Critical  bool    `json:"critical"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// Report is the body of /livez and /readyz.
+type Report struct {
+	Status  string   `json:"status"`
+	Service string   `json:"service"`
+	Checks  []Result `json:"checks"`
+}
+
+// Checker holds a service's liveness and readiness checks.
+type Checker struct {
+	service string
+
+	mu    sync.Mutex
+	live  []Check
+	ready []Check
+}
+
+// New returns a Checker without checks; service names it in reports.
+func New(service string) *Checker {
+	return &Checker{service: service}
+}
+
+// Live adds a liveness check. It also applies to readiness.
+func (c *Checker) Live(check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.live = append(c.live, check)
+}
+
+// Ready adds a readiness check.
+func (c *Checker) Ready(check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ready = append(c.ready, check)
+}
+
+// Liveness runs the liveness checks.
+func (c *Checker) Liveness(ctx context.Context) Report {
+	c.mu.Lock()
+	checks := append([]Check(nil), c.live...)
+	c.mu.Unlock()
+	return c.run(ctx, checks)
+}
+
+// Readiness runs the liveness and readiness checks.
+func (c *Checker) Readiness(ctx context.Context) Report {
+	c.mu.Lock()
+	checks := append(append([]Check(nil), c.live...), c.ready...)
+	c.mu.Unlock()
+	return c.run(ctx, checks)
+}
+
+// run executes checks concurrently, each under its own timeout.
+func (c *Checker) run(ctx context.Context, checks []Check) Report {
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = runCheck(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Service: c.service, Checks: results}
+	for _, r := range results {
+		switch {
+		case r.Status == StatusOK:
+		case r.Critical:
+			report.Status = StatusFail
+		case report.Status == StatusOK:
+			report.Status = StatusDegraded
+		}
+	}
+	return report
+}
+
+func runCheck(ctx context.Context, check Check) Result {
+	timeout := check.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				errc <- fmt.Errorf("check panicked: %v", p)
+			}
+		}()
+		errc <- check.Run(ctx)
+	}()
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	r := Result{
+		Name:      check.Name,
+		Status:    StatusOK,
+		Critical:  check.Critical,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		r.Status, r.Error = StatusFail, err.Error()
+	}
+	return r
+}
+
+// LiveHandler serves /livez.
+func (c *Checker) LiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, c.Liveness(r.Context()))
+}
+
+// ReadyHandler serves /readyz.
+func (c *Checker) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, c.Readiness(r.Context()))
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	status := http.StatusOK
+	if report.Status == StatusFail {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// Draining is a critical readiness check that fails once draining reports
+// true, for example shutdown.Server.Draining.
+func Draining(draining func() bool) Check {
+	return Check{
+		Name:     "shutdown",
+		Critical: true,
+		Run: func(context.Context) error {
+			if draining() {
+				return fmt.Errorf("draining")
+			}
+			return nil
+		},
+	}
+}
+
+// Writable is a critical check that creates and removes a file in dir.
+func Writable(name, dir string) Check {
+	return Check{
+		Name:     name,
+		Critical: true,
+		Run: func(context.Context) error {
+			f, err := os.CreateTemp(dir, ".health-*")
+			if err != nil {
+				return err
+			}
+			_, werr := f.Write([]byte("ok"))
+			cerr := f.Close()
+			if err := os.Remove(f.Name()); err != nil {
+				return err
+			}
+			if werr != nil {
+				return werr
+			}
+			return cerr
+		},
+	}
+}
@@ -0,0 +1,133 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, h http.HandlerFunc, path string) (int, Report) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, path, nil))
+	var report Report
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%s: %v in %s", path, err, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s: Content-Type %q", path, ct)
+	}
+	return w.Code, report
+}
+
+func pass(context.Context) error { return nil }
+
+func TestLiveAndReady(t *testing.T) {
+	var scannerDown, storeDown atomic.Bool
+	c := New("test")
+	c.Live(Check{Name: "process", Critical: true, Run: pass})
+	c.Ready(Check{Name: "store", Critical: true, Run: func(context.Context) error {
+		if storeDown.Load() {
+			return errors.New("store unreachable")
+		}
+		return nil
+	}})
+	c.Ready(Check{Name: "scanner", Run: func(context.Context) error {
+		if scannerDown.Load() {
+			return errors.New("scanner unreachable")
+		}
+		return nil
+	}})
+
+	for _, tc := range []struct {
+		name                 string
+		scanner, store       bool
+		readyCode            int
+		readyStatus, failing string
+	}{
+		{"all up", false, false, http.StatusOK, StatusOK, ""},
+		{"optional dependency down", true, false, http.StatusOK, StatusDegraded, "scanner"},
+		{"critical dependency down", false, true, http.StatusServiceUnavailable, StatusFail, "store"},
+	} {
+		scannerDown.Store(tc.scanner)
+		storeDown.Store(tc.store)
+		code, report := get(t, c.ReadyHandler, "/readyz")
+		if code != tc.readyCode || report.Status != tc.readyStatus || report.Service != "test" {
+			t.Errorf("%s: /readyz %d %s for %s, want %d %s", tc.name, code, report.Status, report.Service, tc.readyCode, tc.readyStatus)
+		}
+		if len(report.Checks) != 3 {
+			t.Fatalf("%s: checks %+v", tc.name, report.Checks)
+		}
+		for _, r := range report.Checks {
+			if failed := r.Status == StatusFail; failed != (r.Name == tc.failing) || (failed && r.Error == "") {
+				t.Errorf("%s: check %+v", tc.name, r)
+			}
+		}
+		// Dependencies never make the process unhealthy
+		code, report = get(t, c.LiveHandler, "/livez")
+		if code != http.StatusOK || report.Status != StatusOK || len(report.Checks) != 1 {
+			t.Errorf("%s: /livez %d %+v", tc.name, code, report)
+		}
+	}
+}
+
+func TestReadyWhileDraining(t *testing.T) {
+	var draining atomic.Bool
+	c := New("test")
+	c.Ready(Draining(draining.Load))
+	if code, _ := get(t, c.ReadyHandler, "/readyz"); code != http.StatusOK {
+		t.Fatalf("ready before draining: %d", code)
+	}
+	draining.Store(true)
+	code, report := get(t, c.ReadyHandler, "/readyz")
+	if code != http.StatusServiceUnavailable || report.Checks[0].Error != "draining" {
+		t.Errorf("draining: %d %+v", code, report)
+	}
+	if code, _ := get(t, c.LiveHandler, "/livez"); code != http.StatusOK {
+		t.Errorf("/livez while draining: %d", code)
+	}
+}
+
+func TestCheckTimeoutAndPanic(t *testing.T) {
+	stuck := make(chan struct{})
+	defer close(stuck)
+	c := New("test")
+	c.Live(Check{Name: "hung", Critical: true, Timeout: 50 * time.Millisecond, Run: func(context.Context) error {
+		<-stuck // ignores ctx, as a stuck dependency client might
+		return nil
+	}})
+	c.Live(Check{Name: "broken", Run: func(context.Context) error { panic("nil map") }})
+	start := time.Now()
+	report := c.Liveness(context.Background())
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("liveness took %s", elapsed)
+	}
+	if report.Status != StatusFail {
+		t.Errorf("status %s, want fail", report.Status)
+	}
+	for i, want := range []string{"timed out after 50ms", "check panicked: nil map"} {
+		if report.Checks[i].Error != want {
+			t.Errorf("check %s: error %q, want %q", report.Checks[i].Name, report.Checks[i].Error, want)
+		}
+	}
+}
+
+func TestWritable(t *testing.T) {
+	dir := t.TempDir()
+	if err := Writable("uploads", dir).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("probe file left behind: %v", entries)
+	}
+	if err := Writable("uploads", filepath.Join(dir, "missing")).Run(context.Background()); err == nil {
+		t.Error("missing directory reported writable")
+	}
+}
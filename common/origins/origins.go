@@ -0,0 +1,304 @@
+// Package origins decides which browser origins may call the services, for
+// CORS responses and WebSocket upgrades.
+//
+// A pattern has the form scheme://host[:port]:
+//
+//	https://boringpapercompany.com   exact origin on the default port
+//	https://*.elb.amazonaws.com      any subdomain (not the domain itself)
+//	http://localhost:*               any port
+//	*://10.0.0.0/8:*                 any address in a CIDR range, any scheme
+//	http://[fd00::/8]:8080           IPv6 hosts and ranges are bracketed
+//	*://fd00::1                      or bare, when no port is given
+//
+// Origins are parsed as URLs and compared component by component, so
+// "http://evil.com/.elb.amazonaws.com" matches nothing above.
+package origins
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// DefaultPatterns are allowed unless ALLOWED_ORIGINS_FILE replaces them.
+var DefaultPatterns = []string{
+	// Internal service communication
+	"*://ui-service",
+	"*://ollama-service",
+	// Cloud load balancers
+	"*://*.elb.amazonaws.com",
+	"*://*.cloudapp.azure.com",
+	"*://*.run.app",
+	// Public domains
+	"*://boringpapercompany.com",
+	"*://*.boringpapercompany.com",
+	// Development
+	"*://localhost:*",
+	"*://127.0.0.0/8:*",
+}
+
+// rule is one parsed pattern.
+type rule struct {
+	scheme string // "" matches http and https
+	host   string // exact hostname or IP
+	suffix string // ".example.com" for *.example.com
+	cidr   *net.IPNet
+	port   string // "" for the scheme's default, "*" for any
+}
+
+func (r rule) matches(o origin) bool {
+	if r.scheme != "" && r.scheme != o.scheme {
+		return false
+	}
+	switch r.port {
+	case "*":
+	case "":
+		if o.port != defaultPort(o.scheme) {
+			return false
+		}
+	default:
+		if r.port != o.port {
+			return false
+		}
+	}
+	switch {
+	case r.cidr != nil:
+		ip := net.ParseIP(o.host)
+		return ip != nil && r.cidr.Contains(ip)
+	case r.suffix != "":
+		return strings.HasSuffix(o.host, r.suffix) && len(o.host) > len(r.suffix)
+	default:
+		return o.host == r.host
+	}
+}
+
+// Policy is a list of origin patterns. It can be replaced with Update while
+// requests are being checked.
+type Policy struct {
+	rules atomic.Pointer[[]rule]
+}
+
+// Parse compiles patterns, rejecting any it cannot understand.
+func Parse(patterns []string) (*Policy, error) {
+	rules, err := parseRules(patterns)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	p.rules.Store(&rules)
+	return p, nil
+}
+
+func parseRules(patterns []string) ([]rule, error) {
+	rules := make([]rule, 0, len(patterns))
+	for _, pat := range patterns {
+		r, err := parseRule(pat)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func parseRule(pattern string) (rule, error) {
+	bad := func(why string) (rule, error) {
+		return rule{}, fmt.Errorf("origin pattern %q: %s", pattern, why)
+	}
+	scheme, rest, ok := strings.Cut(strings.ToLower(strings.TrimSpace(pattern)), "://")
+	if !ok {
+		return bad("want scheme://host[:port]")
+	}
+	var r rule
+	switch scheme {
+	case "*":
+	case "http", "https":
+		r.scheme = scheme
+	default:
+		return bad("scheme must be http, https or *")
+	}
+
+	host, port := rest, ""
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]")
+		if end < 0 {
+			return bad("unclosed [")
+		}
+		host, port = rest[1:end], strings.TrimPrefix(rest[end+1:], ":")
+		if rest[end+1:] != "" && !strings.HasPrefix(rest[end+1:], ":") {
+			return bad("unexpected text after ]")
+		}
+		if !strings.Contains(host, ":") {
+			return bad("only IPv6 addresses and ranges are bracketed")
+		}
+	} else if strings.Count(rest, ":") > 1 {
+		// A bare IPv6 address or range; its last group is not a port
+		if net.ParseIP(rest) == nil {
+			if _, _, err := net.ParseCIDR(rest); err != nil {
+				return bad("bracket IPv6 addresses to give a port")
+			}
+		}
+	} else if i := strings.LastIndex(rest, ":"); i >= 0 {
+		host, port = rest[:i], rest[i+1:]
+	}
+	if port != "" && port != "*" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return bad("invalid port")
+		}
+	}
+	r.port = port
+
+	switch {
+	case strings.Contains(host, "/"):
+		_, cidr, err := net.ParseCIDR(host)
+		if err != nil {
+			return bad("invalid CIDR range")
+		}
+		r.cidr = cidr
+	case strings.HasPrefix(host, "*."):
+		r.suffix = host[1:]
+		if strings.Contains(r.suffix[1:], "*") || len(r.suffix) < 2 {
+			return bad("wildcards are only allowed as the leftmost label")
+		}
+	case host == "" || strings.ContainsAny(host, "*/?#@ "):
+		return bad("invalid host")
+	case net.ParseIP(host) != nil:
+		r.host = net.ParseIP(host).String()
+	default:
+		r.host = strings.TrimSuffix(host, ".")
+	}
+	return r, nil
+}
+
+// origin is a parsed Origin header.
+type origin struct {
+	scheme, host, port string
+}
+
+func parseOrigin(s string) (origin, bool) {
+	u, err := url.Parse(s)
+	if err != nil || u.User != nil || u.Opaque != "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return origin{}, false
+	}
+	o := origin{
+		scheme: strings.ToLower(u.Scheme),
+		host:   strings.TrimSuffix(strings.ToLower(u.Hostname()), "."),
+		port:   u.Port(),
+	}
+	if (o.scheme != "http" && o.scheme != "https") || o.host == "" {
+		return origin{}, false
+	}
+	if o.port == "" {
+		o.port = defaultPort(o.scheme)
+	}
+	// Compare addresses in canonical form, so [FD00:0::1] is fd00::1
+	if ip := net.ParseIP(o.host); ip != nil {
+		o.host = ip.String()
+	}
+	return o, true
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// Allowed reports whether a browser at origin may call the service.
+func (p *Policy) Allowed(s string) bool {
+	o, ok := parseOrigin(s)
+	if !ok {
+		return false
+	}
+	for _, r := range *p.rules.Load() {
+		if r.matches(o) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadPatterns returns the DefaultPatterns, or the lines of file when set
+// (blank lines and # comments are ignored), followed by the comma-separated
+// patterns in extra and the http and https origins of loadBalancerIP.
+func LoadPatterns(file, extra, loadBalancerIP string) ([]string, error) {
+	patterns := append([]string(nil), DefaultPatterns...)
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		patterns = nil
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line, _, _ := strings.Cut(sc.Text(), "#")
+			if line = strings.TrimSpace(line); line != "" {
+				patterns = append(patterns, line)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, pat := range strings.Split(extra, ",") {
+		if pat = strings.TrimSpace(pat); pat != "" {
+			patterns = append(patterns, pat)
+		}
+	}
+	if ip := strings.TrimSpace(loadBalancerIP); ip != "" {
+		if strings.Contains(ip, ":") {
+			ip = "[" + ip + "]"
+		}
+		patterns = append(patterns, "*://"+ip)
+	}
+	return patterns, nil
+}
+
+// Config lists where the allowed origins come from; see LoadPatterns.
+type Config struct {
+	File           string   `yaml:"file" env:"ALLOWED_ORIGINS_FILE"`
+	Extra          []string `yaml:"extra" env:"ALLOWED_ORIGINS"`
+	LoadBalancerIP string   `yaml:"load_balancer_ip" env:"LOAD_BALANCER_IP"`
+}
+
+// Patterns returns the patterns cfg describes.
+func (c Config) Patterns() ([]string, error) {
+	return LoadPatterns(c.File, strings.Join(c.Extra, ","), c.LoadBalancerIP)
+}
+
+// Update replaces the allowed origins with those cfg describes.
+func (p *Policy) Update(cfg Config) error {
+	patterns, err := cfg.Patterns()
+	if err != nil {
+		return err
+	}
+	rules, err := parseRules(patterns)
+	if err != nil {
+		return err
+	}
+	p.rules.Store(&rules)
+	return nil
+}
+
+// Must builds the policy cfg describes, exiting the process if a pattern is
+// invalid.
+func Must(service string, cfg Config) *Policy {
+	patterns, err := cfg.Patterns()
+	if err != nil {
+		log.Fatalf("Failed to load %s allowed origins: %v", service, err)
+	}
+	p, err := Parse(patterns)
+	if err != nil {
+		log.Fatalf("Failed to load %s allowed origins: %v", service, err)
+	}
+	log.Printf("%s allowed origins: %s", service, strings.Join(patterns, ", "))
+	return p
+}
@@ -0,0 +1,142 @@
+package origins
+
+import "testing"
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		pattern string
+		origin  string
+		allowed bool
+	}{
+		// Exact origins on the default port
+		{"https://boringpapercompany.com", "https://boringpapercompany.com", true},
+		{"https://boringpapercompany.com", "https://BoringPaperCompany.com.", true},
+		{"https://boringpapercompany.com", "https://boringpapercompany.com:443", true},
+		{"https://boringpapercompany.com", "https://boringpapercompany.com:8443", false},
+		{"https://boringpapercompany.com", "http://boringpapercompany.com", false},
+		{"https://boringpapercompany.com", "https://evil.com", false},
+		{"https://boringpapercompany.com", "https://boringpapercompany.com.evil.com", false},
+		{"https://boringpapercompany.com", "https://evilboringpapercompany.com", false},
+
+		// Subdomain wildcards leave out the apex
+		{"*://*.elb.amazonaws.com", "http://web-1234.us-east-1.elb.amazonaws.com", true},
+		{"*://*.elb.amazonaws.com", "https://a.b.elb.amazonaws.com", true},
+		{"*://*.elb.amazonaws.com", "https://elb.amazonaws.com", false},
+		{"*://*.elb.amazonaws.com", "https://.elb.amazonaws.com", false},
+		{"*://*.elb.amazonaws.com", "https://evil-elb.amazonaws.com", false},
+		{"*://*.elb.amazonaws.com", "https://elb.amazonaws.com.evil.com", false},
+		{"*://*.elb.amazonaws.com", "http://evil.com/.elb.amazonaws.com", false},
+		{"*://*.elb.amazonaws.com", "http://evil.com?.elb.amazonaws.com", false},
+		{"*://*.elb.amazonaws.com", "http://x.elb.amazonaws.com@evil.com", false},
+		{"*://*.elb.amazonaws.com", "ftp://x.elb.amazonaws.com", false},
+		{"*://*.boringpapercompany.com", "https://boringpapercompany.com", false},
+
+		// Ports
+		{"http://localhost:*", "http://localhost:5173", true},
+		{"http://localhost:*", "http://localhost", true},
+		{"http://localhost:*", "https://localhost:5173", false},
+		{"http://localhost:*", "http://localhost.evil.com:5173", false},
+		{"http://localhost:8080", "http://localhost:8080", true},
+		{"http://localhost:8080", "http://localhost:8081", false},
+		{"http://localhost:8080", "http://localhost", false},
+
+		// CIDR ranges
+		{"*://10.0.0.0/8:*", "http://10.1.2.3:3000", true},
+		{"*://10.0.0.0/8:*", "https://11.1.2.3", false},
+		{"*://10.0.0.0/8", "http://10.1.2.3", true},
+		{"*://10.0.0.0/8", "http://10.1.2.3:8080", false},
+		{"*://127.0.0.0/8:*", "http://127.0.0.1:5173", true},
+		{"*://127.0.0.0/8:*", "http://127.0.0.1.evil.com", false},
+		{"*://127.0.0.0/8:*", "http://localhost", false},
+
+		// IPv6, bracketed and bare
+		{"http://[fd00::/8]:8080", "http://[fd12::1]:8080", true},
+		{"http://[fd00::/8]:8080", "http://[fd12::1]", false},
+		{"http://[fd00::/8]:8080", "http://[fe80::1]:8080", false},
+		{"*://[::1]:*", "http://[::1]:5173", true},
+		{"*://[::1]", "http://[0:0::1]", true},
+		{"*://[FD00::1]", "https://[fd00::1]", true},
+		{"*://fd00::1", "https://[fd00::1]", true},
+		{"*://fd00::1", "https://[fd00::1]:8443", false},
+		{"*://fd00::1", "https://[fd00::100]", false},
+		{"*://fd00::/8", "http://[fd34::5]", true},
+		{"*://fd00::/8", "http://[fe80::5]", false},
+		{"*://2001:db8::8080", "http://[2001:db8::8080]", true},
+		{"*://2001:db8::8080", "http://[2001:db8::]:8080", false},
+	}
+	for _, tt := range tests {
+		p, err := Parse([]string{tt.pattern})
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.pattern, err)
+			continue
+		}
+		if got := p.Allowed(tt.origin); got != tt.allowed {
+			t.Errorf("pattern %q, origin %q: Allowed() = %t, want %t", tt.pattern, tt.origin, got, tt.allowed)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, pattern := range []string{
+		"boringpapercompany.com",
+		"ftp://boringpapercompany.com",
+		"https://",
+		"https://*",
+		"https://*.",
+		"https://evil*.com",
+		"https://*.*.amazonaws.com",
+		"https://a.*.amazonaws.com",
+		"https://example.com/path",
+		"https://example.com:0",
+		"https://example.com:65536",
+		"https://example.com:http",
+		"*://10.0.0.0/33",
+		"*://[fd00::1",
+		"*://[fd00::1]8080",
+		"*://[example.com]:8080",
+		"*://fd00::1:*",
+		"*://fd00::zz",
+	} {
+		if _, err := Parse([]string{pattern}); err == nil {
+			t.Errorf("Parse(%q) accepted an invalid pattern", pattern)
+		}
+	}
+}
+
+func TestDefaultPatterns(t *testing.T) {
+	p, err := Parse(DefaultPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for origin, allowed := range map[string]bool{
+		"http://ui-service":                          true,
+		"https://app.boringpapercompany.com":         true,
+		"https://boringpapercompany.com":             true,
+		"http://localhost:5173":                      true,
+		"http://127.0.0.1:8080":                      true,
+		"https://x.cloudapp.azure.com":               true,
+		"https://evil.com":                           false,
+		"https://boringpapercompany.com.evil.com":    false,
+		"https://evil.com.elb.amazonaws.com.evil.io": false,
+		"null": false,
+		"":     false,
+	} {
+		if got := p.Allowed(origin); got != allowed {
+			t.Errorf("Allowed(%q) = %t, want %t", origin, got, allowed)
+		}
+	}
+}
+
+func TestLoadPatternsBracketsIPv6LoadBalancer(t *testing.T) {
+	patterns, err := LoadPatterns("", "", "2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Parse(patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Allowed("http://[2001:db8::1]") || p.Allowed("http://[2001:db8::2]") {
+		t.Error("IPv6 load balancer origin not matched exactly")
+	}
+}
@@ -0,0 +1,290 @@
+// Package rbac decides which authenticated callers may use which routes.
+//
+// A Policy grants permissions to roles and maps routes to the permission
+// they require. Callers get their roles from their credentials (see package
+// auth); requests lacking the route's permission are refused with 403.
+package rbac
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"common/auth"
+)
+
+// Roles known to the default policy.
+const (
+	RoleViewer       = "viewer"
+	RoleUploader     = "uploader"
+	RoleSecurityDemo = "security-demo"
+	RoleIndexer      = "indexer"
+	RoleAdmin        = "admin"
+)
+
+// AnyPermission granted to a role allows every route.
+const AnyPermission = "*"
+
+// Route maps requests to the permission they need. Method "*" matches any
+// method. A Path ending in "/*" matches every path below it; one ending in
+// "*" otherwise matches that path and every path below it, so "/chat*"
+// covers "/chat" and "/chat/stream" but not "/chatfoo".
+type Route struct {
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Permission string `json:"permission"`
+}
+
+func (rt Route) matches(method, path string) bool {
+	if rt.Method != "*" && !strings.EqualFold(rt.Method, method) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(rt.Path, "*"); ok {
+		if strings.HasSuffix(prefix, "/") {
+			return strings.HasPrefix(path, prefix)
+		}
+		return path == prefix || strings.HasPrefix(path, prefix+"/")
+	}
+	return path == rt.Path
+}
+
+// Policy grants permissions to roles and protects routes with them. Routes
+// are matched in order and the first match wins; requests matching no route
+// are refused unless the caller holds AnyPermission.
+type Policy struct {
+	Roles  map[string][]string `json:"roles"`
+	Routes []Route             `json:"routes"`
+	// AnonymousRoles apply when authentication is disabled, DefaultRoles to
+	// authenticated callers whose credentials carry no roles.
+	AnonymousRoles []string `json:"anonymous_roles"`
+	DefaultRoles   []string `json:"default_roles"`
+}
+
+// DefaultPolicy covers the routes of sdk, aichat and containerxdr. The web
+// terminal and the unscanned demo upload need the security-demo role;
+// quarantine, pending review and pulling chat models are for admins. Only
+// the indexer role, meant for the keys sdk and aichat call each other with,
+// may add documents to the chat assistant's knowledge base or read them
+// back from the sdk, so nothing unscanned reaches it.
+//
+// While authentication is off, anonymous callers may only browse and
+// upload scanned files. The terminal and the unscanned upload open a shell
+// and bypass scanning, so an operator who wants them without credentials
+// adds security-demo to anonymous_roles in the policy file; indexing always
+// needs a credential.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Roles: map[string][]string{
+			RoleViewer:       {"documents:read", "scans:read", "tenant:read", "chat:use"},
+			RoleUploader:     {"documents:read", "scans:read", "tenant:read", "chat:use", "documents:upload", "documents:delete"},
+			RoleSecurityDemo: {"demo:vulnerable-upload", "terminal:open"},
+			RoleIndexer:      {"documents:index"},
+			RoleAdmin:        {AnyPermission},
+		},
+		Routes: []Route{
+			// sdk
+			{"POST", "/upload", "documents:upload"},
+			{"*", "/upload-vulnerable", "demo:vulnerable-upload"},
+			{"GET", "/documents", "documents:read"},
+			{"GET", "/documents/*", "documents:read"},
+			{"DELETE", "/documents/*", "documents:delete"},
+			{"*", "/uploads/resumable*", "documents:upload"},
+			{"GET", "/indexing/documents/*", "documents:index"},
+			{"GET", "/tenant/usage", "tenant:read"},
+			{"GET", "/scans", "scans:read"},
+			{"GET", "/scans/*", "scans:read"},
+			{"*", "/quarantine*", "quarantine:manage"},
+			{"*", "/pending*", "quarantine:manage"},
+			// aichat
+			{"*", "/chat*", "chat:use"},
+			{"*", "/conversations*", "chat:use"},
+			{"GET", "/personas", "chat:use"},
+			{"GET", "/models", "chat:use"},
+			{"*", "/models*", "models:manage"},
+			{"GET", "/knowledge*", "documents:read"},
+			{"*", "/knowledge*", "documents:index"},
+			// containerxdr
+			{"*", "/terminal", "terminal:open"},
+		},
+		AnonymousRoles: []string{RoleViewer, RoleUploader},
+		DefaultRoles:   []string{RoleViewer},
+	}
+}
+
+// LoadPolicy reads a policy from a JSON file with the fields of Policy.
+// Fields the file sets replace the DefaultPolicy ones whole, so a file
+// listing roles defines every role there is; fields it leaves out keep
+// their DefaultPolicy values.
+func LoadPolicy(path string) (*Policy, error) {
+	defaults := DefaultPolicy()
+	if path == "" {
+		return defaults, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	// Decoding leaves absent (or null) fields nil; empty ones are kept
+	if p.Roles == nil {
+		p.Roles = defaults.Roles
+	}
+	if p.Routes == nil {
+		p.Routes = defaults.Routes
+	}
+	if p.AnonymousRoles == nil {
+		p.AnonymousRoles = defaults.AnonymousRoles
+	}
+	if p.DefaultRoles == nil {
+		p.DefaultRoles = defaults.DefaultRoles
+	}
+	for _, rt := range p.Routes {
+		if rt.Method == "" || !strings.HasPrefix(rt.Path, "/") || rt.Permission == "" {
+			return nil, fmt.Errorf("%s: route %+v needs method, path and permission", path, rt)
+		}
+	}
+	return p, nil
+}
+
+// Config selects the policy file and overrides its role fallbacks. Nil
+// role lists keep the policy's own.
+type Config struct {
+	PolicyFile     string   `yaml:"policy_file" env:"RBAC_POLICY_FILE"`
+	AnonymousRoles []string `yaml:"anonymous_roles" env:"RBAC_ANONYMOUS_ROLES"`
+	DefaultRoles   []string `yaml:"default_roles" env:"RBAC_DEFAULT_ROLES"`
+}
+
+// Load builds the policy described by cfg.
+func Load(cfg Config) (*Policy, error) {
+	p, err := LoadPolicy(cfg.PolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AnonymousRoles != nil {
+		p.AnonymousRoles = cfg.AnonymousRoles
+	}
+	if cfg.DefaultRoles != nil {
+		p.DefaultRoles = cfg.DefaultRoles
+	}
+	return p, nil
+}
+
+// Enforcer applies the current policy to requests. The policy can be
+// replaced while requests are served.
+type Enforcer struct {
+	policy atomic.Pointer[Policy]
+}
+
+// Must builds an Enforcer, exiting the process if the policy is invalid.
+func Must(service string, cfg Config) *Enforcer {
+	e := &Enforcer{}
+	if err := e.Update(cfg); err != nil {
+		log.Fatalf("Failed to load %s access policy: %v", service, err)
+	}
+	p := e.Policy()
+	log.Printf("%s access policy: %d roles, %d routes, anonymous roles: %v", service, len(p.Roles), len(p.Routes), p.AnonymousRoles)
+	return e
+}
+
+// Update loads the policy described by cfg and starts enforcing it.
+func (e *Enforcer) Update(cfg Config) error {
+	p, err := Load(cfg)
+	if err != nil {
+		return err
+	}
+	e.policy.Store(p)
+	return nil
+}
+
+// UpdateWithAuth reloads authentication and the access policy together.
+// The policy is loaded first, and neither changes unless both are valid, so
+// new credentials are never checked against an old policy or the reverse.
+func (e *Enforcer) UpdateWithAuth(authn *auth.Authenticator, authCfg auth.Config, cfg Config) error {
+	p, err := Load(cfg)
+	if err != nil {
+		return fmt.Errorf("access: %w", err)
+	}
+	if err := authn.Update(authCfg); err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+	e.policy.Store(p)
+	return nil
+}
+
+// Policy returns the policy in force.
+func (e *Enforcer) Policy() *Policy { return e.policy.Load() }
+
+// RolesOf returns the roles that apply to a principal.
+func (p *Policy) RolesOf(pr *auth.Principal) []string {
+	switch {
+	case pr == nil || pr.Anonymous():
+		return p.AnonymousRoles
+	case len(pr.Roles) == 0:
+		return p.DefaultRoles
+	}
+	return pr.Roles
+}
+
+// Allowed reports whether the principal holds permission.
+func (p *Policy) Allowed(pr *auth.Principal, permission string) bool {
+	for _, role := range p.RolesOf(pr) {
+		for _, granted := range p.Roles[role] {
+			if granted == permission || granted == AnyPermission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Permission returns the permission a request needs, if any route maps it.
+func (p *Policy) Permission(method, path string) (string, bool) {
+	for _, rt := range p.Routes {
+		if rt.matches(method, path) {
+			return rt.Permission, true
+		}
+	}
+	return "", false
+}
+
+// Middleware refuses requests whose principal lacks the permission of the
+// matched route. It must run after auth's middleware; CORS preflight
+// requests pass through.
+func (e *Enforcer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p := e.Policy()
+		pr, _ := auth.FromContext(r.Context())
+		perm, ok := p.Permission(r.Method, r.URL.Path)
+		if !ok && !p.Allowed(pr, AnyPermission) {
+			log.Printf("Access denied: no permission is mapped to %s %s", r.Method, r.URL.Path)
+			http.Error(w, fmt.Sprintf("Forbidden: no permission is mapped to %s %s", r.Method, r.URL.Path), http.StatusForbidden)
+			return
+		}
+		if ok && !p.Allowed(pr, perm) {
+			subject := auth.MethodAnonymous
+			if pr != nil {
+				subject = pr.Subject
+			}
+			log.Printf("Access denied: %s (roles %v) lacks %s for %s %s", subject, p.RolesOf(pr), perm, r.Method, r.URL.Path)
+			http.Error(w, fmt.Sprintf("Forbidden: missing permission %q", perm), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wrap is Middleware for a single handler function.
+func (e *Enforcer) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return e.Middleware(next).ServeHTTP
+}
@@ -0,0 +1,136 @@
+package rbac
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"common/auth"
+)
+
+func writePolicy(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPolicyReplacesFields(t *testing.T) {
+	p, err := LoadPolicy(writePolicy(t, `{
+		"roles": {"reader": ["documents:read"]},
+		"anonymous_roles": []
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]string{"reader": {"documents:read"}}; !reflect.DeepEqual(p.Roles, want) {
+		t.Errorf("roles were merged with the defaults: %v", p.Roles)
+	}
+	if len(p.AnonymousRoles) != 0 {
+		t.Errorf("empty anonymous_roles replaced by %v", p.AnonymousRoles)
+	}
+	defaults := DefaultPolicy()
+	if !reflect.DeepEqual(p.Routes, defaults.Routes) || !reflect.DeepEqual(p.DefaultRoles, defaults.DefaultRoles) {
+		t.Errorf("absent fields did not keep their defaults: %+v", p)
+	}
+	if p.Allowed(&auth.Principal{Subject: "bob", Roles: []string{RoleAdmin}, Method: auth.MethodAPIKey}, "documents:read") {
+		t.Error("admin role from the default policy survived a file defining its own roles")
+	}
+}
+
+func TestLoadPolicyRejectsIncompleteRoutes(t *testing.T) {
+	if _, err := LoadPolicy(writePolicy(t, `{"routes": [{"method": "GET", "path": "/documents"}]}`)); err == nil {
+		t.Fatal("route without a permission accepted")
+	}
+}
+
+func TestDefaultPolicyWithoutAuthentication(t *testing.T) {
+	p := DefaultPolicy()
+	anonymous := &auth.Principal{Subject: auth.MethodAnonymous, Method: auth.MethodAnonymous}
+	for _, req := range []struct{ method, path string }{
+		{"POST", "/upload"},
+		{"GET", "/knowledge/documents"},
+		{"GET", "/documents/abc"},
+	} {
+		perm, ok := p.Permission(req.method, req.path)
+		if !ok || !p.Allowed(anonymous, perm) {
+			t.Errorf("%s %s refused while authentication is off", req.method, req.path)
+		}
+	}
+	for _, req := range []struct{ method, path string }{
+		{"POST", "/upload-vulnerable"},
+		{"GET", "/terminal"},
+		{"GET", "/quarantine"},
+		{"GET", "/pending/abc"},
+		{"GET", "/audit/export"},
+		{"POST", "/knowledge/documents"},
+		{"DELETE", "/knowledge/documents/abc"},
+		{"GET", "/indexing/documents/abc/content"},
+	} {
+		perm, ok := p.Permission(req.method, req.path)
+		if ok && p.Allowed(anonymous, perm) || !ok && p.Allowed(anonymous, AnyPermission) {
+			t.Errorf("%s %s allowed while authentication is off", req.method, req.path)
+		}
+	}
+}
+
+func TestRouteMatchesPathSegments(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/chat*", "/chat", true},
+		{"/chat*", "/chat/stream", true},
+		{"/chat*", "/chatfoo", false},
+		{"/chat*", "/chat-admin/x", false},
+		{"/documents/*", "/documents/abc", true},
+		{"/documents/*", "/documents/abc/content", true},
+		{"/documents/*", "/documents", false},
+		{"/documents/*", "/documentsx", false},
+		{"/uploads/resumable*", "/uploads/resumable", true},
+		{"/uploads/resumable*", "/uploads/resumable/abc", true},
+		{"/uploads/resumable*", "/uploads/resumablex", false},
+		{"/terminal", "/terminal", true},
+		{"/terminal", "/terminal/x", false},
+	} {
+		rt := Route{Method: "*", Path: tc.pattern, Permission: "p"}
+		if got := rt.matches("GET", tc.path); got != tc.want {
+			t.Errorf("%s matches %s = %v, want %v", tc.pattern, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateWithAuthChangesBothOrNeither(t *testing.T) {
+	authCfg := auth.DefaultConfig()
+	authn, err := auth.New(authCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Enforcer{}
+	if err := e.Update(Config{}); err != nil {
+		t.Fatal(err)
+	}
+	before := e.Policy()
+
+	keyed := authCfg
+	keyed.APIKeyList = "ops:secret::admin"
+	if err := e.UpdateWithAuth(authn, keyed, Config{PolicyFile: writePolicy(t, `{"routes": [{"path": "/x"}]}`)}); err == nil {
+		t.Fatal("invalid policy accepted")
+	}
+	if authn.Enabled() {
+		t.Error("credentials changed although the policy was refused")
+	}
+	if e.Policy() != before {
+		t.Error("policy changed although it was refused")
+	}
+
+	if err := e.UpdateWithAuth(authn, keyed, Config{AnonymousRoles: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+	if !authn.Enabled() || len(e.Policy().AnonymousRoles) != 0 {
+		t.Error("credentials and policy not both applied")
+	}
+}
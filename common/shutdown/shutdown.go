@@ -0,0 +1,136 @@
+// Package shutdown drains a service's HTTP server on SIGTERM or SIGINT.
+//
+// Draining starts by reporting not-ready (see Server.Draining) while the
+// server keeps serving for Config.Delay, so load balancers stop routing new
+// requests to it. The server then stops accepting connections and waits for
+// in-flight requests, and finally runs the service's hooks, such as waiting
+// for queued work or closing WebSocket sessions. Everything shares the
+// Config.Timeout deadline; connections still open when it passes are closed.
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Config times the drain.
+type Config struct {
+	// Delay keeps serving after readiness flips, until load balancers have
+	// noticed.
+	Delay time.Duration `yaml:"delay" env:"SHUTDOWN_DELAY_SECONDS" unit:"s"`
+	// Timeout bounds the whole drain; keep it below the orchestrator's
+	// grace period (Kubernetes' terminationGracePeriodSeconds).
+	Timeout time.Duration `yaml:"timeout" env:"SHUTDOWN_TIMEOUT_SECONDS" unit:"s"`
+}
+
+// DefaultConfig fits Kubernetes' default grace period of 30 seconds.
+func DefaultConfig() Config {
+	return Config{Delay: 5 * time.Second, Timeout: 25 * time.Second}
+}
+
+// Validate checks that the drain can finish.
+func (c Config) Validate() error {
+	switch {
+	case c.Delay < 0:
+		return errors.New("shutdown: delay must not be negative")
+	case c.Timeout <= c.Delay:
+		return errors.New("shutdown: timeout must be longer than delay")
+	}
+	return nil
+}
+
+type hook struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// Server runs an http.Server until the process is asked to stop.
+type Server struct {
+	service  string
+	srv      *http.Server
+	cfg      Config
+	draining atomic.Bool
+	done     chan struct{}
+
+	mu    sync.Mutex
+	hooks []hook
+}
+
+// New prepares srv for graceful shutdown. service names it in the log.
+func New(service string, srv *http.Server, cfg Config) *Server {
+	return &Server{service: service, srv: srv, cfg: cfg, done: make(chan struct{})}
+}
+
+// Draining reports whether shutdown has begun; readiness checks should fail
+// from then on.
+func (s *Server) Draining() bool { return s.draining.Load() }
+
+// Done is closed when shutdown begins, for long-lived handlers that should
+// wind down early.
+func (s *Server) Done() <-chan struct{} { return s.done }
+
+// OnShutdown registers fn to run once the server has stopped serving
+// requests. Hooks run in registration order and share the deadline.
+func (s *Server) OnShutdown(name string, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, hook{name, fn})
+}
+
+// ListenAndServe serves until SIGTERM or SIGINT, then drains. It returns
+// nil after a complete drain, or the error that stopped the server.
+func (s *Server) ListenAndServe() error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sig)
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.srv.ListenAndServe() }()
+	select {
+	case err := <-errc:
+		return err
+	case got := <-sig:
+		log.Printf("%s received, draining %s (delay %s, timeout %s)", got, s.service, s.cfg.Delay, s.cfg.Timeout)
+	}
+	return s.drain()
+}
+
+func (s *Server) drain() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+	defer cancel()
+	s.draining.Store(true)
+	close(s.done)
+
+	select {
+	case <-time.After(s.cfg.Delay):
+	case <-ctx.Done():
+	}
+	var errs []error
+	if err := s.srv.Shutdown(ctx); err != nil {
+		log.Printf("%s: requests still in flight at the deadline, closing their connections", s.service)
+		_ = s.srv.Close()
+		errs = append(errs, err)
+	}
+	s.mu.Lock()
+	hooks := s.hooks
+	s.mu.Unlock()
+	for _, h := range hooks {
+		if err := h.fn(ctx); err != nil {
+			log.Printf("%s shutdown: %s: %v", s.service, h.name, err)
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	log.Printf("%s stopped cleanly", s.service)
+	return nil
+}
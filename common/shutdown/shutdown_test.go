@@ -0,0 +1,171 @@
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serve starts srv on a local port and returns its URL.
+func serve(t *testing.T, srv *http.Server) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(lis)
+	t.Cleanup(func() { srv.Close() })
+	return "http://" + lis.Addr().String()
+}
+
+func TestDrainOrder(t *testing.T) {
+	var mu sync.Mutex
+	var steps []string
+	step := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		steps = append(steps, s)
+	}
+	slowStarted := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(slowStarted)
+		time.Sleep(300 * time.Millisecond)
+		step("slow request finished")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	srv := &http.Server{Handler: mux}
+	url := serve(t, srv)
+	// No keep-alives, so each request needs a new connection
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: time.Second}
+
+	s := New("test", srv, Config{Delay: 100 * time.Millisecond, Timeout: 5 * time.Second})
+	var deadline time.Time
+	s.OnShutdown("first", func(ctx context.Context) error {
+		deadline, _ = ctx.Deadline()
+		if _, err := client.Get(url); err == nil {
+			t.Error("request served after the server stopped")
+		}
+		step("first hook")
+		return nil
+	})
+	s.OnShutdown("second", func(ctx context.Context) error {
+		if d, _ := ctx.Deadline(); !d.Equal(deadline) {
+			t.Errorf("hooks got deadlines %s and %s", deadline, d)
+		}
+		step("second hook")
+		return nil
+	})
+
+	slow := make(chan error, 1)
+	go func() {
+		res, err := client.Get(url + "/slow")
+		if err == nil {
+			res.Body.Close()
+		}
+		slow <- err
+	}()
+	<-slowStarted
+	if s.Draining() {
+		t.Fatal("draining before shutdown")
+	}
+	start := time.Now()
+	drained := make(chan error, 1)
+	go func() { drained <- s.drain() }()
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done not closed when draining began")
+	}
+	began := time.Now()
+	if !s.Draining() {
+		t.Error("not draining after Done closed")
+	}
+	// Requests are still served while load balancers catch up
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("request during the delay: %v", err)
+	}
+	res.Body.Close()
+
+	if err := <-drained; err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	if err := <-slow; err != nil {
+		t.Errorf("in-flight request cut off: %v", err)
+	}
+	want := []string{"slow request finished", "first hook", "second hook"}
+	if len(steps) != len(want) {
+		t.Fatalf("steps %q, want %q", steps, want)
+	}
+	for i := range want {
+		if steps[i] != want[i] {
+			t.Fatalf("steps %q, want %q", steps, want)
+		}
+	}
+	// The hooks get what is left of the timeout, not a fresh one
+	if deadline.Before(start.Add(5*time.Second)) || deadline.After(began.Add(5*time.Second)) {
+		t.Errorf("hooks' deadline %s after draining began, want the 5s timeout", deadline.Sub(start))
+	}
+}
+
+func TestDrainDeadline(t *testing.T) {
+	mux := http.NewServeMux()
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	srv := &http.Server{Handler: mux}
+	url := serve(t, srv)
+	go http.Get(url)
+	<-started
+
+	s := New("test", srv, Config{Timeout: 200 * time.Millisecond})
+	var ran []string
+	s.OnShutdown("slow", func(ctx context.Context) error {
+		ran = append(ran, "slow")
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	s.OnShutdown("after", func(ctx context.Context) error {
+		// Later hooks still run, with the expired deadline
+		ran = append(ran, "after")
+		return ctx.Err()
+	})
+
+	start := time.Now()
+	err := s.drain()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain took %s with a 200ms timeout", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the deadline error", err)
+	}
+	if len(ran) != 2 {
+		t.Errorf("hooks run: %q", ran)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		cfg Config
+		ok  bool
+	}{
+		{DefaultConfig(), true},
+		{Config{Timeout: time.Second}, true},
+		{Config{Delay: -time.Second, Timeout: time.Second}, false},
+		{Config{Delay: time.Second, Timeout: time.Second}, false},
+	} {
+		if err := tc.cfg.Validate(); (err == nil) != tc.ok {
+			t.Errorf("%+v: got %v", tc.cfg, err)
+		}
+	}
+}
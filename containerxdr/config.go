@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+
+	"common/auth"
+	"common/config"
+	"common/origins"
+	"common/rbac"
+	"common/shutdown"
+)
+
+// Config is the terminal service's configuration; see config.Load for how
+// it is read. The port and shutdown timing need a restart; the rest is
+// reloaded on SIGHUP.
+type Config struct {
+	Port     int             `yaml:"port" env:"PORT"`
+	Origins  origins.Config  `yaml:"origins"`
+	Auth     auth.Config     `yaml:"auth"`
+	Access   rbac.Config     `yaml:"access"`
+	Shutdown shutdown.Config `yaml:"shutdown"`
+}
+
+func defaultConfig() *Config {
+	return &Config{Port: 8081, Auth: auth.DefaultConfig(), Shutdown: shutdown.DefaultConfig()}
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs config.Errors
+	if c.Port < 1 || c.Port > 65535 {
+		errs.Addf("port must be between 1 and 65535, got %d", c.Port)
+	}
+	if err := c.Auth.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Shutdown.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs.Err()
+}
+
+// reloadConfig re-reads the configuration and applies the origin, auth and
+// access settings. An invalid file leaves the running settings untouched.
+func reloadConfig(running *Config, file string, authn *auth.Authenticator, access *rbac.Enforcer) {
+	cfg := defaultConfig()
+	if err := config.Load(cfg, file); err != nil {
+		log.Printf("Configuration reload failed, keeping current settings: %v", err)
+		return
+	}
+	if cfg.Port != running.Port || cfg.Shutdown != running.Shutdown {
+		log.Printf("Port or shutdown settings changed; restart to apply")
+	}
+	if err := allowedOrigins.Update(cfg.Origins); err != nil {
+		log.Printf("Cannot reload origins settings: %v", err)
+	} else {
+		running.Origins = cfg.Origins
+	}
+	// Credentials and the policy they are checked against change together
+	if err := access.UpdateWithAuth(authn, cfg.Auth, cfg.Access); err != nil {
+		log.Printf("Cannot reload auth and access settings: %v", err)
+	} else {
+		running.Auth, running.Access = cfg.Auth, cfg.Access
+	}
+	log.Printf("Configuration reloaded")
+}
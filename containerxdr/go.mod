@@ -5,8 +5,14 @@ go 1.23.0
 toolchain go1.23.11
 
 require (
+	common v0.0.0
 	github.com/creack/pty v1.1.24
 	github.com/gorilla/websocket v1.5.1
 )
 
-require golang.org/x/net v0.17.0 // indirect
+require (
+	golang.org/x/net v0.17.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace common => ../common
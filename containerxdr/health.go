@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+
+	"common/health"
+
+	"github.com/creack/pty"
+)
+
+// healthChecks builds the checks behind /livez and /readyz. A terminal is
+// only useful if the pod can still allocate a PTY and start the shell.
+func healthChecks() *health.Checker {
+	h := health.New("containerxdr")
+	h.Ready(health.Draining(func() bool { return server.Draining() }))
+	h.Ready(health.Check{Name: "pty", Critical: true, Run: checkPTY})
+	return h
+}
+
+// checkPTY starts the terminal's shell in a PTY and lets it exit at once.
+func checkPTY(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, "bash", "-c", "exit 0")
+	f, err := pty.Start(cmd)
+	if err != nil {
+		return fmt.Errorf("cannot start shell in a pty: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("shell failed: %w", err)
+	}
+	return nil
+}
@@ -2,124 +2,51 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"os/exec"
-	"strings"
-	"time"
 
+	"common/auth"
+	"common/config"
+	"common/origins"
+	"common/rbac"
+	"common/shutdown"
 	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
 )
 
+// allowedOrigins decides which browser origins may open a terminal.
+var allowedOrigins *origins.Policy
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		origin := r.Header.Get("Origin")
-		
+
 		// Always allow empty origin (direct connections)
-		if origin == "" {
+		if origin == "" || allowedOrigins.Allowed(origin) {
 			return true
 		}
-		
-		// Define allowed origins (matching aichat's secure pattern)
-		allowedOrigins := []string{
-			// Internal service communication
-			"http://ui-service",
-			"https://ui-service", 
-			"http://ollama-service",
-			"https://ollama-service",
-			// AWS ELB patterns
-			"http://*.elb.amazonaws.com",
-			"https://*.elb.amazonaws.com",
-			// Azure patterns
-			"http://*.cloudapp.azure.com",
-			"https://*.cloudapp.azure.com",
-			// GCP patterns  
-			"http://*.run.app",
-			"https://*.run.app",
-					// Development - allow localhost with any port
-			"http://localhost",
-			"https://localhost",
-			"http://localhost:*",
-			"https://localhost:*",
-
-			"http://boringpapercompany.com",
-			"https://boringpapercompany.com",
-			"https://*.boringpapercompany.com",
-			"http://*.boringpapercompany.com",
-		}
-		
-		// Check exact matches first
-		for _, allowed := range allowedOrigins {
-			if allowed == origin {
-				return true
-			}
-		}
-		
-		// Check wildcard patterns (for cloud load balancers and localhost)
-		for _, allowed := range allowedOrigins {
-			if strings.Contains(allowed, "*") {
-				// Handle localhost:* pattern
-				if strings.Contains(allowed, "localhost:*") {
-					if strings.HasPrefix(origin, "http://localhost:") || strings.HasPrefix(origin, "https://localhost:") {
-						return true
-					}
-					continue
-				}
-				
-				// Extract the domain part after the wildcard
-				// "http://*.cloudapp.azure.com" → ".cloudapp.azure.com"
-				parts := strings.Split(allowed, "*")
-				if len(parts) == 2 && strings.Contains(origin, parts[1]) {
-					// Also check the protocol matches
-					if strings.HasPrefix(origin, parts[0]) {
-						return true
-					}
-				}
-			}
-		}
-		
-		// Check for configured allowed origins from environment
-		if envOrigins := os.Getenv("ALLOWED_ORIGINS"); envOrigins != "" {
-			for _, allowed := range strings.Split(envOrigins, ",") {
-				if strings.TrimSpace(allowed) == origin {
-					return true
-				}
-			}
-		}
-		
-		// Allow development IPs and localhost with common ports
-		if strings.Contains(origin, "127.0.0.1") ||
-		   strings.Contains(origin, "192.168.") ||
-		   strings.Contains(origin, "10.0.") {
-			return true
-		}
-		
-		// Allow localhost with any port for development
-		if strings.HasPrefix(origin, "http://localhost:") || strings.HasPrefix(origin, "https://localhost:") {
-			return true
-		}
-		
-		// Allow specific load balancer IP from environment (for GCP/direct IP access)
-		if loadBalancerIP := os.Getenv("LOAD_BALANCER_IP"); loadBalancerIP != "" {
-			if origin == "http://"+loadBalancerIP || origin == "https://"+loadBalancerIP {
-				return true
-			}
-		}
-		
 		log.Printf("WebSocket origin rejected: %s", origin)
 		return false
 	},
 }
 
 func terminalWS(w http.ResponseWriter, r *http.Request) {
+	// A new shell would be hung up within seconds
+	if server.Draining() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("upgrade:", err)
 		return
 	}
 	defer conn.Close()
+	if p, ok := auth.FromContext(r.Context()); ok {
+		log.Printf("Terminal session opened by %s (%s) from %s", p.Subject, p.Method, r.RemoteAddr)
+	}
 
 	// 1. Launch a login shell inside a PTY
 	cmd := exec.Command("bash", "-l") // or "sh" on alpine
@@ -129,6 +56,13 @@ func terminalWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer func() { _ = ptyFile.Close() }()
+	ts := &terminalSession{conn: conn, cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		_ = cmd.Wait()
+		close(ts.exited)
+	}()
+	sessions.add(ts)
+	defer sessions.remove(ts)
 
 	// 2. Copy PTY → WS
 	go func() {
@@ -153,13 +87,48 @@ func terminalWS(w http.ResponseWriter, r *http.Request) {
 		_, _ = ptyFile.Write(data)
 	}
 
-	// 4. Give the shell a moment then clean up
-	time.Sleep(200 * time.Millisecond)
-	_ = cmd.Process.Kill()
+	// 4. Hang up the shell and reap it
+	ts.stop()
 }
 
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if server.Draining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, `{"status":"draining","service":"containerxdr"}`)
+		return
+	}
+	fmt.Fprintln(w, `{"status":"healthy","service":"containerxdr"}`)
+}
+
+// server drains the service on SIGTERM; health checks fail once it starts.
+var server *shutdown.Server
+
 func main() {
-	http.HandleFunc("/terminal", terminalWS)
-	log.Println("WS PTY ready on :8081/terminal")
-	log.Fatal(http.ListenAndServe(":8081", nil))
-}
\ No newline at end of file
+	cfg := defaultConfig()
+	opts := config.MustLoad("containerxdr", cfg)
+
+	// Authenticate and authorize before the upgrade. Browsers cannot set
+	// headers on WebSocket requests, so token-only clients need
+	// AUTH_QUERY_TOKEN=true to pass ?access_token=.
+	// The shell needs the terminal:open permission (security-demo role).
+	allowedOrigins = origins.Must("containerxdr", cfg.Origins)
+	authn := auth.Must("containerxdr", cfg.Auth)
+	access := rbac.Must("containerxdr", cfg.Access)
+	config.OnReload("containerxdr", func() { reloadConfig(cfg, opts.File, authn, access) })
+
+	http.HandleFunc("/health", healthHandler)
+	checks := healthChecks()
+	http.HandleFunc("/livez", checks.LiveHandler)
+	http.HandleFunc("/readyz", checks.ReadyHandler)
+	http.HandleFunc("/terminal", authn.Wrap(access.Wrap(terminalWS)))
+
+	// WebSocket connections are hijacked, so the HTTP server does not wait
+	// for them; the sessions are closed once it has stopped
+	server = shutdown.New("containerxdr", &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port)}, cfg.Shutdown)
+	server.OnShutdown("terminal sessions", sessions.closeAll)
+	log.Printf("WS PTY ready on :%d/terminal", cfg.Port)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
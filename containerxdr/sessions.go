@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// hangupGrace is how long a shell gets to exit after SIGHUP before its
+// process group is killed.
+const hangupGrace = 2 * time.Second
+
+// terminalSession is an open terminal: a WebSocket and the shell behind it.
+type terminalSession struct {
+	conn *websocket.Conn
+	cmd  *exec.Cmd
+	// exited is closed once the shell has been reaped.
+	exited chan struct{}
+}
+
+// sessionSet tracks open terminals so shutdown can close them.
+type sessionSet struct {
+	mu   sync.Mutex
+	open map[*terminalSession]struct{}
+	wg   sync.WaitGroup
+}
+
+var sessions = &sessionSet{open: map[*terminalSession]struct{}{}}
+
+func (s *sessionSet) add(ts *terminalSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.open[ts] = struct{}{}
+	s.wg.Add(1)
+}
+
+func (s *sessionSet) remove(ts *terminalSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.open[ts]; ok {
+		delete(s.open, ts)
+		s.wg.Done()
+	}
+}
+
+// closeAll tells every client the server is going away, hangs up their
+// shells and waits for the sessions to end, or for ctx to expire.
+func (s *sessionSet) closeAll(ctx context.Context) error {
+	s.mu.Lock()
+	open := make([]*terminalSession, 0, len(s.open))
+	for ts := range s.open {
+		open = append(open, ts)
+	}
+	s.mu.Unlock()
+	log.Printf("Closing %d terminal sessions", len(open))
+
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for _, ts := range open {
+		_ = ts.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		ts.hangup()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for ts := range s.open {
+			ts.kill()
+			_ = ts.conn.Close()
+		}
+		return fmt.Errorf("%d terminal sessions still open: %w", len(s.open), ctx.Err())
+	}
+}
+
+// hangup sends SIGHUP to the shell, as closing a real terminal would; bash
+// passes it on to its jobs.
+func (ts *terminalSession) hangup() {
+	if ts.cmd.Process != nil {
+		_ = ts.cmd.Process.Signal(syscall.SIGHUP)
+	}
+}
+
+// kill ends the shell's whole process group. pty.Start makes the shell a
+// session leader, so its process group ID is its PID.
+func (ts *terminalSession) kill() {
+	if ts.cmd.Process != nil {
+		_ = syscall.Kill(-ts.cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// stop hangs up the shell, kills it if it has not exited within hangupGrace
+// and waits until it has been reaped.
+func (ts *terminalSession) stop() {
+	ts.hangup()
+	select {
+	case <-ts.exited:
+	case <-time.After(hangupGrace):
+		ts.kill()
+		<-ts.exited
+	}
+}
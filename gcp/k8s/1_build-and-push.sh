@@ -38,8 +38,8 @@ for service in "${services[@]}"; do
             --build-arg VITE_XDR_WS_URL="/api/xdr/terminal" \
             -t $IMAGE_URL ../../$service
     else
-        # Build other services normally
-        docker build --platform linux/amd64 -t $IMAGE_URL ../../$service
+        # Go services build from the repo root to include the shared common module
+        docker build --platform linux/amd64 -t $IMAGE_URL -f ../../$service/Dockerfile ../..
     fi
     
     echo "📤 Pushing $service..."
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"path"
+	"strings"
+)
+
+// archiveLimits guard server-side archive expansion against zip bombs.
+type archiveLimits struct {
+	MaxEntries int   `yaml:"max_entries" env:"ARCHIVE_MAX_ENTRIES"`   // members per archive
+	MaxRatio   int64 `yaml:"max_ratio" env:"ARCHIVE_MAX_RATIO"`       // uncompressed:compressed size ratio
+	MaxTotal   int64 `yaml:"max_total" env:"ARCHIVE_MAX_TOTAL_BYTES"` // total uncompressed bytes per archive
+}
+
+// expandLimits are the limits applied to ?expand=true uploads; see Config.
+var expandLimits archiveLimits
+
+var errArchiveLimit = errors.New("archive limit exceeded")
+
+// archiveKind returns "zip" or "tar.gz" for supported archive names.
+func archiveKind(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	}
+	return ""
+}
+
+// expandArchive extracts the regular-file members of an uploaded archive into
+// their own uploadInfos. The caller must Close every returned member's
+// Content, also when an error is returned.
+func expandArchive(info *uploadInfo, limits archiveLimits) ([]*uploadInfo, error) {
+	switch archiveKind(info.Name) {
+	case "zip":
+		return expandZip(info, limits)
+	case "tar.gz":
+		return expandTarGz(info, limits)
+	}
+	return nil, fmt.Errorf("%s is not a supported archive", info.Name)
+}
+
+func expandZip(info *uploadInfo, limits archiveLimits) ([]*uploadInfo, error) {
+	zr, err := zip.NewReader(info.Content.Reader(), info.Size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zip: %w", err)
+	}
+	if len(zr.File) > limits.MaxEntries {
+		return nil, fmt.Errorf("%w: %d entries (max %d)", errArchiveLimit, len(zr.File), limits.MaxEntries)
+	}
+
+	var members []*uploadInfo
+	var total int64
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !f.Mode().IsRegular() {
+			continue
+		}
+		if f.CompressedSize64 > 0 && int64(f.UncompressedSize64/f.CompressedSize64) > limits.MaxRatio {
+			return members, fmt.Errorf("%w: %s compression ratio exceeds %d", errArchiveLimit, f.Name, limits.MaxRatio)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return members, fmt.Errorf("open %s: %w", f.Name, err)
+		}
+		member, err := readMember(rc, f.Name, info, limits.MaxTotal-total)
+		rc.Close()
+		if err != nil {
+			return members, err
+		}
+		total += member.Size
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func expandTarGz(info *uploadInfo, limits archiveLimits) ([]*uploadInfo, error) {
+	gz, err := gzip.NewReader(info.Content.Reader())
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip: %w", err)
+	}
+	defer gz.Close()
+
+	// Headers can't be trusted for tar.gz, so the ratio is enforced on the
+	// bytes actually decompressed.
+	budget := limits.MaxTotal
+	if ratioBudget := info.Size * limits.MaxRatio; ratioBudget < budget {
+		budget = ratioBudget
+	}
+
+	var members []*uploadInfo
+	var total int64
+	entries := 0
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return members, fmt.Errorf("invalid tar: %w", err)
+		}
+		entries++
+		if entries > limits.MaxEntries {
+			return members, fmt.Errorf("%w: more than %d entries", errArchiveLimit, limits.MaxEntries)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		member, err := readMember(tr, hdr.Name, info, budget-total)
+		if err != nil {
+			return members, err
+		}
+		total += member.Size
+		members = append(members, member)
+	}
+}
+
+// readMember spools one archive member, failing if it exceeds budget bytes.
+func readMember(r io.Reader, name string, archive *uploadInfo, budget int64) (*uploadInfo, error) {
+	if budget < 0 {
+		budget = 0
+	}
+	content, err := newSpool(io.LimitReader(r, budget+1), uploadMemoryLimit, spoolDir)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	if content.Size() > budget {
+		content.Close()
+		return nil, fmt.Errorf("%w: uncompressed size exceeds budget at %s", errArchiveLimit, name)
+	}
+	memberPath := path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))[1:]
+	contentType := mime.TypeByExtension(path.Ext(memberPath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &uploadInfo{
+		Content:     content,
+		Name:        path.Base(memberPath),
+		ContentType: contentType,
+		Size:        content.Size(),
+		Uploader:    archive.Uploader,
+		Tenant:      archive.Tenant,
+		Archive:     archive.Name,
+		MemberPath:  memberPath,
+		Endpoint:    archive.Endpoint,
+		Tags:        archive.Tags,
+	}, nil
+}
+
+// processArchive expands an archive and runs every member through the
+// protected pipeline. Limit violations reject the whole archive.
+func processArchive(info *uploadInfo) []*ScanResult {
+	members, err := expandArchive(info, expandLimits)
+	defer func() {
+		for _, m := range members {
+			m.Content.Close()
+		}
+	}()
+	if err != nil {
+		log.Printf("Archive %s rejected: %v", info.Name, err)
+		result := newScanResult(info.Name, info.Size)
+		result.SHA256 = info.Content.SHA256()
+		result.Code, result.Verdict, result.Reason, result.Error = CodeArchiveRejected, VerdictError, ReasonArchiveRejected, err.Error()
+		return []*ScanResult{result}
+	}
+
+	log.Printf("Expanded archive %s into %d members", info.Name, len(members))
+	results := make([]*ScanResult, 0, len(members))
+	for _, m := range members {
+		results = append(results, processOrFail(m))
+	}
+	return results
+}
+
+// processOrFail is processUpload with pipeline errors folded into the result,
+// so one bad file doesn't fail a whole batch.
+func processOrFail(info *uploadInfo) *ScanResult {
+	result, err := processUpload(info)
+	if err != nil {
+		log.Printf("Upload processing error for %s: %v", info.Name, err)
+		result = newScanResult(info.Name, info.Size).failed(ReasonScanFailed, err)
+	}
+	result.Archive, result.MemberPath = info.Archive, info.MemberPath
+	return result
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+// testArchiveLimits are small enough to reach with archives built in memory.
+var testArchiveLimits = archiveLimits{MaxEntries: 3, MaxRatio: 20, MaxTotal: 4096}
+
+type archiveMember struct {
+	name string
+	data []byte
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func buildZip(t *testing.T, members ...archiveMember) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, m := range members {
+		w, err := zw.Create(m.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(m.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func buildTarGz(t *testing.T, members ...archiveMember) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, m := range members {
+		if err := tw.WriteHeader(&tar.Header{Name: m.name, Mode: 0o644, Size: int64(len(m.data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(m.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+// expandTestArchive runs expandArchive over data uploaded as name.
+func expandTestArchive(t *testing.T, name string, data []byte) ([]*uploadInfo, error) {
+	t.Helper()
+	spoolDir = t.TempDir()
+	content, err := newSpool(bytes.NewReader(data), 1<<20, spoolDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { content.Close() })
+	members, err := expandArchive(&uploadInfo{Content: content, Name: name, Size: content.Size()}, testArchiveLimits)
+	for _, m := range members {
+		m.Content.Close()
+	}
+	return members, err
+}
+
+func TestExpandArchiveLimits(t *testing.T) {
+	small := func(name string) archiveMember { return archiveMember{name, randomBytes(100)} }
+	zeros := archiveMember{"zeros.bin", make([]byte, 64<<10)}
+	for _, tc := range []struct {
+		name    string
+		archive string
+		data    []byte
+		// members is the number expected when the archive is accepted
+		members int
+		limit   bool
+	}{
+		{"zip within limits", "ok.zip", buildZip(t, small("a.txt"), small("dir/b.txt")), 2, false},
+		{"zip with too many entries", "many.zip", buildZip(t, small("a"), small("b"), small("c"), small("d")), 0, true},
+		{"zip over the ratio", "bomb.zip", buildZip(t, zeros), 0, true},
+		{"zip over the total", "big.zip", buildZip(t, archiveMember{"a", randomBytes(3000)}, archiveMember{"b", randomBytes(3000)}), 0, true},
+		{"tar.gz within limits", "ok.tar.gz", buildTarGz(t, small("a.txt"), small("b.txt")), 2, false},
+		{"tar.gz with too many entries", "many.tgz", buildTarGz(t, small("a"), small("b"), small("c"), small("d")), 0, true},
+		{"tar.gz over the ratio", "bomb.tar.gz", buildTarGz(t, zeros), 0, true},
+		{"tar.gz over the total", "big.tar.gz", buildTarGz(t, archiveMember{"a", randomBytes(3000)}, archiveMember{"b", randomBytes(3000)}), 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			members, err := expandTestArchive(t, tc.archive, tc.data)
+			switch {
+			case tc.limit && !errors.Is(err, errArchiveLimit):
+				t.Fatalf("got %v, want errArchiveLimit", err)
+			case !tc.limit && err != nil:
+				t.Fatal(err)
+			case !tc.limit && len(members) != tc.members:
+				t.Fatalf("got %d members, want %d", len(members), tc.members)
+			}
+		})
+	}
+}
+
+// TestExpandZipWithLyingHeaders checks a zip whose headers understate the
+// uncompressed size, so the ratio check passes on the headers, is refused
+// on the bytes it really inflates to.
+func TestExpandZipWithLyingHeaders(t *testing.T) {
+	plain := make([]byte, 1<<20)
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	fw.Write(plain)
+	fw.Close()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "bomb.bin",
+		Method:             zip.Deflate,
+		CRC32:              crc32.ChecksumIEEE(plain),
+		CompressedSize64:   uint64(deflated.Len()),
+		UncompressedSize64: uint64(deflated.Len()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(deflated.Bytes())
+	zw.Close()
+
+	members, err := expandTestArchive(t, "liar.zip", buf.Bytes())
+	if err == nil {
+		t.Fatalf("zip with lying headers expanded into %d members", len(members))
+	}
+	for _, m := range members {
+		if m.Size > testArchiveLimits.MaxTotal {
+			t.Fatalf("member of %d bytes read past the total budget", m.Size)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// signatureVersioner is implemented by scanners that can report the version
+// of their signature database. Cached verdicts are dropped when it changes.
+type signatureVersioner interface {
+	SignatureVersion() (string, error)
+}
+
+// signatureCheckInterval is how often the scanner's signature version is
+// polled for cache invalidation.
+const signatureCheckInterval = 5 * time.Minute
+
+// cacheFlushInterval is how often a persisted cache is written to disk.
+const cacheFlushInterval = 30 * time.Second
+
+// cachedVerdict is one verdict cache entry. Only verdicts the engine actually
+// produced are cached; skipped and failed scans never are.
+type cachedVerdict struct {
+	Key       string       `json:"key"`
+	Engine    string       `json:"engine"`
+	Signature string       `json:"signature,omitempty"`
+	Verdict   *ScanVerdict `json:"verdict"`
+	StoredAt  time.Time    `json:"stored_at"`
+}
+
+// verdictCache is an LRU cache of scan verdicts keyed by tenant, engine and
+// SHA-256, so identical files are not rescanned. Entries expire after ttl and
+// are optionally persisted to a JSON file across restarts.
+type verdictCache struct {
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	order     *list.List // front is most recently used
+	capacity  int
+	ttl       time.Duration
+	path      string
+	dirty     bool
+	signature string
+	hits      int
+	misses    int
+
+	// stop ends the flusher and signature watcher, which wg waits for
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// verdicts is the process-wide verdict cache; nil disables caching.
+var verdicts *verdictCache
+
+func newVerdictCache(capacity int, ttl time.Duration, path string) *verdictCache {
+	c := &verdictCache{
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		capacity: capacity,
+		ttl:      ttl,
+		path:     path,
+		stop:     make(chan struct{}),
+	}
+	if path != "" {
+		if err := c.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Ignoring unreadable verdict cache %s: %v", path, err)
+		}
+		c.every(cacheFlushInterval, func() {
+			if err := c.save(); err != nil {
+				log.Printf("Failed to persist verdict cache: %v", err)
+			}
+		})
+	}
+	return c
+}
+
+// mustVerdictCache configures the cache from cfg (a size of "off" disables
+// it; a file persists it) and starts watching the scanner's signature
+// version.
+func mustVerdictCache(cfg cacheConfig, s Scanner) *verdictCache {
+	if cfg.Size == 0 {
+		log.Printf("Verdict cache disabled")
+		return nil
+	}
+	path := cfg.File
+	if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			log.Fatalf("Failed to create verdict cache directory: %v", err)
+		}
+	}
+	c := newVerdictCache(int(cfg.Size), cfg.TTL, path)
+	if rs, ok := s.(*resilientScanner); ok {
+		s = rs.Unwrap()
+	}
+	if sv, ok := s.(signatureVersioner); ok {
+		c.checkSignature(sv)
+		c.every(signatureCheckInterval, func() { c.checkSignature(sv) })
+	}
+	log.Printf("Verdict cache enabled: %d entries, TTL %s, %d loaded", c.capacity, c.ttl, c.order.Len())
+	return c
+}
+
+// cacheKey scopes entries to a tenant, so a cache hit never reveals that
+// another tenant uploaded the same file.
+func cacheKey(tenant, engine, sha256 string) string { return tenant + ":" + engine + ":" + sha256 }
+
+// Get returns the cached verdict for content scanned by engine, if any.
+func (c *verdictCache) Get(tenant, engine, sha256 string) (*cachedVerdict, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[cacheKey(tenant, engine, sha256)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	entry := el.Value.(*cachedVerdict)
+	if time.Since(entry.StoredAt) > c.ttl || entry.Signature != c.signature {
+		c.remove(el)
+		c.misses++
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	c.hits++
+	return entry, true
+}
+
+// Put stores a verdict, evicting the least recently used entry when full.
+func (c *verdictCache) Put(tenant, engine, sha256 string, v *ScanVerdict) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey(tenant, engine, sha256)
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	entry := &cachedVerdict{Key: key, Engine: engine, Signature: c.signature, Verdict: v, StoredAt: time.Now().UTC()}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+	c.dirty = true
+}
+
+// Stats reports cache size and hit counts.
+func (c *verdictCache) Stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"entries":   c.order.Len(),
+		"capacity":  c.capacity,
+		"hits":      c.hits,
+		"misses":    c.misses,
+		"signature": c.signature,
+	}
+}
+
+// remove drops an entry. Must be called with c.mu held.
+func (c *verdictCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*cachedVerdict).Key)
+	c.dirty = true
+}
+
+// checkSignature invalidates the cache when the scanner's signature database
+// has been updated since the cached verdicts were produced.
+func (c *verdictCache) checkSignature(sv signatureVersioner) {
+	version, err := sv.SignatureVersion()
+	if err != nil {
+		log.Printf("Cannot read scanner signature version: %v", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version == c.signature {
+		return
+	}
+	if c.signature != "" || c.order.Len() > 0 {
+		log.Printf("Scanner signatures changed (%q -> %q), invalidating %d cached verdicts", c.signature, version, c.order.Len())
+	}
+	c.signature = version
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.dirty = true
+}
+
+// load reads a persisted cache, oldest entry first.
+func (c *verdictCache) load() error {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	var entries []*cachedVerdict
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if time.Since(entry.StoredAt) > c.ttl || entry.Verdict == nil {
+			continue
+		}
+		c.entries[entry.Key] = c.order.PushFront(entry)
+	}
+	// Adopt the newest entry's signature as the baseline, so a restart
+	// against unchanged signatures keeps the cache warm.
+	if c.order.Len() > 0 {
+		c.signature = c.order.Front().Value.(*cachedVerdict).Signature
+	}
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+	return nil
+}
+
+// every runs fn at each interval until the cache is closed.
+func (c *verdictCache) every(interval time.Duration, fn func()) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+}
+
+// Close stops the background work and then writes the cache to disk one
+// last time, if it is persisted, so no periodic flush races the final one.
+func (c *verdictCache) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.stopOnce.Do(func() { close(c.stop) })
+	c.wg.Wait()
+	if c.path == "" {
+		return nil
+	}
+	return c.save()
+}
+
+// save atomically writes the cache, least recently used entry first.
+func (c *verdictCache) save() error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	entries := make([]*cachedVerdict, 0, c.order.Len())
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		entries = append(entries, el.Value.(*cachedVerdict))
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err == nil {
+		tmp := c.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, c.path)
+		}
+	}
+	if err != nil {
+		// Try again on the next flush
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+	}
+	return err
+}
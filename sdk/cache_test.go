@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testVerdict = &ScanVerdict{Raw: map[string]interface{}{"scanResult": 0}}
+
+// fakeSignatures reports a settable signature database version.
+type fakeSignatures struct {
+	version string
+	err     error
+}
+
+func (f *fakeSignatures) SignatureVersion() (string, error) { return f.version, f.err }
+
+func newTestVerdictCache(t *testing.T, capacity int, ttl time.Duration, path string) *verdictCache {
+	t.Helper()
+	c := newVerdictCache(capacity, ttl, path)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func cached(c *verdictCache, sha string) bool {
+	_, ok := c.Get("acme", "fake", sha)
+	return ok
+}
+
+func TestVerdictCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newTestVerdictCache(t, 2, time.Hour, "")
+	c.Put("acme", "fake", "a", testVerdict)
+	c.Put("acme", "fake", "b", testVerdict)
+	if !cached(c, "a") {
+		t.Fatal("a missing before the cache was full")
+	}
+	c.Put("acme", "fake", "c", testVerdict)
+	if cached(c, "b") {
+		t.Error("b, the least recently used entry, was not evicted")
+	}
+	if !cached(c, "a") || !cached(c, "c") {
+		t.Error("recently used entries were evicted")
+	}
+}
+
+func TestVerdictCacheScopesEntries(t *testing.T) {
+	c := newTestVerdictCache(t, 10, time.Hour, "")
+	c.Put("acme", "fake", "a", testVerdict)
+	if _, ok := c.Get("globex", "fake", "a"); ok {
+		t.Error("verdict of one tenant returned to another")
+	}
+	if _, ok := c.Get("acme", "clamav", "a"); ok {
+		t.Error("verdict of one engine returned for another")
+	}
+}
+
+func TestVerdictCacheExpiresEntries(t *testing.T) {
+	c := newTestVerdictCache(t, 10, time.Hour, "")
+	c.Put("acme", "fake", "a", testVerdict)
+	c.Put("acme", "fake", "b", testVerdict)
+	c.entries[cacheKey("acme", "fake", "a")].Value.(*cachedVerdict).StoredAt = time.Now().Add(-2 * time.Hour)
+
+	if cached(c, "a") {
+		t.Error("expired entry returned")
+	}
+	if !cached(c, "b") {
+		t.Error("fresh entry missing")
+	}
+	if n := c.Stats()["entries"]; n != 1 {
+		t.Errorf("%v entries after expiry, want 1", n)
+	}
+}
+
+func TestVerdictCachePersistsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verdicts.json")
+	c := newVerdictCache(10, time.Hour, path)
+	for _, sha := range []string{"old", "a", "b", "c"} {
+		c.Put("acme", "fake", sha, testVerdict)
+	}
+	c.entries[cacheKey("acme", "fake", "old")].Value.(*cachedVerdict).StoredAt = time.Now().Add(-2 * time.Hour)
+	// a becomes the most recently used
+	cached(c, "a")
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A smaller cache keeps the most recently used entries
+	reloaded := newTestVerdictCache(t, 2, time.Hour, path)
+	if cached(reloaded, "old") {
+		t.Error("entry expired before the restart was reloaded")
+	}
+	if cached(reloaded, "b") {
+		t.Error("least recently used entry kept over capacity")
+	}
+	if !cached(reloaded, "a") || !cached(reloaded, "c") {
+		t.Error("most recently used entries not reloaded")
+	}
+}
+
+func TestVerdictCacheInvalidatedBySignatureChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "verdicts.json")
+	sigs := &fakeSignatures{version: "27305"}
+	c := newVerdictCache(10, time.Hour, path)
+	c.checkSignature(sigs)
+	c.Put("acme", "fake", "a", testVerdict)
+
+	c.checkSignature(sigs)
+	if !cached(c, "a") {
+		t.Fatal("entry dropped although the signatures did not change")
+	}
+	sigs.err = errors.New("clamd is restarting")
+	c.checkSignature(sigs)
+	if !cached(c, "a") {
+		t.Fatal("entry dropped because the signature version could not be read")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart the reloaded entries carry the version they were
+	// scanned with, and a newer database drops them
+	reloaded := newTestVerdictCache(t, 10, time.Hour, path)
+	sigs.err = nil
+	reloaded.checkSignature(sigs)
+	if !cached(reloaded, "a") {
+		t.Fatal("entry dropped on restart against the same signatures")
+	}
+	sigs.version = "27306"
+	reloaded.checkSignature(sigs)
+	if cached(reloaded, "a") {
+		t.Error("entry kept after the signature database changed")
+	}
+	reloaded.Put("acme", "fake", "b", testVerdict)
+	if !cached(reloaded, "b") {
+		t.Error("entry scanned with the new signatures missing")
+	}
+}
+
+// TestClamAVSignatureVersion checks that only the database number of a
+// VERSION reply is used, so the daily build date does not flush the cache.
+func TestClamAVSignatureVersion(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			cmd, _ := bufio.NewReader(conn).ReadString(0)
+			if cmd == "zVERSION\x00" {
+				conn.Write([]byte("ClamAV 1.0.5/27305/Tue Jun 11 08:35:20 2024\x00"))
+			}
+			conn.Close()
+		}
+	}()
+
+	version, err := newClamAVScanner("tcp:" + lis.Addr().String()).SignatureVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "27305" {
+		t.Errorf("signature version %q, want 27305", version)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"common/auth"
+	"common/config"
+	"common/origins"
+	"common/rbac"
+	"common/shutdown"
+)
+
+// Config is the upload service's configuration; see config.Load for how it
+// is read. Upload limits and policies, failure policies, tenants, origins,
+// auth and access are reloaded on SIGHUP; the rest needs a restart.
+type Config struct {
+	Port      int             `yaml:"port" env:"PORT"`
+	Uploads   uploadsConfig   `yaml:"uploads"`
+	Archives  archiveLimits   `yaml:"archives"`
+	Scanner   scannerConfig   `yaml:"scanner"`
+	Jobs      jobsConfig      `yaml:"jobs"`
+	Failure   failureConfig   `yaml:"failure"`
+	Cache     cacheConfig     `yaml:"cache"`
+	Storage   storageConfig   `yaml:"storage"`
+	Resumable resumableConfig `yaml:"resumable"`
+	Tenants   tenantsConfig   `yaml:"tenants"`
+	Tags      tagsConfig      `yaml:"tags"`
+	Knowledge knowledgeConfig `yaml:"knowledge"`
+	Origins   origins.Config  `yaml:"origins"`
+	Auth      auth.Config     `yaml:"auth"`
+	Access    rbac.Config     `yaml:"access"`
+	Shutdown  shutdown.Config `yaml:"shutdown"`
+}
+
+// uploadsConfig limits single-request uploads and selects the file type
+// policy. Larger files should use the resumable protocol.
+type uploadsConfig struct {
+	MaxSize     int64              `yaml:"max_size" env:"MAX_UPLOAD_SIZE"`
+	MemoryLimit int64              `yaml:"memory_limit" env:"UPLOAD_MEMORY_LIMIT"`
+	SpoolDir    string             `yaml:"spool_dir" env:"SPOOL_DIR"`
+	Policy      uploadPolicyConfig `yaml:"policy"`
+}
+
+// uploadPolicyConfig names the policy file and overrides its lists; nil
+// lists keep the file's.
+type uploadPolicyConfig struct {
+	File              string   `yaml:"file" env:"UPLOAD_POLICY_FILE"`
+	AllowedExtensions []string `yaml:"allowed_extensions" env:"UPLOAD_ALLOWED_EXTENSIONS"`
+	DeniedExtensions  []string `yaml:"denied_extensions" env:"UPLOAD_DENIED_EXTENSIONS"`
+	AllowedTypes      []string `yaml:"allowed_types" env:"UPLOAD_ALLOWED_TYPES"`
+	DeniedTypes       []string `yaml:"denied_types" env:"UPLOAD_DENIED_TYPES"`
+	DetectMismatch    *bool    `yaml:"detect_mismatch" env:"UPLOAD_DETECT_MISMATCH"`
+}
+
+// scannerConfig selects the engine: "amaas", "clamav" or "fake".
+type scannerConfig struct {
+	Engine       string           `yaml:"engine" env:"SCANNER"`
+	APIKey       string           `yaml:"api_key" env:"API_KEY" secret:"true"`
+	Region       string           `yaml:"region" env:"REGION"`
+	ClamdAddress string           `yaml:"clamd_address" env:"CLAMD_ADDRESS"`
+	AMaaS        amaasConfig      `yaml:"amaas"`
+	Resilience   resilienceConfig `yaml:"resilience"`
+}
+
+// amaasConfig points the AMaaS client at a specific scan server instead of
+// the regional endpoint.
+type amaasConfig struct {
+	Address string `yaml:"address" env:"AMAAS_ADDRESS"`
+	TLS     bool   `yaml:"tls" env:"AMAAS_TLS"`
+	CACert  string `yaml:"ca_cert" env:"AMAAS_CA_CERT"`
+}
+
+type jobsConfig struct {
+	Workers   int `yaml:"workers" env:"SCAN_WORKERS"`
+	QueueSize int `yaml:"queue_size" env:"SCAN_QUEUE_SIZE"`
+}
+
+// failureConfig sets what happens to uploads that could not be scanned.
+// The per-endpoint policies default to Default when empty.
+type failureConfig struct {
+	Default       FailurePolicy `yaml:"default" env:"SCAN_FAILURE_POLICY"`
+	Upload        FailurePolicy `yaml:"upload" env:"SCAN_FAILURE_POLICY_UPLOAD"`
+	Resumable     FailurePolicy `yaml:"resumable" env:"SCAN_FAILURE_POLICY_RESUMABLE"`
+	PendingRescan time.Duration `yaml:"pending_rescan" env:"PENDING_RESCAN_SECONDS" unit:"s"`
+}
+
+type cacheConfig struct {
+	Size cacheSize     `yaml:"size" env:"VERDICT_CACHE_SIZE"`
+	TTL  time.Duration `yaml:"ttl" env:"VERDICT_CACHE_TTL_MINUTES" unit:"m"`
+	File string        `yaml:"file" env:"VERDICT_CACHE_FILE"`
+}
+
+// cacheSize is a number of entries, or "off" to disable the cache.
+type cacheSize int
+
+func (s *cacheSize) UnmarshalText(text []byte) error {
+	if string(text) == "off" {
+		*s = 0
+		return nil
+	}
+	n, err := strconv.Atoi(string(text))
+	if err != nil || n <= 0 {
+		return fmt.Errorf("want a positive number of entries or off, got %q", text)
+	}
+	*s = cacheSize(n)
+	return nil
+}
+
+func (s cacheSize) MarshalText() ([]byte, error) {
+	if s == 0 {
+		return []byte("off"), nil
+	}
+	return []byte(strconv.Itoa(int(s))), nil
+}
+
+// storageConfig selects the document store: "fs" or "s3".
+type storageConfig struct {
+	Backend       string   `yaml:"backend" env:"DOCUMENT_STORE"`
+	S3            s3Config `yaml:"s3"`
+	QuarantineKey string   `yaml:"quarantine_key" env:"QUARANTINE_KEY" secret:"true"`
+}
+
+type s3Config struct {
+	Endpoint        string `yaml:"endpoint" env:"S3_ENDPOINT"`
+	Bucket          string `yaml:"bucket" env:"S3_BUCKET"`
+	Prefix          string `yaml:"prefix" env:"S3_PREFIX"`
+	Region          string `yaml:"region" env:"S3_REGION"`
+	AccessKeyID     string `yaml:"access_key_id" env:"S3_ACCESS_KEY_ID"`
+	SecretAccessKey string `yaml:"secret_access_key" env:"S3_SECRET_ACCESS_KEY" secret:"true"`
+}
+
+type resumableConfig struct {
+	MaxSize int64         `yaml:"max_size" env:"RESUMABLE_MAX_SIZE"`
+	Expiry  time.Duration `yaml:"expiry" env:"RESUMABLE_EXPIRY_HOURS" unit:"h"`
+}
+
+// tenantsConfig names the tenants file; the quota applies when the file
+// sets no default quota of its own.
+type tenantsConfig struct {
+	File  string      `yaml:"file" env:"TENANTS_FILE"`
+	Quota TenantQuota `yaml:"quota"`
+}
+
+type tagsConfig struct {
+	Categories []string `yaml:"categories" env:"SCAN_TAG_CATEGORIES"`
+	Platform   string   `yaml:"platform" env:"PLATFORM"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port: 5000,
+		Uploads: uploadsConfig{
+			MaxSize:     10 << 20,
+			MemoryLimit: 16 << 20,
+			SpoolDir:    uploadFolder,
+		},
+		Archives: archiveLimits{MaxEntries: 1000, MaxRatio: 100, MaxTotal: 100 << 20},
+		Scanner: scannerConfig{
+			Engine:       "amaas",
+			ClamdAddress: "unix:/var/run/clamav/clamd.ctl",
+			AMaaS:        amaasConfig{TLS: true},
+			Resilience: resilienceConfig{
+				MaxConcurrent:    8,
+				MaxAttempts:      3,
+				BaseBackoff:      200 * time.Millisecond,
+				MaxBackoff:       5 * time.Second,
+				BreakerThreshold: 5,
+				BreakerCooldown:  30 * time.Second,
+			},
+		},
+		Jobs:      jobsConfig{Workers: 4, QueueSize: 100},
+		Failure:   failureConfig{Default: FailOpen, PendingRescan: time.Minute},
+		Cache:     cacheConfig{Size: 10000, TTL: 24 * time.Hour},
+		Storage:   storageConfig{Backend: "fs", S3: s3Config{Endpoint: "https://s3.amazonaws.com", Region: "us-east-1"}},
+		Resumable: resumableConfig{MaxSize: 100 << 20, Expiry: 24 * time.Hour},
+		Tags:      tagsConfig{Categories: []string{"general", "artwork", "invoice", "contract", "marketing"}},
+		Knowledge: knowledgeConfig{Timeout: 5 * time.Minute, QueueSize: 100},
+		Auth:      auth.DefaultConfig(),
+		Shutdown:  shutdown.DefaultConfig(),
+	}
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs config.Errors
+	if c.Port < 1 || c.Port > 65535 {
+		errs.Addf("port must be between 1 and 65535, got %d", c.Port)
+	}
+	positive := map[string]int64{
+		"uploads.max_size":                     c.Uploads.MaxSize,
+		"uploads.memory_limit":                 c.Uploads.MemoryLimit,
+		"archives.max_entries":                 int64(c.Archives.MaxEntries),
+		"archives.max_ratio":                   c.Archives.MaxRatio,
+		"archives.max_total":                   c.Archives.MaxTotal,
+		"scanner.resilience.max_concurrent":    int64(c.Scanner.Resilience.MaxConcurrent),
+		"scanner.resilience.max_attempts":      int64(c.Scanner.Resilience.MaxAttempts),
+		"scanner.resilience.breaker_threshold": int64(c.Scanner.Resilience.BreakerThreshold),
+		"scanner.resilience.base_backoff":      int64(c.Scanner.Resilience.BaseBackoff),
+		"scanner.resilience.max_backoff":       int64(c.Scanner.Resilience.MaxBackoff),
+		"scanner.resilience.breaker_cooldown":  int64(c.Scanner.Resilience.BreakerCooldown),
+		"jobs.workers":                         int64(c.Jobs.Workers),
+		"jobs.queue_size":                      int64(c.Jobs.QueueSize),
+		"resumable.max_size":                   c.Resumable.MaxSize,
+		"failure.pending_rescan":               int64(c.Failure.PendingRescan),
+		"cache.ttl":                            int64(c.Cache.TTL),
+		"resumable.expiry":                     int64(c.Resumable.Expiry),
+		"knowledge.timeout":                    int64(c.Knowledge.Timeout),
+		"knowledge.queue_size":                 int64(c.Knowledge.QueueSize),
+	}
+	for name, v := range positive {
+		if v <= 0 {
+			errs.Addf("%s must be positive, got %d", name, v)
+		}
+	}
+	q := c.Tenants.Quota
+	if q.MaxBytes < 0 || q.MaxFiles < 0 || q.MaxScansPerDay < 0 {
+		errs.Addf("tenants.quota limits must not be negative")
+	}
+	switch strings.ToLower(c.Scanner.Engine) {
+	case "amaas", "clamav", "clamd", "fake":
+	default:
+		errs.Addf("scanner.engine must be amaas, clamav or fake, got %q", c.Scanner.Engine)
+	}
+	if _, err := c.Failure.policies(); err != nil {
+		errs = append(errs, err)
+	}
+	switch strings.ToLower(c.Storage.Backend) {
+	case "fs", "filesystem":
+	case "s3":
+		if u, err := url.Parse(c.Storage.S3.Endpoint); err != nil || u.Host == "" {
+			errs.Addf("storage.s3.endpoint must be a URL, got %q", c.Storage.S3.Endpoint)
+		}
+		if c.Storage.S3.Bucket == "" {
+			errs.Addf("storage.s3.bucket is required for the s3 document store")
+		}
+		if c.Storage.S3.AccessKeyID == "" || c.Storage.S3.SecretAccessKey == "" {
+			errs.Addf("storage.s3.access_key_id and secret_access_key are required for the s3 document store")
+		}
+	default:
+		errs.Addf("storage.backend must be fs or s3, got %q", c.Storage.Backend)
+	}
+	if _, err := decodeQuarantineKey(c.Storage.QuarantineKey); err != nil {
+		errs.Addf("storage.quarantine_key is required: %v", err)
+	}
+	if c.Knowledge.URL != "" {
+		if u, err := url.Parse(c.Knowledge.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.Addf("knowledge.url must be an http or https URL, got %q", c.Knowledge.URL)
+		}
+	}
+	for _, cat := range c.Tags.Categories {
+		if !categoryPattern.MatchString(strings.ToLower(cat)) {
+			errs.Addf("tags.categories: invalid category %q", cat)
+		}
+	}
+	if err := c.Auth.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Shutdown.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs.Err()
+}
+
+// reloadable lists the sections applied by reloadConfig; changes anywhere
+// else are only logged.
+var reloadable = map[string]bool{"Uploads": true, "Failure": true, "Tenants": true, "Origins": true, "Auth": true, "Access": true}
+
+// reloadConfig re-reads the configuration and applies the reloadable
+// sections, always in the same order. An invalid file leaves the running
+// settings untouched, as does a section that fails to apply. running is
+// updated to what is in force, so the next reload is compared against it.
+func reloadConfig(running *Config, file string, authn *auth.Authenticator, access *rbac.Enforcer) {
+	cfg := defaultConfig()
+	if err := config.Load(cfg, file); err != nil {
+		log.Printf("Configuration reload failed, keeping current settings: %v", err)
+		return
+	}
+	rv, cv := reflect.ValueOf(running).Elem(), reflect.ValueOf(cfg).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		name := rv.Type().Field(i).Name
+		if !reloadable[name] && !reflect.DeepEqual(rv.Field(i).Interface(), cv.Field(i).Interface()) {
+			log.Printf("%s settings changed; restart to apply", name)
+		}
+	}
+	if cfg.Uploads.MemoryLimit != running.Uploads.MemoryLimit || cfg.Uploads.SpoolDir != running.Uploads.SpoolDir {
+		log.Printf("Upload spooling settings changed; restart to apply")
+	}
+	if cfg.Failure.PendingRescan != running.Failure.PendingRescan {
+		log.Printf("Pending rescan interval changed; restart to apply")
+	}
+
+	steps := []struct {
+		sections []string
+		apply    func() error
+	}{
+		{[]string{"Uploads"}, func() error {
+			if err := applyUploadPolicy(cfg.Uploads.Policy); err != nil {
+				return err
+			}
+			maxUploadSize.Store(cfg.Uploads.MaxSize)
+			return nil
+		}},
+		{[]string{"Failure"}, func() error { return applyFailurePolicies(cfg.Failure) }},
+		{[]string{"Tenants"}, func() error { return tenants.reload(cfg.Tenants) }},
+		{[]string{"Origins"}, func() error { return allowedOrigins.Update(cfg.Origins) }},
+		// Credentials and the policy they are checked against change together
+		{[]string{"Auth", "Access"}, func() error { return access.UpdateWithAuth(authn, cfg.Auth, cfg.Access) }},
+	}
+	applied := map[string]bool{}
+	for _, step := range steps {
+		if err := step.apply(); err != nil {
+			log.Printf("Cannot reload %s settings: %v", strings.ToLower(strings.Join(step.sections, " and ")), err)
+			continue
+		}
+		for _, name := range step.sections {
+			applied[name] = true
+		}
+	}
+
+	next := *cfg
+	nv := reflect.ValueOf(&next).Elem()
+	for i := 0; i < nv.NumField(); i++ {
+		if !applied[nv.Type().Field(i).Name] {
+			nv.Field(i).Set(rv.Field(i))
+		}
+	}
+	next.Uploads.MemoryLimit, next.Uploads.SpoolDir = running.Uploads.MemoryLimit, running.Uploads.SpoolDir
+	next.Failure.PendingRescan = running.Failure.PendingRescan
+	*running = next
+	log.Printf("Configuration reloaded")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"common/auth"
+	"common/config"
+	"common/origins"
+	"common/rbac"
+)
+
+const testQuarantineKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sdk.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Storage.QuarantineKey = testQuarantineKey
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("defaults with a quarantine key: %v", err)
+	}
+
+	cfg = defaultConfig()
+	cfg.Port = 70000
+	cfg.Jobs.Workers = 0
+	cfg.Scanner.Engine = "sophos"
+	cfg.Storage.Backend = "s3"
+	cfg.Knowledge.URL = "ftp://index"
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("invalid configuration accepted")
+	}
+	// Every problem is reported at once
+	for _, want := range []string{
+		"port must be between 1 and 65535",
+		"jobs.workers must be positive",
+		`scanner.engine must be amaas, clamav or fake, got "sophos"`,
+		"storage.s3.bucket is required",
+		"storage.quarantine_key is required",
+		"knowledge.url must be an http or https URL",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error lacks %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestConfigEnvironmentOverridesFile(t *testing.T) {
+	file := writeConfig(t, `
+port: 6000
+uploads:
+  max_size: 2048
+scanner:
+  engine: fake
+`)
+	t.Setenv("QUARANTINE_KEY", testQuarantineKey)
+	t.Setenv("PORT", "7000")
+	t.Setenv("SCAN_WORKERS", "")
+	cfg := defaultConfig()
+	if err := config.Load(cfg, file); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 7000 || cfg.Uploads.MaxSize != 2048 || cfg.Scanner.Engine != "fake" || cfg.Jobs.Workers != 4 {
+		t.Errorf("port %d, max size %d, engine %s, workers %d; want 7000, 2048, fake, 4",
+			cfg.Port, cfg.Uploads.MaxSize, cfg.Scanner.Engine, cfg.Jobs.Workers)
+	}
+
+	t.Setenv("PORT", "0")
+	if err := config.Load(defaultConfig(), file); err == nil || !strings.Contains(err.Error(), "port must be between") {
+		t.Errorf("port 0 from the environment: got %v", err)
+	}
+}
+
+func TestReloadConfigAppliesWhatItCan(t *testing.T) {
+	api := newTestAPI(t, "")
+	t.Setenv("QUARANTINE_KEY", testQuarantineKey)
+	saved := allowedOrigins
+	t.Cleanup(func() { allowedOrigins = saved })
+	policy, err := origins.Parse(origins.DefaultPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowedOrigins = policy
+	authn, err := auth.New(auth.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	access := &rbac.Enforcer{}
+	if err := access.Update(rbac.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	running := defaultConfig()
+	running.Storage.QuarantineKey = testQuarantineKey
+	before := tenants
+
+	// The upload limit and origins apply; the missing tenants file does not,
+	// and the port needs a restart
+	missing := filepath.Join(t.TempDir(), "tenants.json")
+	reloadConfig(running, writeConfig(t, `
+port: 6000
+uploads:
+  max_size: 1234
+tenants:
+  file: `+missing+`
+origins:
+  extra: [https://paper.example]
+`), authn, access)
+	if maxUploadSize.Load() != 1234 || running.Uploads.MaxSize != 1234 {
+		t.Errorf("upload limit %d, running %d; want 1234", maxUploadSize.Load(), running.Uploads.MaxSize)
+	}
+	if !allowedOrigins.Allowed("https://paper.example") || len(running.Origins.Extra) != 1 {
+		t.Errorf("origins not reloaded: running %+v", running.Origins)
+	}
+	if tenants != before || running.Tenants.File != "" {
+		t.Errorf("tenants replaced by a missing file: running %+v", running.Tenants)
+	}
+	if running.Port != 5000 {
+		t.Errorf("running port %d, want 5000 until restart", running.Port)
+	}
+	api.expect(api.do(http.MethodGet, "/documents", "", "", nil, ""), http.StatusOK, "listing after a partial reload")
+
+	// An invalid file changes nothing
+	reloadConfig(running, writeConfig(t, "uploads:\n  max_size: 99\nport: 0\n"), authn, access)
+	if maxUploadSize.Load() != 1234 || running.Uploads.MaxSize != 1234 {
+		t.Errorf("invalid file applied: upload limit %d, running %d", maxUploadSize.Load(), running.Uploads.MaxSize)
+	}
+}
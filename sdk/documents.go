@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"common/auth"
+)
+
+// documents holds each tenant's store that clean uploads are persisted into.
+var documents *tenantStores
+
+// setAPIHeaders sets the CORS headers shared by the JSON APIs and reports
+// whether the request was a preflight that has been fully handled.
+func setAPIHeaders(w http.ResponseWriter, r *http.Request, methods string) bool {
+	setCORSHeaders(w, r)
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-API-Key, X-Requested-With, X-Zip-Password")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Disposition")
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+	return false
+}
+
+// storeCleanUpload persists an upload if the scan found it clean, or if it
+// could not be scanned and was accepted fail-open, and records the new
+// document ID on result.
+func storeCleanUpload(info *uploadInfo, result *ScanResult) error {
+	if result.Verdict != VerdictClean && result.FailurePolicy != FailOpen {
+		return nil
+	}
+	store, err := documents.For(info.Tenant)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	doc := &Document{
+		ID:          newID(),
+		Tenant:      info.Tenant,
+		Name:        info.Name,
+		ContentType: info.ContentType,
+		Size:        result.FileSize,
+		SHA256:      result.SHA256,
+		Uploader:    info.Uploader,
+		Verdict:     result.Verdict,
+		ScanID:      result.ScanID,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := tenants.trackStored(info.Tenant, 1, doc.Size, func() error {
+		return store.Put(doc, info.Content.Reader())
+	}); err != nil {
+		return err
+	}
+	log.Printf("Stored document %s (%s, %d bytes)", doc.ID, doc.Name, doc.Size)
+	result.DocumentID = doc.ID
+	knowledge.Index(doc)
+	return nil
+}
+
+// uploaderFromRequest identifies who uploaded a file: the authenticated
+// subject, or the X-Uploader header when auth is disabled.
+func uploaderFromRequest(r *http.Request) string {
+	if p, ok := auth.FromContext(r.Context()); ok && !p.Anonymous() {
+		return p.Subject
+	}
+	if u := strings.TrimSpace(r.Header.Get("X-Uploader")); u != "" {
+		return u
+	}
+	return "anonymous"
+}
+
+// tenantStore resolves the calling tenant and its document store, writing
+// an error response on failure.
+func tenantStore(w http.ResponseWriter, r *http.Request) (string, DocumentStore, bool) {
+	tenant, ok := requireTenant(w, r)
+	if !ok {
+		return "", nil, false
+	}
+	store, err := documents.For(tenant)
+	if err != nil {
+		writeStoreError(w, err)
+		return "", nil, false
+	}
+	return tenant, store, true
+}
+
+// documentsHandler serves GET /documents for the calling tenant.
+func documentsHandler(w http.ResponseWriter, r *http.Request) {
+	if setAPIHeaders(w, r, "GET, OPTIONS") {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, store, ok := tenantStore(w, r)
+	if !ok {
+		return
+	}
+	docs, err := store.List()
+	if err != nil {
+		log.Printf("List documents error: %v", err)
+		http.Error(w, fmt.Sprintf("Cannot list documents: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"documents": docs})
+}
+
+// documentHandler serves GET/DELETE /documents/{id} and
+// GET /documents/{id}/content. Documents of other tenants are not found.
+func documentHandler(w http.ResponseWriter, r *http.Request) {
+	if setAPIHeaders(w, r, "GET, DELETE, OPTIONS") {
+		return
+	}
+	tenant, documents, ok := tenantStore(w, r)
+	if !ok {
+		return
+	}
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/documents/"), "/")
+
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		doc, err := documents.Get(id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, doc)
+
+	case sub == "" && r.Method == http.MethodDelete:
+		doc, err := documents.Get(id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if err := tenants.trackStored(tenant, -1, -doc.Size, func() error { return documents.Delete(id) }); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		log.Printf("Deleted document %s", id)
+		knowledge.Remove(tenant, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	case sub == "content" && r.Method == http.MethodGet:
+		doc, err := documents.Get(id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		serveDocumentContent(w, documents, doc)
+
+	case sub == "" || sub == "content":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveDocumentContent sends a stored document as an attachment.
+func serveDocumentContent(w http.ResponseWriter, store DocumentStore, doc *Document) {
+	rc, err := store.Open(doc.ID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", doc.ContentType)
+	w.Header().Set("Content-Length", fmt.Sprint(doc.Size))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": doc.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Printf("Document %s download error: %v", doc.ID, err)
+	}
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errDocumentNotFound) {
+		http.Error(w, "Document not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Document store error: %v", err)
+	http.Error(w, fmt.Sprintf("Document store error: %v", err), http.StatusInternalServerError)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// FailurePolicy decides what happens to an upload when it could not be
+// scanned because the scanner is missing, unreachable or erroring.
+type FailurePolicy string
+
+const (
+	// FailOpen accepts the unscanned file.
+	FailOpen FailurePolicy = "open"
+	// FailClosed rejects the upload and never keeps the file.
+	FailClosed FailurePolicy = "closed"
+	// FailHold keeps the file in the pending area until a rescan succeeds.
+	FailHold FailurePolicy = "hold"
+)
+
+// Endpoints that select a failure policy.
+const (
+	endpointUpload    = "upload"
+	endpointResumable = "resumable"
+)
+
+// failurePolicies maps endpoints to their policy; see failureConfig. It is
+// replaced when the configuration is reloaded.
+var failurePolicies atomic.Pointer[map[string]FailurePolicy]
+
+// pending holds uploads kept under the hold-for-review policy, encrypted the
+// same way as the quarantine.
+var pending *quarantineStore
+
+// policies resolves the per-endpoint policies, which fall back to the
+// default when empty.
+func (c failureConfig) policies() (map[string]FailurePolicy, error) {
+	def, err := parseFailurePolicy("failure.default", c.Default, FailOpen)
+	if err != nil {
+		return nil, err
+	}
+	policies := map[string]FailurePolicy{}
+	for endpoint, v := range map[string]FailurePolicy{endpointUpload: c.Upload, endpointResumable: c.Resumable} {
+		p, err := parseFailurePolicy("failure."+endpoint, v, def)
+		if err != nil {
+			return nil, err
+		}
+		policies[endpoint] = p
+	}
+	return policies, nil
+}
+
+func parseFailurePolicy(name string, v, def FailurePolicy) (FailurePolicy, error) {
+	switch v = FailurePolicy(strings.ToLower(strings.TrimSpace(string(v)))); v {
+	case "":
+		return def, nil
+	case FailOpen, FailClosed, FailHold:
+		return v, nil
+	default:
+		return "", fmt.Errorf("%s must be open, closed or hold, got %q", name, v)
+	}
+}
+
+// applyFailurePolicies puts the policies of cfg in force.
+func applyFailurePolicies(cfg failureConfig) error {
+	policies, err := cfg.policies()
+	if err != nil {
+		return err
+	}
+	failurePolicies.Store(&policies)
+	log.Printf("Scan failure policy: %v", policies)
+	return nil
+}
+
+func mustFailurePolicies(cfg failureConfig) {
+	if err := applyFailurePolicies(cfg); err != nil {
+		log.Fatalf("Failed to configure scan failure policy: %v", err)
+	}
+}
+
+func mustPendingStore(key string) *quarantineStore {
+	p, err := newQuarantineStore(filepath.Join(uploadFolder, "pending"), key)
+	if err != nil {
+		log.Fatalf("Failed to open pending area: %v", err)
+	}
+	return p
+}
+
+// scanFailed reports whether the scanner could not produce a verdict.
+func scanFailed(result *ScanResult) bool {
+	switch result.Reason {
+	case ReasonNotConfigured, ReasonScannerUnavailable, ReasonScanFailed:
+		return true
+	}
+	return false
+}
+
+// applyFailurePolicy handles an upload that could not be scanned according
+// to its endpoint's policy and records the decision in result.
+func applyFailurePolicy(info *uploadInfo, result *ScanResult) error {
+	policy, ok := tenants.Config(info.Tenant).FailurePolicy[info.Endpoint]
+	if !ok {
+		policy, ok = (*failurePolicies.Load())[info.Endpoint]
+	}
+	if !ok {
+		policy = FailOpen
+	}
+	result.FailurePolicy = policy
+	switch policy {
+	case FailClosed:
+		log.Printf("Rejecting unscanned upload %s (fail-closed)", info.Name)
+		result.Message = "Upload rejected: the file could not be scanned and unscanned files are not accepted"
+	case FailHold:
+		item := &QuarantineItem{
+			ID:            newID(),
+			Tenant:        info.Tenant,
+			FileName:      info.Name,
+			ContentType:   info.ContentType,
+			Size:          info.Size,
+			SHA256:        info.Content.SHA256(),
+			Uploader:      info.Uploader,
+			MalwareNames:  []string{},
+			QuarantinedAt: time.Now().UTC(),
+			ScanResult:    result,
+		}
+		if err := pending.Add(item, info.Content.Reader()); err != nil {
+			return err
+		}
+		log.Printf("Holding unscanned upload %s as pending %s", info.Name, item.ID)
+		result.PendingID = item.ID
+		result.Message = "File could not be scanned and is held for review until a rescan succeeds"
+	}
+	return nil
+}
+
+// rescanPending periodically retries held uploads, moving them into the
+// document store or the quarantine once the scanner answers. It must start
+// after pending is set.
+func rescanPending(interval time.Duration) {
+	for range time.Tick(interval) {
+		items, err := pending.List()
+		if err != nil {
+			log.Printf("Cannot list pending uploads: %v", err)
+			continue
+		}
+		for _, item := range items {
+			// Items an administrator is rescanning or has just removed are
+			// left to them
+			_, err := rescanPendingItem(item)
+			if err != nil && !errors.Is(err, errQuarantineBusy) && !errors.Is(err, errQuarantineNotFound) {
+				log.Printf("Rescan of pending %s failed: %v", item.ID, err)
+			}
+		}
+	}
+}
+
+// rescanPendingItem scans a held upload again. The item leaves the pending
+// area only when the scan produced a verdict. It is claimed for the whole
+// rescan, so the periodic rescan and an administrator's cannot both store
+// it; the loser gets errQuarantineBusy, or errQuarantineNotFound once the
+// winner has removed it.
+func rescanPendingItem(item *QuarantineItem) (*ScanResult, error) {
+	release, err := pending.Claim(item.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	// Decrypted straight into the spool, which spills large files to disk
+	content, err := pending.Open(item.ID)
+	if err != nil {
+		return nil, err
+	}
+	spooled, err := newSpool(content, uploadMemoryLimit, spoolDir)
+	content.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer spooled.Close()
+	info := &uploadInfo{
+		Content:     spooled,
+		Name:        item.FileName,
+		ContentType: item.ContentType,
+		Size:        spooled.Size(),
+		Uploader:    item.Uploader,
+		Tenant:      item.Tenant,
+	}
+	if info.Tenant == "" {
+		info.Tenant = defaultTenant
+	}
+	if item.ScanResult != nil {
+		info.Tags = item.ScanResult.Tags
+	}
+
+	result, err := scanUploadedFile(info)
+	if err != nil {
+		return nil, err
+	}
+	if scanFailed(result) {
+		return result, nil
+	}
+	if err := storeCleanUpload(info, result); err != nil {
+		return nil, err
+	}
+	if err := quarantineUpload(info, result); err != nil {
+		return nil, err
+	}
+	log.Printf("Pending %s (%s) rescanned: %s", item.ID, item.FileName, result.Verdict)
+	return result, pending.Purge(item.ID)
+}
+
+// pendingListHandler serves GET /pending.
+func pendingListHandler(w http.ResponseWriter, r *http.Request) {
+	if setAPIHeaders(w, r, "GET, OPTIONS") {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	items, err := pending.List()
+	if err != nil {
+		writePendingError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": filterByTenant(items, r.URL.Query().Get("tenant"))})
+}
+
+// pendingItemHandler serves:
+//
+//	GET    /pending/{id}         metadata and the failed scan result
+//	POST   /pending/{id}/rescan  retry the scan now
+//	DELETE /pending/{id}         discard the held file
+func pendingItemHandler(w http.ResponseWriter, r *http.Request) {
+	if setAPIHeaders(w, r, "GET, POST, DELETE, OPTIONS") {
+		return
+	}
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/pending/"), "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		item, err := pending.Get(id)
+		if err != nil {
+			writePendingError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, item)
+
+	case action == "" && r.Method == http.MethodDelete:
+		release, err := pending.Claim(id)
+		if err != nil {
+			writePendingError(w, err)
+			return
+		}
+		err = pending.Purge(id)
+		release()
+		if err != nil {
+			writePendingError(w, err)
+			return
+		}
+		log.Printf("Discarded pending upload %s", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "rescan" && r.Method == http.MethodPost:
+		item, err := pending.Get(id)
+		if err != nil {
+			writePendingError(w, err)
+			return
+		}
+		result, err := rescanPendingItem(item)
+		if err != nil {
+			writePendingError(w, err)
+			return
+		}
+		if scanFailed(result) {
+			result.FailurePolicy, result.PendingID = FailHold, id
+		}
+		writeJSON(w, result.httpStatus(), result)
+
+	case action == "" || action == "rescan":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writePendingError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errQuarantineNotFound) {
+		http.Error(w, "Pending upload not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errQuarantineBusy) {
+		http.Error(w, "Pending upload is being rescanned; try again shortly", http.StatusConflict)
+		return
+	}
+	log.Printf("Pending area error: %v", err)
+	http.Error(w, fmt.Sprintf("Pending area error: %v", err), http.StatusInternalServerError)
+}
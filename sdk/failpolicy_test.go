@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"testing"
+)
+
+// uploadUnscanned posts a file to /upload while the scanner is unavailable
+// and decodes the result.
+func (a *testAPI) uploadUnscanned(key string, code int) *ScanResult {
+	a.t.Helper()
+	activeScanner = unavailableScanner{}
+	defer func() { activeScanner = newFakeScanner() }()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte("quarterly paper order"))
+	mw.Close()
+	w := a.do(http.MethodPost, "/upload", key, "", &body, mw.FormDataContentType())
+	a.expect(w, code, "upload while the scanner is unavailable")
+	var result ScanResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		a.t.Fatal(err)
+	}
+	return &result
+}
+
+func TestFailurePolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy FailurePolicy
+		code   int
+		stored bool
+		held   bool
+	}{
+		{FailOpen, http.StatusOK, true, false},
+		{FailClosed, http.StatusServiceUnavailable, false, false},
+		{FailHold, http.StatusAccepted, false, true},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			api := newTestAPI(t, "")
+			if err := applyFailurePolicies(failureConfig{Upload: tc.policy}); err != nil {
+				t.Fatal(err)
+			}
+			result := api.uploadUnscanned("", tc.code)
+			if result.FailurePolicy != tc.policy {
+				t.Errorf("result reports policy %q, want %q", result.FailurePolicy, tc.policy)
+			}
+			if stored := len(api.listed("", "")) > 0; stored != tc.stored {
+				t.Errorf("unscanned file stored: %t, want %t", stored, tc.stored)
+			}
+			items, err := pending.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if held := len(items) > 0; held != tc.held {
+				t.Errorf("unscanned file held: %t, want %t", held, tc.held)
+			}
+			if tc.held && (result.PendingID == "" || items[0].ID != result.PendingID) {
+				t.Errorf("result pending ID %q does not name the held item", result.PendingID)
+			}
+		})
+	}
+}
+
+func TestHeldUploadStoredAfterRescan(t *testing.T) {
+	api := newTestAPI(t, "")
+	if err := applyFailurePolicies(failureConfig{Upload: FailHold}); err != nil {
+		t.Fatal(err)
+	}
+	// Held files larger than the memory limit are spooled to disk
+	limit := uploadMemoryLimit
+	uploadMemoryLimit = 4
+	t.Cleanup(func() { uploadMemoryLimit = limit })
+	held := api.uploadUnscanned("", http.StatusAccepted)
+	item, err := pending.Get(held.PendingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activeScanner = unavailableScanner{}
+	result, err := rescanPendingItem(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !scanFailed(result) {
+		t.Fatalf("rescan without a scanner got verdict %s", result.Verdict)
+	}
+	if _, err := pending.Get(item.ID); err != nil {
+		t.Fatalf("item left the pending area although the rescan failed: %v", err)
+	}
+
+	activeScanner = newFakeScanner()
+	result, err = rescanPendingItem(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Verdict != VerdictClean || result.DocumentID == "" || result.FileSize != int64(len("quarterly paper order")) {
+		t.Fatalf("rescan result %+v", result)
+	}
+	if _, err := pending.Get(item.ID); err != errQuarantineNotFound {
+		t.Errorf("rescanned item still pending: %v", err)
+	}
+	api.expect(api.do(http.MethodGet, "/documents/"+result.DocumentID, "", "", nil, ""), http.StatusOK, "get rescanned document")
+}
+
+func TestTenantFailurePolicyOverride(t *testing.T) {
+	api := newTestAPI(t, tenantKeys)
+	if err := applyFailurePolicies(failureConfig{Default: FailOpen}); err != nil {
+		t.Fatal(err)
+	}
+	tenants.Tenants["acme"] = &TenantConfig{FailurePolicy: map[string]FailurePolicy{endpointUpload: FailClosed}}
+
+	if result := api.uploadUnscanned("alice-key", http.StatusServiceUnavailable); result.FailurePolicy != FailClosed {
+		t.Errorf("acme upload handled %q, want closed", result.FailurePolicy)
+	}
+	if result := api.uploadUnscanned("bob-key", http.StatusOK); result.FailurePolicy != FailOpen {
+		t.Errorf("globex upload handled %q, want the global open", result.FailurePolicy)
+	}
+}
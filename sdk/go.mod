@@ -2,7 +2,11 @@ module sdk
 
 go 1.21
 
-require github.com/trendmicro/tm-v1-fs-golang-sdk v1.5.1
+require (
+	common v0.0.0
+	github.com/trendmicro/tm-v1-fs-golang-sdk v1.5.1
+	google.golang.org/grpc v1.62.1
+)
 
 require (
 	github.com/golang/protobuf v1.5.4 // indirect
@@ -11,6 +15,8 @@ require (
 	golang.org/x/sys v0.28.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240311173647-c811ad7063a7 // indirect
-	google.golang.org/grpc v1.62.1 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace common => ../common
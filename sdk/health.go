@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+
+	"common/health"
+)
+
+// healthChecks builds the checks behind /livez and /readyz. The upload
+// folder and spool must be writable; an unreachable scanner only degrades
+// readiness, since the failure policy decides what happens to uploads then.
+func healthChecks() *health.Checker {
+	h := health.New("sdk")
+	h.Ready(health.Draining(func() bool { return server.Draining() }))
+	h.Ready(health.Writable("uploads", uploadFolder))
+	if spoolDir != uploadFolder {
+		h.Ready(health.Writable("spool", spoolDir))
+	}
+	h.Ready(health.Check{
+		Name: "scanner",
+		Run:  func(ctx context.Context) error { return pingScanner(ctx, activeScanner) },
+	})
+	return h
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobState is the lifecycle state of an asynchronous scan job.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobScanning  JobState = "scanning"
+	JobClean     JobState = "clean"
+	JobMalicious JobState = "malicious"
+	JobSkipped   JobState = "skipped"
+	JobRejected  JobState = "rejected"
+	JobHeld      JobState = "held"
+	JobError     JobState = "error"
+)
+
+// terminal reports whether no further state changes will happen.
+func (s JobState) terminal() bool {
+	return s != JobQueued && s != JobScanning
+}
+
+// jobRetention is how long finished jobs stay queryable.
+const jobRetention = time.Hour
+
+// ScanJob is the externally visible state of an asynchronous scan.
+type ScanJob struct {
+	ID        string      `json:"id"`
+	Tenant    string      `json:"tenant"`
+	State     JobState    `json:"state"`
+	FileName  string      `json:"file_name"`
+	FileSize  int64       `json:"file_size"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	Result    *ScanResult `json:"result,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type scanTask struct {
+	job  *ScanJob
+	info *uploadInfo
+}
+
+// jobManager runs scans on a bounded worker pool and keeps job state in
+// memory so clients can poll or subscribe across requests.
+type jobManager struct {
+	mu      sync.Mutex
+	jobs    map[string]*ScanJob
+	subs    map[string][]chan ScanJob
+	queue   chan scanTask
+	workers int
+	active  int
+	// closed is set by Drain; the queue accepts no more tasks.
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// scanJobs is the process-wide asynchronous scan queue.
+var scanJobs *jobManager
+
+var (
+	errQueueFull   = errors.New("scan queue is full")
+	errQueueClosed = errors.New("server is shutting down")
+	errJobNotFound = errors.New("scan job not found")
+)
+
+func newJobManager(workers, queueSize int) *jobManager {
+	m := &jobManager{
+		jobs:    make(map[string]*ScanJob),
+		subs:    make(map[string][]chan ScanJob),
+		queue:   make(chan scanTask, queueSize),
+		workers: workers,
+	}
+	m.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go m.worker()
+	}
+	go m.janitor()
+	log.Printf("Scan worker pool started: %d workers, queue size %d", workers, queueSize)
+	return m
+}
+
+// Submit queues info for scanning. The job takes ownership of info.Content.
+func (m *jobManager) Submit(info *uploadInfo) (ScanJob, error) {
+	jobs, err := m.SubmitAll([]*uploadInfo{info})
+	if err != nil {
+		return ScanJob{}, err
+	}
+	return jobs[0], nil
+}
+
+// SubmitAll queues every upload of a request, or none of them if the queue
+// cannot take them all, so a client never loses track of jobs that were
+// queued before one was refused. The jobs take ownership of the contents
+// only when it succeeds.
+func (m *jobManager) SubmitAll(infos []*uploadInfo) ([]ScanJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, errQueueClosed
+	}
+	// Workers only ever take tasks off the queue, so there is still room
+	// for all of them once this check passes
+	if free := cap(m.queue) - len(m.queue); len(infos) > free {
+		return nil, fmt.Errorf("%w: %d files, room for %d", errQueueFull, len(infos), free)
+	}
+	now := time.Now().UTC()
+	jobs := make([]ScanJob, 0, len(infos))
+	for _, info := range infos {
+		job := &ScanJob{
+			ID:        newID(),
+			Tenant:    info.Tenant,
+			State:     JobQueued,
+			FileName:  info.Name,
+			FileSize:  info.Size,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		m.queue <- scanTask{job: job, info: info}
+		m.jobs[job.ID] = job
+		jobs = append(jobs, *job)
+		log.Printf("Queued scan job %s for %s (queue depth %d)", job.ID, info.Name, len(m.queue))
+	}
+	return jobs, nil
+}
+
+// Get returns a snapshot of a job.
+func (m *jobManager) Get(id string) (ScanJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return ScanJob{}, errJobNotFound
+	}
+	return *job, nil
+}
+
+// Stats reports queue depth and worker utilisation.
+func (m *jobManager) Stats() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return map[string]interface{}{
+		"queue_depth":    len(m.queue),
+		"queue_capacity": cap(m.queue),
+		"active":         m.active,
+		"workers":        m.workers,
+		"tracked_jobs":   len(m.jobs),
+	}
+}
+
+// Subscribe returns a channel that receives the job's current state followed
+// by every change until it reaches a terminal state, and a cancel func.
+func (m *jobManager) Subscribe(id string) (<-chan ScanJob, func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, nil, errJobNotFound
+	}
+	ch := make(chan ScanJob, 8)
+	ch <- *job
+	if job.State.terminal() {
+		close(ch)
+		return ch, func() {}, nil
+	}
+	m.subs[id] = append(m.subs[id], ch)
+	cancel := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		subs := m.subs[id]
+		for i, c := range subs {
+			if c == ch {
+				m.subs[id] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, cancel, nil
+}
+
+// update applies fn to a job, notifies subscribers and returns the updated
+// snapshot. Must not be called with m.mu held.
+func (m *jobManager) update(job *ScanJob, fn func(*ScanJob)) ScanJob {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(job)
+	job.UpdatedAt = time.Now().UTC()
+	snapshot := *job
+	for _, ch := range m.subs[job.ID] {
+		select {
+		case ch <- snapshot:
+		default: // slow subscriber; it will catch up on the next event
+		}
+		if snapshot.State.terminal() {
+			close(ch)
+		}
+	}
+	if snapshot.State.terminal() {
+		delete(m.subs, job.ID)
+	}
+	return snapshot
+}
+
+func (m *jobManager) worker() {
+	defer m.wg.Done()
+	for task := range m.queue {
+		m.run(task)
+	}
+}
+
+// Drain stops accepting jobs and waits for the queued and running ones to
+// finish, or for ctx to expire.
+func (m *jobManager) Drain(ctx context.Context) error {
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	queued, active := len(m.queue), m.active
+	m.mu.Unlock()
+	log.Printf("Draining scan queue: %d queued, %d running", queued, active)
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return fmt.Errorf("%d scans still queued and %d running: %w", len(m.queue), m.active, ctx.Err())
+	}
+}
+
+func (m *jobManager) run(task scanTask) {
+	defer task.info.Content.Close()
+
+	m.mu.Lock()
+	m.active++
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.active--
+		m.mu.Unlock()
+	}()
+
+	m.update(task.job, func(j *ScanJob) { j.State = JobScanning })
+
+	result, err := processUpload(task.info)
+	done := m.update(task.job, func(j *ScanJob) {
+		if err != nil {
+			j.State, j.Error = JobError, err.Error()
+			return
+		}
+		j.Result = result
+		if result.PendingID != "" {
+			j.State = JobHeld
+			return
+		}
+		switch result.Verdict {
+		case VerdictClean:
+			j.State = JobClean
+		case VerdictMalicious:
+			j.State = JobMalicious
+		case VerdictSkipped:
+			j.State = JobSkipped
+		case VerdictRejected:
+			j.State = JobRejected
+		default:
+			j.State, j.Error = JobError, result.Error
+		}
+	})
+	log.Printf("Scan job %s finished: %s", done.ID, done.State)
+}
+
+// janitor drops finished jobs after jobRetention.
+func (m *jobManager) janitor() {
+	for range time.Tick(time.Minute) {
+		cutoff := time.Now().Add(-jobRetention)
+		m.mu.Lock()
+		for id, job := range m.jobs {
+			if job.State.terminal() && job.UpdatedAt.Before(cutoff) {
+				delete(m.jobs, id)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// scanQueueHandler serves GET /scans with queue statistics.
+func scanQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if setAPIHeaders(w, r, "GET, OPTIONS") {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := scanJobs.Stats()
+	if rs, ok := activeScanner.(*resilientScanner); ok {
+		stats["scanner"] = rs.Stats()
+	}
+	if verdicts != nil {
+		stats["verdict_cache"] = verdicts.Stats()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// scanJobHandler serves GET /scans/{id} and the SSE stream
+// GET /scans/{id}/events.
+func scanJobHandler(w http.ResponseWriter, r *http.Request) {
+	if setAPIHeaders(w, r, "GET, OPTIONS") {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenant, ok := requireTenant(w, r)
+	if !ok {
+		return
+	}
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/scans/"), "/")
+
+	// Jobs of other tenants are reported as not found
+	job, err := scanJobs.Get(id)
+	if err != nil || job.Tenant != tenant {
+		http.Error(w, "Scan job not found", http.StatusNotFound)
+		return
+	}
+
+	switch sub {
+	case "":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"job":         job,
+			"queue_depth": scanJobs.Stats()["queue_depth"],
+		})
+	case "events":
+		streamJobEvents(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// streamJobEvents writes job state changes as server-sent events until the
+// job finishes, the client goes away or the server starts shutting down.
+func streamJobEvents(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel, err := scanJobs.Subscribe(id)
+	if err != nil {
+		http.Error(w, "Scan job not found", http.StatusNotFound)
+		return
+	}
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var stopping <-chan struct{}
+	if server != nil {
+		stopping = server.Done()
+	}
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-stopping:
+			// The server waits for open streams; the client reconnects elsewhere
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case job, ok := <-events:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(job)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", job.State, data)
+			flusher.Flush()
+			if job.State.terminal() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingScanner reports each scan on started and finishes it, clean, once
+// release is closed.
+type blockingScanner struct {
+	started chan string
+	release chan struct{}
+}
+
+func newBlockingScanner() *blockingScanner {
+	return &blockingScanner{started: make(chan string, 16), release: make(chan struct{})}
+}
+
+func (s *blockingScanner) Name() string { return "blocking" }
+
+func (s *blockingScanner) ScanFile(path string, tags []string) (*ScanVerdict, error) {
+	return s.ScanReader(nil, path, tags)
+}
+
+func (s *blockingScanner) ScanReader(_ io.Reader, name string, _ []string) (*ScanVerdict, error) {
+	s.started <- name
+	<-s.release
+	return &ScanVerdict{Raw: map[string]interface{}{"fileName": name, "scanResult": 0}}, nil
+}
+
+// waitStarted waits for the scanner to start n scans.
+func (s *blockingScanner) waitStarted(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-s.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d scans started", i, n)
+		}
+	}
+}
+
+// useJobs replaces the scan queue with one of the given size and makes
+// scanner the active scanner.
+func useJobs(t *testing.T, workers, queueSize int, scanner *blockingScanner) *jobManager {
+	t.Helper()
+	m := newJobManager(workers, queueSize)
+	scanJobs = m
+	activeScanner = scanner
+	// Let the scans finish so the queue drains before the next test
+	t.Cleanup(func() {
+		select {
+		case <-scanner.release:
+		default:
+			close(scanner.release)
+		}
+		m.Drain(context.Background())
+	})
+	return m
+}
+
+// uploadAsync posts one file to /upload?async=true.
+func (a *testAPI) uploadAsync(name string) *httptest.ResponseRecorder {
+	a.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write([]byte("quarterly paper order for " + name))
+	mw.Close()
+	return a.do(http.MethodPost, "/upload?async=true", "", "", &body, mw.FormDataContentType())
+}
+
+func (a *testAPI) queued(name string) ScanJob {
+	a.t.Helper()
+	w := a.uploadAsync(name)
+	a.expect(w, http.StatusAccepted, "async upload of "+name)
+	var job ScanJob
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		a.t.Fatal(err)
+	}
+	return job
+}
+
+func TestScanQueueRefusesWhenFull(t *testing.T) {
+	api := newTestAPI(t, "")
+	scanner := newBlockingScanner()
+	m := useJobs(t, 1, 1, scanner)
+
+	first := api.queued("first.txt")
+	scanner.waitStarted(t, 1)
+	second := api.queued("second.txt")
+	if first.State != JobQueued || second.State != JobQueued {
+		t.Errorf("new jobs in states %s and %s, want queued", first.State, second.State)
+	}
+	stats := m.Stats()
+	if stats["active"] != 1 || stats["queue_depth"] != 1 {
+		t.Errorf("stats %v, want one running and one queued", stats)
+	}
+
+	// The worker and the queue are both taken
+	api.expect(api.uploadAsync("third.txt"), http.StatusServiceUnavailable, "upload to a full queue")
+	if stats := m.Stats(); stats["tracked_jobs"] != 2 {
+		t.Errorf("refused upload tracked: %v", stats)
+	}
+
+	close(scanner.release)
+	for _, job := range []ScanJob{first, second} {
+		events, cancel, err := m.Subscribe(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var last ScanJob
+		for last = range events {
+		}
+		cancel()
+		if last.State != JobClean || last.Result == nil || last.Result.DocumentID == "" {
+			t.Errorf("job %s ended %s with result %+v", job.FileName, last.State, last.Result)
+		}
+	}
+	if ids := api.listed("", ""); len(ids) != 2 {
+		t.Errorf("%d documents stored, want 2", len(ids))
+	}
+}
+
+func TestWorkerPoolRunsScansInParallel(t *testing.T) {
+	api := newTestAPI(t, "")
+	scanner := newBlockingScanner()
+	m := useJobs(t, 2, 4, scanner)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		api.queued(name)
+	}
+	// Two workers take a scan each; the third waits in the queue
+	scanner.waitStarted(t, 2)
+	select {
+	case name := <-scanner.started:
+		t.Fatalf("third scan %s started with two workers", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if stats := m.Stats(); stats["active"] != 2 || stats["queue_depth"] != 1 {
+		t.Errorf("stats %v, want two running and one queued", stats)
+	}
+	close(scanner.release)
+	scanner.waitStarted(t, 1)
+	if err := m.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.SubmitAll(nil); !errors.Is(err, errQueueClosed) {
+		t.Errorf("submit after drain: got %v, want errQueueClosed", err)
+	}
+}
+
+func TestSubscribeDeliversStateChanges(t *testing.T) {
+	api := newTestAPI(t, "")
+	scanner := newBlockingScanner()
+	m := useJobs(t, 1, 2, scanner)
+
+	// Hold the worker so the second job's whole life can be watched
+	api.queued("first.txt")
+	scanner.waitStarted(t, 1)
+	job := api.queued("second.txt")
+	events, cancel, err := m.Subscribe(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	close(scanner.release)
+
+	var states []JobState
+	for ev := range events {
+		states = append(states, ev.State)
+	}
+	if got := strings.Join(jobStates(states), " "); got != "queued scanning clean" {
+		t.Errorf("states %s, want queued scanning clean", got)
+	}
+
+	// A finished job gives its final state and closes at once
+	events, cancel, err = m.Subscribe(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	if ev := <-events; ev.State != JobClean {
+		t.Errorf("finished job state %s", ev.State)
+	}
+	if _, ok := <-events; ok {
+		t.Error("subscription to a finished job left open")
+	}
+	if _, _, err := m.Subscribe(newID()); !errors.Is(err, errJobNotFound) {
+		t.Errorf("unknown job: got %v, want errJobNotFound", err)
+	}
+}
+
+func jobStates(states []JobState) []string {
+	out := make([]string, len(states))
+	for i, s := range states {
+		out[i] = string(s)
+	}
+	return out
+}
+
+func TestScanJobEventsStream(t *testing.T) {
+	api := newTestAPI(t, "")
+	scanner := newBlockingScanner()
+	useJobs(t, 1, 2, scanner)
+	srv := httptest.NewServer(api.handler)
+	defer srv.Close()
+
+	job := api.queued("notes.txt")
+	scanner.waitStarted(t, 1)
+	res, err := http.Get(srv.URL + "/scans/" + job.ID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+
+	events := bufio.NewScanner(res.Body)
+	next := func() (string, ScanJob) {
+		t.Helper()
+		var name string
+		var job ScanJob
+		for events.Scan() {
+			line := events.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &job); err != nil {
+					t.Fatal(err)
+				}
+			case line == "" && name != "":
+				return name, job
+			}
+		}
+		return "", job
+	}
+	if name, ev := next(); name != "scanning" || ev.ID != job.ID {
+		t.Fatalf("first event %q for %s, want scanning for %s", name, ev.ID, job.ID)
+	}
+	close(scanner.release)
+	if name, ev := next(); name != "clean" || ev.Result == nil || ev.Result.Verdict != VerdictClean {
+		t.Fatalf("second event %q with result %+v, want clean", name, ev.Result)
+	}
+	// The stream ends with the job
+	if name, _ := next(); name != "" {
+		t.Errorf("event %q after the job finished", name)
+	}
+
+	// Jobs of other tenants are not found
+	api.expect(api.do(http.MethodGet, "/scans/"+job.ID+"/events", "", "acme", nil, ""), http.StatusNotFound, "another tenant's job")
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"common/auth"
+)
+
+// knowledgeConfig sends clean documents to the chat assistant's knowledge
+// index, aichat's /knowledge/documents. Indexing is off while URL is empty;
+// APIKey must belong to a principal with the indexer role. aichat fetches
+// each document back from /indexing/documents with an indexer key of its
+// own, so it never has to trust what it is sent.
+type knowledgeConfig struct {
+	URL       string        `yaml:"url" env:"KNOWLEDGE_INDEX_URL"`
+	APIKey    string        `yaml:"api_key" env:"KNOWLEDGE_INDEX_API_KEY" secret:"true"`
+	Timeout   time.Duration `yaml:"timeout" env:"KNOWLEDGE_INDEX_TIMEOUT_SECONDS" unit:"s"`
+	QueueSize int           `yaml:"queue_size" env:"KNOWLEDGE_INDEX_QUEUE_SIZE"`
+}
+
+// knowledgeAttempts bounds how often a document is offered to the index
+// before it is given up on.
+const knowledgeAttempts = 3
+
+// knowledgeTask adds doc to the index, or removes the tenant's document id
+// when doc is nil.
+type knowledgeTask struct {
+	doc    *Document
+	tenant string
+	id     string
+}
+
+// knowledgeIndexer feeds the knowledge index in the background, so uploads
+// don't wait for text extraction and embedding. A nil indexer does nothing.
+type knowledgeIndexer struct {
+	cfg    knowledgeConfig
+	client *http.Client
+	queue  chan knowledgeTask
+
+	mu sync.Mutex
+	// closed is set by Drain; the queue accepts no more tasks.
+	closed bool
+	done   chan struct{}
+}
+
+// knowledge is the process-wide indexer; nil when indexing is off.
+var knowledge *knowledgeIndexer
+
+func newKnowledgeIndexer(cfg knowledgeConfig) *knowledgeIndexer {
+	if cfg.URL == "" {
+		log.Printf("Knowledge indexing off; set KNOWLEDGE_INDEX_URL to index clean documents for the chat assistant")
+		return nil
+	}
+	k := &knowledgeIndexer{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		queue:  make(chan knowledgeTask, cfg.QueueSize),
+		done:   make(chan struct{}),
+	}
+	go k.worker()
+	log.Printf("Indexing clean documents into %s", cfg.URL)
+	return k
+}
+
+// indexable reports whether doc may be indexed: only documents the scanner
+// found clean are; unscanned and released ones never are.
+func indexable(doc *Document) bool {
+	return doc.Verdict == VerdictClean && doc.ReleasedBy == ""
+}
+
+// Index offers a stored document to the index.
+func (k *knowledgeIndexer) Index(doc *Document) {
+	if !indexable(doc) {
+		return
+	}
+	k.enqueue(knowledgeTask{doc: doc, tenant: doc.Tenant, id: doc.ID})
+}
+
+// Remove takes a deleted document out of the index.
+func (k *knowledgeIndexer) Remove(tenant, id string) {
+	k.enqueue(knowledgeTask{tenant: tenant, id: id})
+}
+
+func (k *knowledgeIndexer) enqueue(task knowledgeTask) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closed {
+		log.Printf("Knowledge index: shutting down, dropping document %s", task.id)
+		return
+	}
+	select {
+	case k.queue <- task:
+	default:
+		log.Printf("Knowledge index: queue full, dropping document %s", task.id)
+	}
+}
+
+func (k *knowledgeIndexer) worker() {
+	defer close(k.done)
+	for task := range k.queue {
+		var err error
+		for attempt := 1; attempt <= knowledgeAttempts; attempt++ {
+			if err = k.send(task); err == nil || errors.Is(err, errKnowledgeRejected) {
+				break
+			}
+			if attempt < knowledgeAttempts {
+				time.Sleep(time.Duration(attempt) * 2 * time.Second)
+			}
+		}
+		if err != nil {
+			log.Printf("Knowledge index: document %s: %v", task.id, err)
+		}
+	}
+}
+
+// errKnowledgeRejected marks answers that retrying will not change.
+var errKnowledgeRejected = errors.New("rejected")
+
+// send delivers one task. Documents are named by tenant and ID only;
+// aichat fetches the metadata and content from /indexing/documents.
+func (k *knowledgeIndexer) send(task knowledgeTask) error {
+	var req *http.Request
+	var err error
+	if task.doc == nil {
+		target := strings.TrimSuffix(k.cfg.URL, "/") + "/" + url.PathEscape(task.id) + "?tenant=" + url.QueryEscape(task.tenant)
+		req, err = http.NewRequest(http.MethodDelete, target, nil)
+	} else {
+		body, _ := json.Marshal(map[string]string{"id": task.id, "tenant": task.tenant})
+		req, err = http.NewRequest(http.MethodPost, k.cfg.URL, bytes.NewReader(body))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if k.cfg.APIKey != "" {
+		req.Header.Set("X-API-Key", k.cfg.APIKey)
+	}
+	res, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	switch {
+	case res.StatusCode < 300 || (task.doc == nil && res.StatusCode == http.StatusNotFound):
+		if task.doc != nil {
+			log.Printf("Knowledge index: indexed document %s (%s)", task.id, task.doc.Name)
+		}
+		return nil
+	case res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	default:
+		return fmt.Errorf("%w: %s: %s", errKnowledgeRejected, res.Status, strings.TrimSpace(string(msg)))
+	}
+}
+
+// Drain stops accepting documents and waits for the queued ones to be sent,
+// or for ctx to expire.
+func (k *knowledgeIndexer) Drain(ctx context.Context) error {
+	if k == nil {
+		return nil
+	}
+	k.mu.Lock()
+	if !k.closed {
+		k.closed = true
+		close(k.queue)
+	}
+	queued := len(k.queue)
+	k.mu.Unlock()
+	log.Printf("Draining knowledge index queue: %d queued", queued)
+	select {
+	case <-k.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d documents not yet indexed: %w", len(k.queue), ctx.Err())
+	}
+}
+
+// knowledgeSourceHandler serves GET /indexing/documents/{id} and
+// GET /indexing/documents/{id}/content to the knowledge index, which reads
+// the documents it is asked to index from here. Only authenticated indexers
+// are served, and only documents that may be indexed; ?tenant= names the
+// document's tenant unless the credential is bound to one.
+func knowledgeSourceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := auth.FromContext(r.Context())
+	if !ok || p.Anonymous() {
+		http.Error(w, "Unauthorized: indexing needs an indexer credential", http.StatusUnauthorized)
+		return
+	}
+	tenant := r.URL.Query().Get("tenant")
+	if p.Tenant != "" {
+		if tenant != "" && tenant != p.Tenant {
+			http.Error(w, "Cannot read documents of another tenant", http.StatusForbidden)
+			return
+		}
+		tenant = p.Tenant
+	}
+	tenant, err := tenants.Resolve(tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store, err := documents.For(tenant)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/indexing/documents/"), "/")
+	doc, err := store.Get(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !indexable(doc) {
+		http.Error(w, "Only documents with a clean scan verdict can be indexed", http.StatusConflict)
+		return
+	}
+	switch sub {
+	case "":
+		writeJSON(w, http.StatusOK, doc)
+	case "content":
+		serveDocumentContent(w, store, doc)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndexableOnlyCleanScannedDocuments(t *testing.T) {
+	for _, tc := range []struct {
+		verdict    Verdict
+		releasedBy string
+		want       bool
+	}{
+		{VerdictClean, "", true},
+		{VerdictClean, "admin", false},
+		{VerdictMalicious, "admin", false},
+		{VerdictUnscanned, "", false},
+		{VerdictSkipped, "", false},
+		{VerdictError, "", false},
+	} {
+		if got := indexable(&Document{Verdict: tc.verdict, ReleasedBy: tc.releasedBy}); got != tc.want {
+			t.Errorf("indexable(%s released by %q) = %t, want %t", tc.verdict, tc.releasedBy, got, tc.want)
+		}
+	}
+
+	// Documents that may not be indexed are never queued
+	k := &knowledgeIndexer{queue: make(chan knowledgeTask, 4)}
+	k.Index(&Document{ID: "unscanned", Verdict: VerdictUnscanned})
+	k.Index(&Document{ID: "released", Verdict: VerdictMalicious, ReleasedBy: "admin"})
+	k.Index(&Document{ID: "clean", Verdict: VerdictClean})
+	if len(k.queue) != 1 {
+		t.Fatalf("%d documents queued, want only the clean one", len(k.queue))
+	}
+	if task := <-k.queue; task.id != "clean" {
+		t.Errorf("queued %s, want clean", task.id)
+	}
+}
+
+func TestIndexingSourceRefusesDocumentsNotClean(t *testing.T) {
+	api := newTestAPI(t, "aichat:indexer-key::indexer,carol:carol-key::uploader")
+	store, err := documents.For(defaultTenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]string{}
+	for name, doc := range map[string]*Document{
+		"clean":     {Verdict: VerdictClean},
+		"unscanned": {Verdict: VerdictUnscanned},
+		"released":  {Verdict: VerdictMalicious, ReleasedBy: "admin"},
+	} {
+		doc.ID, doc.Name, doc.ContentType, doc.Size = newID(), name+".txt", "text/plain", int64(len(name))
+		doc.CreatedAt, doc.UpdatedAt = time.Now(), time.Now()
+		if err := store.Put(doc, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = doc.ID
+	}
+
+	content := func(name string) string { return "/indexing/documents/" + ids[name] + "/content" }
+	w := api.do(http.MethodGet, content("clean"), "indexer-key", "", nil, "")
+	api.expect(w, http.StatusOK, "clean document")
+	if w.Body.String() != "clean" {
+		t.Errorf("clean document content %q", w.Body)
+	}
+	api.expect(api.do(http.MethodGet, content("unscanned"), "indexer-key", "", nil, ""), http.StatusConflict, "unscanned document")
+	api.expect(api.do(http.MethodGet, content("released"), "indexer-key", "", nil, ""), http.StatusConflict, "released document")
+	api.expect(api.do(http.MethodGet, content("clean"), "carol-key", "", nil, ""), http.StatusForbidden, "uploader reading for the index")
+}
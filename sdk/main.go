@@ -1,87 +1,127 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync/atomic"
 	"time"
 
-	amaasclient "github.com/trendmicro/tm-v1-fs-golang-sdk"
+	"common/auth"
+	"common/config"
+	"common/origins"
+	"common/rbac"
+	"common/shutdown"
 )
 
-const (
-	uploadFolder = "./uploads"
-	maxUploadSize = 10 << 20 // 10 MB
-)
+const uploadFolder = "./uploads"
+
+// maxUploadSize limits single-request uploads; see uploadsConfig. Larger
+// files should use the resumable /uploads/resumable protocol.
+var maxUploadSize atomic.Int64
+
+// activeScanner is the engine used by the protected upload path.
+var activeScanner Scanner
+
+// server drains the service on SIGTERM; health checks fail once it starts.
+var server *shutdown.Server
+
+// allowedOrigins decides which browser origins get CORS access; see
+// origins.Config.
+var allowedOrigins *origins.Policy
 
 // setCORSHeaders sets appropriate CORS headers for multi-cloud support
 func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
-	origin := r.Header.Get("Origin")
-	
-	// Define allowed origins
-	allowedOrigins := []string{
-		"http://ui-service",
-		"https://ui-service",
-		// AWS ELB patterns
-		"http://*.elb.amazonaws.com",
-		"https://*.elb.amazonaws.com",
-		// Azure patterns
-		"http://*.cloudapp.azure.com",
-		"https://*.cloudapp.azure.com",
-		// GCP patterns  
-		"http://*.run.app",
-		"https://*.run.app",
-		// Development
-		"http://localhost",
-		"https://localhost",
-
-		"http://boringpapercompany.com",
-		"https://boringpapercompany.com",
-		"http://gcp.boringpapercompany.com",
-		"https://gcp.boringpapercompany.com",
-		"http://azure.boringpapercompany.com",
-		"https://azure.boringpapercompany.com",
-	}
-	
-	// Add specific load balancer IP for GCP
-	if loadBalancerIP := os.Getenv("LOAD_BALANCER_IP"); loadBalancerIP != "" {
-		allowedOrigins = append(allowedOrigins, "http://"+loadBalancerIP, "https://"+loadBalancerIP)
-	}
-	
-	// Check if origin is allowed
-	allowed := false
-	for _, allowedOrigin := range allowedOrigins {
-		if origin == allowedOrigin {
-			allowed = true
-			break
-		}
-	}
-	
-	if allowed {
+	w.Header().Set("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); origin != "" && allowedOrigins.Allowed(origin) {
 		w.Header().Set("Access-Control-Allow-Origin", origin)
-	} else {
-		w.Header().Set("Access-Control-Allow-Origin", "http://ui-service") // Default fallback
 	}
 }
 
 func main() {
+	cfg := defaultConfig()
+	opts := config.MustLoad("sdk", cfg)
+
 	// Ensure upload directory exists
 	if err := os.MkdirAll(uploadFolder, os.ModePerm); err != nil {
 		log.Fatalf("Failed to create upload directory: %v", err)
 	}
 
+	maxUploadSize.Store(cfg.Uploads.MaxSize)
+	uploadMemoryLimit = cfg.Uploads.MemoryLimit
+	spoolDir = cfg.Uploads.SpoolDir
+	expandLimits = cfg.Archives
+
+	allowedOrigins = origins.Must("sdk", cfg.Origins)
+	mustUploadPolicy(cfg.Uploads.Policy)
+	loadScanTags(cfg.Tags)
+	tenants = mustTenants(cfg.Tenants)
+	activeScanner = mustScanner(cfg.Scanner)
+	verdicts = mustVerdictCache(cfg.Cache, activeScanner)
+	documents = mustDocumentStore(cfg.Storage)
+	quarantine = mustQuarantineStore(cfg.Storage.QuarantineKey)
+	resumable = mustResumableStore(cfg.Resumable)
+	mustFailurePolicies(cfg.Failure)
+	pending = mustPendingStore(cfg.Storage.QuarantineKey)
+	go rescanPending(cfg.Failure.PendingRescan)
+	scanJobs = newJobManager(cfg.Jobs.Workers, cfg.Jobs.QueueSize)
+	knowledge = newKnowledgeIndexer(cfg.Knowledge)
+	authn := auth.Must("sdk", cfg.Auth)
+	access := rbac.Must("sdk", cfg.Access)
+	config.OnReload("sdk", func() { reloadConfig(cfg, opts.File, authn, access) })
+	if os.Getenv("ADMIN_TOKEN") != "" {
+		log.Printf("WARNING: ADMIN_TOKEN is no longer used; grant the admin role through AUTH_API_KEYS or your identity provider")
+	}
+	// protect authenticates the caller and checks the route's permission.
+	// CORS headers go first so the UI can read 401 and 403 responses.
+	protect := func(h http.HandlerFunc) http.HandlerFunc {
+		guarded := authn.Wrap(access.Wrap(h))
+		return func(w http.ResponseWriter, r *http.Request) {
+			setCORSHeaders(w, r)
+			guarded(w, r)
+		}
+	}
+
 	http.HandleFunc("/", rootHandler)
 	http.HandleFunc("/health", healthHandler)
-	http.HandleFunc("/upload", uploadHandler)           // Protected upload with scanning
-	http.HandleFunc("/upload-vulnerable", vulnerableUploadHandler) // Vulnerable upload without scanning
-
-	log.Println("Starting server on :5000")
-	log.Fatal(http.ListenAndServe(":5000", nil))
+	checks := healthChecks()
+	http.HandleFunc("/livez", checks.LiveHandler)
+	http.HandleFunc("/readyz", checks.ReadyHandler)
+	http.HandleFunc("/schemas/", schemaHandler)
+	http.HandleFunc("/upload", protect(uploadHandler))                      // Protected upload with scanning
+	http.HandleFunc("/upload-vulnerable", protect(vulnerableUploadHandler)) // Vulnerable upload without scanning
+	http.HandleFunc("/documents", protect(documentsHandler))
+	http.HandleFunc("/documents/", protect(documentHandler))
+	http.HandleFunc("/uploads/resumable", protect(resumableCreateHandler))
+	http.HandleFunc("/uploads/resumable/", protect(resumableUploadHandler))
+	http.HandleFunc("/indexing/documents/", protect(knowledgeSourceHandler)) // Indexers only
+	http.HandleFunc("/tenant/usage", protect(tenantUsageHandler))
+	http.HandleFunc("/scans", protect(scanQueueHandler))
+	http.HandleFunc("/scans/", protect(scanJobHandler))
+	http.HandleFunc("/quarantine", protect(quarantineListHandler))  // Admin only
+	http.HandleFunc("/quarantine/", protect(quarantineItemHandler)) // Admin only
+	http.HandleFunc("/pending", protect(pendingListHandler))        // Admin only
+	http.HandleFunc("/pending/", protect(pendingItemHandler))       // Admin only
+
+	addr := fmt.Sprintf(":%d", cfg.Port)
+	server = shutdown.New("sdk", &http.Server{Addr: addr}, cfg.Shutdown)
+	// Uploads already accepted are scanned before the process exits
+	server.OnShutdown("scan queue", scanJobs.Drain)
+	server.OnShutdown("knowledge index", knowledge.Drain)
+	server.OnShutdown("verdict cache", func(context.Context) error { return verdicts.Close() })
+	server.OnShutdown("scanner", func(context.Context) error {
+		closeScanner(activeScanner)
+		return nil
+	})
+	log.Printf("Starting server on %s", addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func rootHandler(w http.ResponseWriter, r *http.Request) {
@@ -92,16 +132,19 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers for health endpoint
 	setCORSHeaders(w, r)
 	w.Header().Set("Content-Type", "application/json")
+	if server != nil && server.Draining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, `{"status":"draining","service":"sdk"}`)
+		return
+	}
 	fmt.Fprintln(w, `{"status":"healthy","service":"sdk"}`)
 }
 
-
-
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers for multi-cloud support
 	setCORSHeaders(w, r)
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-Requested-With")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-API-Key, X-Requested-With")
 	w.Header().Set("Access-Control-Expose-Headers", "Content-Length")
 	w.Header().Set("Access-Control-Max-Age", "86400")
 
@@ -118,68 +161,86 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPost:
 		// Log request details
 		log.Printf("Received PROTECTED upload request. Content-Type: %s", r.Header.Get("Content-Type"))
-
-		// Parse multipart form
-		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-			log.Printf("Form parse error: %v", err)
-			http.Error(w, fmt.Sprintf("Cannot parse form: %v", err), http.StatusBadRequest)
+		tenant, ok := requireTenant(w, r)
+		if !ok {
 			return
 		}
 
-		// Get the file
-		file, handler, err := r.FormFile("file")
+		// Stream the multipart body; the file is hashed and held in memory
+		// while it is received and only spilled to disk if it is very large
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize.Load())
+		mr, err := r.MultipartReader()
 		if err != nil {
-			log.Printf("File retrieval error: %v", err)
-			http.Error(w, fmt.Sprintf("Error retrieving file: %v", err), http.StatusBadRequest)
+			log.Printf("Form parse error: %v", err)
+			http.Error(w, fmt.Sprintf("Cannot parse form: %v", err), http.StatusBadRequest)
 			return
 		}
-		defer file.Close()
 
-		// Check filename
-		if handler.Filename == "" {
+		// Get the files; several "file" parts may be sent in one request
+		infos, err := receiveUploads(mr, r, tenant)
+		if errors.Is(err, errNoSelectedFile) {
 			log.Println("No selected file")
 			http.Error(w, "No selected file", http.StatusBadRequest)
 			return
 		}
-
-		// Log file details
-		log.Printf("Uploaded file: %s, Size: %d bytes", handler.Filename, handler.Size)
-
-		// Save file
-		filename := filepath.Base(handler.Filename)
-		filePath := filepath.Join(uploadFolder, filename)
-		
-		dst, err := os.Create(filePath)
-		if err != nil {
-			log.Printf("File creation error: %v", err)
-			http.Error(w, fmt.Sprintf("Cannot create file: %v", err), http.StatusInternalServerError)
+		if errors.Is(err, errInvalidCategory) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer dst.Close()
-		defer os.Remove(filePath)
-
-		// Copy file
-		bytesWritten, err := io.Copy(dst, file)
 		if err != nil {
-			log.Printf("File write error: %v", err)
-			http.Error(w, fmt.Sprintf("Cannot write file: %v", err), http.StatusInternalServerError)
+			log.Printf("File retrieval error: %v", err)
+			http.Error(w, fmt.Sprintf("Error retrieving file: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		log.Printf("File saved: %s, Bytes written: %d", filePath, bytesWritten)
-
-		// Scan file (ALWAYS scan in protected endpoint)
-		scanResult, err := scanUploadedFile(filePath, handler.Size)
-		if err != nil {
-			log.Printf("Scan error: %v", err)
-			http.Error(w, fmt.Sprintf("Scan failed: %v", err), http.StatusInternalServerError)
+		// Hand off to the worker pool when the client asked for an async scan
+		expand := r.URL.Query().Get("expand") == "true"
+		if r.URL.Query().Get("async") == "true" {
+			if expand {
+				closeUploads(infos)
+				http.Error(w, "Archives cannot be expanded in asynchronous scans; drop async or expand", http.StatusBadRequest)
+				return
+			}
+			jobs, err := scanJobs.SubmitAll(infos)
+			if err != nil {
+				closeUploads(infos)
+				log.Printf("Scan queue error: %v", err)
+				http.Error(w, fmt.Sprintf("Cannot queue scan: %v", err), http.StatusServiceUnavailable)
+				return
+			}
+			if len(jobs) == 1 {
+				writeJSON(w, http.StatusAccepted, jobs[0])
+			} else {
+				writeJSON(w, http.StatusAccepted, map[string]interface{}{"jobs": jobs})
+			}
+			return
+		}
+		defer closeUploads(infos)
+
+		// Scan files (ALWAYS scan in protected endpoint), then store or
+		// quarantine them. Archives are optionally expanded and scanned per member.
+		if len(infos) == 1 && !(expand && archiveKind(infos[0].Name) != "") {
+			scanResult, err := processUpload(infos[0])
+			if err != nil {
+				log.Printf("Upload processing error: %v", err)
+				http.Error(w, fmt.Sprintf("Upload failed: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			// Render results
+			writeJSON(w, scanResult.httpStatus(), scanResult)
 			return
 		}
 
-		// Render results
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(scanResult))
+		var results []*ScanResult
+		for _, info := range infos {
+			if expand && archiveKind(info.Name) != "" {
+				results = append(results, processArchive(info)...)
+				continue
+			}
+			results = append(results, processOrFail(info))
+		}
+		writeJSON(w, http.StatusOK, newUploadBatch(results))
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -190,7 +251,7 @@ func vulnerableUploadHandler(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers for multi-cloud support
 	setCORSHeaders(w, r)
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-Requested-With")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-API-Key, X-Requested-With")
 	w.Header().Set("Access-Control-Expose-Headers", "Content-Length")
 	w.Header().Set("Access-Control-Max-Age", "86400")
 
@@ -211,7 +272,7 @@ func vulnerableUploadHandler(w http.ResponseWriter, r *http.Request) {
 		// SECURITY ISSUE: No file size limits
 		// SECURITY ISSUE: No file type validation
 		// SECURITY ISSUE: No malware scanning
-		
+
 		// Parse multipart form (no size limit!)
 		if err := r.ParseMultipartForm(100 << 20); err != nil { // 100MB limit
 			log.Printf("Form parse error: %v", err)
@@ -241,7 +302,7 @@ func vulnerableUploadHandler(w http.ResponseWriter, r *http.Request) {
 		// SECURITY ISSUE: No filename sanitization - allows path traversal attacks
 		filename := handler.Filename // Use original filename without sanitization!
 		filePath := filepath.Join(uploadFolder, filename)
-		
+
 		// SECURITY ISSUE: No directory traversal protection
 		dst, err := os.Create(filePath)
 		if err != nil {
@@ -263,173 +324,91 @@ func vulnerableUploadHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("VULNERABLE file saved: %s, Bytes written: %d", filePath, bytesWritten)
 
 		// SECURITY ISSUE: NO SCANNING - File is uploaded without any security checks
-		response := map[string]interface{}{
-			"scan_result_code": -4, // -4 indicates vulnerable upload (no scanning)
-			"scan_results": map[string]interface{}{
-				"status": "vulnerable",
-				"reason": "Vulnerable endpoint - no scanning performed",
-				"message": "File uploaded successfully but NO security scanning was performed",
-				"file_path": filePath,
-				"file_size": bytesWritten,
-			},
+		response := newScanResult(filepath.Base(filePath), bytesWritten)
+		response.Code = CodeVulnerable
+		response.Verdict = VerdictUnscanned
+		response.Reason = ReasonVulnerableEndpoint
+		response.Message = "File uploaded successfully but NO security scanning was performed"
+		response.FilePath = filePath
+
+		// Report (but don't enforce) what the file type policy would have done
+		if f, err := os.Open(filePath); err == nil {
+			response.Policy = uploadPolicy.Load().Evaluate(handler.Filename, handler.Header.Get("Content-Type"), readHead(f))
+			f.Close()
+			if !response.Policy.Allowed {
+				log.Printf("VULNERABLE upload would have been rejected by policy: %s", response.Policy.Reason())
+			}
 		}
-		responseJSON, _ := json.Marshal(response)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(responseJSON))
+		writeJSON(w, http.StatusOK, response)
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func scanUploadedFile(filePath string, fileSize int64) (string, error) {
-	// Get API key and region from environment
-	apiKey := os.Getenv("API_KEY")
-	region := os.Getenv("REGION")
-
-	// Log API configuration (without exposing the key)
-	log.Printf("API configuration - Region: %s, Key length: %d", region, len(apiKey))
-
-	// Check if API key is available
-	if apiKey == "" {
-		log.Println("Warning: API_KEY not set; file scanning will be skipped")
-		response := map[string]interface{}{
-			"scan_result_code": -1, // -1 indicates scan was skipped
-			"scan_results": map[string]interface{}{
-				"status": "skipped",
-				"reason": "No API key configured",
-				"message": "File uploaded successfully but not scanned due to missing API key",
-			},
-		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
-	}
-
-	start := time.Now()
-
-	// Initialize client
-	c, err := amaasclient.NewClient(apiKey, region)
-	if err != nil {
-		log.Printf("Failed to create client: %v", err)
-		// Return error response but don't fail the upload
-		response := map[string]interface{}{
-			"scan_result_code": -2, // -2 indicates scan failed
-			"scan_results": map[string]interface{}{
-				"status": "error",
-				"reason": "Failed to create scan client",
-				"error": err.Error(),
-			},
-		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
-	}
-	defer c.Destroy()
+// scanUploadedFile scans a saved upload with the active scanner. Scan
+// problems are reported in the returned ScanResult rather than as an error so
+// the upload itself still succeeds.
+func scanUploadedFile(info *uploadInfo) (*ScanResult, error) {
+	fileSize := info.Size
+	result := newScanResult(info.Name, fileSize)
 
-	// Log file details before scanning
-	log.Printf("Scanning file: %s (size: %d bytes)", filePath, fileSize)
-	
 	// Validate file before scanning
 	if fileSize == 0 {
 		log.Printf("Warning: File is empty, skipping scan")
-		response := map[string]interface{}{
-			"scan_result_code": -3, // -3 indicates empty file
-			"scan_results": map[string]interface{}{
-				"status": "skipped",
-				"reason": "Empty file",
-				"message": "File is empty, no scan needed",
-				"file_name": filepath.Base(filePath),
-				"file_size": fileSize,
-			},
-		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
+		return result.skipped(CodeEmptyFile, ReasonEmptyFile, "File is empty, no scan needed"), nil
 	}
-	
+
 	// Check file size limits (Trend Micro has limits)
 	if fileSize > 100*1024*1024 { // 100MB limit
 		log.Printf("Warning: File too large for scanning (%d bytes), skipping", fileSize)
-		response := map[string]interface{}{
-			"scan_result_code": -3, // -3 indicates file too large
-			"scan_results": map[string]interface{}{
-				"status": "skipped",
-				"reason": "File too large",
-				"message": "File exceeds maximum size for scanning",
-				"file_name": filepath.Base(filePath),
-				"file_size": fileSize,
-			},
-		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
+		return result.skipped(CodeFileTooLarge, ReasonFileTooLarge, "File exceeds maximum size for scanning"), nil
 	}
-	
-	// Scan file
-	tags := []string{"bpc-uploads"}
-	result, err := c.ScanFile(filePath, tags)
-	if err != nil {
-		log.Printf("Scan failed: %v", err)
-		// Check if this is a specific API error that should be retried
-		if strings.Contains(err.Error(), "unknown error") || strings.Contains(err.Error(), "Ecountered") {
-			log.Printf("API returned unknown error, this might be a transient issue")
-		}
-		// Return error response but don't fail the upload
-		response := map[string]interface{}{
-			"scan_result_code": -2, // -2 indicates scan failed
-			"scan_results": map[string]interface{}{
-				"status": "error",
-				"reason": "File scan failed",
-				"error": err.Error(),
-				"file_name": filepath.Base(filePath),
-				"file_size": fileSize,
-			},
+	result.SHA256 = info.Content.SHA256()
+	result.Tags = info.Tags
+
+	// Identical content was already scanned by this engine; reuse its verdict
+	if verdicts != nil {
+		if entry, ok := verdicts.Get(info.Tenant, activeScanner.Name(), result.SHA256); ok {
+			log.Printf("Verdict cache hit for %s (%s)", info.Name, result.SHA256)
+			result = result.finished(entry.Engine, entry.Verdict, 0)
+			result.Cached = true
+			return result, nil
 		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
 	}
 
-	elapsed := time.Since(start)
-	log.Printf("Scanning completed in %.2f seconds.", elapsed.Seconds())
-	log.Printf("Scanning complete: %s", result)
-
-	// Parse result to check scan status
-	var resultMap map[string]interface{}
-	if err := json.Unmarshal([]byte(result), &resultMap); err != nil {
-		log.Printf("Failed to parse scan result: %v", err)
-		// Return error response but don't fail the upload
-		response := map[string]interface{}{
-			"scan_result_code": -2, // -2 indicates scan failed
-			"scan_results": map[string]interface{}{
-				"status": "error",
-				"reason": "Failed to parse scan result",
-				"error": err.Error(),
-			},
-		}
-		responseJSON, _ := json.Marshal(response)
-		return string(responseJSON), nil
-	}
+	// Log file details before scanning
+	log.Printf("Scanning file with %s: %s (size: %d bytes)", activeScanner.Name(), info.Name, fileSize)
+	result.Engine = activeScanner.Name()
+	start := time.Now()
 
-	// Mimic Python version's result handling
-	scanResultCode := 0
-	if val, ok := resultMap["scanResult"].(float64); ok && val == 1 {
-		scanResultCode = 1
-		log.Println("File is malicious")
-	} else if val, ok := resultMap["scanResult"].(float64); ok && val == 0 {
-		log.Println("File is clean")
+	// Scan file, straight from memory unless it had to be spilled to disk
+	tags := info.Tags
+	if len(tags) == 0 {
+		tags = []string{baseScanTag}
+	}
+	var verdict *ScanVerdict
+	var err error
+	if path := info.Content.Path(); path != "" {
+		verdict, err = activeScanner.ScanFile(path, tags)
 	} else {
-		log.Printf("Unexpected scanResult value: %v (type: %T)", resultMap["scanResult"], resultMap["scanResult"])
+		verdict, err = activeScanner.ScanReader(info.Content.Reader(), info.Name, tags)
 	}
-	
-	// Also check foundMalwares array for additional detection
-	if malwares, ok := resultMap["foundMalwares"].([]interface{}); ok && len(malwares) > 0 {
-		scanResultCode = 1
-		log.Printf("File is malicious - found malwares: %v", malwares)
+	switch {
+	case errors.Is(err, errScannerNotConfigured):
+		return result.skipped(CodeNotConfigured, ReasonNotConfigured,
+			"File uploaded successfully but not scanned due to missing scanner configuration"), nil
+	case errors.Is(err, errScannerUnavailable):
+		return result.failed(ReasonScannerUnavailable, err), nil
+	case err != nil:
+		log.Printf("Scan failed: %v", err)
+		return result.failed(ReasonScanFailed, err), nil
 	}
 
-	// Prepare response similar to Python version
-	response := map[string]interface{}{
-		"scan_result_code": scanResultCode,
-		"scan_results":     resultMap,
+	elapsed := time.Since(start)
+	log.Printf("Scanning completed in %.2f seconds.", elapsed.Seconds())
+	if verdicts != nil {
+		verdicts.Put(info.Tenant, activeScanner.Name(), result.SHA256, verdict)
 	}
-
-	responseJSON, _ := json.Marshal(response)
-	return string(responseJSON), nil
-}
\ No newline at end of file
+	return result.finished(activeScanner.Name(), verdict, elapsed), nil
+}
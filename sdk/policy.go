@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// sniffLen is how many leading bytes are inspected for magic numbers.
+const sniffLen = 512
+
+// UploadPolicy decides which files may enter the scan pipeline, based on the
+// file extension and the content type sniffed from its magic bytes.
+type UploadPolicy struct {
+	AllowedExtensions []string `json:"allowed_extensions"`
+	DeniedExtensions  []string `json:"denied_extensions"`
+	AllowedTypes      []string `json:"allowed_types"`
+	DeniedTypes       []string `json:"denied_types"`
+	// DetectMismatch rejects files whose content contradicts their
+	// extension, e.g. a .pdf that is really a PE executable.
+	DetectMismatch bool `json:"detect_mismatch"`
+}
+
+// PolicyDecision is the outcome of evaluating an UploadPolicy for one file.
+type PolicyDecision struct {
+	Allowed      bool     `json:"allowed"`
+	Enforced     bool     `json:"enforced"`
+	Extension    string   `json:"extension"`
+	DeclaredType string   `json:"declared_type,omitempty"`
+	DetectedType string   `json:"detected_type"`
+	Violations   []string `json:"violations,omitempty"`
+}
+
+// Reason joins the violations into a single human-readable sentence.
+func (d *PolicyDecision) Reason() string {
+	return strings.Join(d.Violations, "; ")
+}
+
+// uploadPolicy is the policy applied to uploads; see loadUploadPolicy. It
+// is replaced when the configuration is reloaded.
+var uploadPolicy atomic.Pointer[UploadPolicy]
+
+// loadUploadPolicy reads the policy from the JSON file named in cfg, then
+// applies cfg's list and mismatch overrides.
+func loadUploadPolicy(cfg uploadPolicyConfig) (*UploadPolicy, error) {
+	p := &UploadPolicy{DetectMismatch: true}
+	if path := cfg.File; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, p); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	for src, dst := range map[*[]string]*[]string{
+		&cfg.AllowedExtensions: &p.AllowedExtensions,
+		&cfg.DeniedExtensions:  &p.DeniedExtensions,
+		&cfg.AllowedTypes:      &p.AllowedTypes,
+		&cfg.DeniedTypes:       &p.DeniedTypes,
+	} {
+		if *src != nil {
+			*dst = splitList(strings.Join(*src, ","))
+		}
+	}
+	if cfg.DetectMismatch != nil {
+		p.DetectMismatch = *cfg.DetectMismatch
+	}
+	for _, list := range [][]string{p.AllowedExtensions, p.DeniedExtensions} {
+		for i, ext := range list {
+			list[i] = normalizeExt(ext)
+		}
+	}
+	return p, nil
+}
+
+// applyUploadPolicy puts the policy described by cfg in force.
+func applyUploadPolicy(cfg uploadPolicyConfig) error {
+	p, err := loadUploadPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	uploadPolicy.Store(p)
+	return nil
+}
+
+func mustUploadPolicy(cfg uploadPolicyConfig) {
+	if err := applyUploadPolicy(cfg); err != nil {
+		log.Fatalf("Failed to load upload policy: %v", err)
+	}
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func normalizeExt(ext string) string {
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// magicSignatures cover formats http.DetectContentType doesn't distinguish.
+var magicSignatures = []struct {
+	prefix      []byte
+	contentType string
+}{
+	{[]byte("MZ"), "application/vnd.microsoft.portable-executable"},
+	{[]byte("\x7fELF"), "application/x-elf"},
+	{[]byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("\xce\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("\xca\xfe\xba\xbe"), "application/java-vm"},
+	{[]byte("#!"), "text/x-shellscript"},
+	{[]byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), "application/x-ole-storage"},
+}
+
+// executableTypes are sniffed types that can run on their own.
+var executableTypes = map[string]bool{
+	"application/vnd.microsoft.portable-executable": true,
+	"application/x-elf":                             true,
+	"application/x-mach-binary":                     true,
+	"application/java-vm":                           true,
+	"text/x-shellscript":                            true,
+}
+
+// executableExtensions may legitimately contain executable content.
+var executableExtensions = map[string]bool{
+	".exe": true, ".dll": true, ".sys": true, ".scr": true, ".com": true, ".msi": true,
+	".so": true, ".bin": true, ".elf": true, ".dylib": true, ".class": true, ".jar": true,
+	".sh": true, ".bash": true, ".py": true, ".pl": true, ".rb": true,
+}
+
+// expectedTypes lists the sniffed types acceptable for well-known
+// extensions. Extensions not listed are only checked for disguised
+// executables.
+var expectedTypes = map[string][]string{
+	".pdf":  {"application/pdf"},
+	".png":  {"image/png"},
+	".jpg":  {"image/jpeg"},
+	".jpeg": {"image/jpeg"},
+	".gif":  {"image/gif"},
+	".webp": {"image/webp"},
+	".bmp":  {"image/bmp"},
+	".zip":  {"application/zip"},
+	".docx": {"application/zip"},
+	".xlsx": {"application/zip"},
+	".pptx": {"application/zip"},
+	".odt":  {"application/zip"},
+	".gz":   {"application/x-gzip"},
+	".tgz":  {"application/x-gzip"},
+	".doc":  {"application/x-ole-storage"},
+	".xls":  {"application/x-ole-storage"},
+	".ppt":  {"application/x-ole-storage"},
+	".txt":  {"text/plain"},
+	".csv":  {"text/plain"},
+	".md":   {"text/plain"},
+	".json": {"text/plain", "application/json"},
+}
+
+// sniffContentType identifies content from its leading bytes.
+func sniffContentType(head []byte) string {
+	for _, sig := range magicSignatures {
+		if bytes.HasPrefix(head, sig.prefix) {
+			return sig.contentType
+		}
+	}
+	ct, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	return ct
+}
+
+// Evaluate checks a file's name, declared type and leading bytes.
+func (p *UploadPolicy) Evaluate(name, declaredType string, head []byte) *PolicyDecision {
+	ext := strings.ToLower(filepath.Ext(name))
+	detected := sniffContentType(head)
+	d := &PolicyDecision{Extension: ext, DeclaredType: declaredType, DetectedType: detected}
+
+	if len(p.AllowedExtensions) > 0 && !contains(p.AllowedExtensions, ext) {
+		d.Violations = append(d.Violations, fmt.Sprintf("extension %q is not in the allow list", ext))
+	}
+	if contains(p.DeniedExtensions, ext) {
+		d.Violations = append(d.Violations, fmt.Sprintf("extension %q is denied", ext))
+	}
+	if len(p.AllowedTypes) > 0 && !matchesType(p.AllowedTypes, detected) {
+		d.Violations = append(d.Violations, fmt.Sprintf("content type %s is not in the allow list", detected))
+	}
+	if matchesType(p.DeniedTypes, detected) {
+		d.Violations = append(d.Violations, fmt.Sprintf("content type %s is denied", detected))
+	}
+	if p.DetectMismatch && len(head) > 0 {
+		if executableTypes[detected] && !executableExtensions[ext] {
+			d.Violations = append(d.Violations, fmt.Sprintf("file named %q is actually executable content (%s)", ext, detected))
+		} else if want, ok := expectedTypes[ext]; ok && !contains(want, detected) {
+			d.Violations = append(d.Violations, fmt.Sprintf("content type %s does not match extension %q", detected, ext))
+		}
+	}
+	d.Allowed = len(d.Violations) == 0
+	return d
+}
+
+// matchesType reports whether ct matches any pattern; patterns may end in
+// "/*" to match a whole family such as "image/*".
+func matchesType(patterns []string, ct string) bool {
+	for _, p := range patterns {
+		if p == ct || (strings.HasSuffix(p, "/*") && strings.HasPrefix(ct, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readHead returns up to sniffLen leading bytes of r.
+func readHead(r io.Reader) []byte {
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(r, head)
+	return head[:n]
+}
+
+// checkUploadPolicy evaluates the upload policy for info. It returns a
+// rejection result when the policy blocks the file, and the decision either
+// way so callers can report it.
+func checkUploadPolicy(info *uploadInfo) (*PolicyDecision, *ScanResult) {
+	policy := uploadPolicy.Load()
+	if p := tenants.Config(info.Tenant).UploadPolicy; p != nil {
+		policy = p
+	}
+	d := policy.Evaluate(info.Name, info.ContentType, readHead(info.Content.Reader()))
+	d.Enforced = true
+	if d.Allowed {
+		return d, nil
+	}
+	log.Printf("Upload policy rejected %s: %s", info.Name, d.Reason())
+	result := newScanResult(info.Name, info.Size)
+	result.SHA256 = info.Content.SHA256()
+	result.Code, result.Verdict, result.Reason = CodePolicyRejected, VerdictRejected, ReasonPolicyRejected
+	result.Message = "Upload rejected by file type policy: " + d.Reason()
+	result.Policy = d
+	return d, result
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"testing"
+)
+
+var (
+	headPE     = []byte("MZ\x90\x00\x03\x00\x00\x00")
+	headELF    = []byte("\x7fELF\x02\x01\x01\x00")
+	headMachO  = []byte("\xcf\xfa\xed\xfe\x07\x00\x00\x01")
+	headClass  = []byte("\xca\xfe\xba\xbe\x00\x00\x00\x34")
+	headScript = []byte("#!/bin/sh\nrm -rf /\n")
+	headOLE    = []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1\x00\x00")
+	headPDF    = []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	headPNG    = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	headJPEG   = []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	headZip    = []byte("PK\x03\x04\x14\x00\x00\x00\x08\x00")
+	headGzip   = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00")
+	headText   = []byte("quarterly paper order\n")
+)
+
+func TestSniffContentType(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"PE", headPE, "application/vnd.microsoft.portable-executable"},
+		{"ELF", headELF, "application/x-elf"},
+		{"Mach-O", headMachO, "application/x-mach-binary"},
+		{"Java class", headClass, "application/java-vm"},
+		{"shell script", headScript, "text/x-shellscript"},
+		{"OLE", headOLE, "application/x-ole-storage"},
+		{"PDF", headPDF, "application/pdf"},
+		{"PNG", headPNG, "image/png"},
+		{"JPEG", headJPEG, "image/jpeg"},
+		{"zip", headZip, "application/zip"},
+		{"gzip", headGzip, "application/x-gzip"},
+		{"text", headText, "text/plain"},
+		{"empty", nil, "text/plain"},
+	} {
+		if got := sniffContentType(tc.head); got != tc.want {
+			t.Errorf("%s sniffed as %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUploadPolicyEvaluate(t *testing.T) {
+	mismatch := UploadPolicy{DetectMismatch: true}
+	for _, tc := range []struct {
+		name     string
+		policy   UploadPolicy
+		file     string
+		head     []byte
+		detected string
+		allowed  bool
+	}{
+		{"pdf", mismatch, "invoice.pdf", headPDF, "application/pdf", true},
+		{"upper case extension", mismatch, "INVOICE.PDF", headPDF, "application/pdf", true},
+		{"executable named pdf", mismatch, "invoice.pdf", headPE, "application/vnd.microsoft.portable-executable", false},
+		{"elf named png", mismatch, "logo.png", headELF, "application/x-elf", false},
+		{"script named txt", mismatch, "notes.txt", headScript, "text/x-shellscript", false},
+		{"executable named exe", mismatch, "setup.exe", headPE, "application/vnd.microsoft.portable-executable", true},
+		{"script named sh", mismatch, "build.sh", headScript, "text/x-shellscript", true},
+		{"executable with unlisted extension", mismatch, "report.dat", headPE, "application/vnd.microsoft.portable-executable", false},
+		{"text with unlisted extension", mismatch, "report.dat", headText, "text/plain", true},
+		{"zip named docx", mismatch, "contract.docx", headZip, "application/zip", true},
+		{"png named jpg", mismatch, "photo.jpg", headPNG, "image/png", false},
+		{"ole named doc", mismatch, "memo.doc", headOLE, "application/x-ole-storage", true},
+		{"text named pdf", mismatch, "invoice.pdf", headText, "text/plain", false},
+		{"empty file", mismatch, "invoice.pdf", nil, "text/plain", true},
+		{"mismatch off", UploadPolicy{}, "invoice.pdf", headPE, "application/vnd.microsoft.portable-executable", true},
+		{"allowed extension", UploadPolicy{AllowedExtensions: []string{".pdf", ".png"}}, "logo.png", headPNG, "image/png", true},
+		{"extension not allowed", UploadPolicy{AllowedExtensions: []string{".pdf", ".png"}}, "notes.txt", headText, "text/plain", false},
+		{"denied extension", UploadPolicy{DeniedExtensions: []string{".exe"}}, "setup.exe", headPE, "application/vnd.microsoft.portable-executable", false},
+		{"allowed type family", UploadPolicy{AllowedTypes: []string{"image/*"}}, "logo.png", headPNG, "image/png", true},
+		{"type not allowed", UploadPolicy{AllowedTypes: []string{"image/*"}}, "invoice.pdf", headPDF, "application/pdf", false},
+		{"denied type", UploadPolicy{DeniedTypes: []string{"application/x-elf"}}, "tool", headELF, "application/x-elf", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := tc.policy.Evaluate(tc.file, "application/octet-stream", tc.head)
+			if d.DetectedType != tc.detected {
+				t.Errorf("detected %s, want %s", d.DetectedType, tc.detected)
+			}
+			if d.Allowed != tc.allowed {
+				t.Errorf("allowed = %t, want %t (violations: %s)", d.Allowed, tc.allowed, d.Reason())
+			}
+			if d.Allowed != (len(d.Violations) == 0) {
+				t.Errorf("allowed = %t with violations %v", d.Allowed, d.Violations)
+			}
+		})
+	}
+}
+
+func TestUploadRejectsDisguisedExecutable(t *testing.T) {
+	api := newTestAPI(t, "")
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "invoice.pdf")
+	fw.Write(append(headPE, make([]byte, 64)...))
+	mw.Close()
+	w := api.do(http.MethodPost, "/upload", "", "", &body, mw.FormDataContentType())
+	api.expect(w, http.StatusUnsupportedMediaType, "upload an executable named .pdf")
+
+	var result ScanResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Verdict != VerdictRejected || result.Code != CodePolicyRejected || result.Policy == nil || result.Policy.Allowed {
+		t.Fatalf("rejection result %+v", result)
+	}
+	if ids := api.listed("", ""); len(ids) != 0 {
+		t.Fatalf("rejected file stored as %v", ids)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuarantineItem is the metadata kept next to every quarantined file.
+type QuarantineItem struct {
+	ID            string      `json:"id"`
+	Tenant        string      `json:"tenant,omitempty"`
+	FileName      string      `json:"file_name"`
+	ContentType   string      `json:"content_type"`
+	Size          int64       `json:"size"`
+	SHA256        string      `json:"sha256"`
+	Uploader      string      `json:"uploader"`
+	MalwareNames  []string    `json:"malware_names"`
+	QuarantinedAt time.Time   `json:"quarantined_at"`
+	ScanResult    *ScanResult `json:"scan_result"`
+}
+
+// quarantineStore keeps malicious uploads encrypted with AES-256-GCM:
+//
+//	<root>/<id>.bin   nonce || ciphertext
+//	<root>/<id>.json  QuarantineItem
+type quarantineStore struct {
+	root string
+	aead cipher.AEAD
+	mu   sync.RWMutex
+	// claimed holds the items being worked on; see Claim
+	claimed map[string]bool
+}
+
+// quarantine holds malicious uploads for review.
+var quarantine *quarantineStore
+
+var (
+	errQuarantineNotFound = errors.New("quarantined item not found")
+	errQuarantineBusy     = errors.New("quarantined item is being processed")
+)
+
+// newQuarantineStore opens the quarantine under root. encodedKey is the
+// base64 of a 32-byte key; it has to come from the configuration, so the key
+// is never stored on the volume next to the ciphertext it protects.
+func newQuarantineStore(root, encodedKey string) (*quarantineStore, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, err
+	}
+	key, err := loadQuarantineKey(root, encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &quarantineStore{root: root, aead: aead, claimed: map[string]bool{}}, nil
+}
+
+var errQuarantineKey = errors.New("QUARANTINE_KEY must be 32 random bytes, base64 encoded (openssl rand -base64 32)")
+
+// decodeQuarantineKey checks and decodes the configured key.
+func decodeQuarantineKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, errQuarantineKey
+	}
+	return key, nil
+}
+
+// loadQuarantineKey decodes the configured key, which is required.
+func loadQuarantineKey(root, encoded string) ([]byte, error) {
+	if encoded == "" {
+		return nil, fmt.Errorf("QUARANTINE_KEY is required to encrypt %s: %w", root, errQuarantineKey)
+	}
+	return decodeQuarantineKey(encoded)
+}
+
+func mustQuarantineStore(key string) *quarantineStore {
+	q, err := newQuarantineStore(filepath.Join(uploadFolder, "quarantine"), key)
+	if err != nil {
+		log.Fatalf("Failed to open quarantine: %v", err)
+	}
+	return q
+}
+
+// Add encrypts content into the quarantine. The file is sealed into a
+// temporary name first, so it is never listed half written.
+func (q *quarantineStore) Add(item *QuarantineItem, content io.Reader) error {
+	meta, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return err
+	}
+	binPath := filepath.Join(q.root, item.ID+".bin")
+	f, err := os.OpenFile(binPath+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	err = sealSegments(f, q.aead, item.ID, content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(binPath + ".tmp")
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := os.Rename(binPath+".tmp", binPath); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(q.root, item.ID+".json"), meta, 0o600)
+}
+
+func (q *quarantineStore) List() ([]*QuarantineItem, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	matches, err := filepath.Glob(filepath.Join(q.root, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	items := []*QuarantineItem{}
+	for _, m := range matches {
+		item, err := q.readMeta(strings.TrimSuffix(filepath.Base(m), ".json"))
+		if err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].QuarantinedAt.After(items[j].QuarantinedAt) })
+	return items, nil
+}
+
+func (q *quarantineStore) Get(id string) (*QuarantineItem, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.readMeta(id)
+}
+
+func (q *quarantineStore) readMeta(id string) (*QuarantineItem, error) {
+	if !validID.MatchString(id) {
+		return nil, errQuarantineNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(q.root, id+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errQuarantineNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var item QuarantineItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// Open returns a reader decrypting a quarantined file as it is read.
+func (q *quarantineStore) Open(id string) (io.ReadCloser, error) {
+	if !validID.MatchString(id) {
+		return nil, errQuarantineNotFound
+	}
+	q.mu.RLock()
+	f, err := os.Open(filepath.Join(q.root, id+".bin"))
+	q.mu.RUnlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errQuarantineNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	r, err := openSealed(f, q.aead, id)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// Content decrypts a quarantined file into memory.
+func (q *quarantineStore) Content(id string) ([]byte, error) {
+	rc, err := q.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// Claim reserves an item for one caller, such as a rescan, until the
+// returned release is called. It fails with errQuarantineBusy while another
+// caller holds it, so an item is never processed twice at once.
+func (q *quarantineStore) Claim(id string) (release func(), err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.claimed[id] {
+		return nil, errQuarantineBusy
+	}
+	q.claimed[id] = true
+	return func() {
+		q.mu.Lock()
+		delete(q.claimed, id)
+		q.mu.Unlock()
+	}, nil
+}
+
+// Purge permanently deletes a quarantined file.
+func (q *quarantineStore) Purge(id string) error {
+	if !validID.MatchString(id) {
+		return errQuarantineNotFound
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	metaPath := filepath.Join(q.root, id+".json")
+	if _, err := os.Stat(metaPath); errors.Is(err, os.ErrNotExist) {
+		return errQuarantineNotFound
+	}
+	if err := os.Remove(filepath.Join(q.root, id+".bin")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Remove(metaPath)
+}
+
+// quarantineUpload moves a malicious upload into the quarantine and records
+// the quarantine ID on result.
+func quarantineUpload(info *uploadInfo, result *ScanResult) error {
+	if result.Verdict != VerdictMalicious {
+		return nil
+	}
+	item := &QuarantineItem{
+		ID:            newID(),
+		Tenant:        info.Tenant,
+		FileName:      info.Name,
+		ContentType:   info.ContentType,
+		Size:          result.FileSize,
+		SHA256:        result.SHA256,
+		Uploader:      info.Uploader,
+		MalwareNames:  result.MalwareNames,
+		QuarantinedAt: time.Now().UTC(),
+		ScanResult:    result,
+	}
+	if err := quarantine.Add(item, info.Content.Reader()); err != nil {
+		return err
+	}
+	log.Printf("Quarantined %s as %s (malware: %v)", item.FileName, item.ID, item.MalwareNames)
+	result.QuarantineID = item.ID
+	return nil
+}
+
+// quarantineListHandler serves GET /quarantine.
+func quarantineListHandler(w http.ResponseWriter, r *http.Request) {
+	if setAPIHeaders(w, r, "GET, OPTIONS") {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	items, err := quarantine.List()
+	if err != nil {
+		writeQuarantineError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": filterByTenant(items, r.URL.Query().Get("tenant"))})
+}
+
+// quarantineItemHandler serves:
+//
+//	GET    /quarantine/{id}           metadata and scan result
+//	GET    /quarantine/{id}/download  password-protected zip (X-Zip-Password header)
+//	POST   /quarantine/{id}/download  the same, with the password in the password form field
+//	POST   /quarantine/{id}/release   move into the document store
+//	DELETE /quarantine/{id}           purge
+func quarantineItemHandler(w http.ResponseWriter, r *http.Request) {
+	if setAPIHeaders(w, r, "GET, POST, DELETE, OPTIONS") {
+		return
+	}
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/quarantine/"), "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		item, err := quarantine.Get(id)
+		if err != nil {
+			writeQuarantineError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, item)
+
+	case action == "" && r.Method == http.MethodDelete:
+		release, err := quarantine.Claim(id)
+		if err != nil {
+			writeQuarantineError(w, err)
+			return
+		}
+		err = quarantine.Purge(id)
+		release()
+		if err != nil {
+			writeQuarantineError(w, err)
+			return
+		}
+		log.Printf("Purged quarantined item %s", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "download" && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		// The password is never taken from the URL, which ends up in
+		// access and proxy logs
+		password := r.Header.Get("X-Zip-Password")
+		if password == "" && r.Method == http.MethodPost {
+			password = r.PostFormValue("password")
+		}
+		if password == "" {
+			http.Error(w, "A zip password is required in the X-Zip-Password header or the password form field", http.StatusBadRequest)
+			return
+		}
+		item, err := quarantine.Get(id)
+		if err != nil {
+			writeQuarantineError(w, err)
+			return
+		}
+		data, err := quarantine.Content(id)
+		if err != nil {
+			writeQuarantineError(w, err)
+			return
+		}
+		var buf bytes.Buffer
+		if err := writeEncryptedZip(&buf, item.FileName, data, password, item.QuarantinedAt); err != nil {
+			writeQuarantineError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": item.ID + ".zip"}))
+		w.Write(buf.Bytes())
+
+	case action == "release" && r.Method == http.MethodPost:
+		doc, err := releaseQuarantined(id, r)
+		if err != nil {
+			writeQuarantineError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, doc)
+
+	case action == "" || action == "download" || action == "release":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// releaseQuarantined moves a quarantined file into the document store after
+// an administrator has reviewed it.
+//
+// The item is claimed for the whole release, so two releases cannot both
+// store it; the loser gets errQuarantineBusy, or errQuarantineNotFound once
+// the winner has purged it. A document stored for an item that then cannot
+// be purged is deleted again, so the file is never both released and
+// quarantined.
+func releaseQuarantined(id string, r *http.Request) (*Document, error) {
+	release, err := quarantine.Claim(id)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	item, err := quarantine.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := quarantine.Content(id)
+	if err != nil {
+		return nil, err
+	}
+	tenant := item.Tenant
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	store, err := documents.For(tenant)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	doc := &Document{
+		ID:          newID(),
+		Tenant:      tenant,
+		Name:        item.FileName,
+		ContentType: item.ContentType,
+		Size:        int64(len(data)),
+		SHA256:      item.SHA256,
+		Uploader:    item.Uploader,
+		Verdict:     VerdictMalicious,
+		ScanID:      item.ScanResult.ScanID,
+		ReleasedBy:  uploaderFromRequest(r),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := tenants.trackStored(tenant, 1, doc.Size, func() error { return store.Put(doc, bytes.NewReader(data)) }); err != nil {
+		return nil, err
+	}
+	if err := quarantine.Purge(id); err != nil {
+		if derr := tenants.trackStored(tenant, -1, -doc.Size, func() error { return store.Delete(doc.ID) }); derr != nil {
+			log.Printf("Cannot delete document %s released from quarantined item %s: %v", doc.ID, id, derr)
+		}
+		return nil, err
+	}
+	log.Printf("Released quarantined item %s as document %s", id, doc.ID)
+	return doc, nil
+}
+
+// filterByTenant narrows an admin listing to one tenant when asked to.
+func filterByTenant(items []*QuarantineItem, tenant string) []*QuarantineItem {
+	if tenant == "" {
+		return items
+	}
+	filtered := []*QuarantineItem{}
+	for _, item := range items {
+		if item.Tenant == tenant {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+func writeQuarantineError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errQuarantineNotFound) {
+		http.Error(w, "Quarantined item not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errQuarantineBusy) {
+		http.Error(w, "Quarantined item is being released; try again shortly", http.StatusConflict)
+		return
+	}
+	log.Printf("Quarantine error: %v", err)
+	http.Error(w, fmt.Sprintf("Quarantine error: %v", err), http.StatusInternalServerError)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Quarantined and pending files are sealed in segments, so neither writing
+// nor reading one holds the whole file in memory:
+//
+//	magic || base nonce || segment || segment || ...
+//
+// Each segment seals up to sealSegmentSize bytes with AES-GCM under the base
+// nonce XOR its index. The item ID and whether the segment is the last one
+// are authenticated with it, so segments cannot be moved between items,
+// reordered or dropped from the end.
+var sealMagic = []byte("BPQSEG01")
+
+const sealSegmentSize = 64 << 10
+
+var errQuarantineCorrupt = errors.New("quarantined item is corrupt")
+
+// sealSegments encrypts src into w.
+func sealSegments(w io.Writer, aead cipher.AEAD, id string, src io.Reader) error {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := w.Write(append(append([]byte{}, sealMagic...), nonce...)); err != nil {
+		return err
+	}
+	in := bufio.NewReaderSize(src, sealSegmentSize)
+	plain := make([]byte, sealSegmentSize)
+	var sealed []byte
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(in, plain)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if !last {
+			// A full segment is the last one when nothing follows it
+			if _, err := in.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		sealed = aead.Seal(sealed[:0], segmentNonce(nonce, i), plain[:n], segmentData(id, last))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// openSealed returns a reader decrypting the file in src. A segment that
+// fails to authenticate, or a file cut short, is reported as
+// errQuarantineCorrupt by Read.
+func openSealed(src io.Reader, aead cipher.AEAD, id string) (io.Reader, error) {
+	in := bufio.NewReaderSize(src, sealSegmentSize+aead.Overhead())
+	head, err := in.Peek(len(sealMagic) + aead.NonceSize())
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.HasPrefix(head, sealMagic) || len(head) != len(sealMagic)+aead.NonceSize() {
+		return nil, fmt.Errorf("%w: %s", errQuarantineCorrupt, id)
+	}
+	nonce := append([]byte{}, head[len(sealMagic):]...)
+	in.Discard(len(head))
+	return &segmentReader{in: in, aead: aead, id: id, nonce: nonce, sealed: make([]byte, sealSegmentSize+aead.Overhead())}, nil
+}
+
+type segmentReader struct {
+	in     *bufio.Reader
+	aead   cipher.AEAD
+	id     string
+	nonce  []byte
+	index  uint64
+	sealed []byte
+	buf    []byte
+	plain  []byte
+	done   bool
+	err    error
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next decrypts the following segment into r.plain.
+func (r *segmentReader) next() error {
+	n, err := io.ReadFull(r.in, r.sealed)
+	last := err == io.ErrUnexpectedEOF
+	switch {
+	case err == io.EOF:
+		// The segment marked last was never read
+		return fmt.Errorf("%w: %s is truncated", errQuarantineCorrupt, r.id)
+	case err != nil && !last:
+		return err
+	case !last:
+		if _, err := r.in.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	r.buf, err = r.aead.Open(r.buf[:0], segmentNonce(r.nonce, r.index), r.sealed[:n], segmentData(r.id, last))
+	if err != nil {
+		return fmt.Errorf("%w: %s", errQuarantineCorrupt, r.id)
+	}
+	r.plain, r.done = r.buf, last
+	r.index++
+	return nil
+}
+
+// segmentNonce is the base nonce with the segment index XORed into its last
+// eight bytes.
+func segmentNonce(base []byte, index uint64) []byte {
+	nonce := append([]byte{}, base...)
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^index)
+	return nonce
+}
+
+// segmentData is the additional data authenticated with a segment.
+func segmentData(id string, last bool) []byte {
+	if last {
+		return append([]byte(id), 1)
+	}
+	return append([]byte(id), 0)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestQuarantine(t *testing.T) *quarantineStore {
+	t.Helper()
+	q, err := newQuarantineStore(t.TempDir(), "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func addTestItem(t *testing.T, q *quarantineStore, content []byte) string {
+	t.Helper()
+	id := newID()
+	if err := q.Add(&QuarantineItem{ID: id, FileName: "a.bin", QuarantinedAt: time.Now()}, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestQuarantineSealsInSegments(t *testing.T) {
+	q := newTestQuarantine(t)
+	for _, size := range []int{0, 1, sealSegmentSize - 1, sealSegmentSize, sealSegmentSize + 1, 3*sealSegmentSize + 17} {
+		content := make([]byte, size)
+		rand.Read(content)
+		id := addTestItem(t, q, content)
+		got, err := q.Content(id)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("%d bytes: content changed through the quarantine", size)
+		}
+	}
+}
+
+func TestQuarantineDetectsTampering(t *testing.T) {
+	q := newTestQuarantine(t)
+	content := make([]byte, 2*sealSegmentSize)
+	rand.Read(content)
+	id := addTestItem(t, q, content)
+	path := filepath.Join(q.root, id+".bin")
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := sealSegmentSize + q.aead.Overhead()
+	header := len(sealMagic) + q.aead.NonceSize()
+
+	flipped := append([]byte{}, sealed...)
+	flipped[header+segment+10] ^= 1
+	for name, data := range map[string][]byte{
+		"flipped bit":        flipped,
+		"last segment cut":   sealed[:header+segment],
+		"cut inside segment": sealed[:header+segment/2],
+		"segments swapped":   append(append(append([]byte{}, sealed[:header]...), sealed[header+segment:]...), sealed[header:header+segment]...),
+		"header only":        sealed[:header],
+		"no header":          sealed[header:],
+	} {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		rc, err := q.Open(id)
+		if err == nil {
+			_, err = io.Copy(io.Discard, rc)
+			rc.Close()
+		}
+		if !errors.Is(err, errQuarantineCorrupt) {
+			t.Errorf("%s: got %v, want errQuarantineCorrupt", name, err)
+		}
+	}
+}
+
+func TestReleaseQuarantinedOnce(t *testing.T) {
+	api := newTestAPI(t, "")
+	id := newID()
+	item := &QuarantineItem{ID: id, Tenant: defaultTenant, FileName: "eicar.com", Size: 4, QuarantinedAt: time.Now(), ScanResult: &ScanResult{ScanID: "scan"}}
+	if err := quarantine.Add(item, bytes.NewReader([]byte("evil"))); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/quarantine/"+id+"/release", nil)
+
+	// While another caller holds the item, a release stores nothing
+	release, err := quarantine.Claim(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := releaseQuarantined(id, r); !errors.Is(err, errQuarantineBusy) {
+		t.Fatalf("release of a claimed item: got %v, want errQuarantineBusy", err)
+	}
+	release()
+	if ids := api.listed("", ""); len(ids) != 0 {
+		t.Fatalf("refused release stored %v", ids)
+	}
+
+	doc, err := releaseQuarantined(id, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := releaseQuarantined(id, r); !errors.Is(err, errQuarantineNotFound) {
+		t.Fatalf("second release: got %v, want errQuarantineNotFound", err)
+	}
+	if ids := api.listed("", ""); len(ids) != 1 || ids[0] != doc.ID {
+		t.Fatalf("released documents %v, want only %s", ids, doc.ID)
+	}
+	if usage := tenants.usage[defaultTenant]; usage.files != 1 || usage.bytes != 4 {
+		t.Errorf("usage %d files, %d bytes after one release", usage.files, usage.bytes)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// resilienceConfig tunes resilientScanner; see defaultConfig for defaults.
+type resilienceConfig struct {
+	// MaxConcurrent bounds the scans in flight against the engine.
+	MaxConcurrent int `yaml:"max_concurrent" env:"SCAN_MAX_CONCURRENCY"`
+	// MaxAttempts counts attempts per scan, including the first.
+	MaxAttempts int `yaml:"max_attempts" env:"SCAN_MAX_ATTEMPTS"`
+	// BaseBackoff is the first retry delay, doubled per attempt.
+	BaseBackoff time.Duration `yaml:"base_backoff" env:"SCAN_RETRY_BASE_MS" unit:"ms"`
+	MaxBackoff  time.Duration `yaml:"max_backoff" env:"SCAN_RETRY_MAX_MS" unit:"ms"`
+	// BreakerThreshold consecutive failures open the breaker for
+	// BreakerCooldown.
+	BreakerThreshold int           `yaml:"breaker_threshold" env:"SCAN_BREAKER_THRESHOLD"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown" env:"SCAN_BREAKER_COOLDOWN_SECONDS" unit:"s"`
+}
+
+// Circuit breaker states.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// resilientScanner wraps a Scanner with a concurrency bound, retries with
+// exponential backoff and jitter on transient errors, and a circuit breaker
+// that fails fast while the engine is down. Errors wrapping
+// errScannerUnavailable are treated as transient.
+type resilientScanner struct {
+	inner Scanner
+	cfg   resilienceConfig
+	slots chan struct{}
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newResilientScanner(inner Scanner, cfg resilienceConfig) *resilientScanner {
+	return &resilientScanner{
+		inner: inner,
+		cfg:   cfg,
+		slots: make(chan struct{}, cfg.MaxConcurrent),
+		state: breakerClosed,
+	}
+}
+
+func (s *resilientScanner) Name() string { return s.inner.Name() }
+
+// Unwrap returns the wrapped engine.
+func (s *resilientScanner) Unwrap() Scanner { return s.inner }
+
+// Ping fails while the breaker is open, without waiting for the engine.
+func (s *resilientScanner) Ping(ctx context.Context) error {
+	s.mu.Lock()
+	open := s.state == breakerOpen && time.Now().Before(s.openUntil)
+	s.mu.Unlock()
+	if open {
+		return fmt.Errorf("%w: circuit breaker open", errScannerUnavailable)
+	}
+	return pingScanner(ctx, s.inner)
+}
+
+func (s *resilientScanner) ScanFile(path string, tags []string) (*ScanVerdict, error) {
+	return s.do(func() (*ScanVerdict, error) { return s.inner.ScanFile(path, tags) })
+}
+
+func (s *resilientScanner) ScanReader(r io.Reader, name string, tags []string) (*ScanVerdict, error) {
+	// Retries need to replay the content from the start
+	seeker, ok := r.(io.ReadSeeker)
+	if !ok {
+		buf, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		seeker = bytes.NewReader(buf)
+	}
+	return s.do(func() (*ScanVerdict, error) {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return s.inner.ScanReader(seeker, name, tags)
+	})
+}
+
+// do runs scan under the concurrency bound, retrying transient failures.
+func (s *resilientScanner) do(scan func() (*ScanVerdict, error)) (*ScanVerdict, error) {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+
+	var err error
+	for attempt := 1; attempt <= s.cfg.MaxAttempts; attempt++ {
+		if err := s.allow(); err != nil {
+			return nil, err
+		}
+		var v *ScanVerdict
+		v, err = scan()
+		s.record(err)
+		if err == nil || !errors.Is(err, errScannerUnavailable) {
+			return v, err
+		}
+		if attempt < s.cfg.MaxAttempts {
+			delay := s.backoff(attempt)
+			log.Printf("%s scan attempt %d/%d failed, retrying in %s: %v", s.Name(), attempt, s.cfg.MaxAttempts, delay, err)
+			time.Sleep(delay)
+		}
+	}
+	return nil, err
+}
+
+// backoff returns the delay before retry number attempt, using exponential
+// backoff with full jitter.
+func (s *resilientScanner) backoff(attempt int) time.Duration {
+	d := s.cfg.BaseBackoff << (attempt - 1)
+	if d <= 0 || d > s.cfg.MaxBackoff {
+		d = s.cfg.MaxBackoff
+	}
+	if d <= 0 {
+		// rand.Int63n panics on zero; retry straight away instead
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// allow fails fast while the breaker is open. Once the cooldown has passed a
+// single probe scan is let through to test the engine.
+func (s *resilientScanner) allow() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.state {
+	case breakerOpen:
+		if time.Now().Before(s.openUntil) {
+			return fmt.Errorf("%w: circuit breaker open until %s", errScannerUnavailable, s.openUntil.Format(time.RFC3339))
+		}
+		s.state, s.probing = breakerHalfOpen, true
+		log.Printf("%s circuit breaker half-open, probing", s.Name())
+	case breakerHalfOpen:
+		if s.probing {
+			return fmt.Errorf("%w: circuit breaker half-open, probe in progress", errScannerUnavailable)
+		}
+		s.probing = true
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of one attempt. Only transient
+// errors count as failures; a definite answer from the engine, even an
+// error, shows it is reachable.
+func (s *resilientScanner) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.probing = false
+	if err == nil || !errors.Is(err, errScannerUnavailable) {
+		if s.state != breakerClosed {
+			log.Printf("%s circuit breaker closed", s.Name())
+		}
+		s.state, s.failures = breakerClosed, 0
+		return
+	}
+	s.failures++
+	if s.state == breakerHalfOpen || s.failures >= s.cfg.BreakerThreshold {
+		s.state = breakerOpen
+		s.openUntil = time.Now().Add(s.cfg.BreakerCooldown)
+		log.Printf("%s circuit breaker open for %s after %d consecutive failures", s.Name(), s.cfg.BreakerCooldown, s.failures)
+	}
+}
+
+// Stats reports the breaker state and scans in flight.
+func (s *resilientScanner) Stats() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"engine":          s.Name(),
+		"breaker":         s.state,
+		"failures":        s.failures,
+		"in_flight":       len(s.slots),
+		"max_concurrency": cap(s.slots),
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// ScanResultSchemaVersion is bumped whenever the JSON shape of ScanResult
+// changes incompatibly, including new verdict, code or reason values that a
+// client validating against the previous schema would refuse. See
+// schema/scan-result.v2.json.
+const ScanResultSchemaVersion = "2"
+
+// scanResultSchemas holds every published schema version, so clients
+// pinned to an older one can still fetch it.
+//
+//go:embed schema/scan-result.v*.json
+var scanResultSchemas embed.FS
+
+// Verdict is the normalized outcome of an upload scan.
+type Verdict string
+
+const (
+	VerdictClean     Verdict = "clean"
+	VerdictMalicious Verdict = "malicious"
+	VerdictSkipped   Verdict = "skipped"
+	VerdictError     Verdict = "error"
+	VerdictUnscanned Verdict = "unscanned"
+	VerdictRejected  Verdict = "rejected"
+)
+
+// ScanResultCode is the legacy numeric scan_result_code kept for existing
+// dashboards. Every code maps to exactly one Reason.
+type ScanResultCode int
+
+const (
+	CodeClean           ScanResultCode = 0
+	CodeMalicious       ScanResultCode = 1
+	CodeNotConfigured   ScanResultCode = -1
+	CodeScanFailed      ScanResultCode = -2
+	CodeEmptyFile       ScanResultCode = -3
+	CodeVulnerable      ScanResultCode = -4
+	CodeFileTooLarge    ScanResultCode = -5
+	CodeArchiveRejected ScanResultCode = -6
+	CodePolicyRejected  ScanResultCode = -7
+	CodeQuotaExceeded   ScanResultCode = -8
+)
+
+// Machine-readable reasons reported alongside non-clean verdicts.
+const (
+	ReasonNotConfigured      = "scanner_not_configured"
+	ReasonScannerUnavailable = "scanner_unavailable"
+	ReasonScanFailed         = "scan_failed"
+	ReasonEmptyFile          = "empty_file"
+	ReasonFileTooLarge       = "file_too_large"
+	ReasonVulnerableEndpoint = "vulnerable_endpoint"
+	ReasonArchiveRejected    = "archive_rejected"
+	ReasonPolicyRejected     = "policy_rejected"
+	ReasonQuotaExceeded      = "quota_exceeded"
+)
+
+// ScanResult is the response body produced by every upload path.
+type ScanResult struct {
+	SchemaVersion string         `json:"schema_version"`
+	Code          ScanResultCode `json:"scan_result_code"`
+	Verdict       Verdict        `json:"verdict"`
+	Reason        string         `json:"reason,omitempty"`
+	Message       string         `json:"message,omitempty"`
+	Engine        string         `json:"engine,omitempty"`
+	MalwareNames  []string       `json:"malware_names"`
+	FileName      string         `json:"file_name"`
+	FilePath      string         `json:"file_path,omitempty"`
+	FileSize      int64          `json:"file_size"`
+	SHA256        string         `json:"sha256,omitempty"`
+	DurationMS    int64          `json:"duration_ms"`
+	ScanID        string         `json:"scan_id,omitempty"`
+	Error         string         `json:"error,omitempty"`
+	DocumentID    string         `json:"document_id,omitempty"`
+	QuarantineID  string         `json:"quarantine_id,omitempty"`
+	Archive       string         `json:"archive,omitempty"`
+	MemberPath    string         `json:"member_path,omitempty"`
+	// Tags are the scan tags sent to the engine.
+	Tags []string `json:"tags,omitempty"`
+	// FailurePolicy is set when the file could not be scanned and reports
+	// how the endpoint's fail-open/closed/hold policy handled it.
+	FailurePolicy FailurePolicy `json:"failure_policy,omitempty"`
+	PendingID     string        `json:"pending_id,omitempty"`
+	// Cached is set when the verdict was reused from an earlier scan of
+	// identical content instead of scanning again.
+	Cached bool `json:"cached,omitempty"`
+	// Policy reports the file type policy decision made before scanning.
+	Policy *PolicyDecision `json:"policy,omitempty"`
+	// Details carries the engine's own result document unchanged.
+	Details map[string]interface{} `json:"scan_results,omitempty"`
+}
+
+// UploadBatch is the response for uploads carrying several files or an
+// expanded archive: one result per scanned file, in request order.
+type UploadBatch struct {
+	SchemaVersion string          `json:"schema_version"`
+	Results       []*ScanResult   `json:"results"`
+	Summary       map[Verdict]int `json:"summary"`
+}
+
+func newUploadBatch(results []*ScanResult) *UploadBatch {
+	b := &UploadBatch{SchemaVersion: ScanResultSchemaVersion, Results: results, Summary: map[Verdict]int{}}
+	for _, r := range results {
+		b.Summary[r.Verdict]++
+	}
+	return b
+}
+
+// newScanResult returns a ScanResult with the fields common to every branch.
+func newScanResult(fileName string, fileSize int64) *ScanResult {
+	return &ScanResult{
+		SchemaVersion: ScanResultSchemaVersion,
+		FileName:      fileName,
+		FileSize:      fileSize,
+		MalwareNames:  []string{},
+	}
+}
+
+func (r *ScanResult) skipped(code ScanResultCode, reason, message string) *ScanResult {
+	r.Code, r.Verdict, r.Reason, r.Message = code, VerdictSkipped, reason, message
+	return r
+}
+
+func (r *ScanResult) failed(reason string, err error) *ScanResult {
+	r.Code, r.Verdict, r.Reason, r.Error = CodeScanFailed, VerdictError, reason, err.Error()
+	return r
+}
+
+func (r *ScanResult) finished(engine string, v *ScanVerdict, elapsed time.Duration) *ScanResult {
+	r.Engine = engine
+	r.DurationMS = elapsed.Milliseconds()
+	r.Details = v.Raw
+	r.ScanID = v.ScanID
+	if r.ScanID == "" {
+		r.ScanID = newID()
+	}
+	if v.Malicious {
+		r.Code, r.Verdict = CodeMalicious, VerdictMalicious
+		if v.MalwareNames != nil {
+			r.MalwareNames = v.MalwareNames
+		}
+	} else {
+		r.Code, r.Verdict = CodeClean, VerdictClean
+	}
+	return r
+}
+
+// httpStatus is the response status for a single-file upload.
+func (r *ScanResult) httpStatus() int {
+	switch {
+	case r.Reason == ReasonQuotaExceeded:
+		return http.StatusTooManyRequests
+	case r.Verdict == VerdictRejected:
+		return http.StatusUnsupportedMediaType
+	case r.PendingID != "":
+		return http.StatusAccepted
+	case r.FailurePolicy == FailClosed || r.FailurePolicy == FailHold:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// newID returns a random 128-bit identifier in hex.
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// fileSHA256 returns the hex SHA-256 digest of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// schemaHandler serves the JSON schemas for ScanResult under
+// /schemas/scan-result.v<N>.json.
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	schema, err := scanResultSchemas.ReadFile("schema/" + path.Base(r.URL.Path))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(schema)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestScanResultSchemaCoversValues checks the schema of the current version
+// lists every verdict, code and reason the sdk produces, so a new value
+// cannot ship without a schema change and a version bump.
+func TestScanResultSchemaCoversValues(t *testing.T) {
+	data, err := scanResultSchemas.ReadFile("schema/scan-result.v" + ScanResultSchemaVersion + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Properties map[string]struct {
+			Const string        `json:"const"`
+			Enum  []interface{} `json:"enum"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	if got := schema.Properties["schema_version"].Const; got != ScanResultSchemaVersion {
+		t.Errorf("schema pins schema_version %q, want %q", got, ScanResultSchemaVersion)
+	}
+
+	for field, values := range map[string][]interface{}{
+		"verdict": {VerdictClean, VerdictMalicious, VerdictSkipped, VerdictError, VerdictUnscanned, VerdictRejected},
+		"scan_result_code": {CodeClean, CodeMalicious, CodeNotConfigured, CodeScanFailed, CodeEmptyFile, CodeVulnerable,
+			CodeFileTooLarge, CodeArchiveRejected, CodePolicyRejected, CodeQuotaExceeded},
+		"reason": {ReasonNotConfigured, ReasonScannerUnavailable, ReasonScanFailed, ReasonEmptyFile, ReasonFileTooLarge,
+			ReasonVulnerableEndpoint, ReasonArchiveRejected, ReasonPolicyRejected, ReasonQuotaExceeded},
+	} {
+		listed := map[string]bool{}
+		for _, v := range schema.Properties[field].Enum {
+			b, _ := json.Marshal(v)
+			listed[string(b)] = true
+		}
+		for _, v := range values {
+			b, _ := json.Marshal(v)
+			if !listed[string(b)] {
+				t.Errorf("%s %s missing from the v%s schema", field, b, ScanResultSchemaVersion)
+			}
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tusVersion is the tus protocol version the resumable endpoints follow.
+const tusVersion = "1.0.0"
+
+// resumableUpload is the persisted state of a chunked upload. The received
+// bytes live next to it in <id>.part; its size is the authoritative offset.
+type resumableUpload struct {
+	ID          string    `json:"id"`
+	Length      int64     `json:"length"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Uploader    string    `json:"uploader"`
+	Tenant      string    `json:"tenant"`
+	Tags        []string  `json:"tags,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// resumableStore keeps in-progress chunked uploads under root and expires
+// abandoned ones.
+type resumableStore struct {
+	root    string
+	maxSize int64
+	expiry  time.Duration
+
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+// uploadLock serialises the requests for one upload. It is dropped from
+// resumableStore.locks when the last of them is done, so the map only holds
+// uploads being worked on.
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+// resumable holds in-progress chunked uploads; see main.
+var resumable *resumableStore
+
+var errUploadNotFound = errors.New("upload not found")
+
+func newResumableStore(root string, maxSize int64, expiry time.Duration) (*resumableStore, error) {
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, err
+	}
+	s := &resumableStore{root: root, maxSize: maxSize, expiry: expiry, locks: make(map[string]*uploadLock)}
+	go s.janitor()
+	return s, nil
+}
+
+func mustResumableStore(cfg resumableConfig) *resumableStore {
+	s, err := newResumableStore(filepath.Join(uploadFolder, "resumable"), cfg.MaxSize, cfg.Expiry)
+	if err != nil {
+		log.Fatalf("Failed to open resumable upload store: %v", err)
+	}
+	return s
+}
+
+func (s *resumableStore) partPath(id string) string { return filepath.Join(s.root, id+".part") }
+func (s *resumableStore) metaPath(id string) string { return filepath.Join(s.root, id+".json") }
+
+// lock serialises operations on a single upload.
+func (s *resumableStore) lock(id string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[id]
+	if !ok {
+		l = &uploadLock{}
+		s.locks[id] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(s.locks, id)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *resumableStore) create(u *resumableUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.partPath(u.ID), nil, 0o640); err != nil {
+		return err
+	}
+	return os.WriteFile(s.metaPath(u.ID), data, 0o640)
+}
+
+// get returns an upload's state and current offset.
+func (s *resumableStore) get(id string) (*resumableUpload, int64, error) {
+	if !validID.MatchString(id) {
+		return nil, 0, errUploadNotFound
+	}
+	data, err := os.ReadFile(s.metaPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, errUploadNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var u resumableUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, 0, err
+	}
+	if time.Now().After(u.ExpiresAt) {
+		s.remove(id)
+		return nil, 0, errUploadNotFound
+	}
+	fi, err := os.Stat(s.partPath(id))
+	if err != nil {
+		return nil, 0, errUploadNotFound
+	}
+	return &u, fi.Size(), nil
+}
+
+// appendChunk writes body at offset, which must equal the current offset.
+func (s *resumableStore) appendChunk(u *resumableUpload, offset int64, body io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.partPath(u.ID), os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+	n, err := io.Copy(f, io.LimitReader(body, u.Length-offset))
+	return offset + n, err
+}
+
+func (s *resumableStore) remove(id string) {
+	os.Remove(s.partPath(id))
+	os.Remove(s.metaPath(id))
+}
+
+// janitor removes uploads that were abandoned before expiring.
+func (s *resumableStore) janitor() {
+	for range time.Tick(10 * time.Minute) {
+		matches, _ := filepath.Glob(filepath.Join(s.root, "*.json"))
+		for _, m := range matches {
+			id := strings.TrimSuffix(filepath.Base(m), ".json")
+			unlock := s.lock(id)
+			if _, _, err := s.get(id); errors.Is(err, errUploadNotFound) {
+				log.Printf("Expired resumable upload %s", id)
+				s.remove(id)
+			}
+			unlock()
+		}
+	}
+}
+
+// openSpool hands a completed upload's bytes to the scan pipeline as a
+// spool, hashing them on the way. The upload stays until complete is
+// called, so a finalize that fails can be retried; until then the spool
+// must be let go with Detach rather than Close.
+func (s *resumableStore) openSpool(u *resumableUpload) (*spool, error) {
+	f, err := os.Open(s.partPath(u.ID))
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &spool{file: f, size: n, sha256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// complete forgets a finalized upload. Its bytes now belong to the spool
+// from openSpool, which removes them when closed.
+func (s *resumableStore) complete(id string) {
+	os.Remove(s.metaPath(id))
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header
+// ("key base64value,key2 base64value2").
+func parseUploadMetadata(header string) map[string]string {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		meta[key] = string(decoded)
+	}
+	return meta
+}
+
+// setTusHeaders sets the CORS and tus headers for the resumable endpoints and
+// reports whether the request was a preflight that has been fully handled.
+func setTusHeaders(w http.ResponseWriter, r *http.Request) bool {
+	setCORSHeaders(w, r)
+	w.Header().Set("Access-Control-Allow-Methods", "POST, HEAD, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-API-Key, X-Requested-With, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Max-Size, Tus-Extension, Upload-Offset, Upload-Length, Upload-Expires")
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(resumable.maxSize, 10))
+		w.Header().Set("Tus-Extension", "creation,termination,expiration")
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	return false
+}
+
+// resumableCreateHandler serves POST /uploads/resumable: create an upload
+// of Upload-Length bytes described by Upload-Metadata (filename, filetype and optionally category).
+func resumableCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if setTusHeaders(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > resumable.maxSize {
+		http.Error(w, fmt.Sprintf("Upload-Length exceeds maximum of %d bytes", resumable.maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	name := filepath.Base(meta["filename"])
+	if name == "." || name == "/" {
+		http.Error(w, "Upload-Metadata must include filename", http.StatusBadRequest)
+		return
+	}
+	contentType := meta["filetype"]
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	category, err := validCategory(meta["category"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tenant, ok := requireTenant(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	uploader := uploaderFromRequest(r)
+	u := &resumableUpload{
+		ID:          newID(),
+		Length:      length,
+		Name:        name,
+		ContentType: contentType,
+		Uploader:    uploader,
+		Tenant:      tenant,
+		Tags:        scanTags(tenant, uploader, category),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(resumable.expiry),
+	}
+	if err := resumable.create(u); err != nil {
+		log.Printf("Resumable create error: %v", err)
+		http.Error(w, fmt.Sprintf("Cannot create upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Created resumable upload %s for %s (%d bytes)", u.ID, u.Name, u.Length)
+	w.Header().Set("Location", "/uploads/resumable/"+u.ID)
+	w.Header().Set("Upload-Expires", u.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// resumableUploadHandler serves:
+//
+//	HEAD   /uploads/resumable/{id}           progress (Upload-Offset)
+//	PATCH  /uploads/resumable/{id}           append a chunk at Upload-Offset
+//	DELETE /uploads/resumable/{id}           abandon
+//	POST   /uploads/resumable/{id}/finalize  scan the completed upload (?async=true)
+func resumableUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if setTusHeaders(w, r) {
+		return
+	}
+	tenant, ok := requireTenant(w, r)
+	if !ok {
+		return
+	}
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/uploads/resumable/"), "/")
+	if !validID.MatchString(id) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	unlock := resumable.lock(id)
+	defer unlock()
+
+	// Uploads of other tenants are reported as not found
+	u, offset, err := resumable.get(id)
+	if err == nil && u.Tenant != tenant {
+		err = errUploadNotFound
+	}
+	if errors.Is(err, errUploadNotFound) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Resumable upload error: %v", err)
+		http.Error(w, fmt.Sprintf("Upload error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.Format(http.TimeFormat))
+
+	switch {
+	case action == "" && r.Method == http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+
+	case action == "" && r.Method == http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+			return
+		}
+		claimed, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || claimed != offset {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			http.Error(w, "Upload-Offset does not match current offset", http.StatusConflict)
+			return
+		}
+		newOffset, err := resumable.appendChunk(u, offset, r.Body)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+		if err != nil {
+			// The bytes that did arrive are kept; the client resumes from newOffset.
+			log.Printf("Resumable upload %s interrupted at %d: %v", id, newOffset, err)
+			http.Error(w, fmt.Sprintf("Chunk interrupted: %v", err), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "" && r.Method == http.MethodDelete:
+		resumable.remove(id)
+		log.Printf("Terminated resumable upload %s", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "finalize" && r.Method == http.MethodPost:
+		if offset != u.Length {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			http.Error(w, fmt.Sprintf("Upload incomplete: %d of %d bytes received", offset, u.Length), http.StatusConflict)
+			return
+		}
+		finalizeResumable(w, r, u)
+
+	case action == "" || action == "finalize":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// finalizeResumable runs a completed upload through the same scan pipeline
+// as /upload. The upload is only forgotten once its scan is queued or has
+// an answer retrying would not change; otherwise the client can finalize
+// it again.
+func finalizeResumable(w http.ResponseWriter, r *http.Request, u *resumableUpload) {
+	content, err := resumable.openSpool(u)
+	if err != nil {
+		log.Printf("Resumable finalize error: %v", err)
+		http.Error(w, fmt.Sprintf("Cannot finalize upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	info := &uploadInfo{
+		Content:     content,
+		Name:        u.Name,
+		ContentType: u.ContentType,
+		Size:        content.Size(),
+		Uploader:    u.Uploader,
+		Tenant:      u.Tenant,
+		Endpoint:    endpointResumable,
+		Tags:        u.Tags,
+	}
+	log.Printf("Finalized resumable upload %s: %s, Size: %d bytes", u.ID, u.Name, info.Size)
+
+	if r.URL.Query().Get("async") == "true" {
+		job, err := scanJobs.Submit(info)
+		if err != nil {
+			content.Detach()
+			http.Error(w, fmt.Sprintf("Cannot queue scan: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		resumable.complete(u.ID)
+		writeJSON(w, http.StatusAccepted, job)
+		return
+	}
+
+	result, err := processUpload(info)
+	if err != nil {
+		content.Detach()
+		log.Printf("Upload processing error: %v", err)
+		http.Error(w, fmt.Sprintf("Upload failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	status := result.httpStatus()
+	if status >= 500 || status == http.StatusTooManyRequests {
+		content.Detach()
+		log.Printf("Keeping resumable upload %s for another finalize (%d)", u.ID, status)
+	} else {
+		resumable.complete(u.ID)
+		content.Close()
+	}
+	writeJSON(w, status, result)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// unavailableScanner stands in for a scan service that cannot be reached.
+type unavailableScanner struct{}
+
+func (unavailableScanner) Name() string { return "unavailable" }
+
+func (unavailableScanner) ScanFile(string, []string) (*ScanVerdict, error) {
+	return nil, fmt.Errorf("%w: connection refused", errScannerUnavailable)
+}
+
+func (unavailableScanner) ScanReader(io.Reader, string, []string) (*ScanVerdict, error) {
+	return nil, fmt.Errorf("%w: connection refused", errScannerUnavailable)
+}
+
+// createResumable starts a resumable upload of length bytes and returns its
+// location.
+func (a *testAPI) createResumable(length int) string {
+	a.t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/uploads/resumable", nil)
+	r.Header.Set("Upload-Length", strconv.Itoa(length))
+	r.Header.Set("Upload-Metadata", "filename bm90ZXMudHh0")
+	w := httptest.NewRecorder()
+	a.handler.ServeHTTP(w, r)
+	a.expect(w, http.StatusCreated, "create resumable upload")
+	return w.Header().Get("Location")
+}
+
+// patch sends a chunk claiming to start at offset.
+func (a *testAPI) patch(location string, offset int, chunk string) *httptest.ResponseRecorder {
+	a.t.Helper()
+	r := httptest.NewRequest(http.MethodPatch, location, bytes.NewBufferString(chunk))
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	w := httptest.NewRecorder()
+	a.handler.ServeHTTP(w, r)
+	return w
+}
+
+// offset returns the upload's offset as reported by HEAD.
+func (a *testAPI) offset(location string) string {
+	a.t.Helper()
+	w := a.do(http.MethodHead, location, "", "", nil, "")
+	a.expect(w, http.StatusOK, "head resumable upload")
+	return w.Header().Get("Upload-Offset")
+}
+
+func TestResumableOffsetConflicts(t *testing.T) {
+	api := newTestAPI(t, "")
+	location := api.createResumable(10)
+
+	w := api.patch(location, 3, "lo")
+	api.expect(w, http.StatusConflict, "chunk past the offset")
+	if got := w.Header().Get("Upload-Offset"); got != "0" {
+		t.Errorf("conflict reported offset %s, want 0", got)
+	}
+	api.expect(api.patch(location, 0, "hello"), http.StatusNoContent, "first chunk")
+	w = api.patch(location, 0, "hello")
+	api.expect(w, http.StatusConflict, "chunk sent twice")
+	if got := w.Header().Get("Upload-Offset"); got != "5" {
+		t.Errorf("conflict reported offset %s, want 5", got)
+	}
+	api.expect(api.do(http.MethodPatch, location, "", "", bytes.NewBufferString("x"), "text/plain"), http.StatusUnsupportedMediaType, "chunk with the wrong content type")
+
+	w = api.do(http.MethodPost, location+"/finalize", "", "", nil, "")
+	api.expect(w, http.StatusConflict, "finalize an incomplete upload")
+	if got := w.Header().Get("Upload-Offset"); got != "5" {
+		t.Errorf("incomplete finalize reported offset %s, want 5", got)
+	}
+
+	// Bytes past Upload-Length are not taken
+	w = api.patch(location, 5, " world and more")
+	api.expect(w, http.StatusNoContent, "last chunk")
+	if got := w.Header().Get("Upload-Offset"); got != "10" {
+		t.Errorf("last chunk left offset %s, want 10", got)
+	}
+	if got := api.offset(location); got != "10" {
+		t.Errorf("HEAD reported offset %s, want 10", got)
+	}
+}
+
+func TestResumableFinalize(t *testing.T) {
+	api := newTestAPI(t, "")
+	location := api.createResumable(11)
+	api.expect(api.patch(location, 0, "hello world"), http.StatusNoContent, "chunk")
+
+	w := api.do(http.MethodPost, location+"/finalize", "", "", nil, "")
+	api.expect(w, http.StatusOK, "finalize")
+	var result ScanResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Verdict != VerdictClean || result.DocumentID == "" || result.FileSize != 11 {
+		t.Fatalf("finalize result %+v", result)
+	}
+	api.expect(api.do(http.MethodHead, location, "", "", nil, ""), http.StatusNotFound, "head a finalized upload")
+	id := location[len("/uploads/resumable/"):]
+	for _, path := range []string{resumable.partPath(id), resumable.metaPath(id)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", path, err)
+		}
+	}
+}
+
+func TestResumableFinalizeRetriedAfterQueueRefused(t *testing.T) {
+	api := newTestAPI(t, "")
+	location := api.createResumable(5)
+	api.expect(api.patch(location, 0, "hello"), http.StatusNoContent, "chunk")
+
+	scanJobs.Drain(context.Background())
+	api.expect(api.do(http.MethodPost, location+"/finalize?async=true", "", "", nil, ""), http.StatusServiceUnavailable, "finalize while the queue is closed")
+	if got := api.offset(location); got != "5" {
+		t.Fatalf("upload after a refused finalize has offset %s, want 5", got)
+	}
+
+	scanJobs = newJobManager(1, 10)
+	jobs := scanJobs
+	t.Cleanup(func() { jobs.Drain(context.Background()) })
+	api.expect(api.do(http.MethodPost, location+"/finalize?async=true", "", "", nil, ""), http.StatusAccepted, "finalize again")
+	api.expect(api.do(http.MethodHead, location, "", "", nil, ""), http.StatusNotFound, "head a queued upload")
+}
+
+func TestResumableFinalizeRetriedAfterScannerFailed(t *testing.T) {
+	api := newTestAPI(t, "")
+	if err := applyFailurePolicies(failureConfig{Resumable: FailClosed}); err != nil {
+		t.Fatal(err)
+	}
+	location := api.createResumable(5)
+	api.expect(api.patch(location, 0, "hello"), http.StatusNoContent, "chunk")
+
+	activeScanner = unavailableScanner{}
+	api.expect(api.do(http.MethodPost, location+"/finalize", "", "", nil, ""), http.StatusServiceUnavailable, "finalize without a scanner")
+	if got := api.offset(location); got != "5" {
+		t.Fatalf("upload after a failed scan has offset %s, want 5", got)
+	}
+
+	activeScanner = newFakeScanner()
+	api.expect(api.do(http.MethodPost, location+"/finalize", "", "", nil, ""), http.StatusOK, "finalize once the scanner is back")
+}
+
+func TestResumableUploadExpires(t *testing.T) {
+	api := newTestAPI(t, "")
+	resumable.expiry = -time.Minute
+	location := api.createResumable(5)
+	id := location[len("/uploads/resumable/"):]
+
+	api.expect(api.do(http.MethodHead, location, "", "", nil, ""), http.StatusNotFound, "head an expired upload")
+	api.expect(api.patch(location, 0, "hello"), http.StatusNotFound, "patch an expired upload")
+	for _, path := range []string{resumable.partPath(id), resumable.metaPath(id)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s of an expired upload left behind: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Scanner is implemented by every malware scanning engine the SDK can route
+// uploads through. Implementations must be safe for concurrent use.
+type Scanner interface {
+	// Name identifies the engine in logs and responses.
+	Name() string
+	// ScanFile scans the file stored at path.
+	ScanFile(path string, tags []string) (*ScanVerdict, error)
+	// ScanReader scans content read from r. name is used as the identifier
+	// reported by the engine.
+	ScanReader(r io.Reader, name string, tags []string) (*ScanVerdict, error)
+}
+
+// ScanVerdict is the engine-independent outcome of a single scan.
+type ScanVerdict struct {
+	Malicious    bool     `json:"malicious"`
+	MalwareNames []string `json:"malware_names,omitempty"`
+	// ScanID is the engine's identifier for the scan, if it assigns one.
+	ScanID string `json:"scan_id,omitempty"`
+	// Raw holds the engine's own result document, if it produced one.
+	Raw map[string]interface{} `json:"raw,omitempty"`
+}
+
+var (
+	// errScannerNotConfigured is returned when the selected engine is
+	// missing required configuration (e.g. the AMaaS API key).
+	errScannerNotConfigured = errors.New("scanner not configured")
+	// errScannerUnavailable is returned when the engine could not be reached
+	// or initialised.
+	errScannerUnavailable = errors.New("scanner unavailable")
+)
+
+// newScanner builds the engine selected by cfg: "amaas" (default), "clamav"
+// or "fake".
+func newScanner(cfg scannerConfig) (Scanner, error) {
+	engine := strings.ToLower(strings.TrimSpace(cfg.Engine))
+	switch engine {
+	case "", "amaas":
+		return newAMaaSScanner(cfg.APIKey, cfg.Region, cfg.AMaaS), nil
+	case "clamav", "clamd":
+		return newClamAVScanner(cfg.ClamdAddress), nil
+	case "fake":
+		return newFakeScanner(), nil
+	default:
+		return nil, fmt.Errorf("unknown scanner %q (want amaas, clamav or fake)", engine)
+	}
+}
+
+// pinger is implemented by engines that can check they are reachable
+// without scanning anything.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// pingScanner checks that s can take scans. Engines that cannot be pinged
+// are assumed to be available.
+func pingScanner(ctx context.Context, s Scanner) error {
+	if p, ok := s.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// closeScanner releases the engine's connections, if it holds any.
+func closeScanner(s Scanner) {
+	if rs, ok := s.(*resilientScanner); ok {
+		s = rs.Unwrap()
+	}
+	if c, ok := s.(interface{ Close() }); ok {
+		c.Close()
+	}
+}
+
+// mustScanner is like newScanner but exits on misconfiguration. The engine
+// is wrapped with retries and a circuit breaker.
+func mustScanner(cfg scannerConfig) Scanner {
+	s, err := newScanner(cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure scanner: %v", err)
+	}
+	log.Printf("Using %s scanner", s.Name())
+	return newResilientScanner(s, cfg.Resilience)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	amaasclient "github.com/trendmicro/tm-v1-fs-golang-sdk"
+)
+
+// amaasScanner scans files with Trend Vision One File Security (AMaaS). It
+// shares one long-lived, concurrency-safe client between all scans.
+type amaasScanner struct {
+	apiKey string
+	region string
+	// addr, if set, points the client at a specific scan server instead of
+	// the regional endpoint, e.g. a local fake gRPC server in tests.
+	addr   string
+	useTLS bool
+	caCert string
+
+	mu     sync.Mutex
+	client *amaasclient.AmaasClient
+}
+
+func newAMaaSScanner(apiKey, region string, server amaasConfig) *amaasScanner {
+	// Log API configuration (without exposing the key)
+	log.Printf("API configuration - Region: %s, Key length: %d", region, len(apiKey))
+	if apiKey == "" {
+		log.Println("Warning: API_KEY not set; file scanning will be skipped")
+	}
+	s := &amaasScanner{apiKey: apiKey, region: region}
+	if server.Address != "" {
+		s.addr, s.useTLS, s.caCert = server.Address, server.TLS, server.CACert
+		log.Printf("AMaaS scan server override: %s (TLS: %t)", s.addr, s.useTLS)
+	}
+	// Connect eagerly so the first upload doesn't pay for it; failures are
+	// retried on the next scan.
+	if apiKey != "" {
+		if _, err := s.getClient(); err != nil {
+			log.Printf("AMaaS client not ready yet: %v", err)
+		}
+	}
+	return s
+}
+
+func (s *amaasScanner) Name() string { return "amaas" }
+
+// getClient returns the shared client, creating it on first use.
+func (s *amaasScanner) getClient() (*amaasclient.AmaasClient, error) {
+	if s.apiKey == "" {
+		return nil, fmt.Errorf("%w: no API key configured", errScannerNotConfigured)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	var c *amaasclient.AmaasClient
+	var err error
+	if s.addr != "" {
+		c, err = amaasclient.NewClientInternal(s.apiKey, s.addr, s.useTLS, s.caCert)
+	} else {
+		c, err = amaasclient.NewClient(s.apiKey, s.region)
+	}
+	if err != nil {
+		log.Printf("Failed to create client: %v", err)
+		return nil, fmt.Errorf("%w: failed to create scan client: %v", errScannerUnavailable, err)
+	}
+	s.client = c
+	return c, nil
+}
+
+// Close releases the shared client.
+func (s *amaasScanner) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		s.client.Destroy()
+		s.client = nil
+	}
+}
+
+// Ping checks that the client can be created; the SDK has no call that
+// reaches the scan service without scanning.
+func (s *amaasScanner) Ping(ctx context.Context) error {
+	_, err := s.getClient()
+	return err
+}
+
+func (s *amaasScanner) ScanFile(path string, tags []string) (*ScanVerdict, error) {
+	c, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.ScanFile(path, tags)
+	if err != nil {
+		return nil, wrapAMaaSError(err)
+	}
+	return parseAMaaSResult(result)
+}
+
+func (s *amaasScanner) ScanReader(r io.Reader, name string, tags []string) (*ScanVerdict, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.ScanBuffer(buf, name, tags)
+	if err != nil {
+		return nil, wrapAMaaSError(err)
+	}
+	return parseAMaaSResult(result)
+}
+
+// transientAMaaSErrors are fragments of SDK and gRPC errors worth retrying.
+// "Ecountered" is spelled as the SDK spells it.
+var transientAMaaSErrors = []string{
+	"unknown error", "Ecountered", "Unavailable", "DeadlineExceeded",
+	"ResourceExhausted", "connection reset", "connection refused", "timeout",
+}
+
+// wrapAMaaSError marks transient failures as errScannerUnavailable so they
+// are retried and counted by the circuit breaker.
+func wrapAMaaSError(err error) error {
+	for _, fragment := range transientAMaaSErrors {
+		if strings.Contains(err.Error(), fragment) {
+			return fmt.Errorf("%w: %v", errScannerUnavailable, err)
+		}
+	}
+	return err
+}
+
+// parseAMaaSResult converts the AMaaS JSON result into a ScanVerdict.
+func parseAMaaSResult(result string) (*ScanVerdict, error) {
+	log.Printf("Scanning complete: %s", result)
+
+	var resultMap map[string]interface{}
+	if err := json.Unmarshal([]byte(result), &resultMap); err != nil {
+		return nil, fmt.Errorf("failed to parse scan result: %w", err)
+	}
+
+	v := &ScanVerdict{Raw: resultMap}
+	if id, ok := resultMap["scanId"].(string); ok {
+		v.ScanID = id
+	}
+	if val, ok := resultMap["scanResult"].(float64); ok && val == 1 {
+		v.Malicious = true
+		log.Println("File is malicious")
+	} else if val, ok := resultMap["scanResult"].(float64); ok && val == 0 {
+		log.Println("File is clean")
+	} else {
+		log.Printf("Unexpected scanResult value: %v (type: %T)", resultMap["scanResult"], resultMap["scanResult"])
+	}
+
+	// Also check foundMalwares array for additional detection
+	if malwares, ok := resultMap["foundMalwares"].([]interface{}); ok && len(malwares) > 0 {
+		v.Malicious = true
+		for _, m := range malwares {
+			if entry, ok := m.(map[string]interface{}); ok {
+				if name, ok := entry["malwareName"].(string); ok {
+					v.MalwareNames = append(v.MalwareNames, name)
+				}
+			}
+		}
+		log.Printf("File is malicious - found malwares: %v", malwares)
+	}
+	return v, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeScanServer is a local gRPC server standing in for the AMaaS scan
+// service. It is down (Unavailable) for its first unavailable calls and
+// rejects the ones after that (PermissionDenied), which the scanner has to
+// treat as a definite answer.
+type fakeScanServer struct {
+	addr        string
+	calls       atomic.Int32
+	unavailable atomic.Int32
+}
+
+func startFakeScanServer(t *testing.T, unavailable int32) *fakeScanServer {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeScanServer{addr: lis.Addr().String()}
+	f.unavailable.Store(unavailable)
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(_ interface{}, _ grpc.ServerStream) error {
+		if f.calls.Add(1) <= f.unavailable.Load() {
+			return status.Error(codes.Unavailable, "fake scan server is down")
+		}
+		return status.Error(codes.PermissionDenied, "fake scan server refused the key")
+	}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return f
+}
+
+// newFakeAMaaSScanner points an AMaaS scanner at f, the way AMAAS_ADDRESS
+// does, and wraps it like mustScanner.
+func newFakeAMaaSScanner(t *testing.T, f *fakeScanServer, cfg resilienceConfig) *resilientScanner {
+	t.Helper()
+	inner, err := newScanner(scannerConfig{Engine: "amaas", APIKey: "test-key", AMaaS: amaasConfig{Address: f.addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newResilientScanner(inner, cfg)
+	t.Cleanup(func() { closeScanner(s) })
+	return s
+}
+
+var fakeResilience = resilienceConfig{
+	MaxConcurrent:    1,
+	MaxAttempts:      3,
+	BaseBackoff:      time.Millisecond,
+	MaxBackoff:       2 * time.Millisecond,
+	BreakerThreshold: 3,
+	BreakerCooldown:  50 * time.Millisecond,
+}
+
+func scanHello(s Scanner) error {
+	_, err := s.ScanReader(strings.NewReader("hello"), "hello.txt", nil)
+	return err
+}
+
+func checkBreaker(t *testing.T, s *resilientScanner, want string) {
+	t.Helper()
+	if got := s.Stats()["breaker"]; got != want {
+		t.Fatalf("breaker is %v, want %s", got, want)
+	}
+}
+
+func TestAMaaSScannerRetriesTransientErrors(t *testing.T) {
+	f := startFakeScanServer(t, 1)
+	s := newFakeAMaaSScanner(t, f, fakeResilience)
+
+	err := scanHello(s)
+	if err == nil || errors.Is(err, errScannerUnavailable) {
+		t.Fatalf("want the server's definite answer after a retry, got %v", err)
+	}
+	if n := f.calls.Load(); n != 2 {
+		t.Fatalf("server saw %d calls, want 2", n)
+	}
+	checkBreaker(t, s, breakerClosed)
+}
+
+func TestAMaaSScannerBreaker(t *testing.T) {
+	f := startFakeScanServer(t, 1000)
+	s := newFakeAMaaSScanner(t, f, fakeResilience)
+
+	// Every attempt fails; the last one opens the breaker
+	if err := scanHello(s); !errors.Is(err, errScannerUnavailable) {
+		t.Fatalf("want a transient error, got %v", err)
+	}
+	if n := f.calls.Load(); n != 3 {
+		t.Fatalf("server saw %d calls, want 3", n)
+	}
+	checkBreaker(t, s, breakerOpen)
+
+	// While open, scans fail without reaching the server
+	if err := scanHello(s); !errors.Is(err, errScannerUnavailable) {
+		t.Fatalf("want a transient error, got %v", err)
+	}
+	if n := f.calls.Load(); n != 3 {
+		t.Fatalf("server saw %d calls while the breaker was open, want 3", n)
+	}
+
+	// After the cooldown one probe goes through; it fails and the breaker
+	// opens again
+	time.Sleep(fakeResilience.BreakerCooldown + 10*time.Millisecond)
+	if err := scanHello(s); !errors.Is(err, errScannerUnavailable) {
+		t.Fatalf("want a transient error, got %v", err)
+	}
+	if n := f.calls.Load(); n != 4 {
+		t.Fatalf("server saw %d calls after the half-open probe, want 4", n)
+	}
+	checkBreaker(t, s, breakerOpen)
+
+	// Once the server answers, the next probe closes the breaker
+	f.unavailable.Store(0)
+	time.Sleep(fakeResilience.BreakerCooldown + 10*time.Millisecond)
+	if err := scanHello(s); err == nil || errors.Is(err, errScannerUnavailable) {
+		t.Fatalf("want the server's definite answer, got %v", err)
+	}
+	if n := f.calls.Load(); n != 5 {
+		t.Fatalf("server saw %d calls after recovering, want 5", n)
+	}
+	checkBreaker(t, s, breakerClosed)
+}
+
+func TestResilienceZeroBackoff(t *testing.T) {
+	s := newResilientScanner(newFakeScanner(), resilienceConfig{MaxConcurrent: 1, MaxAttempts: 2})
+	if d := s.backoff(1); d != 0 {
+		t.Fatalf("backoff with no delays configured is %s, want 0", d)
+	}
+}
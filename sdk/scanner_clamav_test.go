@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeClamd is a clamd stand-in on a unix socket. It answers PING, and
+// INSTREAM with whatever reply returns for the streamed content.
+type fakeClamd struct {
+	addr  string
+	reply func(content []byte) string
+
+	mu sync.Mutex
+	// chunks holds the chunk sizes of the last INSTREAM, ending with 0.
+	chunks  []int
+	content []byte
+}
+
+func startFakeClamd(t *testing.T, reply func(content []byte) string) *fakeClamd {
+	t.Helper()
+	// Socket paths are limited to about 100 bytes, which t.TempDir can exceed
+	dir, err := os.MkdirTemp("", "clamd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "clamd.sock")
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	f := &fakeClamd{addr: "unix:" + path, reply: reply}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	cmd, err := in.ReadString(0)
+	if err != nil {
+		return
+	}
+	switch cmd {
+	case "zPING\x00":
+		conn.Write([]byte("PONG\x00"))
+	case "zINSTREAM\x00":
+		var chunks []int
+		var content []byte
+		size := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(in, size); err != nil {
+				return
+			}
+			n := int(binary.BigEndian.Uint32(size))
+			chunks = append(chunks, n)
+			if n == 0 {
+				break
+			}
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(in, chunk); err != nil {
+				return
+			}
+			content = append(content, chunk...)
+		}
+		f.mu.Lock()
+		f.chunks, f.content = chunks, content
+		f.mu.Unlock()
+		conn.Write([]byte(f.reply(content) + "\x00"))
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+// eicarReply is clamd's answer for content with or without the EICAR string.
+func eicarReply(content []byte) string {
+	if bytes.Contains(content, []byte(eicarSignature)) {
+		return "stream: Win.Test.EICAR_HDB-1 FOUND"
+	}
+	return "stream: OK"
+}
+
+func TestClamAVStreamsChunks(t *testing.T) {
+	clamd := startFakeClamd(t, eicarReply)
+	content := bytes.Repeat([]byte("paper "), 25000) // 150000 bytes, three chunks
+	verdict, err := newClamAVScanner(clamd.addr).ScanReader(bytes.NewReader(content), "big.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verdict.Malicious {
+		t.Error("clean content reported malicious")
+	}
+	clamd.mu.Lock()
+	defer clamd.mu.Unlock()
+	if want := []int{clamdChunkSize, clamdChunkSize, len(content) - 2*clamdChunkSize, 0}; !reflect.DeepEqual(clamd.chunks, want) {
+		t.Errorf("chunk sizes %v, want %v", clamd.chunks, want)
+	}
+	if !bytes.Equal(clamd.content, content) {
+		t.Error("clamd received different content")
+	}
+}
+
+func TestClamAVReplies(t *testing.T) {
+	for _, tc := range []struct {
+		reply     string
+		malicious bool
+		malware   []string
+		err       string
+	}{
+		{"stream: OK", false, nil, ""},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", true, []string{"Win.Test.EICAR_HDB-1"}, ""},
+		{"INSTREAM size limit exceeded. ERROR", false, nil, "size limit exceeded"},
+		{"stream: Can't allocate memory ERROR", false, nil, "Can't allocate memory"},
+	} {
+		clamd := startFakeClamd(t, func([]byte) string { return tc.reply })
+		verdict, err := newClamAVScanner(clamd.addr).ScanReader(strings.NewReader("content"), "file.txt", nil)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q: got %v, want an error containing %q", tc.reply, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.reply, err)
+			continue
+		}
+		if verdict.Malicious != tc.malicious || !reflect.DeepEqual(verdict.MalwareNames, tc.malware) {
+			t.Errorf("%q: malicious %t %v, want %t %v", tc.reply, verdict.Malicious, verdict.MalwareNames, tc.malicious, tc.malware)
+		}
+		if verdict.Raw["reply"] != tc.reply {
+			t.Errorf("%q: raw reply %v", tc.reply, verdict.Raw["reply"])
+		}
+	}
+}
+
+func TestClamAVUnreachable(t *testing.T) {
+	clamd := startFakeClamd(t, eicarReply)
+	if err := newClamAVScanner(clamd.addr).Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	missing := newClamAVScanner(filepath.Join(t.TempDir(), "missing.sock"))
+	if _, err := missing.ScanReader(strings.NewReader("content"), "file.txt", nil); !errors.Is(err, errScannerUnavailable) {
+		t.Errorf("scan without clamd: got %v, want errScannerUnavailable", err)
+	}
+	if err := missing.Ping(context.Background()); !errors.Is(err, errScannerUnavailable) {
+		t.Errorf("Ping without clamd: got %v, want errScannerUnavailable", err)
+	}
+}
+
+func TestEICARUploadIsQuarantined(t *testing.T) {
+	clamd := startFakeClamd(t, eicarReply)
+	for name, scanner := range map[string]func() Scanner{
+		"fake":   func() Scanner { return newFakeScanner() },
+		"clamav": func() Scanner { return newClamAVScanner(clamd.addr) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := newTestAPI(t, "")
+			activeScanner = scanner()
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			fw, _ := mw.CreateFormFile("file", "eicar.txt")
+			fw.Write([]byte(eicarSignature))
+			mw.Close()
+			w := api.do(http.MethodPost, "/upload", "", "", &body, mw.FormDataContentType())
+			var result ScanResult
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatalf("upload: %d %s", w.Code, w.Body)
+			}
+			if result.Verdict != VerdictMalicious || result.Code != CodeMalicious || len(result.MalwareNames) != 1 {
+				t.Fatalf("verdict %s (code %d) naming %v, want malicious", result.Verdict, result.Code, result.MalwareNames)
+			}
+			if result.QuarantineID == "" || result.DocumentID != "" {
+				t.Fatalf("quarantine ID %q, document ID %q", result.QuarantineID, result.DocumentID)
+			}
+			content, err := quarantine.Content(result.QuarantineID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != eicarSignature {
+				t.Errorf("quarantined content %q", content)
+			}
+			item, err := quarantine.Get(result.QuarantineID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(item.MalwareNames, result.MalwareNames) || item.FileName != "eicar.txt" {
+				t.Errorf("quarantined %q naming %v", item.FileName, item.MalwareNames)
+			}
+			if ids := api.listed("", ""); len(ids) != 0 {
+				t.Errorf("malicious upload stored as documents %v", ids)
+			}
+
+			// The same scanner lets a clean file through
+			var clean ScanResult
+			api.upload("/upload", "", "", &clean)
+			if clean.Verdict != VerdictClean || clean.DocumentID == "" {
+				t.Errorf("clean upload: verdict %s, document %q", clean.Verdict, clean.DocumentID)
+			}
+		})
+	}
+}
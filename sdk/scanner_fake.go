@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// eicarSignature is the standard anti-malware test string.
+const eicarSignature = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeScanner is a deterministic, offline scanner that reports any content
+// containing the EICAR test string as malicious. It lets the full upload flow
+// run in CI without an API key.
+type fakeScanner struct{}
+
+func newFakeScanner() *fakeScanner { return &fakeScanner{} }
+
+func (s *fakeScanner) Name() string { return "fake" }
+
+func (s *fakeScanner) ScanFile(path string, tags []string) (*ScanVerdict, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return s.ScanReader(f, path, tags)
+}
+
+func (s *fakeScanner) ScanReader(r io.Reader, name string, tags []string) (*ScanVerdict, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{
+		"fileName":   name,
+		"scanResult": 0,
+	}
+	if !bytes.Contains(data, []byte(eicarSignature)) {
+		return &ScanVerdict{Raw: raw}, nil
+	}
+	raw["scanResult"] = 1
+	raw["foundMalwares"] = []map[string]string{{"fileName": name, "malwareName": "Eicar_test_file"}}
+	return &ScanVerdict{Malicious: true, MalwareNames: []string{"Eicar_test_file"}, Raw: raw}, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// spool holds received upload content in memory and only spills it to a
+// temporary file once it grows beyond the memory limit. The SHA-256 digest
+// is computed while the content is received.
+type spool struct {
+	mem    []byte
+	file   *os.File
+	size   int64
+	sha256 string
+}
+
+// newSpool reads src to EOF, keeping up to memLimit bytes in memory and
+// writing anything larger to a temporary file in dir.
+func newSpool(src io.Reader, memLimit int64, dir string) (*spool, error) {
+	h := sha256.New()
+	src = io.TeeReader(src, h)
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, src, memLimit+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	s := &spool{size: n}
+	if n <= memLimit {
+		s.mem = buf.Bytes()
+		s.sha256 = hex.EncodeToString(h.Sum(nil))
+		return s, nil
+	}
+
+	f, err := os.CreateTemp(dir, "spool-*")
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		s.Close()
+		return nil, err
+	}
+	rest, err := io.Copy(f, src)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.size += rest
+	s.sha256 = hex.EncodeToString(h.Sum(nil))
+	return s, nil
+}
+
+// Size returns the number of bytes received.
+func (s *spool) Size() int64 { return s.size }
+
+// SHA256 returns the hex digest of the received content.
+func (s *spool) SHA256() string { return s.sha256 }
+
+// Path returns the spill file, or "" if the content is held in memory.
+func (s *spool) Path() string {
+	if s.file == nil {
+		return ""
+	}
+	return s.file.Name()
+}
+
+// Reader returns a fresh reader over the whole content. It also supports
+// random access, which archive expansion relies on.
+func (s *spool) Reader() *io.SectionReader {
+	if s.file == nil {
+		return io.NewSectionReader(bytes.NewReader(s.mem), 0, s.size)
+	}
+	return io.NewSectionReader(s.file, 0, s.size)
+}
+
+// Detach releases the content but leaves the spill file on disk, for a file
+// that still belongs to someone else.
+func (s *spool) Detach() error {
+	s.mem = nil
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Close releases the content and removes any spill file.
+func (s *spool) Close() error {
+	s.mem = nil
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	s.file.Close()
+	s.file = nil
+	return os.Remove(name)
+}
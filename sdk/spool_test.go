@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// spoolFiles lists the spill files left in dir.
+func spoolFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestSpoolSpillsPastMemoryLimit(t *testing.T) {
+	const limit = 1024
+	for _, tc := range []struct {
+		name    string
+		size    int
+		spilled bool
+	}{
+		{"empty", 0, false},
+		{"below the limit", limit - 1, false},
+		{"at the limit", limit, false},
+		{"one byte over", limit + 1, true},
+		{"many times over", 10*limit + 7, true},
+	} {
+		dir := t.TempDir()
+		content := bytes.Repeat([]byte("0123456789abcdef"), tc.size/16+1)[:tc.size]
+		s, err := newSpool(bytes.NewReader(content), limit, dir)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if spilled := s.Path() != ""; spilled != tc.spilled {
+			t.Errorf("%s: spilled %t, want %t", tc.name, spilled, tc.spilled)
+		}
+		if files := spoolFiles(t, dir); (len(files) == 1) != tc.spilled || len(files) > 1 {
+			t.Errorf("%s: spill files %v", tc.name, files)
+		}
+		sum := sha256.Sum256(content)
+		if s.Size() != int64(tc.size) || s.SHA256() != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: size %d, sha256 %s; want %d, %x", tc.name, s.Size(), s.SHA256(), tc.size, sum)
+		}
+		// The content reads back whole, twice, and by offset
+		for i := 0; i < 2; i++ {
+			got, err := io.ReadAll(s.Reader())
+			if err != nil || !bytes.Equal(got, content) {
+				t.Errorf("%s: read %d bytes back, %v", tc.name, len(got), err)
+			}
+		}
+		if tc.size > 10 {
+			tail := make([]byte, 10)
+			if _, err := s.Reader().ReadAt(tail, int64(tc.size-10)); err != nil || !bytes.Equal(tail, content[tc.size-10:]) {
+				t.Errorf("%s: ReadAt the end got %q, %v", tc.name, tail, err)
+			}
+		}
+
+		if err := s.Close(); err != nil {
+			t.Errorf("%s: Close: %v", tc.name, err)
+		}
+		if files := spoolFiles(t, dir); len(files) != 0 {
+			t.Errorf("%s: spill files %v left after Close", tc.name, files)
+		}
+	}
+}
+
+func TestSpoolDetachKeepsSpillFile(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("x"), 100)
+	s, err := newSpool(bytes.NewReader(content), 10, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := s.Path()
+	if err := s.Detach(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Path() != "" {
+		t.Error("detached spool still has its file")
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("spill file after Detach: %d bytes, %v", len(got), err)
+	}
+	// Closing afterwards leaves the file to its new owner
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Close after Detach removed the file: %v", err)
+	}
+}
+
+// failingReader returns data and then err.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestSpoolRemovesSpillFileOnReadError(t *testing.T) {
+	dir := t.TempDir()
+	broken := errors.New("connection reset")
+	if _, err := newSpool(&failingReader{bytes.Repeat([]byte("x"), 100), broken}, 10, dir); !errors.Is(err, broken) {
+		t.Fatalf("got %v, want the read error", err)
+	}
+	if files := spoolFiles(t, dir); len(files) != 0 {
+		t.Errorf("spill files %v left after a failed read", files)
+	}
+	if _, err := newSpool(&failingReader{[]byte("short"), broken}, 10, dir); !errors.Is(err, broken) {
+		t.Fatalf("in memory: got %v, want the read error", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Document is the metadata kept for every file persisted by the SDK.
+type Document struct {
+	ID          string  `json:"id"`
+	Tenant      string  `json:"tenant,omitempty"`
+	Name        string  `json:"name"`
+	ContentType string  `json:"content_type"`
+	Size        int64   `json:"size"`
+	SHA256      string  `json:"sha256"`
+	Uploader    string  `json:"uploader"`
+	Verdict     Verdict `json:"verdict"`
+	ScanID      string  `json:"scan_id,omitempty"`
+	// ReleasedBy is set when an administrator released the file from
+	// quarantine despite a malicious verdict.
+	ReleasedBy string    `json:"released_by,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// DocumentStore persists uploaded documents and their metadata.
+// Implementations must be safe for concurrent use.
+type DocumentStore interface {
+	// Put stores content under doc.ID together with doc's metadata.
+	Put(doc *Document, content io.Reader) error
+	// List returns the metadata of every stored document, newest first.
+	List() ([]*Document, error)
+	// Get returns the metadata of a single document.
+	Get(id string) (*Document, error)
+	// Open returns a reader for a document's content.
+	Open(id string) (io.ReadCloser, error)
+	// Delete removes a document and its metadata.
+	Delete(id string) error
+}
+
+// errDocumentNotFound is returned by DocumentStore methods for unknown IDs.
+var errDocumentNotFound = errors.New("document not found")
+
+// validID matches identifiers produced by newID.
+var validID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// newDocumentStore builds the store selected by cfg: "fs" (default, under
+// uploadFolder) or "s3". Every tenant gets its own directory or key prefix.
+func newDocumentStore(cfg storageConfig) (*tenantStores, error) {
+	backend := strings.ToLower(strings.TrimSpace(cfg.Backend))
+	switch backend {
+	case "", "fs", "filesystem":
+		root := filepath.Join(uploadFolder, "documents")
+		if err := os.MkdirAll(root, 0o750); err != nil {
+			return nil, err
+		}
+		return newTenantStores(func(tenant string) (DocumentStore, error) {
+			return newFSStore(filepath.Join(root, tenant))
+		}), nil
+	case "s3":
+		base, err := newS3Store(cfg.S3)
+		if err != nil {
+			return nil, err
+		}
+		return newTenantStores(func(tenant string) (DocumentStore, error) {
+			return base.withPrefix(base.prefix + tenant + "/"), nil
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown document store %q (want fs or s3)", backend)
+	}
+}
+
+// mustDocumentStore is like newDocumentStore but exits on misconfiguration.
+func mustDocumentStore(cfg storageConfig) *tenantStores {
+	s, err := newDocumentStore(cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure document store: %v", err)
+	}
+	return s
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// fsStore keeps each document in its own directory:
+//
+//	<root>/<id>/content
+//	<root>/<id>/meta.json
+type fsStore struct {
+	root string
+	mu   sync.RWMutex
+}
+
+func newFSStore(root string) (*fsStore, error) {
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, err
+	}
+	return &fsStore{root: root}, nil
+}
+
+func (s *fsStore) dir(id string) (string, error) {
+	if !validID.MatchString(id) {
+		return "", errDocumentNotFound
+	}
+	return filepath.Join(s.root, id), nil
+}
+
+func (s *fsStore) Put(doc *Document, content io.Reader) error {
+	dir, err := s.dir(doc.ID)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "content"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	return s.writeMeta(dir, doc)
+}
+
+func (s *fsStore) writeMeta(dir string, doc *Document) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "meta.json.tmp")
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "meta.json"))
+}
+
+func (s *fsStore) readMeta(dir string) (*Document, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "meta.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errDocumentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func (s *fsStore) List() ([]*Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+	docs := []*Document{}
+	for _, e := range entries {
+		if !e.IsDir() || !validID.MatchString(e.Name()) {
+			continue
+		}
+		doc, err := s.readMeta(filepath.Join(s.root, e.Name()))
+		if err != nil {
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].CreatedAt.After(docs[j].CreatedAt) })
+	return docs, nil
+}
+
+func (s *fsStore) Get(id string) (*Document, error) {
+	dir, err := s.dir(id)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.readMeta(dir)
+}
+
+func (s *fsStore) Open(id string) (io.ReadCloser, error) {
+	dir, err := s.dir(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(dir, "content"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errDocumentNotFound
+	}
+	return f, err
+}
+
+func (s *fsStore) Delete(id string) error {
+	dir, err := s.dir(id)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return errDocumentNotFound
+	}
+	return os.RemoveAll(dir)
+}
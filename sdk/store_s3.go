@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Store keeps documents in an S3-compatible bucket (AWS S3, MinIO, GCS
+// interoperability mode, ...) using path-style requests signed with SigV4:
+//
+//	<prefix><id>/content
+//	<prefix><id>/meta.json
+//
+// Each tenant's store has its own prefix, <prefix><tenant>/.
+type s3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// newS3Store connects to the bucket described by cfg.
+func newS3Store(cfg s3Config) (*s3Store, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	s := &s3Store{
+		endpoint:  u,
+		bucket:    cfg.Bucket,
+		prefix:    cfg.Prefix,
+		region:    cfg.Region,
+		accessKey: cfg.AccessKeyID,
+		secretKey: cfg.SecretAccessKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+	if s.bucket == "" {
+		return nil, errors.New("a bucket is required for the s3 document store")
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("an access key ID and secret access key are required for the s3 document store")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.prefix != "" && !strings.HasSuffix(s.prefix, "/") {
+		s.prefix += "/"
+	}
+	return s, nil
+}
+
+// withPrefix returns a store sharing s's bucket and credentials that keeps
+// its objects under prefix.
+func (s *s3Store) withPrefix(prefix string) *s3Store {
+	c := *s
+	c.prefix = prefix
+	return &c
+}
+
+func (s *s3Store) key(id, name string) string { return s.prefix + id + "/" + name }
+
+func (s *s3Store) Put(doc *Document, content io.Reader) error {
+	if !validID.MatchString(doc.ID) {
+		return errDocumentNotFound
+	}
+	if err := s.putObject(s.key(doc.ID, "content"), content, doc.Size, doc.ContentType); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return s.putObject(s.key(doc.ID, "meta.json"), bytes.NewReader(meta), int64(len(meta)), "application/json")
+}
+
+func (s *s3Store) List() ([]*Document, error) {
+	var docs []*Document
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		res, err := s.do(http.MethodGet, "", q, nil, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			if !strings.HasSuffix(obj.Key, "/meta.json") {
+				continue
+			}
+			id := strings.TrimSuffix(strings.TrimPrefix(obj.Key, s.prefix), "/meta.json")
+			doc, err := s.Get(id)
+			if err != nil {
+				continue
+			}
+			docs = append(docs, doc)
+		}
+		if !page.IsTruncated {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	if docs == nil {
+		docs = []*Document{}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].CreatedAt.After(docs[j].CreatedAt) })
+	return docs, nil
+}
+
+func (s *s3Store) Get(id string) (*Document, error) {
+	rc, err := s.getObject(id, "meta.json")
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var doc Document
+	if err := json.NewDecoder(rc).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func (s *s3Store) Open(id string) (io.ReadCloser, error) {
+	return s.getObject(id, "content")
+}
+
+func (s *s3Store) Delete(id string) error {
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	for _, name := range []string{"content", "meta.json"} {
+		res, err := s.do(http.MethodDelete, s.key(id, name), nil, nil, 0, "")
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+	}
+	return nil
+}
+
+func (s *s3Store) getObject(id, name string) (io.ReadCloser, error) {
+	if !validID.MatchString(id) {
+		return nil, errDocumentNotFound
+	}
+	res, err := s.do(http.MethodGet, s.key(id, name), nil, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *s3Store) putObject(key string, body io.Reader, size int64, contentType string) error {
+	res, err := s.do(http.MethodPut, key, nil, body, size, contentType)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// do sends a signed request for key (empty for bucket-level operations) and
+// maps 404 to errDocumentNotFound and other non-2xx statuses to errors.
+func (s *s3Store) do(method, key string, query url.Values, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, time.Now().UTC())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errDocumentNotFound
+	}
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, u.Path, res.Status, msg)
+	}
+	return res, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req. The payload is sent
+// unsigned so large documents can be streamed.
+func (s *s3Store) sign(req *http.Request, now time.Time) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query with sorted keys as SigV4 requires.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsURIEncode percent-encodes everything except unreserved characters, and
+// '/' unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
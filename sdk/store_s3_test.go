@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a local stand-in for an S3-compatible service such as MinIO. It
+// keeps objects in memory, answers path-style object and ListObjectsV2
+// requests, and refuses requests whose SigV4 signature it cannot reproduce
+// from what it received.
+type fakeS3 struct {
+	t         *testing.T
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	// pageSize limits the keys per listing page, so paging is exercised.
+	pageSize int
+
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+	// headers holds the headers of the last request.
+	headers http.Header
+}
+
+type fakeS3Object struct {
+	data        []byte
+	contentType string
+}
+
+func startFakeS3(t *testing.T) (*fakeS3, s3Config) {
+	t.Helper()
+	f := &fakeS3{
+		t:         t,
+		bucket:    "bpc-docs",
+		region:    "eu-west-1",
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		pageSize:  2,
+		objects:   map[string]fakeS3Object{},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, s3Config{Endpoint: srv.URL, Bucket: f.bucket, Region: f.region, AccessKeyID: f.accessKey, SecretAccessKey: f.secretKey}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.headers = r.Header.Clone()
+	if err := f.verify(r); err != nil {
+		f.t.Logf("fake S3 refused %s %s: %v", r.Method, r.URL, err)
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+	bucketPath := "/" + f.bucket
+	if r.URL.Path != bucketPath && !strings.HasPrefix(r.URL.Path, bucketPath+"/") {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, bucketPath), "/")
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, r.URL.Query())
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			http.Error(w, "<Error><Code>IncompleteBody</Code></Error>", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = fakeS3Object{data: data, contentType: r.Header.Get("Content-Type")}
+	case r.Method == http.MethodGet:
+		obj, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		w.Write(obj.data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+	}
+}
+
+// list answers ListObjectsV2, one page of pageSize keys at a time. The
+// continuation token is the index of the next key.
+func (f *fakeS3) list(w http.ResponseWriter, q url.Values) {
+	if q.Get("list-type") != "2" {
+		http.Error(w, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+		return
+	}
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	type entry struct{ key, commonPrefix string }
+	var entries []entry
+	seen := map[string]bool{}
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					entries = append(entries, entry{commonPrefix: p})
+				}
+				continue
+			}
+		}
+		entries = append(entries, entry{key: key})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key+entries[i].commonPrefix < entries[j].key+entries[j].commonPrefix
+	})
+	start, _ := strconv.Atoi(q.Get("continuation-token"))
+	end := start + f.pageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+	type content struct {
+		Key string `xml:"Key"`
+	}
+	type commonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+	page := struct {
+		XMLName               xml.Name       `xml:"ListBucketResult"`
+		Contents              []content      `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+		IsTruncated           bool           `xml:"IsTruncated"`
+		NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	}{IsTruncated: end < len(entries)}
+	for _, e := range entries[start:end] {
+		if e.commonPrefix != "" {
+			page.CommonPrefixes = append(page.CommonPrefixes, commonPrefix{e.commonPrefix})
+		} else {
+			page.Contents = append(page.Contents, content{e.key})
+		}
+	}
+	if page.IsTruncated {
+		page.NextContinuationToken = strconv.Itoa(end)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(page)
+}
+
+// verify recomputes the request's SigV4 signature from the request as
+// received, the way the service would.
+func (f *fakeS3) verify(r *http.Request) error {
+	authz, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return errors.New("not signed with AWS4-HMAC-SHA256")
+	}
+	fields := map[string]string{}
+	for _, part := range strings.Split(authz, ", ") {
+		k, v, _ := strings.Cut(part, "=")
+		fields[k] = v
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	signedAt, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return fmt.Errorf("bad X-Amz-Date %q", amzDate)
+	}
+	if d := time.Since(signedAt); d > 15*time.Minute || d < -15*time.Minute {
+		return fmt.Errorf("X-Amz-Date %s is too far off", amzDate)
+	}
+	scope := amzDate[:8] + "/" + f.region + "/s3/aws4_request"
+	if fields["Credential"] != f.accessKey+"/"+scope {
+		return fmt.Errorf("credential %q, want %s/%s", fields["Credential"], f.accessKey, scope)
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, name := range strings.Split(fields["SignedHeaders"], ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+	query := r.URL.Query()
+	names := make([]string, 0, len(query))
+	for k := range query {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	escape := func(s string) string { return strings.ReplaceAll(url.QueryEscape(s), "+", "%20") }
+	var pairs []string
+	for _, k := range names {
+		for _, v := range query[k] {
+			pairs = append(pairs, escape(k)+"="+escape(v))
+		}
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Join(pairs, "&"),
+		canonicalHeaders.String(),
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + f.secretKey)
+	for _, part := range []string{amzDate[:8], f.region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if want := hex.EncodeToString(key); fields["Signature"] != want {
+		return fmt.Errorf("signature %s, want %s for\n%s", fields["Signature"], want, canonicalRequest)
+	}
+	return nil
+}
+
+func (f *fakeS3) object(key string) fakeS3Object {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[key]
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newTestS3Store(t *testing.T, cfg s3Config) *s3Store {
+	t.Helper()
+	s, err := newS3Store(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func putTestDocument(t *testing.T, s DocumentStore, content string, created time.Time) *Document {
+	t.Helper()
+	doc := &Document{
+		ID:          newID(),
+		Name:        "notes.txt",
+		ContentType: "text/plain",
+		Size:        int64(len(content)),
+		Verdict:     VerdictClean,
+		CreatedAt:   created,
+		UpdatedAt:   created,
+	}
+	if err := s.Put(doc, strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestS3StorePutGetListDelete(t *testing.T) {
+	f, cfg := startFakeS3(t)
+	// A prefix needing escaping checks that the signed path is the one sent
+	cfg.Prefix = "paper docs"
+	s := newTestS3Store(t, cfg)
+
+	now := time.Now().UTC()
+	var docs []*Document
+	for i := 0; i < 3; i++ {
+		docs = append(docs, putTestDocument(t, s, fmt.Sprintf("document %d", i), now.Add(time.Duration(i)*time.Minute)))
+	}
+	obj := f.object("paper docs/" + docs[0].ID + "/content")
+	if string(obj.data) != "document 0" || obj.contentType != "text/plain" {
+		t.Errorf("content stored as %q (%s)", obj.data, obj.contentType)
+	}
+	if meta := f.object("paper docs/" + docs[0].ID + "/meta.json"); meta.contentType != "application/json" {
+		t.Errorf("metadata stored as %s", meta.contentType)
+	}
+
+	got, err := s.Get(docs[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != docs[1].ID || got.Size != docs[1].Size || got.Verdict != VerdictClean {
+		t.Errorf("Get returned %+v, want %+v", got, docs[1])
+	}
+	rc, err := s.Open(docs[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(content) != "document 1" {
+		t.Errorf("Open read %q", content)
+	}
+
+	// Six objects over two-key pages
+	listed, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 3 || listed[0].ID != docs[2].ID || listed[2].ID != docs[0].ID {
+		t.Errorf("List returned %d documents, want the 3 newest first", len(listed))
+	}
+
+	if err := s.Delete(docs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(docs[0].ID); !errors.Is(err, errDocumentNotFound) {
+		t.Errorf("Get after Delete: %v, want errDocumentNotFound", err)
+	}
+	if err := s.Delete(docs[0].ID); !errors.Is(err, errDocumentNotFound) {
+		t.Errorf("second Delete: %v, want errDocumentNotFound", err)
+	}
+	if keys := f.keys(); len(keys) != 4 {
+		t.Errorf("objects left after Delete: %v", keys)
+	}
+}
+
+func TestS3StoreRefusesInvalidIDs(t *testing.T) {
+	f, cfg := startFakeS3(t)
+	s := newTestS3Store(t, cfg)
+	for _, id := range []string{"", "../other/meta", "ABCDEF0123456789ABCDEF0123456789"} {
+		if _, err := s.Get(id); !errors.Is(err, errDocumentNotFound) {
+			t.Errorf("Get(%q): %v, want errDocumentNotFound", id, err)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.headers != nil || len(f.objects) != 0 {
+		t.Error("invalid IDs reached the service")
+	}
+}
+
+func TestS3StoreSignsRequests(t *testing.T) {
+	f, cfg := startFakeS3(t)
+	s := newTestS3Store(t, cfg)
+	if _, err := s.List(); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	headers := f.headers
+	f.mu.Unlock()
+	if got := headers.Get("X-Amz-Content-Sha256"); got != "UNSIGNED-PAYLOAD" {
+		t.Errorf("X-Amz-Content-Sha256 = %q, want UNSIGNED-PAYLOAD", got)
+	}
+	date := headers.Get("X-Amz-Date")
+	prefix := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s/%s/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=",
+		f.accessKey, date[:8], f.region)
+	authz := headers.Get("Authorization")
+	if sig, ok := strings.CutPrefix(authz, prefix); !ok || len(sig) != 64 {
+		t.Errorf("Authorization = %q", authz)
+	}
+
+	cfg.SecretAccessKey = "not-the-secret"
+	wrong := newTestS3Store(t, cfg)
+	if err := wrong.Put(&Document{ID: newID()}, bytes.NewReader(nil)); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Put with the wrong secret: %v, want 403", err)
+	}
+}
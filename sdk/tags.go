@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// AMaaS accepts at most maxScanTags tags per scan, each at most
+// maxScanTagLength characters.
+const (
+	maxScanTags      = 8
+	maxScanTagLength = 63
+)
+
+// baseScanTag marks every scan from this service in the Vision One console.
+const baseScanTag = "bpc-uploads"
+
+// scanCategories are the document categories a client may choose, and
+// scanPlatform the cloud recorded in every scan's tags; see tagsConfig.
+var (
+	scanCategories []string
+	scanPlatform   string
+)
+
+var (
+	errInvalidCategory = errors.New("invalid document category")
+	// categoryPattern keeps categories usable as tag values.
+	categoryPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+	// unsafeTagChars are replaced in free-form values such as uploader names.
+	unsafeTagChars = regexp.MustCompile(`[^a-zA-Z0-9._@+-]+`)
+)
+
+func loadScanTags(cfg tagsConfig) {
+	scanCategories = nil
+	for _, cat := range cfg.Categories {
+		scanCategories = append(scanCategories, strings.ToLower(cat))
+	}
+	scanPlatform = cfg.Platform
+}
+
+// validCategory normalizes a client-chosen category, defaulting to
+// "general" when none was given.
+func validCategory(category string) (string, error) {
+	category = strings.ToLower(strings.TrimSpace(category))
+	if category == "" {
+		return "general", nil
+	}
+	if !categoryPattern.MatchString(category) || !contains(scanCategories, category) {
+		return "", fmt.Errorf("%w %q (want one of %s)", errInvalidCategory, category, strings.Join(scanCategories, ", "))
+	}
+	return category, nil
+}
+
+// scanTags builds the tags sent with a scan so detections can be filtered
+// by tenant, uploader, source cloud and document category. Values are
+// sanitized and every tag is cut to the engine's length limit.
+func scanTags(tenant, uploader, category string) []string {
+	tags := []string{baseScanTag}
+	add := func(key, value string) {
+		value = unsafeTagChars.ReplaceAllString(strings.TrimSpace(value), "_")
+		if value == "" || len(tags) >= maxScanTags {
+			return
+		}
+		tag := key + "=" + value
+		if len(tag) > maxScanTagLength {
+			tag = tag[:maxScanTagLength]
+		}
+		tags = append(tags, tag)
+	}
+	add("tenant", tenant)
+	add("uploader", uploader)
+	add("platform", scanPlatform)
+	add("category", category)
+	return tags
+}
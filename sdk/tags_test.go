@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScanTags(t *testing.T) {
+	defer loadScanTags(defaultConfig().Tags)
+	loadScanTags(tagsConfig{Categories: []string{"general", "invoices"}, Platform: "aws"})
+
+	long := strings.Repeat("a", 80)
+	for _, tc := range []struct {
+		name                       string
+		tenant, uploader, category string
+		want                       []string
+	}{
+		{"every tag", "acme", "alice@acme.com", "invoices",
+			[]string{"bpc-uploads", "tenant=acme", "uploader=alice@acme.com", "platform=aws", "category=invoices"}},
+		{"empty values left out", "acme", "  ", "",
+			[]string{"bpc-uploads", "tenant=acme", "platform=aws"}},
+		{"unsafe characters replaced", "acme", "Bob Smith <bob>", "general",
+			[]string{"bpc-uploads", "tenant=acme", "uploader=Bob_Smith_bob_", "platform=aws", "category=general"}},
+		{"nothing but unsafe characters", "acme", "éè", "general",
+			[]string{"bpc-uploads", "tenant=acme", "uploader=_", "platform=aws", "category=general"}},
+		{"long values cut to the limit", "acme", long, "general",
+			[]string{"bpc-uploads", "tenant=acme", ("uploader=" + long)[:maxScanTagLength], "platform=aws", "category=general"}},
+	} {
+		got := scanTags(tc.tenant, tc.uploader, tc.category)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+		if len(got) > maxScanTags {
+			t.Errorf("%s: %d tags, more than %d", tc.name, len(got), maxScanTags)
+		}
+		for _, tag := range got {
+			if len(tag) > maxScanTagLength {
+				t.Errorf("%s: tag %q longer than %d", tc.name, tag, maxScanTagLength)
+			}
+		}
+	}
+
+	loadScanTags(tagsConfig{Categories: []string{"general"}})
+	if got := scanTags("acme", "alice", "general"); !reflect.DeepEqual(got, []string{"bpc-uploads", "tenant=acme", "uploader=alice", "category=general"}) {
+		t.Errorf("without a platform: got %q", got)
+	}
+}
+
+func TestValidCategory(t *testing.T) {
+	defer loadScanTags(defaultConfig().Tags)
+	loadScanTags(tagsConfig{Categories: []string{"General", "invoices"}})
+	for _, tc := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"", "general", true},
+		{"  Invoices ", "invoices", true},
+		{"general", "general", true},
+		{"contracts", "", false},
+		{"invoices=x", "", false},
+		{"-invoices", "", false},
+	} {
+		got, err := validCategory(tc.in)
+		if tc.ok && (err != nil || got != tc.want) {
+			t.Errorf("validCategory(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+		if !tc.ok && !errors.Is(err, errInvalidCategory) {
+			t.Errorf("validCategory(%q) = %q, %v; want errInvalidCategory", tc.in, got, err)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"common/auth"
+)
+
+// defaultTenant owns uploads that don't name a tenant.
+const defaultTenant = "default"
+
+// TenantQuota limits what a tenant may store and scan. Zero means unlimited.
+type TenantQuota struct {
+	MaxBytes       int64 `json:"max_bytes" yaml:"max_bytes" env:"TENANT_MAX_BYTES"`
+	MaxFiles       int   `json:"max_files" yaml:"max_files" env:"TENANT_MAX_FILES"`
+	MaxScansPerDay int   `json:"max_scans_per_day" yaml:"max_scans_per_day" env:"TENANT_MAX_SCANS_PER_DAY"`
+}
+
+// TenantConfig holds a tenant's quota and optional policy overrides.
+type TenantConfig struct {
+	Quota TenantQuota `json:"quota"`
+	// UploadPolicy replaces the global file type policy when set.
+	UploadPolicy *UploadPolicy `json:"upload_policy,omitempty"`
+	// FailurePolicy overrides the scan failure policy per endpoint
+	// ("upload", "resumable").
+	FailurePolicy map[string]FailurePolicy `json:"failure_policy,omitempty"`
+}
+
+// tenantRegistry resolves tenants and tracks their daily scan usage.
+type tenantRegistry struct {
+	// Strict rejects tenants that are not listed in Tenants.
+	Strict   bool                     `json:"strict"`
+	Defaults TenantConfig             `json:"defaults"`
+	Tenants  map[string]*TenantConfig `json:"tenants"`
+
+	// mu guards the settings above, which reload replaces, and the usage
+	// counters.
+	mu    sync.Mutex
+	day   string
+	scans map[string]int
+	usage map[string]*tenantUsage
+	// loading serialises reading a tenant's stored usage from its store
+	loading sync.Mutex
+}
+
+// tenantUsage counts a tenant's stored documents. It is read from the store
+// once and then kept up to date as documents are stored and deleted, so
+// quota checks never list the store. Uploads that passed the quota check
+// and are still being scanned hold a reservation, so concurrent uploads
+// cannot together exceed the quota. The counts are per process: documents
+// another replica stores are only seen after a restart.
+type tenantUsage struct {
+	files         int
+	bytes         int64
+	reservedFiles int
+	reservedBytes int64
+}
+
+// tenants is the process-wide tenant registry.
+var tenants = &tenantRegistry{scans: map[string]int{}, usage: map[string]*tenantUsage{}}
+
+var (
+	errInvalidTenant = errors.New("invalid tenant")
+	errUnknownTenant = errors.New("unknown tenant")
+	// tenantPattern keeps tenant IDs safe as storage prefixes.
+	tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+)
+
+// loadTenants reads the registry from the JSON file named in cfg:
+//
+//	{"strict": true,
+//	 "defaults": {"quota": {"max_bytes": 1073741824}},
+//	 "tenants": {"acme": {"quota": {"max_scans_per_day": 500},
+//	                      "failure_policy": {"upload": "closed"}}}}
+//
+// cfg's quota fills in the default quota where the file leaves it at zero.
+func loadTenants(cfg tenantsConfig) (*tenantRegistry, error) {
+	t := &tenantRegistry{Tenants: map[string]*TenantConfig{}, scans: map[string]int{}, usage: map[string]*tenantUsage{}}
+	if path := cfg.File; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, t); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	q := &t.Defaults.Quota
+	if q.MaxBytes == 0 {
+		q.MaxBytes = cfg.Quota.MaxBytes
+	}
+	if q.MaxFiles == 0 {
+		q.MaxFiles = cfg.Quota.MaxFiles
+	}
+	if q.MaxScansPerDay == 0 {
+		q.MaxScansPerDay = cfg.Quota.MaxScansPerDay
+	}
+	for id, cfg := range t.Tenants {
+		if !tenantPattern.MatchString(id) {
+			return nil, fmt.Errorf("%w %q in tenants file", errInvalidTenant, id)
+		}
+		if cfg.UploadPolicy != nil {
+			for _, list := range [][]string{cfg.UploadPolicy.AllowedExtensions, cfg.UploadPolicy.DeniedExtensions} {
+				for i, ext := range list {
+					list[i] = normalizeExt(ext)
+				}
+			}
+		}
+	}
+	return t, nil
+}
+
+func mustTenants(cfg tenantsConfig) *tenantRegistry {
+	t, err := loadTenants(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load tenants: %v", err)
+	}
+	log.Printf("Tenants: %d configured, strict: %t, default quota: %+v", len(t.Tenants), t.Strict, t.Defaults.Quota)
+	return t
+}
+
+// Config returns the effective configuration for a tenant. Quota fields left
+// at zero fall back to the defaults.
+func (t *tenantRegistry) Config(tenant string) TenantConfig {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cfg := t.Defaults
+	if c, ok := t.Tenants[tenant]; ok {
+		if c.Quota.MaxBytes != 0 {
+			cfg.Quota.MaxBytes = c.Quota.MaxBytes
+		}
+		if c.Quota.MaxFiles != 0 {
+			cfg.Quota.MaxFiles = c.Quota.MaxFiles
+		}
+		if c.Quota.MaxScansPerDay != 0 {
+			cfg.Quota.MaxScansPerDay = c.Quota.MaxScansPerDay
+		}
+		if c.UploadPolicy != nil {
+			cfg.UploadPolicy = c.UploadPolicy
+		}
+		if c.FailurePolicy != nil {
+			cfg.FailurePolicy = c.FailurePolicy
+		}
+	}
+	return cfg
+}
+
+// Resolve validates a tenant ID.
+func (t *tenantRegistry) Resolve(tenant string) (string, error) {
+	tenant = strings.ToLower(strings.TrimSpace(tenant))
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	if !tenantPattern.MatchString(tenant) {
+		return "", fmt.Errorf("%w %q", errInvalidTenant, tenant)
+	}
+	t.mu.Lock()
+	_, known := t.Tenants[tenant]
+	strict := t.Strict
+	t.mu.Unlock()
+	if strict && !known {
+		return "", fmt.Errorf("%w %q", errUnknownTenant, tenant)
+	}
+	return tenant, nil
+}
+
+// reload replaces the tenants and quotas with those cfg describes, keeping
+// today's usage.
+func (t *tenantRegistry) reload(cfg tenantsConfig) error {
+	n, err := loadTenants(cfg)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Strict, t.Defaults, t.Tenants = n.Strict, n.Defaults, n.Tenants
+	log.Printf("Tenants reloaded: %d configured, strict: %t, default quota: %+v", len(t.Tenants), t.Strict, t.Defaults.Quota)
+	return nil
+}
+
+// reserveScan counts a scan against the tenant's daily allowance and
+// reports whether it was within quota. t.mu must be held.
+func (t *tenantRegistry) reserveScan(tenant string, limit int) bool {
+	if today := time.Now().UTC().Format("2006-01-02"); today != t.day {
+		t.day, t.scans = today, map[string]int{}
+	}
+	if limit > 0 && t.scans[tenant] >= limit {
+		return false
+	}
+	t.scans[tenant]++
+	return true
+}
+
+// loadUsage makes sure the tenant's stored usage is known, reading it from
+// the store the first time. Every change to a tenant's documents calls it
+// first, so none is missed while the store is read.
+func (t *tenantRegistry) loadUsage(tenant string) error {
+	t.mu.Lock()
+	_, ok := t.usage[tenant]
+	t.mu.Unlock()
+	if ok {
+		return nil
+	}
+	t.loading.Lock()
+	defer t.loading.Unlock()
+	t.mu.Lock()
+	_, ok = t.usage[tenant]
+	t.mu.Unlock()
+	if ok {
+		return nil
+	}
+	files, bytes, err := storedUsage(tenant)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.usage[tenant] = &tenantUsage{files: files, bytes: bytes}
+	t.mu.Unlock()
+	return nil
+}
+
+// trackStored runs change, which stores (files 1) or deletes (files -1) a
+// tenant's document of size bytes, and counts it in the tenant's usage.
+func (t *tenantRegistry) trackStored(tenant string, files int, bytes int64, change func() error) error {
+	if err := t.loadUsage(tenant); err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	u := t.usage[tenant]
+	u.files += files
+	u.bytes += bytes
+	t.mu.Unlock()
+	return nil
+}
+
+// reserveUpload checks an upload of size bytes against the tenant's quotas.
+// Within quota, it counts one of the tenant's scans for the day and holds
+// room for the file until release is called, by which time a stored file is
+// counted in the tenant's usage. Otherwise it returns the violation.
+func (t *tenantRegistry) reserveUpload(tenant string, size int64) (release func(), violation string, err error) {
+	quota := t.Config(tenant).Quota
+	if err := t.loadUsage(tenant); err != nil {
+		return nil, "", err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.usage[tenant]
+	switch {
+	case quota.MaxFiles > 0 && u.files+u.reservedFiles+1 > quota.MaxFiles:
+		return nil, fmt.Sprintf("tenant %s has reached its limit of %d stored files", tenant, quota.MaxFiles), nil
+	case quota.MaxBytes > 0 && u.bytes+u.reservedBytes+size > quota.MaxBytes:
+		return nil, fmt.Sprintf("tenant %s would exceed its storage limit of %d bytes", tenant, quota.MaxBytes), nil
+	case !t.reserveScan(tenant, quota.MaxScansPerDay):
+		return nil, fmt.Sprintf("tenant %s has used its %d scans for today", tenant, quota.MaxScansPerDay), nil
+	}
+	u.reservedFiles++
+	u.reservedBytes += size
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			u.reservedFiles--
+			u.reservedBytes -= size
+			t.mu.Unlock()
+		})
+	}, "", nil
+}
+
+// Usage reports a tenant's stored files and bytes and today's scans.
+func (t *tenantRegistry) Usage(tenant string) (map[string]interface{}, error) {
+	if err := t.loadUsage(tenant); err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	u := *t.usage[tenant]
+	scans := 0
+	if t.day == time.Now().UTC().Format("2006-01-02") {
+		scans = t.scans[tenant]
+	}
+	t.mu.Unlock()
+	return map[string]interface{}{
+		"tenant":      tenant,
+		"files":       u.files,
+		"bytes":       u.bytes,
+		"scans_today": scans,
+		"quota":       t.Config(tenant).Quota,
+	}, nil
+}
+
+// storedUsage adds up a tenant's stored documents; see loadUsage.
+func storedUsage(tenant string) (int, int64, error) {
+	store, err := documents.For(tenant)
+	if err != nil {
+		return 0, 0, err
+	}
+	docs, err := store.List()
+	if err != nil {
+		return 0, 0, err
+	}
+	var total int64
+	for _, doc := range docs {
+		total += doc.Size
+	}
+	return len(docs), total, nil
+}
+
+// tenantFromRequest identifies the tenant an upload or API call belongs to:
+// the tenant bound to the caller's credentials, or the default tenant for
+// credentials without one. The X-Tenant header is only honoured while
+// authentication is disabled; otherwise any caller could reach another
+// tenant's documents by setting it.
+func tenantFromRequest(r *http.Request) (string, error) {
+	p, ok := auth.FromContext(r.Context())
+	switch {
+	case ok && p.Tenant != "":
+		return tenants.Resolve(p.Tenant)
+	case ok && p.Anonymous():
+		return tenants.Resolve(r.Header.Get("X-Tenant"))
+	}
+	return tenants.Resolve(defaultTenant)
+}
+
+// requireTenant resolves the request's tenant, writing an error response if
+// it is invalid or unknown.
+func requireTenant(w http.ResponseWriter, r *http.Request) (string, bool) {
+	tenant, err := tenantFromRequest(r)
+	switch {
+	case errors.Is(err, errUnknownTenant):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return "", false
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return tenant, true
+}
+
+// checkTenantQuota rejects an upload that would exceed its tenant's quota.
+// A passing check counts as one of the tenant's scans for the day and
+// reserves room for the file; the caller calls release once the file has
+// been stored or turned away.
+func checkTenantQuota(info *uploadInfo) (release func(), rejected *ScanResult, err error) {
+	release, violation, err := tenants.reserveUpload(info.Tenant, info.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	if violation == "" {
+		return release, nil, nil
+	}
+	log.Printf("Quota rejected %s: %s", info.Name, violation)
+	result := newScanResult(info.Name, info.Size)
+	result.SHA256 = info.Content.SHA256()
+	result.Code, result.Verdict, result.Reason = CodeQuotaExceeded, VerdictRejected, ReasonQuotaExceeded
+	result.Message = "Upload rejected: " + violation
+	return func() {}, result, nil
+}
+
+// tenantStores hands out one DocumentStore per tenant, each under its own
+// storage prefix, so tenants can never see each other's documents.
+type tenantStores struct {
+	mu     sync.Mutex
+	stores map[string]DocumentStore
+	open   func(tenant string) (DocumentStore, error)
+}
+
+func newTenantStores(open func(tenant string) (DocumentStore, error)) *tenantStores {
+	return &tenantStores{stores: map[string]DocumentStore{}, open: open}
+}
+
+// For returns the document store of a tenant.
+func (t *tenantStores) For(tenant string) (DocumentStore, error) {
+	if !tenantPattern.MatchString(tenant) {
+		return nil, fmt.Errorf("%w %q", errInvalidTenant, tenant)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s, ok := t.stores[tenant]; ok {
+		return s, nil
+	}
+	s, err := t.open(tenant)
+	if err != nil {
+		return nil, err
+	}
+	t.stores[tenant] = s
+	return s, nil
+}
+
+// tenantUsageHandler serves GET /tenant/usage for the calling tenant.
+func tenantUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if setAPIHeaders(w, r, "GET, OPTIONS") {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenant, ok := requireTenant(w, r)
+	if !ok {
+		return
+	}
+	usage, err := tenants.Usage(tenant)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
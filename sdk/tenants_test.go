@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"common/auth"
+	"common/rbac"
+)
+
+// testAPI serves the tenant-scoped sdk routes the way main does, with the
+// fake scanner and stores under a temporary directory.
+type testAPI struct {
+	t       *testing.T
+	handler http.Handler
+}
+
+// newTestAPI sets up the sdk's globals for a test. keys is an AUTH_API_KEYS
+// list; with none, authentication is disabled.
+func newTestAPI(t *testing.T, keys string) *testAPI {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	maxUploadSize.Store(cfg.Uploads.MaxSize)
+	spoolDir = dir
+	if err := applyUploadPolicy(cfg.Uploads.Policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyFailurePolicies(cfg.Failure); err != nil {
+		t.Fatal(err)
+	}
+	loadScanTags(cfg.Tags)
+	reg, err := loadTenants(cfg.Tenants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants = reg
+	activeScanner = newFakeScanner()
+	verdicts = nil
+	documents = newTenantStores(func(tenant string) (DocumentStore, error) {
+		return newFSStore(filepath.Join(dir, "documents", tenant))
+	})
+	key := "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	if quarantine, err = newQuarantineStore(filepath.Join(dir, "quarantine"), key); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err = newQuarantineStore(filepath.Join(dir, "pending"), key); err != nil {
+		t.Fatal(err)
+	}
+	if resumable, err = newResumableStore(filepath.Join(dir, "resumable"), cfg.Resumable.MaxSize, cfg.Resumable.Expiry); err != nil {
+		t.Fatal(err)
+	}
+	scanJobs = newJobManager(1, 10)
+	// Finish queued scans before the next test replaces the stores
+	jobs := scanJobs
+	t.Cleanup(func() { jobs.Drain(context.Background()) })
+
+	authCfg := auth.DefaultConfig()
+	authCfg.APIKeyList = keys
+	authn, err := auth.New(authCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access := &rbac.Enforcer{}
+	if err := access.Update(rbac.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	for path, h := range map[string]http.HandlerFunc{
+		"/upload":              uploadHandler,
+		"/documents":           documentsHandler,
+		"/documents/":          documentHandler,
+		"/uploads/resumable":   resumableCreateHandler,
+		"/uploads/resumable/":  resumableUploadHandler,
+		"/tenant/usage":        tenantUsageHandler,
+		"/scans/":              scanJobHandler,
+		"/indexing/documents/": knowledgeSourceHandler,
+	} {
+		mux.HandleFunc(path, authn.Wrap(access.Wrap(h)))
+	}
+	return &testAPI{t: t, handler: mux}
+}
+
+// do sends a request with the given API key and X-Tenant header, either of
+// which may be empty.
+func (a *testAPI) do(method, target, key, tenant string, body *bytes.Buffer, contentType string) *httptest.ResponseRecorder {
+	a.t.Helper()
+	if body == nil {
+		body = &bytes.Buffer{}
+	}
+	r := httptest.NewRequest(method, target, body)
+	if key != "" {
+		r.Header.Set("X-API-Key", key)
+	}
+	if tenant != "" {
+		r.Header.Set("X-Tenant", tenant)
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	a.handler.ServeHTTP(w, r)
+	return w
+}
+
+// upload posts one file to /upload and decodes the JSON response.
+func (a *testAPI) upload(target, key, tenant string, into interface{}) {
+	a.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", "notes.txt")
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	fw.Write([]byte("quarterly paper order"))
+	mw.Close()
+	w := a.do(http.MethodPost, target, key, tenant, &body, mw.FormDataContentType())
+	if w.Code != http.StatusOK && w.Code != http.StatusAccepted {
+		a.t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), into); err != nil {
+		a.t.Fatalf("upload: %v in %s", err, w.Body)
+	}
+}
+
+// expect checks a response's status code.
+func (a *testAPI) expect(w *httptest.ResponseRecorder, code int, what string) {
+	a.t.Helper()
+	if w.Code != code {
+		a.t.Fatalf("%s: got %d, want %d: %s", what, w.Code, code, w.Body)
+	}
+}
+
+// listed returns the IDs of the documents a caller can list.
+func (a *testAPI) listed(key, tenant string) []string {
+	a.t.Helper()
+	w := a.do(http.MethodGet, "/documents", key, tenant, nil, "")
+	a.expect(w, http.StatusOK, "list documents")
+	var resp struct{ Documents []*Document }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		a.t.Fatal(err)
+	}
+	var ids []string
+	for _, d := range resp.Documents {
+		ids = append(ids, d.ID)
+	}
+	return ids
+}
+
+// checkHidden asserts that a caller cannot read, download or delete a
+// document and does not see it listed.
+func (a *testAPI) checkHidden(id, key, tenant string) {
+	a.t.Helper()
+	a.expect(a.do(http.MethodGet, "/documents/"+id, key, tenant, nil, ""), http.StatusNotFound, "get another tenant's document")
+	a.expect(a.do(http.MethodGet, "/documents/"+id+"/content", key, tenant, nil, ""), http.StatusNotFound, "download another tenant's document")
+	a.expect(a.do(http.MethodDelete, "/documents/"+id, key, tenant, nil, ""), http.StatusNotFound, "delete another tenant's document")
+	for _, listed := range a.listed(key, tenant) {
+		if listed == id {
+			a.t.Fatalf("document %s of another tenant is listed", id)
+		}
+	}
+}
+
+const tenantKeys = "alice:alice-key:acme:uploader,bob:bob-key:globex:uploader,carol:carol-key::uploader"
+
+func TestTenantCannotReachAnotherTenantsDocuments(t *testing.T) {
+	api := newTestAPI(t, tenantKeys)
+	var result ScanResult
+	api.upload("/upload", "alice-key", "", &result)
+	if result.DocumentID == "" {
+		t.Fatalf("clean upload was not stored: %+v", result)
+	}
+
+	api.checkHidden(result.DocumentID, "bob-key", "")
+	// The header does not override the tenant bound to the key
+	api.checkHidden(result.DocumentID, "bob-key", "acme")
+
+	// The owner still has it, as nothing above deleted it
+	api.expect(api.do(http.MethodGet, "/documents/"+result.DocumentID, "alice-key", "", nil, ""), http.StatusOK, "owner gets document")
+}
+
+func TestTenantHeaderIgnoredForCredentialsWithoutTenant(t *testing.T) {
+	api := newTestAPI(t, tenantKeys)
+	var result ScanResult
+	api.upload("/upload", "alice-key", "", &result)
+
+	api.checkHidden(result.DocumentID, "carol-key", "acme")
+	w := api.do(http.MethodGet, "/tenant/usage", "carol-key", "acme", nil, "")
+	api.expect(w, http.StatusOK, "usage")
+	var usage struct{ Tenant string }
+	json.Unmarshal(w.Body.Bytes(), &usage)
+	if usage.Tenant != defaultTenant {
+		t.Fatalf("key without a tenant got usage of %q, want %q", usage.Tenant, defaultTenant)
+	}
+}
+
+func TestTenantCannotReachAnotherTenantsScansAndUploads(t *testing.T) {
+	api := newTestAPI(t, tenantKeys)
+	var job ScanJob
+	api.upload("/upload?async=true", "alice-key", "", &job)
+	for _, key := range []string{"bob-key", "carol-key"} {
+		api.expect(api.do(http.MethodGet, "/scans/"+job.ID, key, "acme", nil, ""), http.StatusNotFound, "get another tenant's scan job")
+	}
+	api.expect(api.do(http.MethodGet, "/scans/"+job.ID, "alice-key", "", nil, ""), http.StatusOK, "owner gets scan job")
+
+	r := httptest.NewRequest(http.MethodPost, "/uploads/resumable", nil)
+	r.Header.Set("X-API-Key", "alice-key")
+	r.Header.Set("Upload-Length", "5")
+	r.Header.Set("Upload-Metadata", "filename bm90ZXMudHh0")
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, r)
+	api.expect(w, http.StatusCreated, "create resumable upload")
+	location := w.Header().Get("Location")
+	for _, key := range []string{"bob-key", "carol-key"} {
+		api.expect(api.do(http.MethodHead, location, key, "acme", nil, ""), http.StatusNotFound, "head another tenant's upload")
+		api.expect(api.do(http.MethodDelete, location, key, "acme", nil, ""), http.StatusNotFound, "delete another tenant's upload")
+	}
+	api.expect(api.do(http.MethodHead, location, "alice-key", "", nil, ""), http.StatusOK, "owner heads upload")
+}
+
+func TestTenantHeaderWithoutAuthentication(t *testing.T) {
+	api := newTestAPI(t, "")
+	var result ScanResult
+	api.upload("/upload", "", "acme", &result)
+
+	api.checkHidden(result.DocumentID, "", "globex")
+	api.checkHidden(result.DocumentID, "", "")
+	api.expect(api.do(http.MethodGet, "/documents/"+result.DocumentID, "", "acme", nil, ""), http.StatusOK, "owner gets document")
+}
+
+func TestTenantQuotaReservations(t *testing.T) {
+	newTestAPI(t, "")
+	tenants.Defaults.Quota = TenantQuota{MaxFiles: 1, MaxBytes: 100}
+
+	release, violation, err := tenants.reserveUpload("acme", 60)
+	if err != nil || violation != "" {
+		t.Fatalf("first upload refused: %v %s", err, violation)
+	}
+	// A concurrent upload cannot use the room the first one holds
+	if _, violation, _ := tenants.reserveUpload("acme", 10); violation == "" {
+		t.Fatal("second upload fits in a quota of one file")
+	}
+	if err := tenants.trackStored("acme", 1, 60, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if _, violation, _ := tenants.reserveUpload("acme", 10); violation == "" {
+		t.Fatal("upload fits although the stored file fills the quota")
+	}
+
+	// Deleting the file frees the room again
+	if err := tenants.trackStored("acme", -1, -60, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, violation, _ := tenants.reserveUpload("acme", 100); violation != "" {
+		t.Fatalf("upload refused after the stored file was deleted: %s", violation)
+	}
+	if _, violation, _ := tenants.reserveUpload("globex", 100); violation != "" {
+		t.Fatalf("another tenant's upload refused: %s", violation)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+)
+
+// uploadInfo describes a received upload independently of the HTTP request,
+// so it can be processed synchronously or by a scan worker.
+type uploadInfo struct {
+	Content     *spool
+	Name        string // sanitized original file name
+	ContentType string
+	Size        int64
+	Uploader    string
+	Tenant      string
+	// Archive and MemberPath are set for files extracted from an archive.
+	Archive    string
+	MemberPath string
+	// Endpoint selects the scan failure policy; see failurePolicies.
+	Endpoint string
+	// Tags are sent to the scanner; see scanTags.
+	Tags []string
+}
+
+// Spool settings; see main.
+var (
+	uploadMemoryLimit int64 = 16 << 20
+	spoolDir                = uploadFolder
+)
+
+// receiveUpload streams src into memory (spilling to spoolDir only beyond
+// uploadMemoryLimit) while hashing it.
+func receiveUpload(src io.Reader, originalName, contentType string, r *http.Request) (*uploadInfo, error) {
+	content, err := newSpool(src, uploadMemoryLimit, spoolDir)
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Base(originalName)
+	if contentType == "" || contentType == "application/octet-stream" {
+		if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+			contentType = t
+		}
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &uploadInfo{
+		Content:     content,
+		Name:        name,
+		ContentType: contentType,
+		Size:        content.Size(),
+		Uploader:    uploaderFromRequest(r),
+		Endpoint:    endpointUpload,
+	}, nil
+}
+
+// maxFormFieldSize bounds the non-file form fields kept by nextFilePart.
+const maxFormFieldSize = 1024
+
+// nextFilePart returns the next multipart part named "file". Other form
+// fields seen on the way are stored in fields, so only fields sent before a
+// file apply to it. It returns http.ErrMissingFile when there are no more
+// parts.
+func nextFilePart(mr *multipart.Reader, fields map[string]string) (*multipart.Part, error) {
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, http.ErrMissingFile
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+		if part.FileName() == "" && part.FormName() != "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			if err != nil {
+				part.Close()
+				return nil, err
+			}
+			fields[part.FormName()] = string(value)
+		}
+		part.Close()
+	}
+}
+
+// receiveUploads reads every "file" part of a multipart request for tenant
+// and tags it for scanning. The document category comes from a "category" field sent
+// before the files, or the ?category= query parameter. On error the already
+// received uploads are closed.
+func receiveUploads(mr *multipart.Reader, r *http.Request, tenant string) ([]*uploadInfo, error) {
+	var infos []*uploadInfo
+	fields := map[string]string{"category": r.URL.Query().Get("category")}
+	for {
+		part, err := nextFilePart(mr, fields)
+		if err == http.ErrMissingFile && len(infos) > 0 {
+			return infos, nil
+		}
+		if err != nil {
+			closeUploads(infos)
+			return nil, err
+		}
+		if part.FileName() == "" {
+			part.Close()
+			closeUploads(infos)
+			return nil, errNoSelectedFile
+		}
+		category, err := validCategory(fields["category"])
+		if err != nil {
+			part.Close()
+			closeUploads(infos)
+			return nil, err
+		}
+		info, err := receiveUpload(part, part.FileName(), part.Header.Get("Content-Type"), r)
+		part.Close()
+		if err != nil {
+			closeUploads(infos)
+			return nil, err
+		}
+		info.Tenant = tenant
+		info.Tags = scanTags(tenant, info.Uploader, category)
+		log.Printf("Uploaded file: %s, Size: %d bytes, on disk: %t", info.Name, info.Size, info.Content.Path() != "")
+		infos = append(infos, info)
+	}
+}
+
+var errNoSelectedFile = errors.New("no selected file")
+
+func closeUploads(infos []*uploadInfo) {
+	for _, info := range infos {
+		info.Content.Close()
+	}
+}
+
+// processUpload runs the protected pipeline on a saved upload: scan, then
+// store clean files or quarantine malicious ones, and handle files that
+// could not be scanned per the endpoint's failure policy. The caller owns
+// info.Content.
+func processUpload(info *uploadInfo) (*ScanResult, error) {
+	// Check the file type policy before spending a scan on the file
+	decision, rejected := checkUploadPolicy(info)
+	if rejected != nil {
+		return rejected, nil
+	}
+
+	// Enforce the tenant's storage and daily scan quotas
+	release, rejected, err := checkTenantQuota(info)
+	if err != nil {
+		return nil, fmt.Errorf("cannot check quota: %w", err)
+	}
+	defer release()
+	if rejected != nil {
+		return rejected, nil
+	}
+
+	result, err := scanUploadedFile(info)
+	if err != nil {
+		return nil, err
+	}
+	result.Policy = decision
+
+	// Unscanned files are accepted, rejected or held per endpoint policy
+	if scanFailed(result) {
+		if err := applyFailurePolicy(info, result); err != nil {
+			return nil, fmt.Errorf("cannot apply scan failure policy: %w", err)
+		}
+	}
+
+	// Keep clean files in the document store
+	if err := storeCleanUpload(info, result); err != nil {
+		return nil, fmt.Errorf("cannot store file: %w", err)
+	}
+
+	// Move malicious files into quarantine
+	if err := quarantineUpload(info, result); err != nil {
+		return nil, fmt.Errorf("cannot quarantine file: %w", err)
+	}
+	return result, nil
+}
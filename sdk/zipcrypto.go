@@ -0,0 +1,83 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// writeEncryptedZip writes a single-entry zip archive protected with the
+// traditional PKWARE ("ZipCrypto") scheme. It is weak cryptography, but it is
+// what every unzip tool understands and the convention for exchanging
+// malware samples, which keeps them from being opened or scanned by accident.
+func writeEncryptedZip(w io.Writer, name string, data []byte, password string, modified time.Time) error {
+	crc := crc32.ChecksumIEEE(data)
+
+	header := make([]byte, 12)
+	if _, err := rand.Read(header); err != nil {
+		return err
+	}
+	// The last header byte lets extractors verify the password.
+	header[11] = byte(crc >> 24)
+
+	z := newZipCrypto([]byte(password))
+	enc := make([]byte, 0, len(header)+len(data))
+	enc = append(enc, z.encrypt(header)...)
+	enc = append(enc, z.encrypt(data)...)
+
+	zw := zip.NewWriter(w)
+	fw, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		Flags:              0x1, // encrypted
+		Modified:           modified,
+		CRC32:              crc,
+		CompressedSize64:   uint64(len(enc)),
+		UncompressedSize64: uint64(len(data)),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(enc); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+type zipCrypto struct {
+	k0, k1, k2 uint32
+}
+
+func newZipCrypto(password []byte) *zipCrypto {
+	z := &zipCrypto{k0: 0x12345678, k1: 0x23456789, k2: 0x34567890}
+	for _, b := range password {
+		z.update(b)
+	}
+	return z
+}
+
+func crc32Update(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[(crc^uint32(b))&0xff] ^ (crc >> 8)
+}
+
+func (z *zipCrypto) update(b byte) {
+	z.k0 = crc32Update(z.k0, b)
+	z.k1 = (z.k1+(z.k0&0xff))*134775813 + 1
+	z.k2 = crc32Update(z.k2, byte(z.k1>>24))
+}
+
+func (z *zipCrypto) keystream() byte {
+	t := uint16(z.k2 | 2)
+	return byte((uint32(t) * uint32(t^1)) >> 8)
+}
+
+func (z *zipCrypto) encrypt(plain []byte) []byte {
+	out := make([]byte, len(plain))
+	for i, p := range plain {
+		out[i] = p ^ z.keystream()
+		z.update(p)
+	}
+	return out
+}
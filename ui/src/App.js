@@ -22,6 +22,7 @@ import About from './pages/About';
 import Products from './pages/Products';
 import Upload from './pages/Upload';
 import ChatBot from './components/ChatBot';
+import SignInButton from './components/SignInButton';
 
 import './App.css';
 
@@ -144,6 +145,7 @@ function App() {
               <Button color="inherit" component={Link} to="/about" startIcon={<AboutIcon />}>
                 About
               </Button>
+              <SignInButton />
             </Box>
           </Toolbar>
         </AppBar>
@@ -0,0 +1,37 @@
+// src/auth.js
+// Credentials the UI sends to the sdk, aichat and containerxdr APIs. With
+// authentication enabled on the services, the user pastes a bearer token from
+// their identity provider or an API key (see "Authentication" in the README);
+// it is kept for the browser session only. With no credential set nothing is
+// sent and the services give the caller their anonymous roles.
+
+const STORAGE_KEY = 'bpc.credential';
+
+export const getCredential = () => sessionStorage.getItem(STORAGE_KEY) || '';
+
+export const setCredential = (value) => {
+  const trimmed = (value || '').trim();
+  if (trimmed) {
+    sessionStorage.setItem(STORAGE_KEY, trimmed);
+  } else {
+    sessionStorage.removeItem(STORAGE_KEY);
+  }
+};
+
+// authHeaders returns the Authorization header for fetch requests. The
+// services try a bearer value that is not a JWT as an API key, so one header
+// covers both kinds of credential.
+export const authHeaders = () => {
+  const credential = getCredential();
+  return credential ? { Authorization: `Bearer ${credential}` } : {};
+};
+
+// withAccessToken adds the credential to a WebSocket URL. Browsers cannot set
+// headers on WebSocket requests, so the service must accept ?access_token=
+// (AUTH_QUERY_TOKEN=true).
+export const withAccessToken = (url) => {
+  const credential = getCredential();
+  if (!credential) return url;
+  const separator = url.includes('?') ? '&' : '?';
+  return `${url}${separator}access_token=${encodeURIComponent(credential)}`;
+};
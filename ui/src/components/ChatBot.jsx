@@ -18,6 +18,7 @@ import {
   SmartToy as BotIcon
 } from '@mui/icons-material';
 import { DESIGN_TOKENS } from '../theme';
+import { authHeaders } from '../auth';
 
 export default function ChatBot() {
   const theme = useTheme();
@@ -26,11 +27,44 @@ export default function ChatBot() {
   const [inputValue, setInputValue] = useState('');
   const [isLoading, setIsLoading] = useState(false);
   const [securityEnabled, setSecurityEnabled] = useState(true);
+  // Continues the conversation on the server, so the assistant remembers it
+  const [conversationId, setConversationId] = useState(null);
   const messagesEndRef = useRef(null);
 
-  // Add a message to the chat
-  const addMessage = (text, sender = 'bot') => {
-    setMessages(prev => [...prev, { text, sender }]);
+  // Add a message to the chat; sources are the document excerpts a bot
+  // reply cites
+  const addMessage = (text, sender = 'bot', streaming = false, sources = []) => {
+    setMessages(prev => [...prev, { text, sender, streaming, sources }]);
+  };
+
+  // Replace the text of the last message, the reply being streamed
+  const updateLastMessage = (text, streaming, sources = []) => {
+    setMessages(prev => [...prev.slice(0, -1), { ...prev[prev.length - 1], text, streaming, sources }]);
+  };
+
+  // Read server-sent events from a fetch response, calling onEvent(type, data)
+  // for each; EventSource cannot POST
+  const readEvents = async (response, onEvent) => {
+    const reader = response.body.getReader();
+    const decoder = new TextDecoder();
+    let buffer = '';
+    while (true) {
+      const { done, value } = await reader.read();
+      if (done) break;
+      buffer += decoder.decode(value, { stream: true });
+      let boundary;
+      while ((boundary = buffer.indexOf('\n\n')) !== -1) {
+        const frame = buffer.slice(0, boundary);
+        buffer = buffer.slice(boundary + 2);
+        let type = 'message';
+        const data = [];
+        for (const line of frame.split('\n')) {
+          if (line.startsWith('event:')) type = line.slice(6).trim();
+          else if (line.startsWith('data:')) data.push(line.slice(5).trim());
+        }
+        if (data.length) onEvent(type, JSON.parse(data.join('\n')));
+      }
+    }
   };
 
   // Send a message
@@ -42,37 +76,73 @@ export default function ChatBot() {
     setIsLoading(true);
     setInputValue('');
 
+    const errorMessage = 'Sorry, I encountered an error. Could you try again?';
+    let started = false;
+    let finished = false;
+    // Show the final text in place of the partial reply, if there is one
+    const finish = (text, sources = []) => {
+      finished = true;
+      if (started) {
+        updateLastMessage(text, false, sources);
+      } else {
+        addMessage(text, 'bot', false, sources);
+      }
+    };
+
     try {
-      // Fetch response from backend
-      const response = await fetch('/api/chat/chat', {
+      // Stream the response from the backend as it is generated
+      const response = await fetch('/api/chat/chat/stream', {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
+          ...authHeaders(),
         },
         body: JSON.stringify({ 
           message: inputValue,
-          securityEnabled: securityEnabled 
+          securityEnabled: securityEnabled,
+          ...(conversationId && { conversationId })
         }),
       });
 
-      const data = await response.json();
-
+      if (response.status === 401 || response.status === 403) {
+        addMessage('Please sign in with a token or API key allowed to use the chat.', 'bot');
+        return;
+      }
       if (!response.ok) {
-        // Handle specific error cases
-        if (response.status === 403) {
-          // Show the actual blocked message from the API
-          addMessage(`⚠️ ${data.response}`, 'bot');
-        } else {
-          addMessage('Sorry, I encountered an error. Could you try again?', 'bot');
-        }
+        addMessage(errorMessage, 'bot');
         return;
       }
-      
-      // Add bot response
-      addMessage(data.response);
+
+      let reply = '';
+      await readEvents(response, (type, data) => {
+        if (type === 'token') {
+          reply += data.text;
+          if (started) {
+            updateLastMessage(reply, true);
+          } else {
+            started = true;
+            addMessage(reply, 'bot', true);
+          }
+        } else if (type === 'verdict') {
+          if (data.verdict === 'allowed') {
+            if (data.conversationId) setConversationId(data.conversationId);
+            finish(data.response, data.sources || []);
+          } else if (data.verdict === 'blocked') {
+            // Show the actual blocked message from the API
+            finish(`⚠️ ${data.response}`);
+          } else {
+            finish(errorMessage);
+          }
+        }
+      });
+      if (!finished) {
+        finish(errorMessage);
+      }
     } catch (error) {
       console.error('Chat error:', error);
-      addMessage('Sorry, I encountered an error. Could you try again?', 'bot');
+      if (!finished) {
+        finish(errorMessage);
+      }
     } finally {
       setIsLoading(false);
     }
@@ -214,9 +284,23 @@ export default function ChatBot() {
                 >
                   {msg.text}
                 </Typography>
+                {msg.sources?.length > 0 && (
+                  <Box sx={{ mt: theme.spacing(0.25), px: theme.spacing(0.5) }}>
+                    {msg.sources.map(source => (
+                      <Typography
+                        key={source.ref}
+                        variant="caption"
+                        title={source.excerpt}
+                        sx={{ display: 'block', color: theme.palette.text.secondary }}
+                      >
+                        [{source.ref}] {source.name}
+                      </Typography>
+                    ))}
+                  </Box>
+                )}
               </Box>
             ))}
-            {isLoading && (
+            {isLoading && !messages[messages.length - 1]?.streaming && (
               <Box 
                 sx={{ 
                   alignSelf: 'flex-start',
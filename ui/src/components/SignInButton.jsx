@@ -0,0 +1,69 @@
+// src/components/SignInButton.jsx
+import React, { useState } from 'react';
+import {
+  Button,
+  Dialog,
+  DialogTitle,
+  DialogContent,
+  DialogContentText,
+  DialogActions,
+  TextField
+} from '@mui/material';
+import { Key as KeyIcon } from '@mui/icons-material';
+import { getCredential, setCredential } from '../auth';
+
+// SignInButton lets the user set the token or API key sent with API calls.
+function SignInButton() {
+  const [open, setOpen] = useState(false);
+  const [value, setValue] = useState('');
+  const [signedIn, setSignedIn] = useState(Boolean(getCredential()));
+
+  const handleOpen = () => {
+    setValue(getCredential());
+    setOpen(true);
+  };
+
+  const handleSave = () => {
+    setCredential(value);
+    setSignedIn(Boolean(getCredential()));
+    setOpen(false);
+  };
+
+  const handleSignOut = () => {
+    setCredential('');
+    setSignedIn(false);
+    setOpen(false);
+  };
+
+  return (
+    <>
+      <Button color="inherit" onClick={handleOpen} startIcon={<KeyIcon />}>
+        {signedIn ? 'Signed In' : 'Sign In'}
+      </Button>
+      <Dialog open={open} onClose={() => setOpen(false)} fullWidth maxWidth="sm">
+        <DialogTitle>API Credentials</DialogTitle>
+        <DialogContent>
+          <DialogContentText sx={{ mb: 2 }}>
+            Paste a bearer token from your identity provider or an API key. It is sent with
+            uploads, chat and terminal sessions and forgotten when the browser tab closes.
+          </DialogContentText>
+          <TextField
+            autoFocus
+            fullWidth
+            type="password"
+            label="Token or API key"
+            value={value}
+            onChange={(e) => setValue(e.target.value)}
+          />
+        </DialogContent>
+        <DialogActions>
+          {signedIn && <Button onClick={handleSignOut}>Sign Out</Button>}
+          <Button onClick={() => setOpen(false)}>Cancel</Button>
+          <Button onClick={handleSave} variant="contained">Save</Button>
+        </DialogActions>
+      </Dialog>
+    </>
+  );
+}
+
+export default SignInButton;
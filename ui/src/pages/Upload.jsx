@@ -24,6 +24,69 @@ import {
   Send as SendIcon
 } from '@mui/icons-material';
 import { DESIGN_TOKENS } from '../theme';
+import { authHeaders } from '../auth';
+
+// The sdk answers every upload with a ScanResult (schema_version 2, served at
+// /api/sdk/schemas/scan-result.v2.json), or with {results, summary} when the
+// upload held several files. The status code tells how it was handled.
+const VERDICT_COLORS = {
+  clean: '#80ff80',
+  malicious: '#ff8080',
+  rejected: '#ff8080',
+  error: '#ffb080',
+  skipped: '#ffd080',
+  unscanned: '#ffd080'
+};
+
+const STATUS_MESSAGES = {
+  202: 'The scanner is unavailable; the file is held for review until a rescan succeeds',
+  415: 'The file was rejected by the upload policy',
+  429: 'The upload quota for your tenant is exhausted',
+  503: 'The scanner is unavailable and the file was not accepted'
+};
+
+// describeResult summarizes a single ScanResult in one line.
+const describeResult = (result) => {
+  switch (result.verdict) {
+    case 'clean':
+      return result.document_id ? `Clean, stored as document ${result.document_id}` : 'Clean';
+    case 'malicious':
+      return `Malware detected: ${result.malware_names.join(', ') || 'unnamed'}` +
+        (result.quarantine_id ? ` (quarantined as ${result.quarantine_id})` : '');
+    case 'rejected':
+      return result.policy?.violations?.length ? `Rejected: ${result.policy.violations.join('; ')}` : `Rejected: ${result.reason}`;
+    case 'error':
+      return `Scan failed: ${result.error || result.reason}`;
+    default:
+      return result.message || result.reason || result.verdict;
+  }
+};
+
+function ScanResultSummary({ result }) {
+  const rows = [
+    ['Engine', result.engine],
+    ['Size', `${(result.file_size / 1024).toFixed(1)} KB`],
+    ['SHA-256', result.sha256],
+    ['Duration', result.duration_ms ? `${result.duration_ms} ms` : null],
+    ['Scan ID', result.scan_id],
+    ['Failure policy', result.failure_policy],
+    ['Pending ID', result.pending_id],
+    ['Detected type', result.policy?.detected_type]
+  ].filter(([, value]) => value);
+
+  return (
+    <Box sx={{ mb: DESIGN_TOKENS.spacing.sm }}>
+      <Typography variant="body2" sx={{ color: VERDICT_COLORS[result.verdict] || 'rgba(255,255,255,0.8)' }}>
+        {result.member_path || result.file_name}: {describeResult(result)}{result.cached ? ' (cached verdict)' : ''}
+      </Typography>
+      {rows.map(([label, value]) => (
+        <Typography key={label} variant="caption" component="div" sx={{ color: 'rgba(255,255,255,0.6)', wordBreak: 'break-all' }}>
+          {label}: {value}
+        </Typography>
+      ))}
+    </Box>
+  );
+}
 
 function Upload() {
   const canvasRef = useRef(null);
@@ -44,6 +107,7 @@ function Upload() {
   const [submitSuccess, setSubmitSuccess] = useState(false);
   const [scanResult, setScanResult] = useState(null);
   const [scanProtectionEnabled, setScanProtectionEnabled] = useState(true);
+  const [category, setCategory] = useState('general');
 
   const productOptions = [
     { label: 'Paper Stack', src: '/images/paper_products.png' },
@@ -52,6 +116,15 @@ function Upload() {
     { label: 'Files', src: '/images/files.png' }
   ];
 
+  // Document categories are sent as scan tags so detections can be filtered by business unit
+  const categoryOptions = [
+    { label: 'General', value: 'general' },
+    { label: 'Artwork', value: 'artwork' },
+    { label: 'Invoice', value: 'invoice' },
+    { label: 'Contract', value: 'contract' },
+    { label: 'Marketing', value: 'marketing' }
+  ];
+
   const draw = () => {
     const canvas = canvasRef.current;
     const base = baseImageRef.current;
@@ -177,17 +250,29 @@ function Upload() {
     
     try {
       const formData = new FormData();
+      // The category must come before the file part
+      formData.append('category', category);
       
       // SECURITY ISSUE: No filename sanitization - allows path traversal attacks
       formData.append('file', originalFile, originalWatermarkFilename);
       
       // Route to protected or vulnerable endpoint based on toggle
       const endpoint = scanProtectionEnabled ? '/api/sdk/upload' : '/api/sdk/upload-vulnerable';
-      const res = await fetch(endpoint, { method: 'POST', body: formData });
-      if (!res.ok) throw new Error('Upload failed');
+      const res = await fetch(endpoint, { method: 'POST', headers: authHeaders(), body: formData });
+      // Errors before a scan (bad form, oversized body, missing credentials) come back as text
+      if (!(res.headers.get('Content-Type') || '').includes('application/json')) {
+        const text = (await res.text()).trim();
+        throw new Error(text ? `Upload failed: ${text}` : `Upload failed (HTTP ${res.status})`);
+      }
       const json = await res.json();
       setScanResult(json);
-      setSubmitSuccess(true);
+      if (STATUS_MESSAGES[res.status]) {
+        setSubmitError(STATUS_MESSAGES[res.status]);
+      } else if (!res.ok) {
+        setSubmitError(`Upload failed (HTTP ${res.status})`);
+      } else {
+        setSubmitSuccess(true);
+      }
     } catch (e) {
       setSubmitError(e.message || 'Upload failed');
     } finally {
@@ -265,6 +350,21 @@ function Upload() {
                   </label>
                 </Box>
 
+                <FormControl size="small" fullWidth sx={{ mb: DESIGN_TOKENS.spacing.md }}>
+                  <InputLabel id="category-label" sx={{ color: 'rgba(255,255,255,0.8)' }}>Document Category</InputLabel>
+                  <Select
+                    labelId="category-label"
+                    value={category}
+                    label="Document Category"
+                    onChange={(e) => setCategory(e.target.value)}
+                    sx={{ color: 'white', '.MuiOutlinedInput-notchedOutline': { borderColor: 'rgba(255,255,255,0.3)' } }}
+                  >
+                    {categoryOptions.map((opt) => (
+                      <MenuItem key={opt.value} value={opt.value}>{opt.label}</MenuItem>
+                    ))}
+                  </Select>
+                </FormControl>
+
                 <FormControlLabel
                   control={
                     <Switch
@@ -378,9 +478,15 @@ function Upload() {
                     <Typography variant="subtitle2" sx={{ color: 'rgba(255,255,255,0.85)', mb: DESIGN_TOKENS.spacing.sm }}>
                       Security Scan Result
                     </Typography>
-                    <pre style={{ margin: 0, whiteSpace: 'pre-wrap', wordBreak: 'break-word', color: 'rgba(255,255,255,0.8)' }}>
-                      {JSON.stringify(scanResult, null, 2)}
-                    </pre>
+                    {(scanResult.results || [scanResult]).map((result, i) => (
+                      <ScanResultSummary key={i} result={result} />
+                    ))}
+                    <details>
+                      <summary style={{ color: 'rgba(255,255,255,0.6)', cursor: 'pointer' }}>Raw response</summary>
+                      <pre style={{ margin: 0, whiteSpace: 'pre-wrap', wordBreak: 'break-word', color: 'rgba(255,255,255,0.8)' }}>
+                        {JSON.stringify(scanResult, null, 2)}
+                      </pre>
+                    </details>
                   </Box>
                 )}
               </Box>
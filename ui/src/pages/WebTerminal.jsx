@@ -2,6 +2,7 @@ import React, { useEffect, useRef } from 'react';
 import { Terminal } from 'xterm';
 import { FitAddon } from 'xterm-addon-fit';
 import 'xterm/css/xterm.css';
+import { withAccessToken } from '../auth';
 
 export default function WebTerminal({ onClose }) {
   const termRef = useRef(null);
@@ -21,7 +22,8 @@ export default function WebTerminal({ onClose }) {
     const wsProtocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
     const wsHost = window.location.host;
     const xdrUrl = `${wsProtocol}//${wsHost}/api/xdr/terminal`;
-    const ws = new WebSocket(xdrUrl);
+    // Sent as ?access_token=, which containerxdr accepts with AUTH_QUERY_TOKEN=true
+    const ws = new WebSocket(withAccessToken(xdrUrl));
     ws.binaryType = 'arraybuffer';
 
     ws.onopen    = ()   => term.focus();